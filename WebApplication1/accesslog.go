@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log, one line per request, kept apart from the application log so
+// it can be shipped or rotated on its own.
+//
+//	access_log         "stdout", "stderr" or a file path; empty disables it
+//	access_log_format  "clf" (Combined Log Format, default) or "json"
+type accessLogger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	asJSON bool
+}
+
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	ClientIP  string    `json:"client_ip"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	LatencyMS float64   `json:"latency_ms"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// nil when the access log is disabled
+func newAccessLogger(target, format string) *accessLogger {
+	var out io.Writer
+	switch target {
+	case "":
+		return nil
+	case "stdout", "-":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			fatal("Opening access log failed", "path", target, "err", err)
+		}
+		out = f
+	}
+
+	format = strings.ToLower(format)
+	if format != "clf" && format != "json" {
+		fatal("Invalid access log format, use clf or json", "value", format)
+	}
+	return &accessLogger{out: out, asJSON: format == "json"}
+}
+
+func (l *accessLogger) write(e accessEntry) {
+	var line []byte
+	if l.asJSON {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		line = []byte(fmt.Sprintf("%s - - [%s] %s %d %s %s %s\n",
+			e.ClientIP,
+			e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			strconv.Quote(e.Method+" "+e.Path+" "+e.Proto),
+			e.Status,
+			clfBytes(e.Bytes),
+			clfQuote(e.Referrer),
+			clfQuote(e.UserAgent)))
+	}
+
+	l.mu.Lock()
+	l.out.Write(line)
+	l.mu.Unlock()
+}
+
+// CLF writes "-" rather than 0 for an empty body
+func clfBytes(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func clfQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+type byteCounter struct {
+	http.ResponseWriter
+	bytes int64
+}
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(b)
+	c.bytes += int64(n)
+	return n, err
+}
+
+func (c *byteCounter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func withAccessLog(logger *accessLogger, next http.Handler) http.Handler {
+	if logger == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		counter := &byteCounter{ResponseWriter: rec}
+		next.ServeHTTP(counter, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		logger.write(accessEntry{
+			Time:      start,
+			ClientIP:  getClientIP(r),
+			Method:    r.Method,
+			Path:      redactedRequestURI(r.URL),
+			Proto:     r.Proto,
+			Status:    rec.status,
+			Bytes:     counter.bytes,
+			LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			Referrer:  r.Referer(),
+			UserAgent: r.UserAgent(),
+			RequestID: w.Header().Get(requestIDHeader),
+		})
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Admin authentication - a single shared bearer token from the environment.
+// Admin endpoints are disabled entirely when ADMIN_TOKEN is unset.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := secret("ADMIN_TOKEN")
+	if token == "" {
+		writeError(w, http.StatusNotFound, "not_found", "Not found")
+		return false
+	}
+
+	provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return false
+	}
+
+	return true
+}
+
+type AdminLink struct {
+	ShortCode      string     `json:"short_code"`
+	OriginalURL    string     `json:"original_url"`
+	Owner          string     `json:"owner,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	ClickCount     int64      `json:"click_count"`
+	DisabledAt     *time.Time `json:"disabled_at,omitempty"`
+	DisabledReason string     `json:"disabled_reason,omitempty"`
+}
+
+type AdminLinkListResponse struct {
+	Links      []AdminLink `json:"links"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+type AdminStatsResponse struct {
+	TotalLinks    int64 `json:"total_links"`
+	ActiveLinks   int64 `json:"active_links"`
+	ExpiredLinks  int64 `json:"expired_links"`
+	TotalClicks   int64 `json:"total_clicks"`
+	Clicks24h     int64 `json:"clicks_24h"`
+	Owners        int64 `json:"owners"`
+	ActiveAPIKeys int64 `json:"active_api_keys"`
+}
+
+// GET /api/v1/admin/links?owner=&url=&status=active|expired&created_after=&created_before=&cursor=&limit=
+func adminListLinksHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	afterID, limit, ok := parsePageQuery(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := LinkFilter{
+		Owner:       query.Get("owner"),
+		Destination: canonicalDestination(query.Get("url")),
+		Status:      query.Get("status"),
+	}
+	if filter.Status != "" && filter.Status != "active" && filter.Status != "expired" && filter.Status != "disabled" {
+		writeError(w, http.StatusBadRequest, "invalid_status", "status must be active, expired or disabled")
+		return
+	}
+	for param, dst := range map[string]**time.Time{"created_after": &filter.CreatedAfter, "created_before": &filter.CreatedBefore} {
+		if v := query.Get(param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_"+param, param+" must be an RFC 3339 timestamp")
+				return
+			}
+			*dst = &parsed
+		}
+	}
+
+	links, err := store.ListLinks(r.Context(), filter, afterID, limit+1)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Admin link list error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	hasNext := len(links) > limit
+	if hasNext {
+		links = links[:limit]
+	}
+
+	resp := AdminLinkListResponse{Links: []AdminLink{}}
+	for _, link := range links {
+		resp.Links = append(resp.Links, AdminLink{
+			ShortCode:      link.ShortCode,
+			OriginalURL:    link.OriginalURL,
+			Owner:          link.Owner,
+			CreatedAt:      link.CreatedAt,
+			ExpiresAt:      link.ExpiresAt,
+			ClickCount:     link.ClickCount,
+			DisabledAt:     link.DisabledAt,
+			DisabledReason: link.DisabledReason,
+		})
+	}
+	if len(links) > 0 {
+		resp.NextCursor = nextCursor(links[len(links)-1].ID, hasNext)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// DELETE /api/v1/admin/links/{code}
+func adminDeleteLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	link, err := store.DeleteLink(r.Context(), r.PathValue("code"))
+	if errors.Is(err, ErrLinkNotFound) {
+		writeError(w, http.StatusNotFound, "link_not_found", "Short URL not found")
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Admin link delete error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	// Other instances drop it from their caches too
+	invalidateCachedURL(r.Context(), link.ShortCode)
+	slog.InfoContext(r.Context(), "Admin deleted link", "short_code", link.ShortCode)
+	auditAdmin(r, "link.delete", link.ShortCode, map[string]interface{}{"original_url": link.OriginalURL, "owner": link.Owner})
+	goBackground(func() { emitLinkEvent(EventLinkDeleted, link) })
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/v1/admin/stats
+func adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var stats AdminStatsResponse
+	err := db.QueryRowContext(r.Context(), `
+		SELECT COUNT(*),
+		       COUNT(*) FILTER (WHERE expires_at IS NULL OR expires_at > NOW()),
+		       COALESCE(SUM(click_count), 0),
+		       COUNT(DISTINCT owner),
+		       (SELECT COUNT(*) FROM click_events WHERE clicked_at > NOW() - INTERVAL '24 hours'),
+		       (SELECT COUNT(*) FROM api_keys WHERE revoked_at IS NULL)
+		FROM urls`).Scan(&stats.TotalLinks, &stats.ActiveLinks, &stats.TotalClicks,
+		&stats.Owners, &stats.Clicks24h, &stats.ActiveAPIKeys)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Admin stats error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	stats.ExpiredLinks = stats.TotalLinks - stats.ActiveLinks
+
+	writeJSON(w, http.StatusOK, stats)
+}
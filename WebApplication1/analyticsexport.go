@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Daily click aggregates exported to an S3-compatible bucket for
+// data-warehouse ingestion, one object per UTC day:
+//
+//	<prefix>dt=2026-10-13/clicks.csv   (or clicks.parquet)
+//
+// Each day is exported once it is over. Exported days are recorded, so
+// after downtime the missed days are caught up, up to exportMaxCatchUp.
+// Objects are rewritten whole, so two instances exporting the same day
+// just write the same file twice. Credentials and region come from the
+// default AWS chain; ANALYTICS_EXPORT_ENDPOINT points at MinIO, R2 and
+// the like.
+const (
+	exportCheckTick  = time.Hour
+	exportMaxCatchUp = 31 // days
+	exportTimeout    = 10 * time.Minute
+)
+
+type clickAggregate struct {
+	Day            string `parquet:"day"`
+	ShortCode      string `parquet:"short_code"`
+	Clicks         int64  `parquet:"clicks"`
+	UniqueVisitors int64  `parquet:"unique_visitors"`
+}
+
+var exportClient *s3.Client
+
+func initAnalyticsExport() {
+	if cfg.AnalyticsExportBucket == "" {
+		return
+	}
+
+	createTable := `
+	CREATE TABLE IF NOT EXISTS analytics_exports (
+		day DATE PRIMARY KEY,
+		object_key TEXT NOT NULL,
+		row_count BIGINT NOT NULL,
+		exported_at TIMESTAMP DEFAULT NOW()
+	);
+	`
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Analytics export table creation failed", "err", err)
+	}
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.Background())
+	if err != nil {
+		fatal("AWS configuration failed", "err", err)
+	}
+	exportClient = s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.AnalyticsExportEndpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.AnalyticsExportEndpoint)
+			// Most S3-compatible stores don't do virtual-hosted buckets
+			o.UsePathStyle = true
+		}
+	})
+	slog.Info("Analytics export enabled", "bucket", cfg.AnalyticsExportBucket, "format", cfg.AnalyticsExportFormat)
+
+	go func() {
+		ticker := time.NewTicker(exportCheckTick)
+		defer ticker.Stop()
+		for {
+			if isLeader() {
+				if err := exportPendingDays(time.Now()); err != nil {
+					slog.Error("Analytics export error", "err", err)
+				}
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// Export every finished day since the last one exported
+func exportPendingDays(now time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	earliest := today.AddDate(0, 0, -exportMaxCatchUp)
+
+	var last sql.NullTime
+	if err := db.QueryRowContext(ctx, `SELECT MAX(day) FROM analytics_exports`).Scan(&last); err != nil {
+		return err
+	}
+	day := today.AddDate(0, 0, -1) // first run: yesterday only
+	if last.Valid {
+		day = last.Time.UTC().AddDate(0, 0, 1)
+	}
+	if day.Before(earliest) {
+		slog.Warn("Analytics export skipping days beyond catch-up window", "from", day.Format(time.DateOnly), "to", earliest.Format(time.DateOnly))
+		day = earliest
+	}
+
+	for ; day.Before(today); day = day.AddDate(0, 0, 1) {
+		if err := exportDay(ctx, day); err != nil {
+			return fmt.Errorf("%s: %w", day.Format(time.DateOnly), err)
+		}
+	}
+	return nil
+}
+
+func exportDay(ctx context.Context, day time.Time) error {
+	rows, err := db.QueryContext(ctx,
+		`SELECT short_code, COUNT(*), COUNT(DISTINCT ip_address) FROM click_events
+		 WHERE clicked_at >= $1 AND clicked_at < $2 AND suspicious IS NULL
+		 GROUP BY short_code ORDER BY short_code`, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	dayString := day.Format(time.DateOnly)
+	var aggregates []clickAggregate
+	for rows.Next() {
+		a := clickAggregate{Day: dayString}
+		if err := rows.Scan(&a.ShortCode, &a.Clicks, &a.UniqueVisitors); err != nil {
+			return err
+		}
+		aggregates = append(aggregates, a)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	format := strings.ToLower(cfg.AnalyticsExportFormat)
+	body, err := encodeAggregates(format, aggregates)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%sdt=%s/clicks.%s", cfg.AnalyticsExportPrefix, dayString, format)
+	_, err = exportClient.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(cfg.AnalyticsExportBucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(exportContentType(format)),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx,
+		`INSERT INTO analytics_exports (day, object_key, row_count) VALUES ($1, $2, $3)
+		 ON CONFLICT (day) DO UPDATE SET object_key = EXCLUDED.object_key,
+		 row_count = EXCLUDED.row_count, exported_at = NOW()`, day, key, len(aggregates))
+	if err != nil {
+		return err
+	}
+	slog.Info("Analytics exported", "day", dayString, "key", key, "rows", len(aggregates))
+	return nil
+}
+
+func encodeAggregates(format string, aggregates []clickAggregate) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case "parquet":
+		w := parquet.NewGenericWriter[clickAggregate](&buf)
+		if _, err := w.Write(aggregates); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"day", "short_code", "clicks", "unique_visitors"})
+		for _, a := range aggregates {
+			w.Write([]string{a.Day, a.ShortCode, strconv.FormatInt(a.Clicks, 10), strconv.FormatInt(a.UniqueVisitors, 10)})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func exportContentType(format string) string {
+	if format == "parquet" {
+		return "application/vnd.apache.parquet"
+	}
+	return "text/csv"
+}
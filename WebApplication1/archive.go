@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Wayback Machine snapshots: with archive_links on, every new link's
+// destination is sent to the Internet Archive's Save Page Now in the
+// background and the snapshot URL stored on the link. An owner whose
+// destination has died can switch the link to serve the snapshot instead
+// (PUT /api/v1/links/{code}/archive) without losing the code or its clicks.
+// Save Page Now is slow and rate limited, so captures go through one worker
+// and a full queue skips them.
+const (
+	archiveQueueSize = 500
+	archiveTimeout   = 2 * time.Minute // captures routinely take tens of seconds
+	archiveSaveURL   = "https://web.archive.org/save/"
+	archiveHost      = "https://web.archive.org"
+)
+
+type LinkArchive struct {
+	ShortCode    string `json:"short_code"`
+	ArchiveURL   string `json:"archive_url,omitempty"` // empty until a snapshot is stored
+	ServeArchive bool   `json:"serve_archive"`
+}
+
+type LinkArchiveRequest struct {
+	ServeArchive bool `json:"serve_archive"`
+}
+
+var archiveQueue = make(chan *Link, archiveQueueSize)
+
+func initArchive() {
+	if !cfg.ArchiveLinks {
+		return
+	}
+	client := &http.Client{Timeout: archiveTimeout}
+	go func() {
+		for link := range archiveQueue {
+			archiveLink(client, link)
+		}
+	}()
+}
+
+// Queue a snapshot of a link's destination; a full queue skips it
+func queueArchive(link *Link) {
+	if !cfg.ArchiveLinks {
+		return
+	}
+	select {
+	case archiveQueue <- link:
+	default:
+		slog.Warn("Archive queue full, skipping", "short_code", link.ShortCode)
+	}
+}
+
+func archiveLink(client *http.Client, link *Link) {
+	ctx, cancel := context.WithTimeout(context.Background(), archiveTimeout)
+	defer cancel()
+
+	snapshot, err := saveToWayback(ctx, client, link.OriginalURL)
+	if err != nil {
+		slog.Warn("Archive snapshot failed", "short_code", link.ShortCode, "err", err)
+		return
+	}
+	stored, err := encryptURL(link.ShortCode, snapshot)
+	if err != nil {
+		slog.Error("Archive URL encryption error", "short_code", link.ShortCode, "err", err)
+		return
+	}
+	if _, err := db.ExecContext(ctx,
+		`UPDATE urls SET archive_url = $2 WHERE short_code = $1`, link.ShortCode, stored); err != nil {
+		slog.Error("Archive URL store error", "short_code", link.ShortCode, "err", err)
+		return
+	}
+	emitLinkUpdated(link.ShortCode)
+}
+
+// Ask Save Page Now for a capture and return the snapshot's URL
+func saveToWayback(ctx context.Context, client *http.Client, destination string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, archiveSaveURL+destination, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "ihdas-archive/1")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("save page now answered " + resp.Status)
+	}
+
+	// The snapshot path comes back in Content-Location, or as where the
+	// redirects ended up
+	if loc := resp.Header.Get("Content-Location"); strings.HasPrefix(loc, "/web/") {
+		return archiveHost + loc, nil
+	}
+	if final := resp.Request.URL; strings.HasPrefix(final.Path, "/web/") {
+		return archiveHost + final.RequestURI(), nil
+	}
+	return "", errors.New("save page now returned no snapshot location")
+}
+
+// Where a link's redirect goes: its snapshot once the owner has switched to it
+func redirectDestination(link *Link) string {
+	if link.ServeArchive && link.ArchiveURL != "" {
+		return link.ArchiveURL
+	}
+	return link.OriginalURL
+}
+
+// GET /api/v1/links/{code}/archive
+func getLinkArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := callerLink(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, LinkArchive{ShortCode: link.ShortCode, ArchiveURL: link.ArchiveURL, ServeArchive: link.ServeArchive})
+}
+
+// POST /api/v1/links/{code}/archive - take a fresh snapshot
+func archiveLinkHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := callerLink(w, r)
+	if !ok {
+		return
+	}
+	if !cfg.ArchiveLinks {
+		writeError(w, http.StatusNotFound, "archive_disabled", "Archiving is not enabled")
+		return
+	}
+	select {
+	case archiveQueue <- link:
+	default:
+		writeError(w, http.StatusServiceUnavailable, "archive_busy", "Too many snapshots queued, try again later")
+		return
+	}
+	auditCaller(r.Context(), "link.archive", link.ShortCode, nil)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// PUT /api/v1/links/{code}/archive - redirect to the snapshot, or back to
+// the destination
+func putLinkArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := callerLink(w, r)
+	if !ok {
+		return
+	}
+	var req LinkArchiveRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	if req.ServeArchive && link.ArchiveURL == "" {
+		writeError(w, http.StatusConflict, "no_archive", "Link has no snapshot yet")
+		return
+	}
+
+	if _, err := db.ExecContext(r.Context(),
+		`UPDATE urls SET serve_archive = $2 WHERE short_code = $1`, link.ShortCode, req.ServeArchive); err != nil {
+		slog.ErrorContext(r.Context(), "Archive switch error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	invalidateCachedURL(r.Context(), link.ShortCode)
+	auditCaller(r.Context(), "link.archive.serve", link.ShortCode, map[string]interface{}{"serve_archive": req.ServeArchive})
+	emitLinkUpdated(link.ShortCode)
+	writeJSON(w, http.StatusOK, LinkArchive{ShortCode: link.ShortCode, ArchiveURL: link.ArchiveURL, ServeArchive: req.ServeArchive})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// The pages under static/ (landing page, health dashboard, error pages) are
+// compiled into the binary; error pages are templates filled in from the
+// message catalogs, and summary_report.txt is the summary email's template.
+// With STATIC_DIR set, files found there are served instead of the embedded
+// ones of the same name, so a deployment can restyle a page without
+// rebuilding; anything missing from the directory still comes from the binary.
+
+//go:embed static
+var embeddedStatic embed.FS
+
+var staticFiles fs.FS
+
+func initStaticAssets() {
+	embedded, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		fatal("Embedded static assets missing", "err", err)
+	}
+	staticFiles = embedded
+	if cfg.StaticDir != "" {
+		if info, err := os.Stat(cfg.StaticDir); err != nil || !info.IsDir() {
+			fatal("Static directory unusable", "dir", cfg.StaticDir, "err", err)
+		}
+		staticFiles = overlayFS{top: os.DirFS(cfg.StaticDir), base: embedded}
+		slog.Info("Serving static assets with overrides", "dir", cfg.StaticDir)
+	}
+}
+
+// Files in top shadow those in base
+type overlayFS struct {
+	top, base fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.top.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.base.Open(name)
+	}
+	return f, err
+}
+
+func serveStatic(w http.ResponseWriter, r *http.Request, name string) {
+	http.ServeFileFS(w, r, staticFiles, name)
+}
+
+// Catalog keys for error page titles; other statuses use the status text
+var errorPageTitles = map[int]string{
+	http.StatusNotFound:            "not_found.title",
+	http.StatusGone:                "gone.title",
+	http.StatusInternalServerError: "error.title",
+}
+
+// Problem codes for when there's no page to show
+var errorPageCodes = map[int]string{
+	http.StatusNotFound:            "not_found",
+	http.StatusGone:                "gone",
+	http.StatusInternalServerError: "internal_error",
+}
+
+type errorPage struct {
+	Lang, Title, Message, Home string
+}
+
+// The <status>.html template filled in the visitor's language, or the
+// message as problem+json when there's no such page
+func serveErrorPage(w http.ResponseWriter, r *http.Request, status int, messageKey string) {
+	t := localizer(w, r)
+	message := t(messageKey)
+	code, ok := errorPageCodes[status]
+	if !ok {
+		code = "error"
+	}
+	tmpl, err := template.ParseFS(staticFiles, strconv.Itoa(status)+".html")
+	if err != nil {
+		writeError(w, status, code, message)
+		return
+	}
+	page := errorPage{Lang: w.Header().Get("Content-Language"), Title: http.StatusText(status), Message: message, Home: t("home")}
+	if key, ok := errorPageTitles[status]; ok {
+		page.Title = t(key)
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, page); err != nil {
+		slog.ErrorContext(r.Context(), "Error page template failed", "status", status, "err", err)
+		writeError(w, status, code, message)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", linkPageCSP)
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
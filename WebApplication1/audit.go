@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Audit log of mutating actions - who (admin, an API key owner, anonymous
+// or the system itself), what, on which target, from where and when.
+const (
+	actorAdmin     = "admin"
+	actorAnonymous = "anonymous"
+	actorSystem    = "system"
+)
+
+type AuditEntry struct {
+	ID        int64                  `json:"id"`
+	Actor     string                 `json:"actor"`
+	Action    string                 `json:"action"`
+	Target    string                 `json:"target,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	SourceIP  string                 `json:"source_ip,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+type AuditListResponse struct {
+	Entries    []AuditEntry `json:"entries"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+func initAuditLog() {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id BIGSERIAL PRIMARY KEY,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT,
+		details JSONB,
+		source_ip TEXT,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log(actor, id);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log(target, id);
+	`
+
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Audit log table creation failed", "err", err)
+	}
+}
+
+// Address the request came from, as seen by the authenticate middleware
+func requestIP(ctx context.Context) string {
+	ip, _ := ctx.Value(requestIPKey).(string)
+	return ip
+}
+
+func recordAudit(ctx context.Context, actor, action, target string, details map[string]interface{}) {
+	// Lets an audit entry be matched up with the request's logs
+	if id := requestID(ctx); id != "" {
+		merged := map[string]interface{}{"request_id": id}
+		for k, v := range details {
+			merged[k] = v
+		}
+		details = merged
+	}
+
+	var detailsJSON []byte
+	if len(details) > 0 {
+		detailsJSON, _ = json.Marshal(details)
+	}
+
+	// Detached from the request so a client hanging up doesn't lose the entry
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO audit_log (actor, action, target, details, source_ip)
+		 VALUES ($1, $2, NULLIF($3, ''), $4, NULLIF($5, ''))`,
+		actor, action, target, detailsJSON, requestIP(ctx))
+	if err != nil {
+		slog.ErrorContext(ctx, "Audit log error", "actor", actor, "action", action, "target", target, "err", err)
+	}
+}
+
+// Action taken by whoever is calling - an API key owner or anonymous
+func auditCaller(ctx context.Context, action, target string, details map[string]interface{}) {
+	actor := callerOwner(ctx)
+	if actor == "" {
+		actor = actorAnonymous
+	}
+	recordAudit(ctx, actor, action, target, details)
+}
+
+// Action taken through an admin endpoint
+func auditAdmin(r *http.Request, action, target string, details map[string]interface{}) {
+	recordAudit(r.Context(), actorAdmin, action, target, details)
+}
+
+// GET /api/v1/admin/audit?actor=&action=&target=&cursor=&limit=
+func auditLogHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	afterID, limit, ok := parsePageQuery(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+
+	rows, err := db.QueryContext(r.Context(),
+		`SELECT id, actor, action, COALESCE(target, ''), COALESCE(details::TEXT, ''), COALESCE(source_ip, ''), created_at
+		 FROM audit_log
+		 WHERE id > $1
+		   AND ($2 = '' OR actor = $2)
+		   AND ($3 = '' OR action = $3)
+		   AND ($4 = '' OR target = $4)
+		 ORDER BY id LIMIT $5`,
+		afterID, query.Get("actor"), query.Get("action"), query.Get("target"), limit+1)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Audit log query error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	defer rows.Close()
+
+	resp := AuditListResponse{Entries: []AuditEntry{}}
+	for rows.Next() {
+		var entry AuditEntry
+		var details string
+		if err := rows.Scan(&entry.ID, &entry.Actor, &entry.Action, &entry.Target, &details, &entry.SourceIP, &entry.CreatedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Audit log query error", "err", err)
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		if details != "" {
+			json.Unmarshal([]byte(details), &entry.Details)
+		}
+		resp.Entries = append(resp.Entries, entry)
+	}
+
+	hasNext := len(resp.Entries) > limit
+	if hasNext {
+		resp.Entries = resp.Entries[:limit]
+	}
+	if len(resp.Entries) > 0 {
+		resp.NextCursor = nextCursor(resp.Entries[len(resp.Entries)-1].ID, hasNext)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Caller identity - integrations authenticate with an X-API-Key header.
+// Requests without a key are anonymous; an unknown or revoked key is a 401.
+type contextKey int
+
+const (
+	callerOwnerKey contextKey = iota
+	requestIPKey
+	logFieldsKey
+	requestIDKey
+	panicReportedKey
+	servingTenantKey
+)
+
+const apiKeyCacheTTL = time.Minute
+
+type cachedAPIKey struct {
+	owner    string
+	cachedAt time.Time
+}
+
+var apiKeyCache sync.Map // key hash -> cachedAPIKey
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Kept for the audit log, which also sees non-HTTP callers
+		ctx := context.WithValue(r.Context(), requestIPKey, getClientIP(r))
+		ctx = context.WithValue(ctx, servingTenantKey, servingTenant(r.Host))
+		r = r.WithContext(ctx)
+
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Another tenant's key is as unknown here as a made-up one
+		owner, err := lookupAPIKey(r.Context(), key)
+		if err == sql.ErrNoRows || (err == nil && !ownerAllowedHere(r.Context(), owner)) {
+			writeError(w, http.StatusUnauthorized, "invalid_api_key", "Invalid API key")
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "API key lookup error", "err", err)
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+
+		ctx = context.WithValue(r.Context(), callerOwnerKey, owner)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func lookupAPIKey(ctx context.Context, key string) (string, error) {
+	keyHash := hashAPIKey(key)
+	if val, ok := apiKeyCache.Load(keyHash); ok {
+		entry := val.(cachedAPIKey)
+		if time.Since(entry.cachedAt) < apiKeyCacheTTL {
+			return entry.owner, nil
+		}
+		apiKeyCache.Delete(keyHash)
+	}
+
+	var owner string
+	err := db.QueryRowContext(ctx,
+		`SELECT owner FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL`, keyHash).Scan(&owner)
+	if err != nil {
+		return "", err
+	}
+	apiKeyCache.Store(keyHash, cachedAPIKey{owner: owner, cachedAt: time.Now()})
+	return owner, nil
+}
+
+// Owner of the API key used for this request, empty when anonymous
+func callerOwner(ctx context.Context) string {
+	owner, _ := ctx.Value(callerOwnerKey).(string)
+	return owner
+}
+
+// Handlers that only make sense for an identified caller
+func requireCaller(w http.ResponseWriter, r *http.Request) (string, bool) {
+	owner := callerOwner(r.Context())
+	if owner == "" {
+		writeError(w, http.StatusUnauthorized, "api_key_required", "API key required")
+		return "", false
+	}
+	return owner, true
+}
+
+type CreateAPIKeyRequest struct {
+	Owner  string `json:"owner"`
+	Tenant string `json:"tenant,omitempty"` // the key's owner is then "<tenant>/<owner>"
+}
+
+type CreateAPIKeyResponse struct {
+	ID        int64     `json:"id"`
+	Owner     string    `json:"owner"`
+	Key       string    `json:"key"` // only ever shown once
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// POST /api/v1/admin/keys
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var req CreateAPIKeyRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	if req.Owner == "" {
+		writeError(w, http.StatusBadRequest, "missing_owner", "owner is required")
+		return
+	}
+	// The separator would let an owner pass for one in another tenant
+	if strings.Contains(req.Owner, tenantOwnerSep) {
+		writeError(w, http.StatusBadRequest, "invalid_owner", "owner may not contain "+tenantOwnerSep)
+		return
+	}
+	owner := req.Owner
+	if req.Tenant != "" {
+		exists, err := tenantExists(r.Context(), req.Tenant)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "API key creation error", "err", err)
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		if !exists {
+			writeError(w, http.StatusBadRequest, "unknown_tenant", "No such tenant")
+			return
+		}
+		owner = req.Tenant + tenantOwnerSep + req.Owner
+	}
+
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Key generation error")
+		return
+	}
+	resp := CreateAPIKeyResponse{Owner: owner, Key: "ihd_" + hex.EncodeToString(raw)}
+
+	err := db.QueryRowContext(r.Context(),
+		`INSERT INTO api_keys (key_hash, owner, tenant_id) VALUES ($1, $2, NULLIF($3, '')) RETURNING id, created_at`,
+		hashAPIKey(resp.Key), owner, req.Tenant).Scan(&resp.ID, &resp.CreatedAt)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "API key creation error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	auditAdmin(r, "api_key.create", strconv.FormatInt(resp.ID, 10), map[string]interface{}{"owner": owner})
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// DELETE /api/v1/admin/keys/{id}
+func revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_id", "Invalid key id")
+		return
+	}
+
+	var keyHash string
+	err = db.QueryRowContext(r.Context(),
+		`UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL RETURNING key_hash`, id).Scan(&keyHash)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "api_key_not_found", "API key not found")
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "API key revoke error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	// Other instances pick the revocation up within apiKeyCacheTTL
+	apiKeyCache.Delete(keyHash)
+	auditAdmin(r, "api_key.revoke", strconv.FormatInt(id, 10), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Import straight from a Bitly account through its v4 API, for when an
+// export file isn't at hand. The access token is used for this request only
+// and never stored. Every back-half a link has (the generated one and any
+// custom ones) is recreated with the same destination. Bitly's API doesn't
+// list click counts with the links, so those start from zero.
+const (
+	bitlyPageSize    = 100
+	bitlyMaxBodySize = 8 << 20
+)
+
+var (
+	bitlyAPI    = "https://api-ssl.bitly.com/v4"
+	bitlyClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+type BitlyImportRequest struct {
+	AccessToken string `json:"access_token"`
+	GroupGUID   string `json:"group_guid,omitempty"` // default: the token user's default group
+	Owner       string `json:"owner,omitempty"`
+	OnConflict  string `json:"on_conflict,omitempty"` // skip (default) or overwrite
+}
+
+type bitlyLink struct {
+	ID             string   `json:"id"` // "bit.ly/abc123"
+	LongURL        string   `json:"long_url"`
+	CreatedAt      string   `json:"created_at"`
+	CustomBitlinks []string `json:"custom_bitlinks"`
+}
+
+type bitlyPage struct {
+	Links      []bitlyLink `json:"links"`
+	Pagination struct {
+		Next string `json:"next"`
+	} `json:"pagination"`
+}
+
+// POST /api/v1/admin/import/bitly
+// Results use the same shape as the file import, with line numbers counting
+// back-halves in the order Bitly returned them.
+func bitlyImportHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var req BitlyImportRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	if req.AccessToken == "" {
+		writeError(w, http.StatusBadRequest, "missing_access_token", "access_token is required")
+		return
+	}
+	policy, ok := parseImportPolicy(w, req.OnConflict)
+	if !ok {
+		return
+	}
+
+	// Bigger accounts take a while to page through
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	ctx := r.Context()
+
+	group := req.GroupGUID
+	if group == "" {
+		var user struct {
+			DefaultGroupGUID string `json:"default_group_guid"`
+		}
+		if err := bitlyGet(ctx, req.AccessToken, bitlyAPI+"/user", &user); err != nil {
+			writeBitlyError(w, err)
+			return
+		}
+		group = user.DefaultGroupGUID
+	}
+
+	im := &linkImporter{policy: policy, owner: req.Owner}
+	line := 0
+	next := fmt.Sprintf("%s/groups/%s/bitlinks?size=%d", bitlyAPI, url.PathEscape(group), bitlyPageSize)
+	for next != "" {
+		var page bitlyPage
+		if err := bitlyGet(ctx, req.AccessToken, next, &page); err != nil {
+			// Whatever was imported before this stays; report it anyway
+			if line == 0 {
+				writeBitlyError(w, err)
+				return
+			}
+			im.resp.fail(line+1, err)
+			break
+		}
+		for _, link := range page.Links {
+			created, _ := parseImportTime(link.CreatedAt)
+			for _, bitlink := range append([]string{link.ID}, link.CustomBitlinks...) {
+				line++
+				im.handle(ctx, line, exportRecord{
+					ShortCode:   codeFromShortLink(bitlink),
+					OriginalURL: link.LongURL,
+					CreatedAt:   created,
+				})
+			}
+		}
+		next = page.Pagination.Next
+	}
+
+	im.finish(r, "bitly")
+	writeJSON(w, http.StatusOK, im.resp)
+}
+
+// Failures talking to Bitly, with a message safe to pass back to the admin
+type bitlyError struct {
+	status  int
+	message string
+}
+
+func (e *bitlyError) Error() string { return "bitly: " + e.message }
+
+func bitlyGet(ctx context.Context, token, endpoint string, dst interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := bitlyClient.Do(req)
+	if err != nil {
+		return &bitlyError{status: http.StatusBadGateway, message: "request failed"}
+	}
+	defer resp.Body.Close()
+	body := io.LimitReader(resp.Body, bitlyMaxBodySize)
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Message     string `json:"message"`
+			Description string `json:"description"`
+		}
+		json.NewDecoder(body).Decode(&apiErr)
+		message := firstNonEmpty(apiErr.Description, apiErr.Message, resp.Status)
+		if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized {
+			return &bitlyError{status: http.StatusBadRequest, message: "access token rejected: " + message}
+		}
+		return &bitlyError{status: http.StatusBadGateway, message: message}
+	}
+	if err := json.NewDecoder(body).Decode(dst); err != nil {
+		return &bitlyError{status: http.StatusBadGateway, message: "unreadable response"}
+	}
+	return nil
+}
+
+func writeBitlyError(w http.ResponseWriter, err error) {
+	var bErr *bitlyError
+	if errors.As(err, &bErr) {
+		writeError(w, bErr.status, "bitly_error", bErr.Error())
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "internal_error", "Internal error")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+type BulkResult struct {
+	Index  int                `json:"index"`
+	Status int                `json:"status"`
+	Link   *CreateURLResponse `json:"link,omitempty"`
+	Code   string             `json:"code,omitempty"`
+	Error  string             `json:"error,omitempty"`
+}
+
+type BulkCreateResponse struct {
+	Created int          `json:"created"`
+	Failed  int          `json:"failed"`
+	Results []BulkResult `json:"results"`
+}
+
+// POST /api/v1/shorten/bulk - an array of CreateURLRequest, created in one
+// transaction with a result per item, for newsletter and catalog tooling
+func bulkCreateHandler(w http.ResponseWriter, r *http.Request) {
+	var reqs []CreateURLRequest
+	if !decodeJSON(w, r, &reqs, maxBulkBodyBytes) {
+		return
+	}
+	if len(reqs) == 0 {
+		writeError(w, http.StatusBadRequest, "empty_batch", "No URLs to shorten")
+		return
+	}
+	if limit := cfg.BulkShortenMax; len(reqs) > limit {
+		writeError(w, http.StatusRequestEntityTooLarge, "batch_too_large", "Too many URLs, maximum is "+strconv.Itoa(limit))
+		return
+	}
+
+	results, err := createBatch(r.Context(), reqs, r.Host)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Bulk create error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	resp := BulkCreateResponse{Results: results}
+	for _, result := range resp.Results {
+		if result.Status == http.StatusCreated {
+			resp.Created++
+		} else {
+			resp.Failed++
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Create a batch of links in one transaction, one result per request.
+// Only valid items go into the transaction; an error means none were created.
+func createBatch(ctx context.Context, reqs []CreateURLRequest, host string) ([]BulkResult, error) {
+	results := make([]BulkResult, len(reqs))
+
+	var links []*Link
+	var positions []int
+	for i, req := range reqs {
+		results[i].Index = i
+		link, err := prepareLink(ctx, req)
+		if err != nil {
+			results[i].Status, results[i].Code, results[i].Error = bulkErrorStatus(err)
+			continue
+		}
+		links = append(links, link)
+		positions = append(positions, i)
+	}
+	if len(links) == 0 {
+		return results, nil
+	}
+	spam := scoreNewLinks(ctx, links)
+
+	errs, err := store.CreateLinks(ctx, links)
+	if err != nil {
+		return nil, err
+	}
+
+	for j, link := range links {
+		result := &results[positions[j]]
+		if errs[j] != nil {
+			if errors.Is(errs[j], ErrCodeTaken) {
+				errs[j] = &apiError{http.StatusConflict, "code_taken", "Short code already exists"}
+			}
+			result.Status, result.Code, result.Error = bulkErrorStatus(errs[j])
+			continue
+		}
+		recordSpamScore(ctx, link, spam[j])
+		setCachedURL(link)
+		goBackground(func() { emitLinkEvent(EventLinkCreated, link) })
+		queueLinkPreview(link)
+		queueArchive(link)
+		auditCaller(ctx, "link.create", link.ShortCode, map[string]interface{}{"original_url": link.OriginalURL, "bulk": true})
+		result.Status = http.StatusCreated
+		result.Link = buildCreateResponse(link, host)
+	}
+	return results, nil
+}
+
+func bulkErrorStatus(err error) (int, string, string) {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.Status, apiErr.Code, apiErr.Message
+	}
+	slog.Error("Bulk item error", "err", err)
+	return http.StatusInternalServerError, "database_error", "Database error"
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Link bundles: one code answering with a page that lists several
+// destinations (a reading list, a release's downloads). Like link-in-bio
+// pages, the bundle replaces the redirect without replacing the link, and
+// a link has one or the other. Items are followed through /{code}/{n},
+// counting from 1, which redirects and counts the click on the item; the
+// visit to the bundle itself counts on the link as usual. Items are
+// destinations like any other: they're scored for spam when saved and
+// re-checked by the reputation, blocklist and health sweeps with the link,
+// and encrypted at rest like it.
+const (
+	maxBundleItems   = 100
+	maxBundleNoteLen = 300
+)
+
+type LinkBundle struct {
+	ShortCode   string       `json:"short_code"`
+	Title       string       `json:"title"`
+	Description string       `json:"description,omitempty"`
+	Items       []BundleItem `json:"items"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	Status      string       `json:"status,omitempty"` // pending_review while held for spam review
+}
+
+type BundleItem struct {
+	Number int    `json:"number"` // /{code}/{number} leads to it
+	Title  string `json:"title"`
+	URL    string `json:"url"`
+	Note   string `json:"note,omitempty"`
+	Clicks int64  `json:"clicks"`
+}
+
+// Items are listed in the order given
+type LinkBundleRequest struct {
+	Title       string              `json:"title"`
+	Description string              `json:"description,omitempty"`
+	Items       []BundleItemRequest `json:"items"`
+}
+
+type BundleItemRequest struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+	Note  string `json:"note,omitempty"`
+}
+
+func initLinkBundles() {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS link_bundles (
+		short_code VARCHAR(64) PRIMARY KEY REFERENCES urls(short_code) ON DELETE CASCADE,
+		title TEXT NOT NULL,
+		description TEXT,
+		updated_at TIMESTAMP DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS link_bundle_items (
+		short_code VARCHAR(64) NOT NULL REFERENCES link_bundles(short_code) ON DELETE CASCADE,
+		number INT NOT NULL,
+		title TEXT NOT NULL,
+		url TEXT NOT NULL,
+		note TEXT,
+		clicks BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (short_code, number)
+	);
+	ALTER TABLE link_bundle_items ADD COLUMN IF NOT EXISTS url_hash TEXT;
+	`
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Link bundles table creation failed", "err", err)
+	}
+}
+
+// Item destinations get the same checks as link destinations
+func validateLinkBundle(ctx context.Context, req *LinkBundleRequest) error {
+	req.Title = strings.TrimSpace(req.Title)
+	if req.Title == "" || utf8.RuneCountInString(req.Title) > maxPageTitleLen {
+		return &apiError{http.StatusBadRequest, "invalid_title", fmt.Sprintf("title must be 1-%d characters", maxPageTitleLen)}
+	}
+	if utf8.RuneCountInString(req.Description) > maxPageTextLen {
+		return &apiError{http.StatusBadRequest, "invalid_description", fmt.Sprintf("description must be at most %d characters", maxPageTextLen)}
+	}
+	if len(req.Items) == 0 || len(req.Items) > maxBundleItems {
+		return &apiError{http.StatusBadRequest, "invalid_items", fmt.Sprintf("a bundle has 1-%d items", maxBundleItems)}
+	}
+	for i := range req.Items {
+		item := &req.Items[i]
+		item.Title = strings.TrimSpace(item.Title)
+		if item.Title == "" || utf8.RuneCountInString(item.Title) > maxButtonTitleLen {
+			return &apiError{http.StatusBadRequest, "invalid_items",
+				fmt.Sprintf("items[%d]: title must be 1-%d characters", i, maxButtonTitleLen)}
+		}
+		if utf8.RuneCountInString(item.Note) > maxBundleNoteLen {
+			return &apiError{http.StatusBadRequest, "invalid_items",
+				fmt.Sprintf("items[%d]: note must be at most %d characters", i, maxBundleNoteLen)}
+		}
+		destination, err := validateDestination(ctx, item.URL)
+		if err != nil {
+			return prefixAPIError(err, fmt.Sprintf("items[%d]: ", i))
+		}
+		item.URL = destination
+	}
+	return nil
+}
+
+func getLinkBundle(ctx context.Context, shortCode string) (*LinkBundle, error) {
+	bundle := LinkBundle{ShortCode: shortCode, Items: []BundleItem{}}
+	err := db.QueryRowContext(ctx,
+		`SELECT title, COALESCE(description, ''), updated_at FROM link_bundles WHERE short_code = $1`, shortCode).
+		Scan(&bundle.Title, &bundle.Description, &bundle.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT number, title, url, COALESCE(note, ''), clicks FROM link_bundle_items
+		 WHERE short_code = $1 ORDER BY number`, shortCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item BundleItem
+		if err := rows.Scan(&item.Number, &item.Title, &item.URL, &item.Note, &item.Clicks); err != nil {
+			return nil, err
+		}
+		if item.URL, err = decryptURL(pageURLData(shortCode, item.Number), item.URL); err != nil {
+			return nil, fmt.Errorf("decrypt bundle item %d of %s: %w", item.Number, shortCode, err)
+		}
+		bundle.Items = append(bundle.Items, item)
+	}
+	return &bundle, rows.Err()
+}
+
+// A link has a page or a bundle, never both
+var (
+	errLinkHasPage   = &apiError{http.StatusConflict, "link_has_page", "Link has a page; remove it before making a bundle"}
+	errLinkHasBundle = &apiError{http.StatusConflict, "link_has_bundle", "Link is a bundle; remove it before attaching a page"}
+)
+
+// Lock a link's row for the rest of tx and report whether the other kind
+// of page (table link_pages or link_bundles) is on it, so a page and a
+// bundle saved at once can't both land
+func lockLinkPages(ctx context.Context, tx *sql.Tx, shortCode, table string) (bool, error) {
+	var exists bool
+	err := tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM `+table+` WHERE short_code = $1) FROM urls WHERE short_code = $1 FOR UPDATE`,
+		shortCode).Scan(&exists)
+	return exists, err
+}
+
+// Replace a link's bundle. Items keep their clicks while their destination
+// stays at the same number; destinations are encrypted at rest like the
+// link's own, so that's told by their hash.
+func saveLinkBundle(ctx context.Context, shortCode string, req LinkBundleRequest) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if hasPage, err := lockLinkPages(ctx, tx, shortCode, "link_pages"); err != nil {
+		return err
+	} else if hasPage {
+		return errLinkHasPage
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO link_bundles (short_code, title, description) VALUES ($1, $2, NULLIF($3, ''))
+		 ON CONFLICT (short_code) DO UPDATE SET title = EXCLUDED.title, description = EXCLUDED.description,
+		 updated_at = NOW()`, shortCode, req.Title, req.Description); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM link_bundle_items WHERE short_code = $1 AND number > $2`, shortCode, len(req.Items)); err != nil {
+		return err
+	}
+	for i, item := range req.Items {
+		storedURL, err := encryptURL(pageURLData(shortCode, i+1), item.URL)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO link_bundle_items (short_code, number, title, url, url_hash, note) VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))
+			 ON CONFLICT (short_code, number) DO UPDATE SET title = EXCLUDED.title, url = EXCLUDED.url,
+			 url_hash = EXCLUDED.url_hash, note = EXCLUDED.note,
+			 clicks = CASE WHEN link_bundle_items.url_hash = EXCLUDED.url_hash THEN link_bundle_items.clicks ELSE 0 END`,
+			shortCode, i+1, item.Title, storedURL, destinationHash(item.URL), item.Note); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE urls SET has_page = TRUE WHERE short_code = $1`, shortCode); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func scoreBundleItems(ctx context.Context, req LinkBundleRequest) *spamScore {
+	urls := make([]string, len(req.Items))
+	for i, item := range req.Items {
+		urls[i] = item.URL
+	}
+	return scorePageDestinations(ctx, urls, func(i int) string { return "bundle_item:" + strconv.Itoa(i+1) })
+}
+
+func incrementBundleItemClicks(ctx context.Context, shortCode string, number int) {
+	if _, err := db.ExecContext(ctx,
+		`UPDATE link_bundle_items SET clicks = clicks + 1 WHERE short_code = $1 AND number = $2`, shortCode, number); err != nil {
+		slog.ErrorContext(ctx, "Bundle item click error", "err", err)
+	}
+}
+
+// GET /api/v1/links/{code}/bundle
+func getLinkBundleHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := callerLink(w, r)
+	if !ok {
+		return
+	}
+	bundle, err := getLinkBundle(r.Context(), link.ShortCode)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "bundle_not_found", "Link has no bundle")
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Link bundle lookup error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if link.DisabledReason == spamReviewReason {
+		bundle.Status = "pending_review"
+	}
+	writeJSON(w, http.StatusOK, bundle)
+}
+
+// PUT /api/v1/links/{code}/bundle - make the link a bundle, or replace the
+// one there
+func putLinkBundleHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := callerLink(w, r)
+	if !ok {
+		return
+	}
+	var req LinkBundleRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	if err := validateLinkBundle(r.Context(), &req); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	spam := scoreBundleItems(r.Context(), req)
+
+	var apiErr *apiError
+	if err := saveLinkBundle(r.Context(), link.ShortCode, req); errors.As(err, &apiErr) {
+		writeAPIError(w, err)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Link bundle save error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	invalidateCachedURL(r.Context(), link.ShortCode)
+	bundle, err := getLinkBundle(r.Context(), link.ShortCode)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Link bundle lookup error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	auditCaller(r.Context(), "link.bundle.save", link.ShortCode, map[string]interface{}{"items": len(bundle.Items)})
+	emitLinkUpdated(link.ShortCode)
+	if spam != nil {
+		if err := holdForSpamReview(r.Context(), link, spam); err != nil {
+			slog.ErrorContext(r.Context(), "Spam hold error", "err", err)
+		}
+	}
+	if spam != nil || link.DisabledReason == spamReviewReason {
+		bundle.Status = "pending_review"
+	}
+	writeJSON(w, http.StatusOK, bundle)
+}
+
+// DELETE /api/v1/links/{code}/bundle - the code redirects again
+func deleteLinkBundleHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := callerLink(w, r)
+	if !ok {
+		return
+	}
+	res, err := db.ExecContext(r.Context(), `DELETE FROM link_bundles WHERE short_code = $1`, link.ShortCode)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Link bundle delete error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, http.StatusNotFound, "bundle_not_found", "Link has no bundle")
+		return
+	}
+	if _, err := db.ExecContext(r.Context(), `UPDATE urls SET has_page = FALSE WHERE short_code = $1`, link.ShortCode); err != nil {
+		slog.ErrorContext(r.Context(), "Link bundle delete error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	invalidateCachedURL(r.Context(), link.ShortCode)
+	auditCaller(r.Context(), "link.bundle.delete", link.ShortCode, nil)
+	emitLinkUpdated(link.ShortCode)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Render a bundle for a visitor; items link to /{code}/{n} relative to the
+// bundle, so prefixes and namespace hosts carry over
+func serveBundlePage(w http.ResponseWriter, r *http.Request, shortCode string) {
+	bundle, err := getLinkBundle(r.Context(), shortCode)
+	if err == sql.ErrNoRows {
+		serveErrorPage(w, r, http.StatusNotFound, "not_found.message")
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Link bundle lookup error", "err", err)
+		serveErrorPage(w, r, http.StatusInternalServerError, "error.retry")
+		return
+	}
+	color := defaultButtonColor
+	if c := tenantBrand(codeTenant(shortCode)).PrimaryColor; c != "" {
+		color = c
+	}
+	code := localCode(publicToken(shortCode))
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Content-Security-Policy", linkPageCSP)
+	fmt.Fprintf(w, `<!doctype html><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>%s</title>
+<style>body{font-family:system-ui,sans-serif;max-width:40rem;margin:2rem auto;padding:0 1rem}
+li{margin:.75rem 0}li a{color:%s;font-weight:600}li small{display:block;color:#666}</style>
+<h1>%s</h1>
+`, html.EscapeString(bundle.Title), color, html.EscapeString(bundle.Title))
+	if bundle.Description != "" {
+		fmt.Fprintf(w, "<p>%s</p>\n", html.EscapeString(bundle.Description))
+	}
+	fmt.Fprint(w, "<ol>\n")
+	for _, item := range bundle.Items {
+		shown := item.URL
+		if d := displayURL(item.URL); d != "" {
+			shown = d
+		}
+		fmt.Fprintf(w, "<li><a href=\"%s/%d\" rel=\"nofollow noopener\">%s</a><small>%s</small>",
+			html.EscapeString(code), item.Number, html.EscapeString(item.Title), html.EscapeString(shown))
+		if item.Note != "" {
+			fmt.Fprintf(w, "<p>%s</p>", html.EscapeString(item.Note))
+		}
+		fmt.Fprint(w, "</li>\n")
+	}
+	fmt.Fprint(w, "</ol>\n")
+}
+
+// GET /{code}/{n} - follow a bundle's item. The link is checked the way a
+// redirect checks it, so expired and disabled bundles lead nowhere.
+func bundleItemHandler(w http.ResponseWriter, r *http.Request, number int) {
+	domain := requestDomain(r)
+	settings := domainSettings(domain)
+	shortCode, ok := resolveCode(r.Context(), namespacedCode(domain, r.PathValue("code")))
+	if !ok {
+		serveNotFound(w, r, settings)
+		return
+	}
+	addLogAttrs(r.Context(), slog.String("short_code", shortCode))
+	if inMaintenance() {
+		writeMaintenance(w)
+		return
+	}
+	if dbDown() {
+		w.Header().Set("Retry-After", "5")
+		writeError(w, http.StatusServiceUnavailable, "database_unavailable", "Service is reconnecting to its database, please retry shortly")
+		return
+	}
+
+	link, err := store.GetLink(r.Context(), shortCode)
+	if errors.Is(err, ErrLinkNotFound) || (err == nil && (link.Domain != domain || !link.HasPage)) {
+		serveNotFound(w, r, settings)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Database error", "err", err)
+		serveErrorPage(w, r, http.StatusInternalServerError, "error.retry")
+		return
+	}
+	if link.ExpiresAt != nil && time.Now().After(*link.ExpiresAt) {
+		serveErrorPage(w, r, http.StatusGone, "link_expired")
+		return
+	}
+	if link.DisabledAt != nil {
+		serveErrorPage(w, r, http.StatusGone, "link_disabled")
+		return
+	}
+
+	var destination string
+	err = db.QueryRowContext(r.Context(),
+		`SELECT url FROM link_bundle_items WHERE short_code = $1 AND number = $2`, link.ShortCode, number).Scan(&destination)
+	if err == nil {
+		destination, err = decryptURL(pageURLData(link.ShortCode, number), destination)
+	}
+	if err == sql.ErrNoRows {
+		serveNotFound(w, r, settings)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Bundle item lookup error", "err", err)
+		serveErrorPage(w, r, http.StatusInternalServerError, "error.retry")
+		return
+	}
+	recordBundleClick(r, link.ShortCode, number)
+	serveRedirect(w, r, destination, settings)
+}
+
+// A path segment naming a bundle item
+func bundleItemNumber(s string) (int, bool) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > maxBundleItems || strconv.Itoa(n) != s {
+		return 0, false
+	}
+	return n, true
+}
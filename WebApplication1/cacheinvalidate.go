@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Redirect cache invalidation across instances. A link disabled, edited
+// or deleted on one instance is evicted there and announced with
+// PostgreSQL NOTIFY; every instance LISTENs on a connection of its own,
+// outside the pool, and drops the code from its cache. Notifications sent
+// while the listener is reconnecting are lost, so after a reconnect the
+// whole cache is dropped, and entries expire after linkCacheTTL regardless.
+// Like leader election, LISTEN needs a direct connection rather than a
+// transaction-pooling PgBouncer.
+const (
+	cacheInvalidationChannel = "ihdas_link_cache"
+	cacheListenRetry         = 5 * time.Second
+	linkCacheTTL             = 30 * time.Second
+)
+
+func initCacheInvalidation() {
+	go func() {
+		for !shuttingDown.Load() {
+			if err := listenCacheInvalidations(context.Background()); err != nil && !shuttingDown.Load() {
+				slog.Warn("Cache invalidation listener stopped", "err", err)
+			}
+			time.Sleep(cacheListenRetry)
+		}
+	}()
+}
+
+func listenCacheInvalidations(ctx context.Context) error {
+	// The DSN the pool connects with, re-loaded after a failover
+	config := dbReresolved.Load()
+	if config == nil {
+		parsed, err := pgx.ParseConfig(cfg.DatabaseURL)
+		if err != nil {
+			// pgx errors can echo the DSN back, password and all
+			return errors.New("DATABASE_URL is not a valid connection string")
+		}
+		config = parsed
+	}
+	conn, err := pgx.ConnectConfig(ctx, config.Copy())
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+cacheInvalidationChannel); err != nil {
+		return err
+	}
+	// Anything announced before LISTEN took effect was missed
+	clearLinkCache()
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		deleteCachedURL(n.Payload)
+	}
+}
+
+// Evict a link from every instance's redirect cache. Call it after the
+// change is committed, or an instance could cache the old row again.
+func invalidateCachedURL(ctx context.Context, shortCode string) {
+	deleteCachedURL(shortCode)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, cacheInvalidationChannel, shortCode); err != nil {
+		// Other instances catch up within linkCacheTTL
+		slog.WarnContext(ctx, "Cache invalidation notify failed", "short_code", shortCode, "err", err)
+	}
+}
+
+func clearLinkCache() {
+	cacheMutex.Lock()
+	clear(recentCache)
+	cacheMutex.Unlock()
+}
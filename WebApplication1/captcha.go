@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Optional CAPTCHA on anonymous link creation. The index page renders the
+// widget using GET /api/v1/captcha and sends the solved token in the
+// X-Captcha-Token header. Requests made with an API key are never asked.
+//
+//	CAPTCHA_PROVIDER=hcaptcha|turnstile
+//	CAPTCHA_SITE_KEY=...  (public, handed to the page)
+//	CAPTCHA_SECRET=...    (server-side verification)
+var captchaVerifyURLs = map[string]string{
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+	"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+var captchaClient = &http.Client{Timeout: 5 * time.Second}
+
+type CaptchaConfigResponse struct {
+	Enabled  bool   `json:"enabled"`
+	Provider string `json:"provider,omitempty"`
+	SiteKey  string `json:"site_key,omitempty"`
+}
+
+func captchaProvider() string {
+	provider := strings.ToLower(cfg.CaptchaProvider)
+	if _, ok := captchaVerifyURLs[provider]; !ok || secret("CAPTCHA_SECRET") == "" {
+		return ""
+	}
+	return provider
+}
+
+// GET /api/v1/captcha
+func captchaConfigHandler(w http.ResponseWriter, r *http.Request) {
+	resp := CaptchaConfigResponse{}
+	if provider := captchaProvider(); provider != "" {
+		resp = CaptchaConfigResponse{Enabled: true, Provider: provider, SiteKey: cfg.CaptchaSiteKey}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Wrap a creation handler so anonymous callers must pass a CAPTCHA
+func requireCaptcha(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider := captchaProvider()
+		if provider == "" || callerOwner(r.Context()) != "" {
+			next(w, r)
+			return
+		}
+
+		token := r.Header.Get("X-Captcha-Token")
+		if token == "" {
+			writeError(w, http.StatusForbidden, "captcha_required", "Solve the CAPTCHA or use an API key")
+			return
+		}
+
+		ok, err := verifyCaptcha(r.Context(), provider, token, getClientIP(r))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "CAPTCHA verification error", "provider", provider, "err", err)
+			writeError(w, http.StatusServiceUnavailable, "captcha_unavailable", "CAPTCHA verification unavailable, try again")
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusForbidden, "captcha_failed", "CAPTCHA verification failed")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func verifyCaptcha(ctx context.Context, provider, token, remoteIP string) (bool, error) {
+	form := url.Values{
+		"secret":   {secret("CAPTCHA_SECRET")},
+		"response": {token},
+		"remoteip": {remoteIP},
+	}
+	if siteKey := cfg.CaptchaSiteKey; siteKey != "" && provider == "hcaptcha" {
+		form.Set("sitekey", siteKey)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, captchaVerifyURLs[provider], strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := captchaClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s returned %d", provider, resp.StatusCode)
+	}
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
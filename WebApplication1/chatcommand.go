@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const shortenCommandUsage = "Usage: /shorten <url> [custom-code]"
+
+// The /shorten command as typed into a chat integration: "<url> [code]",
+// or "help". ctx carries the owner the chat account is linked to, if any;
+// account ("slack:T123") is what the rate limit is counted against. Returns
+// the reply text and whether it's a success worth showing to the whole
+// channel rather than just the caller.
+func runShortenCommand(ctx context.Context, account, text, host string) (string, bool) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || len(fields) > 2 || strings.EqualFold(fields[0], "help") {
+		return shortenCommandUsage, false
+	}
+
+	req := CreateURLRequest{OriginalURL: unwrapChatLink(fields[0])}
+	if len(fields) == 2 {
+		req.CustomCode = fields[1]
+	}
+
+	if limiter := shortenLimiter.current(); limiter != nil {
+		// Every chat request comes from the platform's servers, so the
+		// budget is per chat account rather than per IP
+		if d, err := limiter.Allow(ctx, "chat:"+account); err == nil && !d.Allowed {
+			return "Too many links at once, try again in a minute.", false
+		}
+	}
+
+	resp, err := createShortURL(ctx, req, host)
+	if err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.Status < 500 {
+			return "Couldn't shorten that: " + apiErr.Message, false
+		}
+		slog.ErrorContext(ctx, "Chat command shorten error", "err", err)
+		return "Something went wrong on our side, please try again.", false
+	}
+	return resp.ShortURL, true
+}
+
+// Chat clients may wrap a pasted link as <https://a.b> or <https://a.b|label>
+func unwrapChatLink(s string) string {
+	if strings.HasPrefix(s, "<") && strings.HasSuffix(s, ">") {
+		s = strings.TrimSuffix(strings.TrimPrefix(s, "<"), ">")
+		s, _, _ = strings.Cut(s, "|")
+	}
+	return s
+}
+
+// Chat workspaces (Slack teams, Discord servers, ...) connected to an API
+// key. Links made from a connected workspace belong to the key's owner,
+// and revoking the key disconnects it.
+type chatPlatform struct {
+	name     string // used in logs, audit actions and messages
+	table    string
+	idColumn string
+}
+
+var chatPlatforms = []*chatPlatform{slackWorkspaces, discordGuilds, telegramChats, mattermostTeams, rocketChatChannels}
+
+type ChatConnection struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner,omitempty"` // empty once the key is revoked
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ChatConnectionRequest struct {
+	APIKey string `json:"api_key"`
+}
+
+func initChatPlatforms() {
+	for _, p := range chatPlatforms {
+		createTable := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			%s TEXT PRIMARY KEY,
+			api_key_hash TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT NOW()
+		);
+		`, p.table, p.idColumn)
+		if _, err := db.Exec(createTable); err != nil {
+			fatal("Chat connection table creation failed", "platform", p.name, "err", err)
+		}
+	}
+}
+
+// Owner of the live API key a workspace is connected to
+func (p *chatPlatform) owner(ctx context.Context, id string) (string, error) {
+	var owner string
+	err := db.QueryRowContext(ctx, fmt.Sprintf(
+		`SELECT k.owner FROM %s c
+		 JOIN api_keys k ON k.key_hash = c.api_key_hash AND k.revoked_at IS NULL
+		 WHERE c.%s = $1`, p.table, p.idColumn), id).Scan(&owner)
+	return owner, err
+}
+
+func listChatConnectionsHandler(p *chatPlatform) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+
+		rows, err := db.QueryContext(r.Context(), fmt.Sprintf(
+			`SELECT c.%[2]s, COALESCE(k.owner, ''), c.created_at FROM %[1]s c
+			 LEFT JOIN api_keys k ON k.key_hash = c.api_key_hash AND k.revoked_at IS NULL
+			 ORDER BY c.%[2]s`, p.table, p.idColumn))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Chat connection list error", "platform", p.name, "err", err)
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		defer rows.Close()
+
+		connections := []ChatConnection{}
+		for rows.Next() {
+			var c ChatConnection
+			if err := rows.Scan(&c.ID, &c.Owner, &c.CreatedAt); err != nil {
+				slog.ErrorContext(r.Context(), "Chat connection list error", "platform", p.name, "err", err)
+				writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+				return
+			}
+			connections = append(connections, c)
+		}
+		writeJSON(w, http.StatusOK, connections)
+	}
+}
+
+func putChatConnectionHandler(p *chatPlatform) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+		id := strings.TrimSpace(r.PathValue("id"))
+
+		var req ChatConnectionRequest
+		if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+			return
+		}
+		owner, err := lookupAPIKey(r.Context(), req.APIKey)
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusBadRequest, "invalid_api_key", "api_key is not a live API key")
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "API key lookup error", "err", err)
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+
+		c := ChatConnection{ID: id, Owner: owner}
+		err = db.QueryRowContext(r.Context(), fmt.Sprintf(
+			`INSERT INTO %[1]s (%[2]s, api_key_hash) VALUES ($1, $2)
+			 ON CONFLICT (%[2]s) DO UPDATE SET api_key_hash = EXCLUDED.api_key_hash
+			 RETURNING created_at`, p.table, p.idColumn), id, hashAPIKey(req.APIKey)).Scan(&c.CreatedAt)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Chat connection insert error", "platform", p.name, "err", err)
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		auditAdmin(r, p.name+".connect", id, map[string]interface{}{"owner": owner})
+		writeJSON(w, http.StatusOK, c)
+	}
+}
+
+func deleteChatConnectionHandler(p *chatPlatform) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+		id := r.PathValue("id")
+
+		result, err := db.ExecContext(r.Context(), fmt.Sprintf(`DELETE FROM %s WHERE %s = $1`, p.table, p.idColumn), id)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Chat connection delete error", "platform", p.name, "err", err)
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			writeError(w, http.StatusNotFound, "connection_not_found", "Not connected")
+			return
+		}
+		auditAdmin(r, p.name+".disconnect", id, nil)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
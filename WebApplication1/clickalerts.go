@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Click alerts: per-link "tell me when this passes N clicks" rules. Each
+// fires once, on the click that reaches it, as a link.click_alert webhook
+// event carrying the threshold and/or an email to the owner's notification
+// address. urls.next_alert_at holds the lowest unfired threshold so the
+// click counter can tell it's time without a lookup on every redirect.
+const maxAlertsPerLink = 20
+
+type ClickAlert struct {
+	ID        int64      `json:"id"`
+	Threshold int64      `json:"threshold"`
+	Webhook   bool       `json:"webhook"`
+	Email     bool       `json:"email"`
+	CreatedAt time.Time  `json:"created_at"`
+	FiredAt   *time.Time `json:"fired_at,omitempty"`
+}
+
+type ClickAlertRequest struct {
+	Threshold int64 `json:"threshold"`
+	Webhook   *bool `json:"webhook,omitempty"` // default true
+	Email     bool  `json:"email,omitempty"`
+}
+
+func initClickAlerts() {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS click_alerts (
+		id BIGSERIAL PRIMARY KEY,
+		short_code VARCHAR(64) NOT NULL REFERENCES urls(short_code) ON DELETE CASCADE,
+		threshold BIGINT NOT NULL,
+		webhook BOOLEAN NOT NULL,
+		email BOOLEAN NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		fired_at TIMESTAMP,
+		UNIQUE (short_code, threshold)
+	);
+	`
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Click alerts table creation failed", "err", err)
+	}
+}
+
+// Called with the new count once it has reached next_alert_at. Claiming
+// the alerts in the database fires each once across instances.
+func fireClickAlerts(shortCode string, clicks int64) {
+	ctx := context.Background()
+	rows, err := db.QueryContext(ctx,
+		`UPDATE click_alerts SET fired_at = NOW()
+		 WHERE short_code = $1 AND threshold <= $2 AND fired_at IS NULL
+		 RETURNING threshold, webhook, email`, shortCode, clicks)
+	if err != nil {
+		slog.Error("Click alert claim error", "short_code", shortCode, "err", err)
+		return
+	}
+	type firing struct {
+		threshold      int64
+		webhook, email bool
+	}
+	var fired []firing
+	for rows.Next() {
+		var f firing
+		if err := rows.Scan(&f.threshold, &f.webhook, &f.email); err != nil {
+			slog.Error("Click alert claim error", "short_code", shortCode, "err", err)
+			break
+		}
+		fired = append(fired, f)
+	}
+	rows.Close()
+	if err := updateNextAlert(ctx, shortCode); err != nil {
+		slog.Error("Click alert update error", "short_code", shortCode, "err", err)
+	}
+	if len(fired) == 0 {
+		return
+	}
+
+	link, err := store.GetLink(ctx, shortCode)
+	if err != nil {
+		slog.Error("Click alert link lookup error", "short_code", shortCode, "err", err)
+		return
+	}
+	link.ClickCount = clicks
+	for _, f := range fired {
+		if f.webhook {
+			queueClickAlert(link, f.threshold)
+		}
+		if f.email && emailEnabled() {
+			if err := sendClickAlertEmail(ctx, link, f.threshold); err != nil {
+				slog.Error("Click alert email error", "short_code", shortCode, "err", err)
+			}
+		}
+	}
+}
+
+func queueClickAlert(link *Link, threshold int64) {
+	hooks, err := ownerWebhooks(context.Background(), link.Owner)
+	if err != nil {
+		slog.Error("Webhook lookup error", "err", err)
+		return
+	}
+	event := newWebhookEvent(EventClickAlert, link)
+	event.Data.AlertThreshold = threshold
+	payload, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Webhook payload error", "err", err)
+		return
+	}
+	for _, hook := range hooks {
+		if hook.subscribed(EventClickAlert) {
+			enqueueWebhook(&webhookDelivery{hook: hook, event: EventClickAlert, payload: payload})
+		}
+	}
+}
+
+func sendClickAlertEmail(ctx context.Context, link *Link, threshold int64) error {
+	var to string
+	err := db.QueryRowContext(ctx,
+		`SELECT email FROM notification_preferences WHERE owner = $1`, link.Owner).Scan(&to)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	host := publicHost()
+	tenant := ownerTenant(link.Owner)
+	if h := tenantPrimaryHost(tenant); h != "" {
+		host = h
+	}
+	subject := fmt.Sprintf("Your short link passed %d clicks", threshold)
+	if brand := tenantBrand(tenant); brand.Name != "" {
+		subject = brand.Name + ": " + subject
+	}
+	body := fmt.Sprintf("%s has been clicked %d times, passing the %d you asked to hear about.\n\n  -> %s\n",
+		shortURL(linkHost(link, host), link.ShortCode), link.ClickCount, threshold, link.OriginalURL)
+	return sendEmail(ctx, emailMessage{To: to, Subject: subject, Body: body})
+}
+
+// Recompute the lowest unfired threshold after alerts change
+func updateNextAlert(ctx context.Context, shortCode string) error {
+	_, err := db.ExecContext(ctx,
+		`UPDATE urls SET next_alert_at = (SELECT MIN(threshold) FROM click_alerts WHERE short_code = $1 AND fired_at IS NULL)
+		 WHERE short_code = $1`, shortCode)
+	return err
+}
+
+func listClickAlerts(ctx context.Context, shortCode string) ([]ClickAlert, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, threshold, webhook, email, created_at, fired_at FROM click_alerts
+		 WHERE short_code = $1 ORDER BY threshold`, shortCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	alerts := []ClickAlert{}
+	for rows.Next() {
+		var a ClickAlert
+		if err := rows.Scan(&a.ID, &a.Threshold, &a.Webhook, &a.Email, &a.CreatedAt, &a.FiredAt); err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
+
+// GET /api/v1/links/{code}/alerts
+func listClickAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := callerLink(w, r)
+	if !ok {
+		return
+	}
+	alerts, err := listClickAlerts(r.Context(), link.ShortCode)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Click alert list error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, alerts)
+}
+
+// POST /api/v1/links/{code}/alerts
+func createClickAlertHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := callerLink(w, r)
+	if !ok {
+		return
+	}
+	var req ClickAlertRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	alert := ClickAlert{Threshold: req.Threshold, Webhook: req.Webhook == nil || *req.Webhook, Email: req.Email}
+	if alert.Threshold <= link.ClickCount {
+		writeError(w, http.StatusBadRequest, "invalid_threshold",
+			fmt.Sprintf("threshold must be above the link's %d clicks", link.ClickCount))
+		return
+	}
+	if !alert.Webhook && !alert.Email {
+		writeError(w, http.StatusBadRequest, "no_channel", "an alert needs webhook, email or both")
+		return
+	}
+
+	var count int
+	if err := db.QueryRowContext(r.Context(),
+		`SELECT COUNT(*) FROM click_alerts WHERE short_code = $1 AND fired_at IS NULL`, link.ShortCode).Scan(&count); err != nil {
+		slog.ErrorContext(r.Context(), "Click alert count error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if count >= maxAlertsPerLink {
+		writeError(w, http.StatusConflict, "too_many_alerts", fmt.Sprintf("a link has at most %d pending alerts", maxAlertsPerLink))
+		return
+	}
+
+	err := db.QueryRowContext(r.Context(),
+		`INSERT INTO click_alerts (short_code, threshold, webhook, email) VALUES ($1, $2, $3, $4)
+		 RETURNING id, created_at`, link.ShortCode, alert.Threshold, alert.Webhook, alert.Email).Scan(&alert.ID, &alert.CreatedAt)
+	if isUniqueViolation(err) {
+		writeError(w, http.StatusConflict, "alert_exists", "The link already has an alert at that threshold")
+		return
+	} else if err == nil {
+		err = updateNextAlert(r.Context(), link.ShortCode)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Click alert create error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	auditCaller(r.Context(), "link.alert.create", link.ShortCode, map[string]interface{}{"threshold": alert.Threshold})
+	writeJSON(w, http.StatusCreated, alert)
+}
+
+// DELETE /api/v1/links/{code}/alerts/{id}
+func deleteClickAlertHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := callerLink(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "alert_not_found", "Alert not found")
+		return
+	}
+	result, err := db.ExecContext(r.Context(),
+		`DELETE FROM click_alerts WHERE id = $1 AND short_code = $2`, id, link.ShortCode)
+	if err == nil {
+		if n, _ := result.RowsAffected(); n == 0 {
+			writeError(w, http.StatusNotFound, "alert_not_found", "Alert not found")
+			return
+		}
+		err = updateNextAlert(r.Context(), link.ShortCode)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Click alert delete error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	auditCaller(r.Context(), "link.alert.delete", link.ShortCode, map[string]interface{}{"id": id})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Per-click event log, partitioned by month so analytics queries and
+// retention drops stay cheap at tens of millions of rows.
+const (
+	clickEventsTable   = "click_events"
+	partitionsAhead    = 3 // months created in advance
+	partitionCheckTick = 6 * time.Hour
+)
+
+func initClickEvents() {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS click_events (
+		id BIGSERIAL,
+		short_code VARCHAR(64) NOT NULL,
+		clicked_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		ip_address TEXT,
+		user_agent TEXT,
+		referrer TEXT,
+		PRIMARY KEY (id, clicked_at)
+	) PARTITION BY RANGE (clicked_at);
+	CREATE INDEX IF NOT EXISTS idx_click_events_code_time ON click_events(short_code, clicked_at);
+	CREATE INDEX IF NOT EXISTS idx_click_events_code_id ON click_events(short_code, id);
+	ALTER TABLE click_events ADD COLUMN IF NOT EXISTS domain TEXT;
+	CREATE INDEX IF NOT EXISTS idx_click_events_domain_time ON click_events(domain, clicked_at) WHERE domain IS NOT NULL;
+	`
+
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Click events table creation failed", "err", err)
+	}
+
+	if err := maintainClickPartitions(time.Now()); err != nil {
+		fatal("Click events partitioning failed", "err", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(partitionCheckTick)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !isLeader() {
+				continue
+			}
+			if err := maintainClickPartitions(time.Now()); err != nil {
+				slog.Error("Click partition maintenance error", "err", err)
+			}
+		}
+	}()
+}
+
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func partitionName(month time.Time) string {
+	return fmt.Sprintf("%s_y%04dm%02d", clickEventsTable, month.Year(), int(month.Month()))
+}
+
+// Create the current and upcoming monthly partitions, drop expired ones
+func maintainClickPartitions(now time.Time) error {
+	current := monthStart(now.UTC())
+
+	for i := 0; i <= partitionsAhead; i++ {
+		from := current.AddDate(0, i, 0)
+		to := from.AddDate(0, 1, 0)
+		ddl := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')`,
+			partitionName(from), clickEventsTable, from.Format("2006-01-02"), to.Format("2006-01-02"))
+		if _, err := db.Exec(ddl); err != nil {
+			return fmt.Errorf("create partition %s: %w", partitionName(from), err)
+		}
+	}
+
+	retention := cfg.ClickRetentionMonths // 0 keeps every partition forever
+	if retention == 0 {
+		return nil
+	}
+	cutoff := current.AddDate(0, -retention, 0)
+
+	rows, err := db.Query(`
+		SELECT child.relname
+		FROM pg_inherits
+		JOIN pg_class parent ON pg_inherits.inhparent = parent.oid
+		JOIN pg_class child ON pg_inherits.inhrelid = child.oid
+		WHERE parent.relname = $1`, clickEventsTable)
+	if err != nil {
+		return fmt.Errorf("list partitions: %w", err)
+	}
+	var expired []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		month, err := time.Parse("2006m01", strings.TrimPrefix(name, clickEventsTable+"_y"))
+		if err != nil {
+			// Not one of ours - leave manually created partitions alone
+			continue
+		}
+		if month.Before(cutoff) {
+			expired = append(expired, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range expired {
+		if _, err := db.Exec(fmt.Sprintf(`DROP TABLE IF EXISTS %s`, name)); err != nil {
+			return fmt.Errorf("drop partition %s: %w", name, err)
+		}
+		slog.Info("Dropped expired click partition", "partition", name)
+	}
+
+	return nil
+}
+
+// ClickEvent is one recorded redirect
+type ClickEvent struct {
+	ID        int64     `json:"id"`
+	ShortCode string    `json:"short_code"`
+	ClickedAt time.Time `json:"clicked_at"`
+	IPAddress string    `json:"ip_address"`
+	UserAgent string    `json:"user_agent"`
+	Referrer  string    `json:"referrer"`
+}
+
+// Up to limit events for a link with id > afterID, oldest first
+func listClickEvents(ctx context.Context, shortCode string, afterID int64, limit int) ([]ClickEvent, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, short_code, clicked_at, COALESCE(ip_address, ''), COALESCE(user_agent, ''), COALESCE(referrer, '')
+		 FROM click_events WHERE short_code = $1 AND id > $2 ORDER BY id LIMIT $3`,
+		shortCode, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []ClickEvent
+	for rows.Next() {
+		var ev ClickEvent
+		if err := rows.Scan(&ev.ID, &ev.ShortCode, &ev.ClickedAt, &ev.IPAddress, &ev.UserAgent, &ev.Referrer); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+// Record a single click, with why it looks suspicious if it does
+func logClickEvent(c *click, suspicious string) {
+	// The flag only governs the table row
+	ip := clickIP(c.ctx, c.ip)
+	publishClickEvent(c, ip)
+	if !flagEnabled("enable_click_events", c.shortCode) {
+		return
+	}
+	_, err := db.ExecContext(c.ctx, `INSERT INTO click_events (short_code, clicked_at, ip_address, user_agent, referrer, domain, suspicious)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, NULLIF($6, ''), NULLIF($7, ''))`,
+		c.shortCode, c.at, ip, c.userAgent, c.referrer, c.domain, suspicious)
+	if err != nil {
+		slog.ErrorContext(c.ctx, "Click event error", "short_code", c.shortCode, "err", err)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Click anomaly detection. A click is flagged when its IP has already
+// clicked the same link click_burst_threshold times within
+// click_burst_window, or when the IP belongs to a hosting provider's
+// network (by ASN, from the ip_asn_file table). Flagged clicks are still
+// redirected and recorded, with the reason, but count towards a link's
+// suspicious clicks instead of its click count, and analytics leave them
+// out of clicks and unique visitors. Burst state is per instance.
+//
+//	ip_asn_file  iptoasn.com's ip2asn-combined.tsv or the same layout:
+//	             range start, range end, ASN, ... separated by tabs
+const (
+	anomalyBurst      = "burst"
+	anomalyDatacenter = "datacenter"
+)
+
+// Hosting providers whose addresses rarely belong to people clicking
+var datacenterASNs = map[int]bool{
+	16509:  true, // Amazon
+	14618:  true, // Amazon
+	15169:  true, // Google
+	396982: true, // Google Cloud
+	8075:   true, // Microsoft
+	14061:  true, // DigitalOcean
+	16276:  true, // OVH
+	24940:  true, // Hetzner
+	63949:  true, // Akamai Linode
+	20473:  true, // Vultr
+	31898:  true, // Oracle Cloud
+	45102:  true, // Alibaba Cloud
+	132203: true, // Tencent Cloud
+	12876:  true, // Scaleway
+	51167:  true, // Contabo
+}
+
+type ClickAnomaly struct {
+	Reason    string    `json:"reason"`
+	Clicks    int64     `json:"clicks"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type asnRange struct {
+	start, end netip.Addr
+	asn        int
+}
+
+var (
+	clickBursts = struct {
+		mu     sync.Mutex
+		counts map[string]*missCounter // ip + "\x00" + code
+	}{counts: map[string]*missCounter{}}
+
+	// Sorted by start; ranges don't overlap
+	asnRanges []asnRange
+
+	suspiciousClicks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ihdas_suspicious_clicks_total",
+		Help: "Redirects flagged as suspicious, by reason.",
+	}, []string{"reason"})
+)
+
+func initClickFraud() {
+	schema := `
+	ALTER TABLE click_events ADD COLUMN IF NOT EXISTS suspicious TEXT;
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS suspicious_clicks BIGINT NOT NULL DEFAULT 0;
+	`
+	if _, err := db.Exec(schema); err != nil {
+		fatal("Click anomaly columns creation failed", "err", err)
+	}
+
+	for _, extra := range cfg.DatacenterASNs {
+		asn, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(extra), "AS"))
+		if err != nil {
+			fatal("Invalid datacenter ASN", "asn", extra)
+		}
+		datacenterASNs[asn] = true
+	}
+	if cfg.IPASNFile != "" {
+		ranges, err := loadASNRanges(cfg.IPASNFile)
+		if err != nil {
+			fatal("IP to ASN table unreadable", "file", cfg.IPASNFile, "err", err)
+		}
+		asnRanges = ranges
+	}
+
+	if cfg.ClickBurstThreshold > 0 {
+		go evictClickBursts()
+	}
+}
+
+func loadASNRanges(path string) ([]asnRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ranges []asnRange
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 3 {
+			continue
+		}
+		start, err1 := netip.ParseAddr(fields[0])
+		end, err2 := netip.ParseAddr(fields[1])
+		asn, err3 := strconv.Atoi(fields[2])
+		// ASN 0 marks unrouted space
+		if err1 != nil || err2 != nil || err3 != nil || asn == 0 {
+			continue
+		}
+		if datacenterASNs[asn] {
+			ranges = append(ranges, asnRange{start: start.Unmap(), end: end.Unmap(), asn: asn})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start.Less(ranges[j].start) })
+	return ranges, nil
+}
+
+// ASN of a datacenter network ip is in, 0 when it isn't in one
+func datacenterASN(ip string) int {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return 0
+	}
+	addr = addr.Unmap()
+	i := sort.Search(len(asnRanges), func(i int) bool { return addr.Less(asnRanges[i].start) })
+	if i == 0 {
+		return 0
+	}
+	if r := asnRanges[i-1]; addr.Compare(r.end) <= 0 && addr.BitLen() == r.start.BitLen() {
+		return r.asn
+	}
+	return 0
+}
+
+// Whether this click makes a burst from ip on the link
+func clickBurst(ip, shortCode string) bool {
+	threshold := cfg.ClickBurstThreshold
+	if threshold <= 0 {
+		return false
+	}
+	key := ip + "\x00" + shortCode
+	now := time.Now()
+	clickBursts.mu.Lock()
+	defer clickBursts.mu.Unlock()
+	c, ok := clickBursts.counts[key]
+	if !ok || now.Sub(c.windowStart) > cfg.ClickBurstWindow {
+		c = &missCounter{windowStart: now}
+		clickBursts.counts[key] = c
+	}
+	c.misses++
+	return c.misses > threshold
+}
+
+func evictClickBursts() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		clickBursts.mu.Lock()
+		for key, c := range clickBursts.counts {
+			if now.Sub(c.windowStart) > cfg.ClickBurstWindow {
+				delete(clickBursts.counts, key)
+			}
+		}
+		clickBursts.mu.Unlock()
+	}
+}
+
+// Why a click looks suspicious, "" when it doesn't
+func clickAnomaly(ip, shortCode string) string {
+	// Counted first so a burst from a datacenter still fills the window
+	burst := clickBurst(ip, shortCode)
+	switch {
+	case datacenterASN(ip) != 0:
+		return anomalyDatacenter
+	case burst:
+		return anomalyBurst
+	}
+	return ""
+}
+
+// A link's suspicious click count and what the recorded ones were flagged for
+func loadClickAnomalies(ctx context.Context, shortCode string) (int64, []ClickAnomaly, error) {
+	var total int64
+	if err := db.QueryRowContext(ctx,
+		`SELECT suspicious_clicks FROM urls WHERE short_code = $1`, shortCode).Scan(&total); err != nil {
+		return 0, nil, err
+	}
+	if total == 0 {
+		return 0, nil, nil
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT suspicious, COUNT(*), MIN(clicked_at), MAX(clicked_at) FROM click_events
+		 WHERE short_code = $1 AND suspicious IS NOT NULL
+		 GROUP BY suspicious ORDER BY 2 DESC`, shortCode)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	var anomalies []ClickAnomaly
+	for rows.Next() {
+		var a ClickAnomaly
+		if err := rows.Scan(&a.Reason, &a.Clicks, &a.FirstSeen, &a.LastSeen); err != nil {
+			return 0, nil, err
+		}
+		anomalies = append(anomalies, a)
+	}
+	return total, anomalies, rows.Err()
+}
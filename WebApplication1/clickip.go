@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// How visitor IPs are kept in click events and on the event stream:
+//
+//	raw       as received
+//	truncate  the network only, /24 for IPv4 and /48 for IPv6
+//	hash      HMAC-SHA256 under a salt that changes every
+//	          click_ip_salt_rotation; old salts are thrown away, so a hash
+//	          can't be tied back to an address once its period is over
+//
+// Hashes stay equal within a period, so unique visitor counts keep working.
+// The salt lives in the database so every instance hashes alike. Abuse
+// checks (bursts, datacenter ranges) look at the raw IP before this, and
+// rows already stored are left as they are.
+const (
+	clickIPRaw      = "raw"
+	clickIPTruncate = "truncate"
+	clickIPHash     = "hash"
+)
+
+var clickIPSalt struct {
+	mu     sync.Mutex
+	period int64
+	salt   []byte
+}
+
+func initClickIPs() {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS click_ip_salts (
+		period BIGINT PRIMARY KEY,
+		salt BYTEA NOT NULL
+	);
+	`
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Click IP salt table creation failed", "err", err)
+	}
+}
+
+// The client IP as it may be stored for a click, "" if it can't be
+func clickIP(ctx context.Context, ip string) string {
+	switch cfg.ClickIPMode {
+	case clickIPTruncate:
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return ""
+		}
+		addr = addr.Unmap()
+		bits := 48
+		if addr.Is4() {
+			bits = 24
+		}
+		prefix, _ := addr.Prefix(bits)
+		return prefix.Addr().String()
+	case clickIPHash:
+		salt, err := currentIPSalt(ctx)
+		if err != nil {
+			// Better no IP than a raw one
+			slog.ErrorContext(ctx, "Click IP salt error", "err", err)
+			return ""
+		}
+		mac := hmac.New(sha256.New, salt)
+		mac.Write([]byte(ip))
+		return hex.EncodeToString(mac.Sum(nil)[:16])
+	}
+	return ip
+}
+
+// Salt of the current period, created by whichever instance needs it first
+func currentIPSalt(ctx context.Context) ([]byte, error) {
+	period := time.Now().Unix() / int64(cfg.ClickIPSaltRotation/time.Second)
+	clickIPSalt.mu.Lock()
+	defer clickIPSalt.mu.Unlock()
+	if clickIPSalt.period == period && clickIPSalt.salt != nil {
+		return clickIPSalt.salt, nil
+	}
+
+	fresh := make([]byte, 32)
+	if _, err := rand.Read(fresh); err != nil {
+		return nil, err
+	}
+	var salt []byte
+	err := db.QueryRowContext(ctx,
+		`WITH ins AS (
+			INSERT INTO click_ip_salts (period, salt) VALUES ($1, $2) ON CONFLICT (period) DO NOTHING RETURNING salt
+		 )
+		 SELECT salt FROM ins UNION ALL SELECT salt FROM click_ip_salts WHERE period = $1 LIMIT 1`,
+		period, fresh).Scan(&salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM click_ip_salts WHERE period < $1`, period); err != nil {
+		slog.WarnContext(ctx, "Old click IP salts not removed", "err", err)
+	}
+	clickIPSalt.period, clickIPSalt.salt = period, salt
+	return salt, nil
+}
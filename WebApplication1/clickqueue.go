@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Click processing runs off the redirect path: the handler copies what it
+// needs from the request into a click and hands it to a bounded pool of
+// workers, which do the abuse checks, counting, event rows, stream events
+// and alerts. A full queue drops the click rather than slowing the
+// redirect. Queued clicks are worked off before the pools close at
+// shutdown.
+type click struct {
+	ctx       context.Context // the request's values, without its cancellation
+	shortCode string
+	ip        string
+	userAgent string
+	referrer  string
+	domain    string
+	at        time.Time
+	item      int // bundle item followed, counting from 1; 0 for the link itself
+}
+
+var (
+	clickQueue   chan *click
+	clickPending sync.WaitGroup
+
+	clicksDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ihdas_clicks_dropped_total",
+		Help: "Clicks not recorded because the click queue was full.",
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ihdas_click_queue_length",
+		Help: "Clicks waiting for a worker.",
+	}, func() float64 { return float64(len(clickQueue)) })
+)
+
+func initClickWorkers() {
+	clickQueue = make(chan *click, cfg.ClickQueueSize)
+	for i := 0; i < cfg.ClickWorkers; i++ {
+		go func() {
+			for c := range clickQueue {
+				processClick(c)
+				clickPending.Done()
+			}
+		}()
+	}
+}
+
+// Queue a redirect's click; never blocks
+func recordClick(r *http.Request, shortCode string) {
+	queueClick(r, shortCode, 0)
+}
+
+// Queue a click through to one of a bundle's items (see bundles.go)
+func recordBundleClick(r *http.Request, shortCode string, item int) {
+	queueClick(r, shortCode, item)
+}
+
+func queueClick(r *http.Request, shortCode string, item int) {
+	c := &click{
+		ctx:       context.WithoutCancel(r.Context()),
+		shortCode: shortCode,
+		ip:        getClientIP(r),
+		userAgent: r.UserAgent(),
+		referrer:  r.Referer(),
+		domain:    requestDomain(r),
+		at:        time.Now().UTC(),
+		item:      item,
+	}
+	clickPending.Add(1)
+	select {
+	case clickQueue <- c:
+	default:
+		clickPending.Done()
+		clicksDropped.Inc()
+	}
+}
+
+// Count and record a click, setting suspicious ones aside. Item clicks
+// only count on their item; the visit to the bundle was the link's click.
+func processClick(c *click) {
+	reason := clickAnomaly(c.ip, c.shortCode)
+	if c.item > 0 {
+		if reason == "" {
+			incrementBundleItemClicks(c.ctx, c.shortCode, c.item)
+		} else {
+			suspiciousClicks.WithLabelValues(reason).Inc()
+		}
+		return
+	}
+	if reason == "" {
+		incrementClickCount(c.ctx, c.shortCode)
+	} else {
+		suspiciousClicks.WithLabelValues(reason).Inc()
+		db.ExecContext(c.ctx, `UPDATE urls SET suspicious_clicks = suspicious_clicks + 1 WHERE short_code = $1`, c.shortCode)
+	}
+	logClickEvent(c, reason)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The server's response shapes, as far as the CLI reads them
+type createRequest struct {
+	OriginalURL string `json:"original_url"`
+	CustomCode  string `json:"custom_code,omitempty"`
+	ExpiresAt   string `json:"expires_at,omitempty"`
+	Domain      string `json:"domain,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+}
+
+type createResponse struct {
+	ShortCode   string     `json:"short_code"`
+	ShortURL    string     `json:"short_url"`
+	OriginalURL string     `json:"original_url"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+type statsResponse struct {
+	ShortCode   string    `json:"short_code"`
+	OriginalURL string    `json:"original_url"`
+	ClickCount  int64     `json:"click_count"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type listResponse struct {
+	Links      []statsResponse `json:"links"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+type problem struct {
+	Status    int    `json:"status"`
+	Detail    string `json:"detail"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id"`
+}
+
+func (p *problem) Error() string {
+	msg := p.Detail
+	if msg == "" {
+		msg = http.StatusText(p.Status)
+	}
+	if p.RequestID != "" {
+		return fmt.Sprintf("%s (%s, request %s)", msg, p.Code, p.RequestID)
+	}
+	return fmt.Sprintf("%s (%s)", msg, p.Code)
+}
+
+type apiClient struct {
+	base   *url.URL
+	apiKey string
+	http   *http.Client
+}
+
+func newClient(c credentials) (*apiClient, error) {
+	if c.Server == "" {
+		return nil, errors.New("no server configured; run ihdas login or set IHDAS_SERVER")
+	}
+	base, err := url.Parse(strings.TrimRight(c.Server, "/"))
+	if err != nil || (base.Scheme != "https" && base.Scheme != "http") || base.Host == "" {
+		return nil, fmt.Errorf("%q is not an http(s) server URL", c.Server)
+	}
+	return &apiClient{base: base, apiKey: c.APIKey, http: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (c *apiClient) requireKey() error {
+	if c.apiKey == "" {
+		return errors.New("this command needs an API key; run ihdas login or set IHDAS_API_KEY")
+	}
+	return nil
+}
+
+// Send a request and decode the JSON response into out (when not nil).
+// The raw body is returned as well for --json.
+func (c *apiClient) do(method, path string, query url.Values, body, out interface{}) ([]byte, error) {
+	u := c.base.JoinPath(path)
+	u.RawQuery = query.Encode()
+
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u.String(), reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "ihdas-cli/"+version)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		p := &problem{Status: resp.StatusCode}
+		if json.Unmarshal(data, p) != nil || p.Code == "" {
+			return nil, fmt.Errorf("server returned %s", resp.Status)
+		}
+		return nil, p
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return nil, fmt.Errorf("unexpected response: %w", err)
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func client() (*apiClient, error) {
+	c, err := loadCredentials()
+	if err != nil {
+		return nil, err
+	}
+	return newClient(c)
+}
+
+// --json prints the body as the server sent it; otherwise pretty does
+func output(raw []byte, pretty func()) {
+	if flagJSON {
+		os.Stdout.Write(raw)
+		if len(raw) > 0 && raw[len(raw)-1] != '\n' {
+			fmt.Println()
+		}
+		return
+	}
+	pretty()
+}
+
+func loginCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "login",
+		Short: "Check and save the server URL and API key",
+		Long:  "Check the --server and --api-key (or IHDAS_SERVER and IHDAS_API_KEY) against the server and save them for later commands.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			creds, err := loadCredentials()
+			if err != nil {
+				return err
+			}
+			c, err := newClient(creds)
+			if err != nil {
+				return err
+			}
+			// Listing needs a valid key, so it doubles as the check
+			if creds.APIKey != "" {
+				if _, err := c.do("GET", "/api/v1/links", url.Values{"limit": {"1"}}, nil, nil); err != nil {
+					return fmt.Errorf("login failed: %w", err)
+				}
+			}
+			path, err := saveCredentials(creds)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Saved credentials for %s to %s\n", c.base, path)
+			return nil
+		},
+	}
+}
+
+func logoutCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "logout",
+		Short: "Forget the saved credentials",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path, err := removeCredentials()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Removed %s\n", path)
+			return nil
+		},
+	}
+}
+
+func shortenCommand() *cobra.Command {
+	var req createRequest
+	var expiresIn time.Duration
+	cmd := &cobra.Command{
+		Use:   "shorten <url>",
+		Short: "Create a short link and print it",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			req.OriginalURL = args[0]
+			if expiresIn > 0 {
+				req.ExpiresAt = time.Now().Add(expiresIn).UTC().Format(time.RFC3339)
+			}
+			var resp createResponse
+			raw, err := c.do("POST", "/api/v1/shorten", nil, req, &resp)
+			if err != nil {
+				return err
+			}
+			// Just the link, so $(ihdas shorten ...) works in scripts
+			output(raw, func() { fmt.Fprintln(cmd.OutOrStdout(), resp.ShortURL) })
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&req.CustomCode, "code", "", "custom short code")
+	cmd.Flags().StringVar(&req.Domain, "domain", "", "one of your custom domains to serve the link on")
+	cmd.Flags().StringVar(&req.Namespace, "namespace", "", "one of your namespaces to create the link in")
+	cmd.Flags().StringVar(&req.ExpiresAt, "expires-at", "", "expiry time (RFC 3339)")
+	cmd.Flags().DurationVar(&expiresIn, "expires-in", 0, "expire after this long, e.g. 72h")
+	cmd.MarkFlagsMutuallyExclusive("expires-at", "expires-in")
+	cmd.MarkFlagsMutuallyExclusive("domain", "namespace")
+	return cmd
+}
+
+func statsCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "stats <code>",
+		Short: "Show click statistics for a short link",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			var resp statsResponse
+			raw, err := c.do("GET", "/api/v1/stats/"+url.PathEscape(args[0]), nil, nil, &resp)
+			if err != nil {
+				return err
+			}
+			output(raw, func() {
+				tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+				fmt.Fprintf(tw, "Code:\t%s\n", resp.ShortCode)
+				fmt.Fprintf(tw, "Destination:\t%s\n", resp.OriginalURL)
+				fmt.Fprintf(tw, "Clicks:\t%d\n", resp.ClickCount)
+				fmt.Fprintf(tw, "Created:\t%s\n", resp.CreatedAt.Local().Format(time.DateTime))
+				tw.Flush()
+			})
+			return nil
+		},
+	}
+}
+
+func listCommand() *cobra.Command {
+	var limit int
+	var all bool
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List your short links, oldest first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			if err := c.requireKey(); err != nil {
+				return err
+			}
+
+			tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			if !flagJSON {
+				fmt.Fprintln(tw, "CODE\tCLICKS\tCREATED\tDESTINATION")
+			}
+			query := url.Values{"limit": {strconv.Itoa(limit)}}
+			for {
+				var page listResponse
+				raw, err := c.do("GET", "/api/v1/links", query, nil, &page)
+				if err != nil {
+					return err
+				}
+				// One JSON document per page with --json
+				output(raw, func() {
+					for _, l := range page.Links {
+						fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", l.ShortCode, l.ClickCount, l.CreatedAt.Local().Format(time.DateOnly), l.OriginalURL)
+					}
+				})
+				if !all || page.NextCursor == "" {
+					break
+				}
+				query.Set("cursor", page.NextCursor)
+			}
+			return tw.Flush()
+		},
+	}
+	cmd.Flags().IntVar(&limit, "limit", 50, "links per page")
+	cmd.Flags().BoolVar(&all, "all", false, "follow pagination to the last link")
+	return cmd
+}
+
+func deleteCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "delete <code>...",
+		Short: "Delete short links you own",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			if err := c.requireKey(); err != nil {
+				return err
+			}
+			for _, code := range args {
+				if _, err := c.do("DELETE", "/api/v1/links/"+url.PathEscape(code), nil, nil, nil); err != nil {
+					return fmt.Errorf("%s: %w", code, err)
+				}
+				if !flagJSON {
+					fmt.Fprintf(cmd.OutOrStdout(), "Deleted %s\n", code)
+				}
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+type credentials struct {
+	Server string `json:"server"`
+	APIKey string `json:"api_key,omitempty"`
+}
+
+func credentialsPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ihdas", "credentials.json"), nil
+}
+
+// Saved credentials overlaid with the environment and flags. A missing
+// file is not an error; the caller checks for an empty server.
+func loadCredentials() (credentials, error) {
+	var c credentials
+	path, err := credentialsPath()
+	if err != nil {
+		return c, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return c, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &c); err != nil {
+			return c, errors.New(path + " is not valid JSON: " + err.Error())
+		}
+	}
+
+	if v := os.Getenv("IHDAS_SERVER"); v != "" {
+		c.Server = v
+	}
+	if v := os.Getenv("IHDAS_API_KEY"); v != "" {
+		c.APIKey = v
+	}
+	if flagServer != "" {
+		c.Server = flagServer
+	}
+	if flagAPIKey != "" {
+		c.APIKey = flagAPIKey
+	}
+	return c, nil
+}
+
+// The file holds an API key, so only the user may read it
+func saveCredentials(c credentials) (string, error) {
+	path, err := credentialsPath()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", err
+	}
+	data, _ := json.MarshalIndent(c, "", "  ")
+	return path, os.WriteFile(path, append(data, '\n'), 0o600)
+}
+
+func removeCredentials() (string, error) {
+	path, err := credentialsPath()
+	if err != nil {
+		return "", err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	return path, nil
+}
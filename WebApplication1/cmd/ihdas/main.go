@@ -0,0 +1,49 @@
+// Command ihdas is a terminal client for an ihdas server's HTTP API:
+//
+//	ihdas login --server https://ihd.as --api-key ihk_...
+//	ihdas shorten https://example.com/a/long/path --code launch
+//	ihdas stats launch
+//	ihdas list
+//	ihdas delete launch
+//
+// Credentials saved by login live in the user config directory
+// (~/.config/ihdas/credentials.json on Linux). IHDAS_SERVER and
+// IHDAS_API_KEY, or the --server and --api-key flags, take precedence, so
+// scripts don't need a login at all.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// Stamped in at link time like the server's: -ldflags "-X main.version=1.4.0"
+var version = "dev"
+
+var (
+	flagServer string
+	flagAPIKey string
+	flagJSON   bool
+)
+
+func main() {
+	root := &cobra.Command{
+		Use:           "ihdas",
+		Short:         "Shorten links and read their stats from the terminal",
+		Version:       version,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	root.PersistentFlags().StringVar(&flagServer, "server", "", "server URL (default from IHDAS_SERVER or login)")
+	root.PersistentFlags().StringVar(&flagAPIKey, "api-key", "", "API key (default from IHDAS_API_KEY or login)")
+	root.PersistentFlags().BoolVar(&flagJSON, "json", false, "print the raw JSON response")
+
+	root.AddCommand(loginCommand(), logoutCommand(), shortenCommand(), statsCommand(), listCommand(), deleteCommand())
+
+	if err := root.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, "ihdas:", err)
+		os.Exit(1)
+	}
+}
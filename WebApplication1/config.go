@@ -0,0 +1,375 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is every tunable in one place. Values are layered, later ones
+// winning: the defaults below, a YAML or TOML file (-config or CONFIG_FILE),
+// the environment variable in the env tag, then a command-line flag named
+// after the file key with dashes (database_url -> -database-url).
+//
+// Fields tagged secret are read through the secrets loader, so they also
+// accept NAME_FILE and Vault/AWS references. Fields tagged reload take
+// effect on SIGHUP or POST /api/v1/admin/config/reload; the rest need a
+// restart. Only the standard OTEL_* variables keep their own environment
+// handling.
+type Config struct {
+	// Server
+	Port            string        `yaml:"port" toml:"port" env:"PORT" help:"HTTP listen port"`
+	GRPCPort        string        `yaml:"grpc_port" toml:"grpc_port" env:"GRPC_PORT" help:"gRPC listen port, empty disables the gRPC API"`
+	PublicHost      string        `yaml:"public_host" toml:"public_host" env:"PUBLIC_HOST" help:"public host:port used in short URLs outside HTTP"`
+	BaseURL         string        `yaml:"base_url" toml:"base_url" env:"BASE_URL" help:"canonical scheme://host[/prefix] for short URLs, instead of the request Host"`
+	NamespaceDomain string        `yaml:"namespace_domain" toml:"namespace_domain" env:"NAMESPACE_DOMAIN" help:"parent domain of namespace subdomains (team.sho.rt), empty disables namespaces"`
+	TolerantCodes   bool          `yaml:"tolerant_codes" toml:"tolerant_codes" env:"TOLERANT_CODES" help:"retry unknown codes without trailing punctuation and whitespace"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" help:"how long to drain requests on shutdown"`
+	TLSDomains      []string      `yaml:"tls_domains" toml:"tls_domains" env:"TLS_DOMAINS" help:"hostnames for automatic Let's Encrypt certificates"`
+	TLSCacheDir     string        `yaml:"tls_cache_dir" toml:"tls_cache_dir" env:"TLS_CACHE_DIR" help:"directory for cached certificates"`
+	ACMEEmail       string        `yaml:"acme_email" toml:"acme_email" env:"ACME_EMAIL" help:"contact address for Let's Encrypt"`
+	StaticDir       string        `yaml:"static_dir" toml:"static_dir" env:"STATIC_DIR" help:"directory whose files replace the embedded pages of the same name"`
+
+	// CORS and security headers
+	CORSAllowedOrigins    []string `yaml:"cors_allowed_origins" toml:"cors_allowed_origins" env:"CORS_ALLOWED_ORIGINS" help:"origins allowed to call the API, or *"`
+	CORSAllowedMethods    []string `yaml:"cors_allowed_methods" toml:"cors_allowed_methods" env:"CORS_ALLOWED_METHODS" help:"methods allowed in cross-origin requests"`
+	CORSAllowedHeaders    []string `yaml:"cors_allowed_headers" toml:"cors_allowed_headers" env:"CORS_ALLOWED_HEADERS" help:"request headers allowed in cross-origin requests"`
+	CORSExposedHeaders    []string `yaml:"cors_exposed_headers" toml:"cors_exposed_headers" env:"CORS_EXPOSED_HEADERS" help:"response headers cross-origin callers may read"`
+	CORSAllowCredentials  bool     `yaml:"cors_allow_credentials" toml:"cors_allow_credentials" env:"CORS_ALLOW_CREDENTIALS" help:"allow cookies and credentials from explicitly listed origins"`
+	CORSMaxAge            int      `yaml:"cors_max_age" toml:"cors_max_age" env:"CORS_MAX_AGE" help:"seconds browsers may cache a preflight"`
+	CSPPages              string   `yaml:"csp_pages" toml:"csp_pages" env:"CSP_PAGES" help:"Content-Security-Policy for the HTML pages, empty for the built-in one"`
+	CSPAPI                string   `yaml:"csp_api" toml:"csp_api" env:"CSP_API" help:"Content-Security-Policy for everything else"`
+	ReferrerPolicy        string   `yaml:"referrer_policy" toml:"referrer_policy" env:"REFERRER_POLICY" help:"Referrer-Policy header"`
+	HSTSMaxAge            int      `yaml:"hsts_max_age" toml:"hsts_max_age" env:"HSTS_MAX_AGE" help:"Strict-Transport-Security max-age in seconds, 0 disables HSTS"`
+	HSTSIncludeSubdomains bool     `yaml:"hsts_include_subdomains" toml:"hsts_include_subdomains" env:"HSTS_INCLUDE_SUBDOMAINS" help:"add includeSubDomains to HSTS"`
+	HSTSPreload           bool     `yaml:"hsts_preload" toml:"hsts_preload" env:"HSTS_PRELOAD" help:"add preload to HSTS"`
+
+	// Database and cache
+	DatabaseURL            string        `yaml:"database_url" toml:"database_url" env:"DATABASE_URL" secret:"true" help:"PostgreSQL connection string"`
+	DBMaxOpenConns         int           `yaml:"db_max_open_conns" toml:"db_max_open_conns" env:"DB_MAX_OPEN_CONNS" help:"maximum open database connections"`
+	DBMaxIdleConns         int           `yaml:"db_max_idle_conns" toml:"db_max_idle_conns" env:"DB_MAX_IDLE_CONNS" help:"maximum idle database connections"`
+	DBConnMaxLifetime      time.Duration `yaml:"db_conn_max_lifetime" toml:"db_conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME" help:"recycle connections after this long"`
+	MigrationDatabaseURL   string        `yaml:"migration_database_url" toml:"migration_database_url" env:"MIGRATION_DATABASE_URL" secret:"true" help:"PostgreSQL connection string links are also written to during a storage migration"`
+	MigrationCheckInterval time.Duration `yaml:"migration_check_interval" toml:"migration_check_interval" env:"MIGRATION_CHECK_INTERVAL" help:"how often both databases are compared, 0 only on request"`
+	MigrationRepair        bool          `yaml:"migration_repair" toml:"migration_repair" env:"MIGRATION_REPAIR" help:"scheduled checks also fix the links they find differing"`
+	CacheSize              int           `yaml:"cache_size" toml:"cache_size" env:"CACHE_SIZE" reload:"true" help:"entries in the in-memory redirect cache"`
+	WarmCacheSize          int           `yaml:"warm_cache_size" toml:"warm_cache_size" env:"WARM_CACHE_SIZE" help:"links preloaded into the cache at startup"`
+
+	// Limits
+	RateLimitShortenPerMinute  int `yaml:"rate_limit_shorten_per_minute" toml:"rate_limit_shorten_per_minute" env:"RATE_LIMIT_SHORTEN_PER_MINUTE" reload:"true" help:"link creations per IP per minute, 0 disables"`
+	RateLimitShortenBurst      int `yaml:"rate_limit_shorten_burst" toml:"rate_limit_shorten_burst" env:"RATE_LIMIT_SHORTEN_BURST" reload:"true" help:"creation burst, 0 means the per-minute rate"`
+	RateLimitRedirectPerMinute int `yaml:"rate_limit_redirect_per_minute" toml:"rate_limit_redirect_per_minute" env:"RATE_LIMIT_REDIRECT_PER_MINUTE" reload:"true" help:"lookups per IP per minute, 0 disables"`
+	RateLimitRedirectBurst     int `yaml:"rate_limit_redirect_burst" toml:"rate_limit_redirect_burst" env:"RATE_LIMIT_REDIRECT_BURST" reload:"true" help:"lookup burst, 0 means the per-minute rate"`
+	RateLimitReportPerMinute   int `yaml:"rate_limit_report_per_minute" toml:"rate_limit_report_per_minute" env:"RATE_LIMIT_REPORT_PER_MINUTE" reload:"true" help:"abuse reports per IP per minute, 0 disables"`
+	RateLimitReportBurst       int `yaml:"rate_limit_report_burst" toml:"rate_limit_report_burst" env:"RATE_LIMIT_REPORT_BURST" reload:"true" help:"report burst, 0 means the per-minute rate"`
+	BulkShortenMax             int `yaml:"bulk_shorten_max" toml:"bulk_shorten_max" env:"BULK_SHORTEN_MAX" help:"items per bulk request"`
+	CSVImportMaxRows           int `yaml:"csv_import_max_rows" toml:"csv_import_max_rows" env:"CSV_IMPORT_MAX_ROWS" help:"rows per CSV upload"`
+	MaxURLLength               int `yaml:"max_url_length" toml:"max_url_length" env:"MAX_URL_LENGTH" help:"maximum destination length in bytes"`
+	MaxCodeLength              int `yaml:"max_code_length" toml:"max_code_length" env:"MAX_CODE_LENGTH" help:"maximum custom_code length in bytes"`
+	ClickRetentionMonths       int `yaml:"click_events_retention_months" toml:"click_events_retention_months" env:"CLICK_EVENTS_RETENTION_MONTHS" help:"months of click events to keep, 0 keeps all"`
+	ClickWorkers               int `yaml:"click_workers" toml:"click_workers" env:"CLICK_WORKERS" help:"goroutines recording clicks off the redirect path"`
+	ClickQueueSize             int `yaml:"click_queue_size" toml:"click_queue_size" env:"CLICK_QUEUE_SIZE" help:"clicks waiting for a worker before new ones are dropped"`
+
+	// Abuse protection
+	BlockPrivateDestinations  bool          `yaml:"block_private_destinations" toml:"block_private_destinations" env:"BLOCK_PRIVATE_DESTINATIONS" help:"refuse destinations and webhooks on internal addresses"`
+	DomainAllowlistOnly       bool          `yaml:"domain_allowlist_only" toml:"domain_allowlist_only" env:"DOMAIN_ALLOWLIST_ONLY" help:"only accept allowlisted destination domains"`
+	ShortenerDestinations     string        `yaml:"shortener_destinations" toml:"shortener_destinations" env:"SHORTENER_DESTINATIONS" help:"links to other shorteners: reject, unwrap or allow"`
+	StripTrackingParams       bool          `yaml:"strip_tracking_params" toml:"strip_tracking_params" env:"STRIP_TRACKING_PARAMS" help:"drop utm_* and click-ID parameters from new destinations"`
+	KnownShorteners           []string      `yaml:"known_shorteners" toml:"known_shorteners" env:"KNOWN_SHORTENERS" help:"extra shortener domains"`
+	CaptchaProvider           string        `yaml:"captcha_provider" toml:"captcha_provider" env:"CAPTCHA_PROVIDER" help:"hcaptcha or turnstile"`
+	CaptchaSiteKey            string        `yaml:"captcha_site_key" toml:"captcha_site_key" env:"CAPTCHA_SITE_KEY" help:"public CAPTCHA site key"`
+	ReputationRecheckInterval time.Duration `yaml:"reputation_recheck_interval" toml:"reputation_recheck_interval" env:"REPUTATION_RECHECK_INTERVAL" help:"how often live links are re-checked"`
+	EnumBanThreshold          int           `yaml:"enum_ban_threshold" toml:"enum_ban_threshold" env:"ENUM_BAN_THRESHOLD" help:"lookup misses before an IP is banned, 0 disables"`
+	EnumBanWindow             time.Duration `yaml:"enum_ban_window" toml:"enum_ban_window" env:"ENUM_BAN_WINDOW" help:"window the misses are counted over"`
+	EnumBanDuration           time.Duration `yaml:"enum_ban_duration" toml:"enum_ban_duration" env:"ENUM_BAN_DURATION" help:"how long a ban lasts"`
+	EnumBanMode               string        `yaml:"enum_ban_mode" toml:"enum_ban_mode" env:"ENUM_BAN_MODE" help:"ban or tarpit"`
+	ClickBurstThreshold       int           `yaml:"click_burst_threshold" toml:"click_burst_threshold" env:"CLICK_BURST_THRESHOLD" help:"clicks from one IP on a link before the rest are suspicious, 0 disables"`
+	ClickBurstWindow          time.Duration `yaml:"click_burst_window" toml:"click_burst_window" env:"CLICK_BURST_WINDOW" help:"window the clicks are counted over"`
+	IPASNFile                 string        `yaml:"ip_asn_file" toml:"ip_asn_file" env:"IP_ASN_FILE" help:"IP range to ASN table used to spot datacenter clicks"`
+	DatacenterASNs            []string      `yaml:"datacenter_asns" toml:"datacenter_asns" env:"DATACENTER_ASNS" help:"extra hosting provider ASNs"`
+	SpamHoldScore             int           `yaml:"spam_hold_score" toml:"spam_hold_score" env:"SPAM_HOLD_SCORE" help:"spam score at which new links wait for admin review, 0 disables scoring"`
+	SpamDNSBLZones            []string      `yaml:"spam_dnsbl_zones" toml:"spam_dnsbl_zones" env:"SPAM_DNSBL_ZONES" help:"DNS blocklists destination domains are looked up in, e.g. dbl.spamhaus.org"`
+	SpamNewDomainZones        []string      `yaml:"spam_new_domain_zones" toml:"spam_new_domain_zones" env:"SPAM_NEW_DOMAIN_ZONES" help:"DNS lists of newly registered domains"`
+	OpsAllowedCIDRs           []string      `yaml:"ops_allowed_cidrs" toml:"ops_allowed_cidrs" env:"OPS_ALLOWED_CIDRS" help:"networks allowed to reach admin, metrics and dashboard"`
+	TrustedProxyCIDRs         []string      `yaml:"trusted_proxy_cidrs" toml:"trusted_proxy_cidrs" env:"TRUSTED_PROXY_CIDRS" help:"proxies whose X-Forwarded-For is believed"`
+
+	// Privacy
+	ClickIPMode         string        `yaml:"click_ip_mode" toml:"click_ip_mode" env:"CLICK_IP_MODE" help:"how click IPs are stored: raw, truncate or hash"`
+	ClickIPSaltRotation time.Duration `yaml:"click_ip_salt_rotation" toml:"click_ip_salt_rotation" env:"CLICK_IP_SALT_ROTATION" help:"how long a hash salt is used before it's discarded"`
+
+	// Features
+	EnableSwaggerUI          bool          `yaml:"enable_swagger_ui" toml:"enable_swagger_ui" env:"ENABLE_SWAGGER_UI" help:"serve the Swagger UI at /api/v1/docs"`
+	MaintenanceMode          bool          `yaml:"maintenance_mode" toml:"maintenance_mode" env:"MAINTENANCE_MODE" help:"start in maintenance mode, refusing writes"`
+	MaintenanceRetryAfter    time.Duration `yaml:"maintenance_retry_after" toml:"maintenance_retry_after" env:"MAINTENANCE_RETRY_AFTER" help:"default Retry-After during maintenance"`
+	FeatureFlags             []string      `yaml:"feature_flags" toml:"feature_flags" env:"FEATURE_FLAGS" reload:"true" help:"flag defaults as name=true|false|percent"`
+	RobotsTxtFile            string        `yaml:"robots_txt_file" toml:"robots_txt_file" env:"ROBOTS_TXT_FILE" help:"serve this file as robots.txt instead of the generated rules"`
+	RobotsAllowShortCodes    bool          `yaml:"robots_allow_short_codes" toml:"robots_allow_short_codes" env:"ROBOTS_ALLOW_SHORT_CODES" help:"let crawlers follow short codes"`
+	SitemapEnabled           bool          `yaml:"sitemap_enabled" toml:"sitemap_enabled" env:"SITEMAP_ENABLED" help:"serve /sitemap.xml"`
+	SitemapPaths             []string      `yaml:"sitemap_paths" toml:"sitemap_paths" env:"SITEMAP_PATHS" help:"public landing page paths for the sitemap and robots.txt"`
+	ArchiveLinks             bool          `yaml:"archive_links" toml:"archive_links" env:"ARCHIVE_LINKS" help:"snapshot new destinations in the Wayback Machine"`
+	DestinationCheckInterval time.Duration `yaml:"destination_check_interval" toml:"destination_check_interval" env:"DESTINATION_CHECK_INTERVAL" help:"how often destinations are checked for dead links, 0 disables"`
+	DestinationDeadAfter     time.Duration `yaml:"destination_dead_after" toml:"destination_dead_after" env:"DESTINATION_DEAD_AFTER" help:"how long a destination fails before its owner is told"`
+
+	// Logging
+	LogLevel        string `yaml:"log_level" toml:"log_level" env:"LOG_LEVEL" reload:"true" help:"debug, info, warn or error"`
+	LogFormat       string `yaml:"log_format" toml:"log_format" env:"LOG_FORMAT" help:"text or json"`
+	AccessLog       string `yaml:"access_log" toml:"access_log" env:"ACCESS_LOG" help:"stdout, stderr or a file path, empty disables"`
+	AccessLogFormat string `yaml:"access_log_format" toml:"access_log_format" env:"ACCESS_LOG_FORMAT" help:"clf or json"`
+
+	// Error reporting
+	SentryDSN         string `yaml:"sentry_dsn" toml:"sentry_dsn" env:"SENTRY_DSN" secret:"true" help:"Sentry-compatible DSN for 5xx and panic reports, empty disables"`
+	SentryEnvironment string `yaml:"sentry_environment" toml:"sentry_environment" env:"SENTRY_ENVIRONMENT" help:"environment name attached to reports"`
+
+	// Event streaming
+	EventStream  string   `yaml:"event_stream" toml:"event_stream" env:"EVENT_STREAM" help:"kafka or nats, empty disables"`
+	KafkaBrokers []string `yaml:"kafka_brokers" toml:"kafka_brokers" env:"KAFKA_BROKERS" help:"Kafka bootstrap brokers (host:port)"`
+	KafkaTopic   string   `yaml:"kafka_topic" toml:"kafka_topic" env:"KAFKA_TOPIC" help:"topic events are published to"`
+	NATSURL      string   `yaml:"nats_url" toml:"nats_url" env:"NATS_URL" secret:"true" help:"NATS server URL, may embed credentials"`
+	NATSSubject  string   `yaml:"nats_subject" toml:"nats_subject" env:"NATS_SUBJECT" help:"subject prefix; events go to <prefix>.<event>"`
+
+	// Analytics export
+	AnalyticsExportBucket   string `yaml:"analytics_export_bucket" toml:"analytics_export_bucket" env:"ANALYTICS_EXPORT_BUCKET" help:"S3 bucket for daily click aggregates, empty disables"`
+	AnalyticsExportPrefix   string `yaml:"analytics_export_prefix" toml:"analytics_export_prefix" env:"ANALYTICS_EXPORT_PREFIX" help:"object key prefix"`
+	AnalyticsExportFormat   string `yaml:"analytics_export_format" toml:"analytics_export_format" env:"ANALYTICS_EXPORT_FORMAT" help:"csv or parquet"`
+	AnalyticsExportEndpoint string `yaml:"analytics_export_endpoint" toml:"analytics_export_endpoint" env:"ANALYTICS_EXPORT_ENDPOINT" help:"S3-compatible endpoint URL, empty for AWS"`
+
+	// Email
+	SMTPHost     string `yaml:"smtp_host" toml:"smtp_host" env:"SMTP_HOST" help:"SMTP server for notification emails, empty disables"`
+	SMTPPort     int    `yaml:"smtp_port" toml:"smtp_port" env:"SMTP_PORT" help:"SMTP port, usually 587"`
+	SMTPUsername string `yaml:"smtp_username" toml:"smtp_username" env:"SMTP_USERNAME" help:"SMTP user"`
+	SMTPPassword string `yaml:"smtp_password" toml:"smtp_password" env:"SMTP_PASSWORD" secret:"true" help:"SMTP password"`
+	EmailFrom    string `yaml:"email_from" toml:"email_from" env:"EMAIL_FROM" help:"From address, e.g. Ihdas <noreply@ihd.as>"`
+
+	// Chat integrations
+	DiscordPublicKey      string   `yaml:"discord_public_key" toml:"discord_public_key" env:"DISCORD_PUBLIC_KEY" help:"Discord application public key (hex), empty disables /discord/interactions"`
+	TelegramBotToken      string   `yaml:"telegram_bot_token" toml:"telegram_bot_token" env:"TELEGRAM_BOT_TOKEN" secret:"true" help:"Telegram bot token, empty disables /telegram/webhook"`
+	TelegramWebhookSecret string   `yaml:"telegram_webhook_secret" toml:"telegram_webhook_secret" env:"TELEGRAM_WEBHOOK_SECRET" secret:"true" help:"secret_token given to setWebhook"`
+	MattermostTokens      []string `yaml:"mattermost_tokens" toml:"mattermost_tokens" env:"MATTERMOST_TOKENS" secret:"true" help:"Mattermost slash command and outgoing webhook tokens, empty disables /mattermost/command"`
+	RocketChatTokens      []string `yaml:"rocketchat_tokens" toml:"rocketchat_tokens" env:"ROCKETCHAT_TOKENS" secret:"true" help:"Rocket.Chat outgoing integration tokens, empty disables /rocketchat/webhook"`
+}
+
+var cfg = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:            "8080",
+		ShutdownTimeout: 30 * time.Second,
+		TLSCacheDir:     "certs",
+
+		CORSAllowedOrigins: []string{"*"},
+		CORSAllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		CORSAllowedHeaders: []string{"Content-Type", "X-API-Key", "X-Captcha-Token", "Authorization", "If-None-Match"},
+		CORSExposedHeaders: []string{"ETag", "Retry-After", "X-Request-ID", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"},
+		CORSMaxAge:         600,
+		CSPAPI:             "default-src 'none'; frame-ancestors 'none'",
+		ReferrerPolicy:     "strict-origin-when-cross-origin",
+		HSTSMaxAge:         31536000,
+
+		DBMaxOpenConns:    20,
+		DBMaxIdleConns:    5,
+		DBConnMaxLifetime: 5 * time.Minute,
+		CacheSize:         1000,
+		WarmCacheSize:     500,
+
+		RateLimitShortenPerMinute:  30,
+		RateLimitRedirectPerMinute: 300,
+		RateLimitReportPerMinute:   10,
+		BulkShortenMax:             100,
+		CSVImportMaxRows:           1000,
+		MaxURLLength:               2048,
+		MaxCodeLength:              32,
+		ClickRetentionMonths:       12,
+		ClickWorkers:               4,
+		ClickQueueSize:             10000,
+
+		ShortenerDestinations:     "reject",
+		ReputationRecheckInterval: 24 * time.Hour,
+		EnumBanThreshold:          20,
+		EnumBanWindow:             time.Minute,
+		EnumBanDuration:           15 * time.Minute,
+		EnumBanMode:               "ban",
+		ClickBurstThreshold:       10,
+		ClickBurstWindow:          time.Minute,
+
+		ClickIPMode:         "raw",
+		ClickIPSaltRotation: 24 * time.Hour,
+
+		MaintenanceRetryAfter: 5 * time.Minute,
+
+		SitemapPaths:         []string{"/"},
+		DestinationDeadAfter: 72 * time.Hour,
+
+		SMTPPort: 587,
+
+		AnalyticsExportPrefix: "clicks/",
+		AnalyticsExportFormat: "csv",
+
+		KafkaTopic:  "ihdas.events",
+		NATSSubject: "ihdas.events",
+
+		LogLevel:        "info",
+		LogFormat:       "text",
+		AccessLogFormat: "clf",
+	}
+}
+
+// Build the configuration from file, environment and command line
+func loadConfig(args []string) (*Config, error) {
+	c := defaultConfig()
+	fields := configFields(c)
+
+	// Flags are collected first but applied last, so they win
+	fs := flag.NewFlagSet("ihdas", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML configuration file")
+	flagValues := make(map[string]string)
+	for _, f := range fields {
+		name := f.flagName()
+		collect := func(s string) error {
+			flagValues[name] = s
+			return nil
+		}
+		if f.value.Kind() == reflect.Bool {
+			fs.BoolFunc(name, f.help, collect)
+		} else {
+			fs.Func(name, f.help, collect)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := decodeConfigFile(*configFile, c); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", *configFile, err)
+		}
+	}
+
+	for _, f := range fields {
+		raw := os.Getenv(f.env)
+		if f.secret {
+			raw = secret(f.env)
+		}
+		if raw == "" {
+			continue
+		}
+		if err := setConfigValue(f.value, raw); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.env, err)
+		}
+	}
+
+	for _, f := range fields {
+		if raw, ok := flagValues[f.flagName()]; ok {
+			if err := setConfigValue(f.value, raw); err != nil {
+				return nil, fmt.Errorf("-%s: %w", f.flagName(), err)
+			}
+		}
+	}
+	return c, nil
+}
+
+func decodeConfigFile(path string, c *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(strings.NewReader(string(data)))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		return nil
+	case ".toml":
+		meta, err := toml.Decode(string(data), c)
+		if err != nil {
+			return err
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown key %s", undecoded[0])
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported format %q, use .yaml or .toml", filepath.Ext(path))
+	}
+}
+
+type configField struct {
+	key    string // file key
+	env    string
+	help   string
+	secret bool
+	reload bool
+	value  reflect.Value
+}
+
+func (f configField) flagName() string {
+	return strings.ReplaceAll(f.key, "_", "-")
+}
+
+func configFields(c *Config) []configField {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	fields := make([]configField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		fields = append(fields, configField{
+			key:    sf.Tag.Get("yaml"),
+			env:    sf.Tag.Get("env"),
+			help:   sf.Tag.Get("help"),
+			secret: sf.Tag.Get("secret") == "true",
+			reload: sf.Tag.Get("reload") == "true",
+			value:  v.Field(i),
+		})
+	}
+	return fields
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Parse an environment or flag string into a config field
+func setConfigValue(v reflect.Value, raw string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("not a number: %q", raw)
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("not a boolean: %q", raw)
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported config type %s", v.Type())
+	}
+	return nil
+}
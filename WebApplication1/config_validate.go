@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/jackc/pgx/v5"
+)
+
+// Startup validation. Everything wrong with the configuration is reported
+// at once, naming both the file key and the environment variable, so a bad
+// deploy fails before it takes traffic rather than on the first request.
+type configProblems []error
+
+func (p *configProblems) add(key, format string, args ...interface{}) {
+	*p = append(*p, fmt.Errorf("%s (%s): %s", key, configEnvName(key), fmt.Sprintf(format, args...)))
+}
+
+// Environment variable for a file key, as declared on the struct
+func configEnvName(key string) string {
+	for _, f := range configFields(&Config{}) {
+		if f.key == key {
+			return f.env
+		}
+	}
+	return strings.ToUpper(key)
+}
+
+func (p *configProblems) port(key, value string, required bool) {
+	if value == "" {
+		if required {
+			p.add(key, "is required")
+		}
+		return
+	}
+	if n, err := strconv.Atoi(value); err != nil || n < 1 || n > 65535 {
+		p.add(key, "%q is not a port number between 1 and 65535", value)
+	}
+}
+
+func (p *configProblems) positive(key string, value int) {
+	if value < 1 {
+		p.add(key, "must be at least 1, got %d", value)
+	}
+}
+
+func (p *configProblems) nonNegative(key string, value int) {
+	if value < 0 {
+		p.add(key, "must not be negative, got %d", value)
+	}
+}
+
+func (p *configProblems) duration(key string, value, min, max time.Duration) {
+	if value < min || value > max {
+		p.add(key, "%s is outside the sensible range %s to %s", value, min, max)
+	}
+}
+
+func (p *configProblems) oneOf(key, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	p.add(key, "%q is not one of %s", value, strings.Join(allowed, ", "))
+}
+
+func (p *configProblems) cidrs(key string, entries []string) {
+	for _, entry := range entries {
+		var err error
+		if strings.Contains(entry, "/") {
+			_, err = netip.ParsePrefix(entry)
+		} else {
+			_, err = netip.ParseAddr(entry)
+		}
+		if err != nil {
+			p.add(key, "%q is not an address or CIDR range", entry)
+		}
+	}
+}
+
+func (c *Config) validate() []error {
+	var p configProblems
+
+	p.port("port", c.Port, true)
+	p.port("grpc_port", c.GRPCPort, false)
+	if c.GRPCPort != "" && c.GRPCPort == c.Port {
+		p.add("grpc_port", "must differ from port %s", c.Port)
+	}
+	if c.PublicHost != "" {
+		if strings.Contains(c.PublicHost, "://") || strings.ContainsAny(c.PublicHost, "/?#") {
+			p.add("public_host", "%q should be a bare host[:port] such as ihd.as, without scheme or path", c.PublicHost)
+		} else if host, port, err := net.SplitHostPort(c.PublicHost); err == nil {
+			if host == "" {
+				p.add("public_host", "%q is missing the host name", c.PublicHost)
+			}
+			p.port("public_host", port, true)
+		}
+	}
+	if c.BaseURL != "" {
+		if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" ||
+			u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+			p.add("base_url", "%q should be scheme://host[/prefix] such as https://ihd.as", c.BaseURL)
+		}
+	}
+	if c.NamespaceDomain != "" && (!strings.Contains(c.NamespaceDomain, ".") || strings.ContainsAny(c.NamespaceDomain, "/:@ *")) {
+		p.add("namespace_domain", "%q should be a bare host name such as sho.rt", c.NamespaceDomain)
+	}
+	p.duration("shutdown_timeout", c.ShutdownTimeout, time.Second, 10*time.Minute)
+	for _, d := range c.TLSDomains {
+		if strings.Contains(d, "://") || strings.ContainsAny(d, "/:") {
+			p.add("tls_domains", "%q should be a bare host name", d)
+		}
+	}
+	if len(c.TLSDomains) > 0 && c.TLSCacheDir == "" {
+		p.add("tls_cache_dir", "is required with tls_domains, or every restart requests new certificates")
+	}
+
+	if c.DatabaseURL == "" {
+		p.add("database_url", "is required, e.g. postgres://user@host/ihdas (set DATABASE_URL or DATABASE_URL_FILE)")
+	} else if _, err := pgx.ParseConfig(c.DatabaseURL); err != nil {
+		// pgx errors can echo the DSN back, password and all
+		p.add("database_url", "is not a valid PostgreSQL connection string")
+	}
+	p.positive("db_max_open_conns", c.DBMaxOpenConns)
+	p.nonNegative("db_max_idle_conns", c.DBMaxIdleConns)
+	if c.DBMaxIdleConns > c.DBMaxOpenConns {
+		p.add("db_max_idle_conns", "%d is more than db_max_open_conns %d", c.DBMaxIdleConns, c.DBMaxOpenConns)
+	}
+	p.duration("db_conn_max_lifetime", c.DBConnMaxLifetime, time.Second, 24*time.Hour)
+	if c.MigrationDatabaseURL != "" {
+		if _, err := pgx.ParseConfig(c.MigrationDatabaseURL); err != nil {
+			p.add("migration_database_url", "is not a valid PostgreSQL connection string")
+		} else if c.MigrationDatabaseURL == c.DatabaseURL {
+			p.add("migration_database_url", "is the same database as database_url")
+		}
+		if c.MigrationCheckInterval != 0 {
+			p.duration("migration_check_interval", c.MigrationCheckInterval, time.Minute, 7*24*time.Hour)
+		}
+	}
+	p.positive("cache_size", c.CacheSize)
+	p.nonNegative("warm_cache_size", c.WarmCacheSize)
+	if c.WarmCacheSize > c.CacheSize {
+		p.add("warm_cache_size", "%d is more than cache_size %d", c.WarmCacheSize, c.CacheSize)
+	}
+
+	p.nonNegative("rate_limit_shorten_per_minute", c.RateLimitShortenPerMinute)
+	p.nonNegative("rate_limit_shorten_burst", c.RateLimitShortenBurst)
+	p.nonNegative("rate_limit_redirect_per_minute", c.RateLimitRedirectPerMinute)
+	p.nonNegative("rate_limit_redirect_burst", c.RateLimitRedirectBurst)
+	p.nonNegative("rate_limit_report_per_minute", c.RateLimitReportPerMinute)
+	p.nonNegative("rate_limit_report_burst", c.RateLimitReportBurst)
+	p.positive("bulk_shorten_max", c.BulkShortenMax)
+	p.positive("csv_import_max_rows", c.CSVImportMaxRows)
+	if c.MaxURLLength < 16 {
+		p.add("max_url_length", "%d is too short for any real URL", c.MaxURLLength)
+	}
+	if c.MaxCodeLength < 1 || c.MaxCodeLength > shortCodeColumnLen {
+		p.add("max_code_length", "%d must be between 1 and %d", c.MaxCodeLength, shortCodeColumnLen)
+	}
+	p.nonNegative("click_events_retention_months", c.ClickRetentionMonths)
+	p.positive("click_workers", c.ClickWorkers)
+	p.positive("click_queue_size", c.ClickQueueSize)
+
+	p.oneOf("shortener_destinations", c.ShortenerDestinations, "reject", "unwrap", "allow")
+	if c.CaptchaProvider != "" {
+		if _, ok := captchaVerifyURLs[strings.ToLower(c.CaptchaProvider)]; !ok {
+			p.add("captcha_provider", "%q is not one of hcaptcha, turnstile", c.CaptchaProvider)
+		} else if secret("CAPTCHA_SECRET") == "" {
+			p.add("captcha_provider", "is set but CAPTCHA_SECRET is missing, so CAPTCHAs would silently be skipped")
+		}
+	}
+	p.duration("reputation_recheck_interval", c.ReputationRecheckInterval, time.Minute, 30*24*time.Hour)
+	p.nonNegative("enum_ban_threshold", c.EnumBanThreshold)
+	if c.EnumBanThreshold > 0 {
+		p.duration("enum_ban_window", c.EnumBanWindow, time.Second, 24*time.Hour)
+		p.duration("enum_ban_duration", c.EnumBanDuration, time.Second, 30*24*time.Hour)
+	}
+	p.oneOf("enum_ban_mode", c.EnumBanMode, "ban", "tarpit")
+	p.nonNegative("click_burst_threshold", c.ClickBurstThreshold)
+	if c.ClickBurstThreshold > 0 {
+		p.duration("click_burst_window", c.ClickBurstWindow, time.Second, 24*time.Hour)
+	}
+	p.nonNegative("spam_hold_score", c.SpamHoldScore)
+	p.nonNegative("cors_max_age", c.CORSMaxAge)
+	p.nonNegative("hsts_max_age", c.HSTSMaxAge)
+	p.cidrs("ops_allowed_cidrs", c.OpsAllowedCIDRs)
+	p.cidrs("trusted_proxy_cidrs", c.TrustedProxyCIDRs)
+	p.oneOf("click_ip_mode", c.ClickIPMode, clickIPRaw, clickIPTruncate, clickIPHash)
+	if c.ClickIPMode == clickIPHash {
+		p.duration("click_ip_salt_rotation", c.ClickIPSaltRotation, time.Hour, 365*24*time.Hour)
+	}
+
+	if _, err := parseFlagOverrides(c.FeatureFlags); err != nil {
+		p.add("feature_flags", "%v", err)
+	}
+	p.duration("maintenance_retry_after", c.MaintenanceRetryAfter, time.Second, 24*time.Hour)
+	if c.DestinationCheckInterval != 0 {
+		p.duration("destination_check_interval", c.DestinationCheckInterval, time.Hour, 30*24*time.Hour)
+		p.duration("destination_dead_after", c.DestinationDeadAfter, 0, 365*24*time.Hour)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		p.add("log_level", "%q is not one of debug, info, warn, error", c.LogLevel)
+	}
+	p.oneOf("log_format", strings.ToLower(c.LogFormat), "text", "json")
+	p.oneOf("access_log_format", strings.ToLower(c.AccessLogFormat), "clf", "json")
+	if c.SentryDSN != "" {
+		// The DSN embeds the project key, so don't echo it
+		if _, err := sentry.NewDsn(c.SentryDSN); err != nil {
+			p.add("sentry_dsn", "is not a valid DSN, expected https://key@host/project")
+		}
+	}
+	if c.DiscordPublicKey != "" {
+		if key, err := hex.DecodeString(c.DiscordPublicKey); err != nil || len(key) != ed25519.PublicKeySize {
+			p.add("discord_public_key", "must be %d hex characters", 2*ed25519.PublicKeySize)
+		}
+	}
+	if c.EventStream != "" {
+		p.oneOf("event_stream", strings.ToLower(c.EventStream), "kafka", "nats")
+	}
+	switch strings.ToLower(c.EventStream) {
+	case "kafka":
+		if len(c.KafkaBrokers) == 0 {
+			p.add("kafka_brokers", "is required with event_stream kafka")
+		}
+		if c.KafkaTopic == "" {
+			p.add("kafka_topic", "is required with event_stream kafka")
+		}
+	case "nats":
+		if c.NATSURL == "" {
+			p.add("nats_url", "is required with event_stream nats")
+		}
+		if c.NATSSubject == "" || strings.ContainsAny(c.NATSSubject, " *>") {
+			p.add("nats_subject", "%q is not a valid subject prefix", c.NATSSubject)
+		}
+	}
+	p.oneOf("analytics_export_format", strings.ToLower(c.AnalyticsExportFormat), "csv", "parquet")
+	if c.AnalyticsExportEndpoint != "" {
+		if u, err := url.Parse(c.AnalyticsExportEndpoint); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			p.add("analytics_export_endpoint", "%q is not an http(s) URL", c.AnalyticsExportEndpoint)
+		}
+	}
+	for _, path := range c.SitemapPaths {
+		if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, "?#*$ ") {
+			p.add("sitemap_paths", "%q should be a plain path starting with /", path)
+		}
+	}
+	if c.SMTPHost != "" {
+		p.port("smtp_port", strconv.Itoa(c.SMTPPort), true)
+		if _, err := mail.ParseAddress(c.EmailFrom); err != nil {
+			p.add("email_from", "%q is not an email address", c.EmailFrom)
+		}
+	}
+	if c.TelegramBotToken != "" && c.TelegramWebhookSecret == "" {
+		// Without it anyone who finds the URL can post updates as Telegram
+		p.add("telegram_webhook_secret", "is required with telegram_bot_token")
+	}
+
+	return p
+}
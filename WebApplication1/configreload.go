@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Live configuration reload on SIGHUP or POST /api/v1/admin/config/reload.
+// The configuration is loaded again the same way as at startup and
+// validated; if it is sound, the fields tagged reload (rate limits, log
+// level, cache size, feature flag defaults) take effect straight away and
+// the domain lists are re-read. The redirect cache is kept. Environment
+// variables can't change under a running process, so in practice this
+// picks up edits to the config file.
+//
+// Everything else keeps its startup value; changed keys are reported as
+// needing a restart.
+type ConfigReloadResponse struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+var (
+	reloadMu sync.Mutex
+	// What the reloadable settings were last set from
+	liveConfig *Config
+
+	cacheLimit atomic.Int64
+)
+
+// Apply the reloadable settings; called once at startup, then per reload
+func applyLiveSettings(c *Config) {
+	if err := setLogLevel(c.LogLevel); err != nil {
+		slog.Warn("Invalid log level ignored", "value", c.LogLevel)
+	}
+
+	cacheLimit.Store(int64(c.CacheSize))
+	trimCache(c.CacheSize)
+
+	shortenLimiter.set(c.RateLimitShortenPerMinute, c.RateLimitShortenBurst)
+	redirectLimiter.set(c.RateLimitRedirectPerMinute, c.RateLimitRedirectBurst)
+	reportLimiter.set(c.RateLimitReportPerMinute, c.RateLimitReportBurst)
+
+	if overrides, err := parseFlagOverrides(c.FeatureFlags); err == nil {
+		flagsMu.Lock()
+		configFlags = overrides
+		flagsMu.Unlock()
+	}
+
+	copied := *c
+	liveConfig = &copied
+}
+
+// Drop arbitrary entries until the cache fits a smaller limit
+func trimCache(limit int) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	for k := range recentCache {
+		if len(recentCache) <= limit {
+			break
+		}
+		delete(recentCache, k)
+	}
+}
+
+func reloadConfig() (ConfigReloadResponse, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	resp := ConfigReloadResponse{Applied: []string{}, RestartRequired: []string{}}
+	loaded, err := loadConfig(os.Args[1:])
+	if err != nil {
+		return resp, err
+	}
+	if problems := loaded.validate(); len(problems) > 0 {
+		return resp, errors.Join(problems...)
+	}
+
+	live := configFields(liveConfig)
+	for i, f := range configFields(loaded) {
+		if reflect.DeepEqual(f.value.Interface(), live[i].value.Interface()) {
+			continue
+		}
+		if f.reload {
+			resp.Applied = append(resp.Applied, f.key)
+		} else {
+			resp.RestartRequired = append(resp.RestartRequired, f.key)
+		}
+	}
+
+	applyLiveSettings(loaded)
+	for _, list := range []*domainList{blocklist, allowlist} {
+		if err := list.reload(); err != nil {
+			slog.Error("Domain list reload error", "list", list.name, "err", err)
+		}
+	}
+
+	slog.Info("Configuration reloaded", "applied", resp.Applied)
+	if len(resp.RestartRequired) > 0 {
+		slog.Warn("Changed settings need a restart", "keys", resp.RestartRequired)
+	}
+	return resp, nil
+}
+
+// Reload on every SIGHUP until the process exits
+func watchReloadSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if _, err := reloadConfig(); err != nil {
+				// The running configuration stays in place
+				slog.Error("Configuration reload failed", "err", err)
+			}
+		}
+	}()
+}
+
+// POST /api/v1/admin/config/reload
+func reloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	resp, err := reloadConfig()
+	if err != nil {
+		slog.WarnContext(r.Context(), "Configuration reload failed", "err", err)
+		writeError(w, http.StatusUnprocessableEntity, "invalid_config", fmt.Sprintf("Configuration not reloaded: %v", err))
+		return
+	}
+	auditAdmin(r, "config.reload", "", map[string]interface{}{"applied": resp.Applied})
+	writeJSON(w, http.StatusOK, resp)
+}
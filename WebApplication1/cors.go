@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORS policy from the cors_* settings. With cors_allow_credentials,
+// cookies and credentials are allowed for explicitly listed origins only.
+type corsPolicy struct {
+	anyOrigin   bool
+	origins     map[string]bool
+	methods     string
+	headers     string
+	exposed     string
+	credentials bool
+	maxAge      string
+}
+
+func corsPolicyFromConfig() *corsPolicy {
+	p := &corsPolicy{
+		origins:     map[string]bool{},
+		methods:     strings.Join(cfg.CORSAllowedMethods, ", "),
+		headers:     strings.Join(cfg.CORSAllowedHeaders, ", "),
+		exposed:     strings.Join(cfg.CORSExposedHeaders, ", "),
+		credentials: cfg.CORSAllowCredentials,
+		maxAge:      strconv.Itoa(cfg.CORSMaxAge),
+	}
+	for _, origin := range cfg.CORSAllowedOrigins {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		switch {
+		case origin == "*":
+			p.anyOrigin = true
+		case origin != "":
+			p.origins[strings.ToLower(origin)] = true
+		}
+	}
+	return p
+}
+
+// Set CORS response headers for r. Credentials are only ever granted to an
+// explicitly listed origin, never through the wildcard.
+func (p *corsPolicy) apply(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	h := w.Header()
+	h.Add("Vary", "Origin")
+
+	listed := p.origins[strings.ToLower(origin)]
+	switch {
+	case listed:
+		h.Set("Access-Control-Allow-Origin", origin)
+		if p.credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+	case p.anyOrigin:
+		h.Set("Access-Control-Allow-Origin", "*")
+	default:
+		return
+	}
+
+	if p.exposed != "" {
+		h.Set("Access-Control-Expose-Headers", p.exposed)
+	}
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		h.Set("Access-Control-Allow-Methods", p.methods)
+		h.Set("Access-Control-Allow-Headers", p.headers)
+		h.Set("Access-Control-Max-Age", p.maxAge)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CSV bulk creation runs as a background job so non-developers can upload
+// hundreds of URLs from a spreadsheet and poll for the results.
+// Jobs live in memory and are forgotten csvJobRetention after they end.
+// A job's status is only for the API key that started it; anonymous jobs
+// are known only by their unguessable IDs.
+const (
+	maxCSVUploadBytes = 10 << 20 // 10 MB
+	csvJobRetention   = 24 * time.Hour
+)
+
+type CSVJob struct {
+	ID         string       `json:"id"`
+	Status     string       `json:"status"` // queued, running, done, failed
+	Total      int          `json:"total"`
+	Processed  int          `json:"processed"`
+	Created    int          `json:"created"`
+	Failed     int          `json:"failed"`
+	Error      string       `json:"error,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	Results    []BulkResult `json:"results,omitempty"`
+
+	owner string // API key owner who uploaded it, empty for anonymous
+}
+
+var (
+	csvJobs   = make(map[string]*CSVJob)
+	csvJobsMu sync.RWMutex
+)
+
+func newJobID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// POST /api/v1/shorten/csv - multipart upload with a "file" field holding
+// original_url, custom_code, expires_at columns
+func csvUploadHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxCSVUploadBytes)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeError(w, http.StatusRequestEntityTooLarge, "body_too_large", "CSV file too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, "missing_file", "Missing CSV file")
+		return
+	}
+	defer file.Close()
+
+	reqs, err := parseShortenCSV(file, cfg.CSVImportMaxRows)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_csv", err.Error())
+		return
+	}
+
+	job := &CSVJob{
+		ID:        newJobID(),
+		Status:    "queued",
+		Total:     len(reqs),
+		CreatedAt: time.Now(),
+		owner:     callerOwner(r.Context()),
+	}
+	csvJobsMu.Lock()
+	csvJobs[job.ID] = job
+	csvJobsMu.Unlock()
+
+	// Detached from the request, but keeping the caller's identity
+	go runCSVJob(context.WithoutCancel(r.Context()), job.ID, reqs, r.Host)
+
+	w.Header().Set("Location", "/api/v1/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"job_id":     job.ID,
+		"status":     job.Status,
+		"total":      job.Total,
+		"status_url": "/api/v1/jobs/" + job.ID,
+	})
+}
+
+func parseShortenCSV(body io.Reader, maxRows int) ([]CreateURLRequest, error) {
+	cr := csv.NewReader(body)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, errors.New("missing CSV header")
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		// Spreadsheets like to prepend a byte-order mark
+		name = strings.TrimPrefix(name, "\ufeff")
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	if _, ok := columns["original_url"]; !ok {
+		return nil, errors.New("CSV header is missing original_url column")
+	}
+
+	field := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	var reqs []CreateURLRequest
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.New("malformed CSV: " + err.Error())
+		}
+		if len(reqs) >= maxRows {
+			return nil, errors.New("too many rows, maximum is " + strconv.Itoa(maxRows))
+		}
+		reqs = append(reqs, CreateURLRequest{
+			OriginalURL: field(row, "original_url"),
+			CustomCode:  field(row, "custom_code"),
+			ExpiresAt:   field(row, "expires_at"),
+		})
+	}
+	if len(reqs) == 0 {
+		return nil, errors.New("CSV has no rows")
+	}
+	return reqs, nil
+}
+
+// Process the rows in bulk-sized batches, updating progress as we go
+func runCSVJob(parent context.Context, id string, reqs []CreateURLRequest, host string) {
+	updateJob := func(fn func(job *CSVJob)) {
+		csvJobsMu.Lock()
+		if job, ok := csvJobs[id]; ok {
+			fn(job)
+		}
+		csvJobsMu.Unlock()
+	}
+	updateJob(func(job *CSVJob) { job.Status = "running" })
+	// However the job ends
+	defer time.AfterFunc(csvJobRetention, func() {
+		csvJobsMu.Lock()
+		delete(csvJobs, id)
+		csvJobsMu.Unlock()
+	})
+
+	batchSize := cfg.BulkShortenMax
+	for start := 0; start < len(reqs); start += batchSize {
+		end := start + batchSize
+		if end > len(reqs) {
+			end = len(reqs)
+		}
+
+		ctx, cancel := context.WithTimeout(parent, 30*time.Second)
+		results, err := createBatch(ctx, reqs[start:end], host)
+		cancel()
+		if err != nil {
+			slog.Error("CSV job failed", "job_id", id, "err", err)
+			updateJob(func(job *CSVJob) {
+				now := time.Now()
+				job.Status = "failed"
+				job.Error = "Database error"
+				job.FinishedAt = &now
+			})
+			return
+		}
+
+		updateJob(func(job *CSVJob) {
+			for _, result := range results {
+				// Report rows relative to the whole file, not the batch
+				result.Index += start
+				if result.Status == http.StatusCreated {
+					job.Created++
+				} else {
+					job.Failed++
+				}
+				job.Results = append(job.Results, result)
+			}
+			job.Processed = end
+		})
+	}
+
+	updateJob(func(job *CSVJob) {
+		now := time.Now()
+		job.Status = "done"
+		job.FinishedAt = &now
+	})
+	slog.Info("CSV job finished", "job_id", id, "rows", len(reqs))
+}
+
+// GET /api/v1/jobs/{id} - job status and results (?format=csv to download)
+func csvJobHandler(w http.ResponseWriter, r *http.Request) {
+	csvJobsMu.RLock()
+	job, ok := csvJobs[r.PathValue("id")]
+	// Other callers' jobs are not found
+	ok = ok && job.owner == callerOwner(r.Context())
+	var snapshot CSVJob
+	if ok {
+		snapshot = *job
+		snapshot.Results = append([]BulkResult(nil), job.Results...)
+	}
+	csvJobsMu.RUnlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "job_not_found", "Job not found")
+		return
+	}
+
+	if r.URL.Query().Get("format") != "csv" {
+		writeJSONWithETag(w, r, http.StatusOK, snapshot)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="ihdas-job-`+snapshot.ID+`.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"row", "status", "short_code", "short_url", "original_url", "error"})
+	for _, result := range snapshot.Results {
+		var code, shortURL, original string
+		if result.Link != nil {
+			code, shortURL, original = result.Link.ShortCode, result.Link.ShortURL, result.Link.OriginalURL
+		}
+		// Row 1 is the header, so data rows start at 2 like in the spreadsheet
+		cw.Write([]string{strconv.Itoa(result.Index + 2), strconv.Itoa(result.Status), code, shortURL, original, result.Error})
+	}
+	cw.Flush()
+}
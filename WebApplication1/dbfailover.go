@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Database failover: every query's outcome is watched from a pgx tracer.
+//
+//   - A read-only error (the primary was demoted under us) or a server
+//     shutdown retires the whole pool: pooled connections are dropped on
+//     their next use rather than left pointing at the old primary.
+//   - A lost connection also marks the database unavailable until a ping
+//     gets through. Meanwhile redirects are served from the cache without
+//     counting clicks, and cache misses get a quick 503 instead of waiting
+//     on a dead host.
+//
+// Either way DATABASE_URL is loaded again (file, Vault or AWS, see
+// secrets.go), so a rotated DSN takes effect without a restart, and host
+// names are resolved afresh on every connect. With several hosts in the DSN
+// and target_session_attrs=read-write, pgx picks whichever is the primary.
+const (
+	dbFailoverCooldown = 10 * time.Second // between pool retirements
+	dbRecoveryTick     = time.Second
+	dbGenerationKey    = "ihdas_generation"
+)
+
+var (
+	// Connections made before the current generation are retired
+	dbGeneration   atomic.Uint64
+	dbLastRetired  atomic.Int64 // unix nanos
+	dbUnavailable  atomic.Bool
+	dbReresolved   atomic.Pointer[pgx.ConnConfig]
+	failoverTracer = &dbFailoverTracer{}
+
+	dbFailovers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ihdas_db_failovers_total",
+		Help: "Connection pool retirements after database errors, by cause (read_only, lost).",
+	}, []string{"cause"})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ihdas_db_unavailable",
+		Help: "1 while the database is unreachable and redirects are served from cache only.",
+	}, func() float64 {
+		if dbUnavailable.Load() {
+			return 1
+		}
+		return 0
+	})
+)
+
+// The pgx connector behind db, with the failover hooks in place
+func newDBConnector(dsn string) (driver.Connector, error) {
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	config.Tracer = failoverTracer
+	return stdlib.GetConnector(*config,
+		stdlib.OptionBeforeConnect(func(ctx context.Context, cc *pgx.ConnConfig) error {
+			if fresh := dbReresolved.Load(); fresh != nil {
+				*cc = *fresh
+			}
+			return nil
+		}),
+		stdlib.OptionAfterConnect(func(ctx context.Context, conn *pgx.Conn) error {
+			conn.PgConn().CustomData()[dbGenerationKey] = dbGeneration.Load()
+			return nil
+		}),
+		stdlib.OptionResetSession(func(ctx context.Context, conn *pgx.Conn) error {
+			if gen, _ := conn.PgConn().CustomData()[dbGenerationKey].(uint64); gen < dbGeneration.Load() {
+				return driver.ErrBadConn
+			}
+			return nil
+		}),
+	), nil
+}
+
+// Whether the database is known to be down right now
+func dbDown() bool {
+	return dbUnavailable.Load()
+}
+
+type dbFailoverTracer struct{}
+
+func (t *dbFailoverTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	return ctx
+}
+
+func (t *dbFailoverTracer) TraceQueryEnd(_ context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	noteDBError(data.Err)
+}
+
+func (t *dbFailoverTracer) TraceConnectStart(ctx context.Context, _ pgx.TraceConnectStartData) context.Context {
+	return ctx
+}
+
+func (t *dbFailoverTracer) TraceConnectEnd(_ context.Context, data pgx.TraceConnectEndData) {
+	noteDBError(data.Err)
+}
+
+func noteDBError(err error) {
+	if err == nil {
+		return
+	}
+	var pgErr *pgconn.PgError
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &pgErr):
+		switch pgErr.Code {
+		case "25006": // read_only_sql_transaction
+			retireDBPool("read_only", err)
+		case "57P01", "57P02", "57P03": // admin_shutdown, crash_shutdown, cannot_connect_now
+			dbLost(err)
+		}
+	case errors.As(err, &connectErr):
+		dbLost(err)
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		// The caller gave up; that says nothing about the server
+	case errors.As(err, &netErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED):
+		dbLost(err)
+	}
+}
+
+// Start a new generation of connections, at most once per cooldown
+func retireDBPool(cause string, err error) {
+	now := time.Now().UnixNano()
+	last := dbLastRetired.Load()
+	if now-last < int64(dbFailoverCooldown) || !dbLastRetired.CompareAndSwap(last, now) {
+		return
+	}
+	dbGeneration.Add(1)
+	dbFailovers.WithLabelValues(cause).Inc()
+	slog.Warn("Database failover suspected, reconnecting", "cause", cause, "err", err)
+	go reresolveDSN()
+}
+
+func dbLost(err error) {
+	retireDBPool("lost", err)
+	if !dbUnavailable.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(dbRecoveryTick)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), dbRecoveryTick)
+			err := db.PingContext(ctx)
+			cancel()
+			if err == nil {
+				dbUnavailable.Store(false)
+				slog.Info("Database reachable again")
+				return
+			}
+		}
+	}()
+}
+
+// Load DATABASE_URL again for new connections. One set in the config file
+// only changes on restart.
+func reresolveDSN() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dsn, err := loadSecret(ctx, "DATABASE_URL")
+	if err != nil {
+		slog.Warn("Re-loading DATABASE_URL failed", "err", err)
+		return
+	}
+	if dsn == "" {
+		return
+	}
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		// pgx errors can echo the DSN back, password and all
+		slog.Warn("Re-loaded DATABASE_URL is not a valid connection string")
+		return
+	}
+	config.Tracer = failoverTracer
+	dbReresolved.Store(config)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Destination checks run on every new link. url.ParseRequestURI on its own
+// happily accepts javascript:, data: and file: URLs.
+const resolveTimeout = 2 * time.Second
+
+// Too long to store is well-formed but unprocessable
+func checkURLLength(rawURL string) error {
+	if limit := cfg.MaxURLLength; len(rawURL) > limit {
+		return &apiError{http.StatusUnprocessableEntity, "url_too_long", "URL must not exceed " + strconv.Itoa(limit) + " bytes"}
+	}
+	return nil
+}
+
+// Syntax-only checks: length, http(s) scheme, a plausible host
+func parseDestination(rawURL string) (*url.URL, error) {
+	if err := checkURLLength(rawURL); err != nil {
+		return nil, err
+	}
+
+	parsed, err := url.ParseRequestURI(rawURL)
+	if err != nil {
+		return nil, &apiError{http.StatusBadRequest, "invalid_url", "Invalid URL"}
+	}
+	if scheme := strings.ToLower(parsed.Scheme); scheme != "http" && scheme != "https" {
+		return nil, &apiError{http.StatusBadRequest, "invalid_scheme", "Only http and https URLs can be shortened"}
+	}
+	if parsed.Hostname() == "" || parsed.User != nil {
+		return nil, &apiError{http.StatusBadRequest, "invalid_host", "URL must have a host and no credentials"}
+	}
+	return parsed, nil
+}
+
+// Full checks for a new destination, including policy lists and DNS.
+// Returns the URL to store: rawURL in canonical form, or the destination
+// of a link on another shortener that was unwrapped.
+func validateDestination(ctx context.Context, rawURL string) (string, error) {
+	parsed, err := parseDestination(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if rawURL, err = canonicalizeDestination(rawURL, parsed); err != nil {
+		return "", err
+	}
+
+	destination, err := checkShortenerDestination(ctx, rawURL, parsed)
+	if err != nil {
+		return "", err
+	}
+	if destination != rawURL {
+		if parsed, err = parseDestination(destination); err != nil {
+			return "", err
+		}
+		if destination, err = canonicalizeDestination(destination, parsed); err != nil {
+			return "", err
+		}
+	}
+	// Punycode and unwrapping can both make it longer
+	if err := checkURLLength(destination); err != nil {
+		return "", err
+	}
+	host := parsed.Hostname()
+
+	if err := checkDomainPolicy(host); err != nil {
+		return "", err
+	}
+	if err := checkDestinationHost(ctx, host); err != nil {
+		return "", err
+	}
+	if err := checkReputation(ctx, destination); err != nil {
+		return "", err
+	}
+	return destination, nil
+}
+
+// Resolve host, and with block_private_destinations refuse any that
+// lands on an internal address
+func checkDestinationHost(ctx context.Context, host string) error {
+	blockPrivate := cfg.BlockPrivateDestinations
+	if blockPrivate && metadataHosts[strings.TrimSuffix(strings.ToLower(host), ".")] {
+		return &apiError{http.StatusForbidden, "private_destination", "Destination points at an internal address"}
+	}
+
+	var addrs []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = []net.IP{ip}
+	} else {
+		ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+		defer cancel()
+		resolved, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil || len(resolved) == 0 {
+			return &apiError{http.StatusBadRequest, "unresolvable_host", "Destination host does not resolve"}
+		}
+		for _, addr := range resolved {
+			addrs = append(addrs, addr.IP)
+		}
+	}
+
+	if blockPrivate {
+		for _, ip := range addrs {
+			if isInternalIP(ip) {
+				return &apiError{http.StatusForbidden, "private_destination", "Destination points at an internal address"}
+			}
+		}
+	}
+	return nil
+}
+
+// Cloud metadata services reachable by name
+var metadataHosts = map[string]bool{
+	"metadata.google.internal": true,
+	"metadata.goog":            true,
+	"metadata":                 true,
+	"instance-data":            true,
+}
+
+// Carrier-grade NAT and the AWS IPv6 metadata endpoint aren't covered by
+// the net.IP helpers
+var internalNets = []*net.IPNet{
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("fd00:ec2::254/128"),
+	mustParseCIDR("0.0.0.0/8"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// Loopback, RFC 1918 / ULA, link-local (incl. 169.254.169.254 metadata),
+// unspecified and multicast addresses
+func isInternalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range internalNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dialer hook that refuses internal addresses at connect time, after DNS,
+// so a host can't pass validation and then rebind to an internal IP
+func blockInternalDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && isInternalIP(ip) {
+		return errors.New("connection to internal address " + host + " refused")
+	}
+	return nil
+}
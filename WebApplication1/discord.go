@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Discord interactions: the app's /shorten and /stats slash commands are
+// delivered to POST /discord/interactions, signed with the application's
+// Ed25519 key (DISCORD_PUBLIC_KEY); without it the endpoint doesn't exist.
+//
+// As with Slack, each Discord server (guild) is connected to an ihdas API
+// key through the admin API. Commands outside a connected server, including
+// direct messages to the app, are refused. The commands themselves are
+// registered with Discord separately:
+//
+//	shorten: url (string, required), code (string)
+//	stats:   code (string, required)
+const (
+	discordMaxBody   = 64 << 10
+	discordClockSkew = 5 * time.Minute
+
+	discordPing               = 1
+	discordApplicationCommand = 2
+
+	discordPong           = 1
+	discordChannelMessage = 4
+
+	discordEphemeral = 1 << 6
+)
+
+var discordGuilds = &chatPlatform{name: "discord", table: "discord_guilds", idColumn: "guild_id"}
+
+type discordInteraction struct {
+	Type    int    `json:"type"`
+	GuildID string `json:"guild_id"`
+	Member  *struct {
+		User struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	} `json:"member"`
+	Data struct {
+		Name    string `json:"name"`
+		Options []struct {
+			Name  string          `json:"name"`
+			Value json.RawMessage `json:"value"`
+		} `json:"options"`
+	} `json:"data"`
+}
+
+// String option by name, empty if absent
+func (in *discordInteraction) option(name string) string {
+	for _, o := range in.Data.Options {
+		if o.Name == name {
+			var s string
+			json.Unmarshal(o.Value, &s)
+			return s
+		}
+	}
+	return ""
+}
+
+type discordResponse struct {
+	Type int                  `json:"type"`
+	Data *discordResponseData `json:"data,omitempty"`
+}
+
+type discordResponseData struct {
+	Content string `json:"content"`
+	Flags   int    `json:"flags,omitempty"`
+}
+
+// Reply to the command; private replies are only shown to the caller
+func discordReply(w http.ResponseWriter, content string, public bool) {
+	data := &discordResponseData{Content: content}
+	if !public {
+		data.Flags = discordEphemeral
+	}
+	writeJSON(w, http.StatusOK, discordResponse{Type: discordChannelMessage, Data: data})
+}
+
+// Check X-Signature-Ed25519 over X-Signature-Timestamp followed by the body
+func verifyDiscordSignature(publicKey ed25519.PublicKey, header http.Header, body []byte, now time.Time) bool {
+	timestamp := header.Get("X-Signature-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := now.Sub(time.Unix(ts, 0)); skew > discordClockSkew || skew < -discordClockSkew {
+		return false
+	}
+	sig, err := hex.DecodeString(header.Get("X-Signature-Ed25519"))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(publicKey, append([]byte(timestamp), body...), sig)
+}
+
+// POST /discord/interactions
+func discordInteractionsHandler(w http.ResponseWriter, r *http.Request) {
+	if cfg.DiscordPublicKey == "" {
+		http.NotFound(w, r)
+		return
+	}
+	// Checked by validate at startup
+	publicKey, _ := hex.DecodeString(cfg.DiscordPublicKey)
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, discordMaxBody))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "body_too_large", "Request body too large")
+		return
+	}
+	// Discord probes the endpoint with bad signatures and expects a 401
+	if !verifyDiscordSignature(publicKey, r.Header, body, time.Now()) {
+		writeError(w, http.StatusUnauthorized, "invalid_signature", "Invalid Discord signature")
+		return
+	}
+	var in discordInteraction
+	if err := json.Unmarshal(body, &in); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Invalid request body")
+		return
+	}
+
+	switch in.Type {
+	case discordPing:
+		writeJSON(w, http.StatusOK, discordResponse{Type: discordPong})
+		return
+	case discordApplicationCommand:
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported_interaction", "Unsupported interaction type")
+		return
+	}
+
+	userID := ""
+	if in.Member != nil {
+		userID = in.Member.User.ID
+	}
+	addLogAttrs(r.Context(), slog.String("discord_guild", in.GuildID), slog.String("discord_user", userID),
+		slog.String("discord_command", in.Data.Name))
+
+	// Like Slack, Discord only shows a 200 with a message to the user
+	if in.GuildID == "" {
+		discordReply(w, "This command only works in a server connected to the link shortener.", false)
+		return
+	}
+	owner, err := discordGuilds.owner(r.Context(), in.GuildID)
+	if err == sql.ErrNoRows {
+		discordReply(w, "This Discord server isn't connected to the link shortener yet.", false)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Discord guild lookup error", "err", err)
+		discordReply(w, "Something went wrong on our side, please try again.", false)
+		return
+	}
+	ctx := context.WithValue(r.Context(), callerOwnerKey, owner)
+
+	switch in.Data.Name {
+	case "shorten":
+		text := strings.TrimSpace(in.option("url") + " " + in.option("code"))
+		reply, ok := runShortenCommand(ctx, "discord:"+in.GuildID, text, r.Host)
+		discordReply(w, reply, ok)
+	case "stats":
+		discordReply(w, discordStats(ctx, in.option("code")), false)
+	default:
+		discordReply(w, "Unknown command.", false)
+	}
+}
+
+// Click count for a code or short URL, as public as GET /api/v1/stats/{code}
+func discordStats(ctx context.Context, code string) string {
+	code = strings.TrimSpace(code)
+	if i := strings.LastIndex(code, "/"); i >= 0 {
+		code = code[i+1:]
+	}
+	shortCode, ok := resolveCode(ctx, code)
+	if !ok || code == "" {
+		return "No short link with that code."
+	}
+	link, err := store.GetLink(ctx, shortCode)
+	if errors.Is(err, ErrLinkNotFound) {
+		return "No short link with that code."
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Database error", "err", err)
+		return "Something went wrong on our side, please try again."
+	}
+	return fmt.Sprintf("%s → <%s>\n%d clicks since %s", code, link.OriginalURL, link.ClickCount,
+		link.CreatedAt.Format("2 Jan 2006"))
+}
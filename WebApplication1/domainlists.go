@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// Destination domain policy, managed through the admin API. Entries match
+// the domain and all of its subdomains. An allowlist entry overrides a
+// block (block example.com, allow docs.example.com); with
+// DOMAIN_ALLOWLIST_ONLY=true nothing outside the allowlist is accepted.
+// Every instance reloads the lists periodically, so changes made elsewhere
+// apply within domainListRefresh.
+const (
+	domainListRefresh = time.Minute
+	domainSweepTick   = time.Hour
+	domainSweepBatch  = 500
+)
+
+type DomainEntry struct {
+	Domain    string    `json:"domain"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type DomainEntryRequest struct {
+	Domain string `json:"domain"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type domainList struct {
+	name  string // "blocklist" or "allowlist", used in logs and reasons
+	table string
+
+	mu      sync.RWMutex
+	domains map[string]bool
+}
+
+var (
+	blocklist = &domainList{name: "blocklist", table: "blocked_domains", domains: map[string]bool{}}
+	allowlist = &domainList{name: "allowlist", table: "allowed_domains", domains: map[string]bool{}}
+)
+
+func initDomainLists() {
+	for _, list := range []*domainList{blocklist, allowlist} {
+		createTable := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			domain TEXT PRIMARY KEY,
+			reason TEXT,
+			created_at TIMESTAMP DEFAULT NOW()
+		);
+		`, list.table)
+
+		if _, err := db.Exec(createTable); err != nil {
+			fatal("Domain list table creation failed", "list", list.name, "err", err)
+		}
+		if err := list.reload(); err != nil {
+			fatal("Domain list load failed", "list", list.name, "err", err)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(domainListRefresh)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, list := range []*domainList{blocklist, allowlist} {
+				if err := list.reload(); err != nil {
+					slog.Error("Domain list reload error", "list", list.name, "err", err)
+				}
+			}
+		}
+	}()
+
+	// Catch links made before a block, including blocks added on other instances
+	go func() {
+		ticker := time.NewTicker(domainSweepTick)
+		defer ticker.Stop()
+		for range ticker.C {
+			if isLeader() {
+				sweepBlockedLinks()
+			}
+		}
+	}()
+}
+
+func (l *domainList) reload() error {
+	rows, err := db.Query(fmt.Sprintf(`SELECT domain FROM %s`, l.table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	domains := map[string]bool{}
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return err
+		}
+		domains[domain] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.domains = domains
+	l.mu.Unlock()
+	return nil
+}
+
+// The entry matching host or one of its parent domains, empty if none
+func (l *domainList) match(host string) string {
+	host = normalizeDomain(host)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for host != "" {
+		if l.domains[host] {
+			return host
+		}
+		_, parent, found := strings.Cut(host, ".")
+		if !found {
+			break
+		}
+		host = parent
+	}
+	return ""
+}
+
+// Lower-case ASCII form, so internationalized names match however they
+// were written
+func normalizeDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if isIDNHost(domain) {
+		if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+			return ascii
+		}
+	}
+	return domain
+}
+
+// Why host may not be shortened, nil when it may
+func checkDomainPolicy(host string) error {
+	if allowlist.match(host) != "" {
+		return nil
+	}
+	if cfg.DomainAllowlistOnly {
+		return &apiError{http.StatusForbidden, "domain_not_allowed", "Destination domain is not on the allowlist"}
+	}
+	if blocklist.match(host) != "" {
+		return &apiError{http.StatusForbidden, "domain_blocked", "Destination domain is blocked"}
+	}
+	return nil
+}
+
+// The blocklisted domain destination is on, empty when it's fine or
+// allowlisted
+func blockedDomain(destination string) string {
+	parsed, err := url.Parse(destination)
+	if err != nil || allowlist.match(parsed.Hostname()) != "" {
+		return ""
+	}
+	return blocklist.match(parsed.Hostname())
+}
+
+// Disable live links to blocked (and not allowlisted) domains. Allowlist-only
+// mode only applies to new links, so turning it on can't mass-disable
+// everything. Destinations may be encrypted at rest, so this walks and
+// decrypts rather than matching in SQL.
+func sweepBlockedLinks() {
+	ctx := context.Background()
+	var afterID int64
+	disabled := 0
+	for {
+		links, err := store.ListLinks(ctx, LinkFilter{Status: "active"}, afterID, domainSweepBatch)
+		if err != nil {
+			slog.Error("Domain sweep error", "err", err)
+			return
+		}
+		if len(links) == 0 {
+			break
+		}
+		afterID = links[len(links)-1].ID
+
+		// Pages and bundles hand out destinations too
+		items, err := pageDestinationURLs(ctx, links)
+		if err != nil {
+			slog.Error("Domain sweep error", "err", err)
+			return
+		}
+		for _, link := range links {
+			domain := blockedDomain(link.OriginalURL)
+			for _, item := range items[link.ShortCode] {
+				if domain != "" {
+					break
+				}
+				domain = blockedDomain(item)
+			}
+			if domain == "" {
+				continue
+			}
+			if err := store.DisableLink(ctx, link.ShortCode, "blocklist:"+domain); err != nil {
+				slog.Error("Disable link error", "short_code", link.ShortCode, "err", err)
+				continue
+			}
+			recordAudit(ctx, actorSystem, "link.disable", link.ShortCode, map[string]interface{}{"reason": "blocklist:" + domain})
+			invalidateCachedURL(ctx, link.ShortCode)
+			emitLinkUpdated(link.ShortCode)
+			disabled++
+		}
+	}
+	if disabled > 0 {
+		slog.Info("Domain sweep disabled links", "count", disabled)
+	}
+}
+
+// Handlers, shared by both lists
+
+// GET /api/v1/admin/{blocklist,allowlist}
+func listDomainsHandler(list *domainList) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+
+		rows, err := db.QueryContext(r.Context(), fmt.Sprintf(
+			`SELECT domain, COALESCE(reason, ''), created_at FROM %s ORDER BY domain`, list.table))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Domain list error", "list", list.name, "err", err)
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		defer rows.Close()
+
+		entries := []DomainEntry{}
+		for rows.Next() {
+			var e DomainEntry
+			if err := rows.Scan(&e.Domain, &e.Reason, &e.CreatedAt); err != nil {
+				slog.ErrorContext(r.Context(), "Domain list error", "list", list.name, "err", err)
+				writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+				return
+			}
+			entries = append(entries, e)
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}
+}
+
+// POST /api/v1/admin/{blocklist,allowlist}
+func addDomainHandler(list *domainList) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+
+		var req DomainEntryRequest
+		if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+			return
+		}
+		domain := normalizeDomain(req.Domain)
+		if domain == "" || strings.ContainsAny(domain, "/:@ ") {
+			writeError(w, http.StatusBadRequest, "invalid_domain", "domain must be a bare host name")
+			return
+		}
+
+		e, err := list.add(r.Context(), domain, req.Reason)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Domain insert error", "list", list.name, "err", err)
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		slog.InfoContext(r.Context(), "Admin added domain", "list", list.name, "domain", domain)
+		auditAdmin(r, list.name+".add", domain, map[string]interface{}{"reason": req.Reason})
+		writeJSON(w, http.StatusCreated, e)
+	}
+}
+
+// Add or update an entry; blocking also sweeps existing links
+func (l *domainList) add(ctx context.Context, domain, reason string) (DomainEntry, error) {
+	e := DomainEntry{Domain: domain, Reason: reason}
+	err := db.QueryRowContext(ctx, fmt.Sprintf(
+		`INSERT INTO %s (domain, reason) VALUES ($1, NULLIF($2, ''))
+		 ON CONFLICT (domain) DO UPDATE SET reason = EXCLUDED.reason
+		 RETURNING created_at`, l.table), domain, reason).Scan(&e.CreatedAt)
+	if err != nil {
+		return e, err
+	}
+
+	l.mu.Lock()
+	l.domains[domain] = true
+	l.mu.Unlock()
+
+	if l == blocklist {
+		go sweepBlockedLinks()
+	}
+	return e, nil
+}
+
+// DELETE /api/v1/admin/{blocklist,allowlist}/{domain}
+func removeDomainHandler(list *domainList) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+
+		domain := normalizeDomain(r.PathValue("domain"))
+		result, err := db.ExecContext(r.Context(), fmt.Sprintf(`DELETE FROM %s WHERE domain = $1`, list.table), domain)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Domain delete error", "list", list.name, "err", err)
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			writeError(w, http.StatusNotFound, "domain_not_listed", "Domain is not on the "+list.name)
+			return
+		}
+
+		list.mu.Lock()
+		delete(list.domains, domain)
+		list.mu.Unlock()
+		// Links disabled by a block stay disabled when it is lifted
+		slog.InfoContext(r.Context(), "Admin removed domain", "list", list.name, "domain", domain)
+		auditAdmin(r, list.name+".remove", domain, nil)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Custom short-link domains. An owner registers a domain, proves control of
+// it (see domainverify.go), then creates links with "domain" set; those links are
+// served only on that host (https://go.example.com/launch) and nowhere
+// else, and links without a domain aren't served on custom domains.
+// Short codes stay unique across all domains, except in namespaces (see
+// namespaces.go), which are registered here too. Every instance reloads the
+// registry periodically, like the domain lists.
+type CustomDomain struct {
+	Domain        string              `json:"domain"`
+	Status        string              `json:"status"` // pending, verified or failing
+	Verification  *DomainVerification `json:"verification,omitempty"`
+	VerifiedAt    *time.Time          `json:"verified_at,omitempty"`
+	LastCheckedAt *time.Time          `json:"last_checked_at,omitempty"`
+	LastError     string              `json:"last_error,omitempty"`
+	CreatedAt     time.Time           `json:"created_at"`
+}
+
+type CustomDomainRequest struct {
+	Domain string `json:"domain"`
+}
+
+var customDomains = struct {
+	mu       sync.RWMutex
+	owners   map[string]string // verified domain -> owner
+	settings map[string]DomainSettings
+}{owners: map[string]string{}, settings: map[string]DomainSettings{}}
+
+// Columns behind a CustomDomain, for scanCustomDomain
+const customDomainColumns = `domain, verification_token, verified_at, failing_since, last_checked_at, COALESCE(last_error, ''), created_at`
+
+func initCustomDomains() {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS custom_domains (
+		domain TEXT PRIMARY KEY,
+		owner TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT NOW()
+	);
+	ALTER TABLE custom_domains ADD COLUMN IF NOT EXISTS verification_token TEXT;
+	ALTER TABLE custom_domains ADD COLUMN IF NOT EXISTS verified_at TIMESTAMP;
+	ALTER TABLE custom_domains ADD COLUMN IF NOT EXISTS failing_since TIMESTAMP;
+	ALTER TABLE custom_domains ADD COLUMN IF NOT EXISTS last_checked_at TIMESTAMP;
+	ALTER TABLE custom_domains ADD COLUMN IF NOT EXISTS last_error TEXT;
+	ALTER TABLE custom_domains ADD COLUMN IF NOT EXISTS redirect_status INTEGER NOT NULL DEFAULT 301;
+	ALTER TABLE custom_domains ADD COLUMN IF NOT EXISTS not_found_url TEXT;
+	ALTER TABLE custom_domains ADD COLUMN IF NOT EXISTS interstitial BOOLEAN NOT NULL DEFAULT FALSE;
+	CREATE INDEX IF NOT EXISTS idx_custom_domains_owner ON custom_domains(owner);
+	CREATE INDEX IF NOT EXISTS idx_urls_domain ON urls(domain) WHERE domain IS NOT NULL;
+	`
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Custom domains table creation failed", "err", err)
+	}
+	// Domains registered before verification existed stay active and get a
+	// token for re-verification; namespace hosts need none
+	if _, err := db.Exec(`
+		UPDATE custom_domains SET verified_at = created_at,
+			verification_token = CASE WHEN $1 <> '' AND right(domain, length($1)) = $1 THEN '' ELSE md5(random()::text || domain) END
+		WHERE verification_token IS NULL`, "."+normalizeDomain(cfg.NamespaceDomain)); err != nil {
+		fatal("Custom domains migration failed", "err", err)
+	}
+	if err := reloadCustomDomains(); err != nil {
+		fatal("Custom domains load failed", "err", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(domainListRefresh)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := reloadCustomDomains(); err != nil {
+				slog.Error("Custom domains reload error", "err", err)
+			}
+		}
+	}()
+}
+
+func reloadCustomDomains() error {
+	rows, err := db.Query(`SELECT domain, owner, redirect_status, COALESCE(not_found_url, ''), interstitial
+		FROM custom_domains WHERE verified_at IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	owners := map[string]string{}
+	settings := map[string]DomainSettings{}
+	for rows.Next() {
+		var domain, owner string
+		var s DomainSettings
+		if err := rows.Scan(&domain, &owner, &s.RedirectStatus, &s.NotFoundURL, &s.Interstitial); err != nil {
+			return err
+		}
+		owners[domain] = owner
+		settings[domain] = s
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	customDomains.mu.Lock()
+	customDomains.owners = owners
+	customDomains.settings = settings
+	customDomains.mu.Unlock()
+	return nil
+}
+
+// Owner of a verified custom domain, empty if it isn't one
+func customDomainOwner(domain string) string {
+	customDomains.mu.RLock()
+	defer customDomains.mu.RUnlock()
+	return customDomains.owners[domain]
+}
+
+// The custom domain host[:port] names, empty for the service's own hosts
+func customDomainHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = normalizeDomain(host)
+	if customDomainOwner(host) == "" {
+		return ""
+	}
+	return host
+}
+
+// The custom domain a request arrived on, empty for the service's own hosts
+func requestDomain(r *http.Request) string {
+	return customDomainHost(r.Host)
+}
+
+// Host a link's short URL is built on. Tenant links fall back to one of
+// the tenant's hosts rather than another tenant's or the service's.
+func linkHost(link *Link, fallback string) string {
+	if link.Domain != "" {
+		return link.Domain
+	}
+	if t := codeTenant(link.ShortCode); t != "" && tenantByHost(fallback) != t {
+		if h := tenantPrimaryHost(t); h != "" {
+			return h
+		}
+	}
+	return fallback
+}
+
+// Check a create request's domain against the caller's registrations
+func checkLinkDomain(ctx context.Context, domain string) (string, error) {
+	domain = normalizeDomain(domain)
+	if domain == "" {
+		return "", nil
+	}
+	owner := callerOwner(ctx)
+	if owner == "" || customDomainOwner(domain) != owner {
+		return "", &apiError{http.StatusBadRequest, "unknown_domain", "domain is not one of your custom domains"}
+	}
+	return domain, nil
+}
+
+// GET /api/v1/domains
+func listCustomDomainsHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	domains, err := ownerCustomDomains(r.Context(), owner)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Custom domain list error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, domains)
+}
+
+// All of an owner's domains, namespace hosts included
+func ownerCustomDomains(ctx context.Context, owner string) ([]CustomDomain, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+customDomainColumns+` FROM custom_domains WHERE owner = $1 ORDER BY domain`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	domains := []CustomDomain{}
+	for rows.Next() {
+		d, err := scanCustomDomain(rows)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, *d)
+	}
+	return domains, rows.Err()
+}
+
+func scanCustomDomain(row interface{ Scan(...interface{}) error }) (*CustomDomain, error) {
+	var d CustomDomain
+	var token string
+	var failingSince *time.Time
+	if err := row.Scan(&d.Domain, &token, &d.VerifiedAt, &failingSince, &d.LastCheckedAt, &d.LastError, &d.CreatedAt); err != nil {
+		return nil, err
+	}
+	switch {
+	case d.VerifiedAt == nil:
+		d.Status = "pending"
+	case failingSince != nil:
+		d.Status = "failing"
+	default:
+		d.Status = "verified"
+	}
+	if token != "" {
+		d.Verification = domainVerification(d.Domain, token)
+	}
+	return &d, nil
+}
+
+// GET /api/v1/domains/{domain} - verification status and instructions
+func getCustomDomainHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return
+	}
+	d, err := scanCustomDomain(db.QueryRowContext(r.Context(),
+		`SELECT `+customDomainColumns+` FROM custom_domains WHERE domain = $1 AND owner = $2`,
+		normalizeDomain(r.PathValue("domain")), owner))
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "domain_not_found", "Custom domain not found")
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Custom domain get error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+// POST /api/v1/domains
+func addCustomDomainHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	var req CustomDomainRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	domain := normalizeDomain(req.Domain)
+	if domain == "" || !strings.Contains(domain, ".") || strings.ContainsAny(domain, "/:@ ") {
+		writeError(w, http.StatusBadRequest, "invalid_domain", "domain must be a bare host name")
+		return
+	}
+	if domain == normalizeDomain(publicHost()) {
+		writeError(w, http.StatusBadRequest, "invalid_domain", "domain is the service's own host")
+		return
+	}
+	if tenantByHost(domain) != "" {
+		writeError(w, http.StatusConflict, "domain_taken", "Domain is already registered")
+		return
+	}
+	if domain == normalizeDomain(cfg.NamespaceDomain) || hostNamespace(domain) != "" {
+		writeError(w, http.StatusBadRequest, "invalid_domain", "register subdomains of the namespace domain as namespaces")
+		return
+	}
+
+	d, taken, err := insertCustomDomain(r.Context(), domain, owner, false)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Custom domain insert error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if taken {
+		writeError(w, http.StatusConflict, "domain_taken", "Domain is already registered")
+		return
+	}
+	auditCaller(r.Context(), "domain.add", domain, nil)
+	writeJSON(w, http.StatusCreated, d)
+}
+
+// Register domain for owner; taken when someone already has it, even
+// unverified. Pre-verified domains (namespace hosts) are active at once,
+// the rest start pending with a verification token.
+func insertCustomDomain(ctx context.Context, domain, owner string, verified bool) (*CustomDomain, bool, error) {
+	token := ""
+	if !verified {
+		token = newVerificationToken()
+	}
+	d, err := scanCustomDomain(db.QueryRowContext(ctx,
+		`INSERT INTO custom_domains (domain, owner, verification_token, verified_at)
+		 VALUES ($1, $2, $3, CASE WHEN $4 THEN NOW() END)
+		 ON CONFLICT (domain) DO NOTHING
+		 RETURNING `+customDomainColumns, domain, owner, token, verified))
+	if err == sql.ErrNoRows {
+		return nil, true, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if verified {
+		customDomains.mu.Lock()
+		customDomains.owners[domain] = owner
+		customDomains.mu.Unlock()
+	}
+	return d, false, nil
+}
+
+// DELETE /api/v1/domains/{domain} - only once no links use it, so none
+// silently stop resolving
+func deleteCustomDomainHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return
+	}
+	domain := normalizeDomain(r.PathValue("domain"))
+
+	found, inUse, err := removeCustomDomain(r.Context(), domain, owner)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Custom domain delete error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if inUse {
+		writeError(w, http.StatusConflict, "domain_in_use", "Delete the domain's links first")
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "domain_not_found", "Custom domain not found")
+		return
+	}
+	auditCaller(r.Context(), "domain.delete", domain, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Remove owner's domain unless links still use it
+func removeCustomDomain(ctx context.Context, domain, owner string) (found, inUse bool, err error) {
+	result, err := db.ExecContext(ctx,
+		`DELETE FROM custom_domains WHERE domain = $1 AND owner = $2
+		 AND NOT EXISTS (SELECT 1 FROM urls WHERE domain = $1)`, domain, owner)
+	if err != nil {
+		return false, false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		// Either not the owner's, or still in use
+		var exists bool
+		err := db.QueryRowContext(ctx,
+			`SELECT EXISTS (SELECT 1 FROM custom_domains WHERE domain = $1 AND owner = $2)`, domain, owner).Scan(&exists)
+		return exists, exists, err
+	}
+
+	customDomains.mu.Lock()
+	delete(customDomains.owners, domain)
+	delete(customDomains.settings, domain)
+	customDomains.mu.Unlock()
+	return true, false, nil
+}
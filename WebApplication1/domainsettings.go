@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Per-domain behavior for links served on a custom domain or namespace:
+// the redirect status, a page for unknown codes, and an interstitial that
+// names the destination before sending visitors on. The service's own hosts
+// keep the defaults. Settings travel with the custom domain registry, and
+// clicks record the domain they arrived on for per-domain stats.
+const (
+	domainStatsDefaultDays = 30
+	domainStatsMaxDays     = 365
+	domainStatsTopLinks    = 10
+)
+
+var allowedRedirectStatuses = map[int]bool{
+	http.StatusMovedPermanently: true, http.StatusFound: true,
+	http.StatusTemporaryRedirect: true, http.StatusPermanentRedirect: true,
+}
+
+var defaultDomainSettings = DomainSettings{RedirectStatus: http.StatusMovedPermanently}
+
+type DomainSettings struct {
+	RedirectStatus int    `json:"redirect_status"`
+	NotFoundURL    string `json:"not_found_url,omitempty"` // unknown codes are sent here
+	Interstitial   bool   `json:"interstitial"`
+}
+
+type DomainSettingsRequest struct {
+	RedirectStatus *int    `json:"redirect_status,omitempty"`
+	NotFoundURL    *string `json:"not_found_url,omitempty"` // "" clears it
+	Interstitial   *bool   `json:"interstitial,omitempty"`
+}
+
+type DomainStats struct {
+	Domain      string        `json:"domain"`
+	Links       int64         `json:"links"`
+	TotalClicks int64         `json:"total_clicks"` // all time
+	Days        int           `json:"days"`
+	Daily       []DailyClicks `json:"daily"`
+	TopLinks    []LinkClicks  `json:"top_links"`
+}
+
+type DailyClicks struct {
+	Date   string `json:"date"`
+	Clicks int64  `json:"clicks"`
+}
+
+type LinkClicks struct {
+	ShortCode string `json:"short_code"`
+	Clicks    int64  `json:"clicks"`
+}
+
+// Settings for the domain a request arrived on ("" for the service's own)
+func domainSettings(domain string) DomainSettings {
+	customDomains.mu.RLock()
+	defer customDomains.mu.RUnlock()
+	if s, ok := customDomains.settings[domain]; ok {
+		return s
+	}
+	return defaultDomainSettings
+}
+
+// Send a visitor on to destination the way the domain is set up to
+func serveRedirect(w http.ResponseWriter, r *http.Request, destination string, settings DomainSettings) {
+	if !settings.Interstitial {
+		http.Redirect(w, r, destination, settings.RedirectStatus)
+		return
+	}
+	t := localizer(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	dest, shown := html.EscapeString(destination), destination
+	if d := displayURL(destination); d != "" {
+		shown = d
+	}
+	fmt.Fprintf(w, `<!doctype html><html lang="%s"><title>%s</title>
+<p>%s</p>
+<p><a href="%s" rel="nofollow noopener">%s</a></p>
+<p><a href="%s" rel="nofollow noopener">%s</a></p>`, w.Header().Get("Content-Language"),
+		html.EscapeString(t("interstitial.title", r.Host)), html.EscapeString(t("interstitial.message")),
+		dest, html.EscapeString(shown), dest, html.EscapeString(t("continue")))
+}
+
+// Unknown codes stay 404s (so enumeration counting still sees them), with
+// the domain's page linked and refreshed to when it has one
+func serveNotFound(w http.ResponseWriter, r *http.Request, settings DomainSettings) {
+	if settings.NotFoundURL == "" {
+		serveErrorPage(w, r, http.StatusNotFound, "not_found.message")
+		return
+	}
+	t := localizer(w, r)
+	page := html.EscapeString(settings.NotFoundURL)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, `<!doctype html><html lang="%s"><title>%s</title>
+<meta http-equiv="refresh" content="0;url=%s">
+<p>%s <a href="%s">%s</a></p>`, w.Header().Get("Content-Language"), html.EscapeString(t("not_found.title")),
+		page, html.EscapeString(t("not_found.message")), page, html.EscapeString(t("continue")))
+}
+
+// Whether owner has domain registered; writes the error response if not
+func ownsCustomDomain(w http.ResponseWriter, r *http.Request, owner, domain string) bool {
+	var exists bool
+	if err := db.QueryRowContext(r.Context(),
+		`SELECT EXISTS (SELECT 1 FROM custom_domains WHERE domain = $1 AND owner = $2)`, domain, owner).Scan(&exists); err != nil {
+		slog.ErrorContext(r.Context(), "Custom domain lookup error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return false
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "domain_not_found", "Custom domain not found")
+	}
+	return exists
+}
+
+// GET /api/v1/domains/{domain}/settings
+func getDomainSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return
+	}
+	var s DomainSettings
+	err := db.QueryRowContext(r.Context(),
+		`SELECT redirect_status, COALESCE(not_found_url, ''), interstitial FROM custom_domains
+		 WHERE domain = $1 AND owner = $2`, normalizeDomain(r.PathValue("domain")), owner).
+		Scan(&s.RedirectStatus, &s.NotFoundURL, &s.Interstitial)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "domain_not_found", "Custom domain not found")
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Domain settings error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+// PUT /api/v1/domains/{domain}/settings - fields left out keep their values
+func putDomainSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return
+	}
+	domain := normalizeDomain(r.PathValue("domain"))
+
+	var req DomainSettingsRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	if req.RedirectStatus != nil && !allowedRedirectStatuses[*req.RedirectStatus] {
+		writeError(w, http.StatusBadRequest, "invalid_redirect_status", "redirect_status must be 301, 302, 307 or 308")
+		return
+	}
+	if req.NotFoundURL != nil && *req.NotFoundURL != "" {
+		if _, err := parseDestination(*req.NotFoundURL); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_url", "not_found_url: "+err.Error())
+			return
+		}
+	}
+
+	var s DomainSettings
+	err := db.QueryRowContext(r.Context(),
+		`UPDATE custom_domains SET redirect_status = COALESCE($3, redirect_status),
+			not_found_url = CASE WHEN $4::TEXT IS NULL THEN not_found_url ELSE NULLIF($4, '') END,
+			interstitial = COALESCE($5, interstitial)
+		 WHERE domain = $1 AND owner = $2
+		 RETURNING redirect_status, COALESCE(not_found_url, ''), interstitial`,
+		domain, owner, req.RedirectStatus, req.NotFoundURL, req.Interstitial).
+		Scan(&s.RedirectStatus, &s.NotFoundURL, &s.Interstitial)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "domain_not_found", "Custom domain not found")
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Domain settings error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	customDomains.mu.Lock()
+	if _, active := customDomains.owners[domain]; active {
+		customDomains.settings[domain] = s
+	}
+	customDomains.mu.Unlock()
+	auditCaller(r.Context(), "domain.settings", domain, map[string]interface{}{
+		"redirect_status": s.RedirectStatus, "not_found_url": s.NotFoundURL, "interstitial": s.Interstitial,
+	})
+	writeJSON(w, http.StatusOK, s)
+}
+
+// GET /api/v1/domains/{domain}/stats?days=30 - daily clicks and top links
+// over the last days, counted from the clicks recorded on the domain
+func domainStatsHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return
+	}
+	domain := normalizeDomain(r.PathValue("domain"))
+	days := domainStatsDefaultDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > domainStatsMaxDays {
+			writeError(w, http.StatusBadRequest, "invalid_days", fmt.Sprintf("days must be between 1 and %d", domainStatsMaxDays))
+			return
+		}
+		days = n
+	}
+	if !ownsCustomDomain(w, r, owner, domain) {
+		return
+	}
+
+	stats, err := queryDomainStats(r.Context(), domain, days)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Domain stats error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func queryDomainStats(ctx context.Context, domain string, days int) (*DomainStats, error) {
+	stats := &DomainStats{Domain: domain, Days: days, Daily: []DailyClicks{}, TopLinks: []LinkClicks{}}
+	if err := db.QueryRowContext(ctx,
+		`SELECT COUNT(*), COALESCE(SUM(click_count), 0) FROM urls WHERE domain = $1`, domain).
+		Scan(&stats.Links, &stats.TotalClicks); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT d, COUNT(c.id) FROM generate_series(date_trunc('day', NOW()) - make_interval(days => $2 - 1),
+			date_trunc('day', NOW()), INTERVAL '1 day') AS d
+		 LEFT JOIN click_events c ON c.domain = $1 AND c.clicked_at >= d AND c.clicked_at < d + INTERVAL '1 day'
+			AND c.suspicious IS NULL
+		 GROUP BY d ORDER BY d`, domain, days)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day time.Time
+		var clicks int64
+		if err := rows.Scan(&day, &clicks); err != nil {
+			return nil, err
+		}
+		stats.Daily = append(stats.Daily, DailyClicks{Date: day.Format(time.DateOnly), Clicks: clicks})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = db.QueryContext(ctx,
+		`SELECT short_code, COUNT(*) FROM click_events
+		 WHERE domain = $1 AND clicked_at >= date_trunc('day', NOW()) - make_interval(days => $2 - 1)
+		   AND suspicious IS NULL
+		 GROUP BY short_code ORDER BY 2 DESC LIMIT $3`, domain, days, domainStatsTopLinks)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var l LinkClicks
+		if err := rows.Scan(&l.ShortCode, &l.Clicks); err != nil {
+			return nil, err
+		}
+		stats.TopLinks = append(stats.TopLinks, l)
+	}
+	return stats, rows.Err()
+}
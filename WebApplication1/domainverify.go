@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Custom domains start pending and only serve links once the owner proves
+// control, by either
+//
+//	a TXT record  _ihdas-verify.<domain>  "ihdas-verify=<token>", or
+//	http://<domain>/.well-known/ihdas-domain-verification answering the same.
+//
+// The HTTP challenge is answered by the service itself, so it passes as soon
+// as the domain points here; the TXT record also works before the CNAME.
+// Pending domains are retried every sweep and dropped after
+// domainPendingTTL. Verified domains are re-checked every
+// domainReverifyInterval and deactivated after failing for
+// domainFailureGrace; their links come back if a later check passes.
+const (
+	domainVerifyTick       = 10 * time.Minute
+	domainVerifyBatch      = 50
+	domainVerifyTimeout    = 10 * time.Second
+	domainReverifyInterval = 24 * time.Hour
+	domainFailureGrace     = 72 * time.Hour
+	domainPendingTTL       = 7 * 24 * time.Hour
+
+	domainTXTPrefix     = "_ihdas-verify."
+	domainTokenPrefix   = "ihdas-verify="
+	domainChallengePath = "/.well-known/ihdas-domain-verification"
+)
+
+type DomainVerification struct {
+	TXTName  string `json:"txt_name"`
+	TXTValue string `json:"txt_value"`
+	HTTPURL  string `json:"http_url"`
+}
+
+func domainVerification(domain, token string) *DomainVerification {
+	return &DomainVerification{
+		TXTName:  domainTXTPrefix + domain,
+		TXTValue: domainTokenPrefix + token,
+		HTTPURL:  "http://" + domain + domainChallengePath,
+	}
+}
+
+func newVerificationToken() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// Built on first use, once the configuration is loaded
+var domainCheckClient = sync.OnceValue(func() *http.Client {
+	if !cfg.BlockPrivateDestinations {
+		return &http.Client{Timeout: domainVerifyTimeout}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: domainVerifyTimeout, Control: blockInternalDial}).DialContext
+	return &http.Client{Timeout: domainVerifyTimeout, Transport: transport}
+})
+
+func initDomainVerification() {
+	go func() {
+		ticker := time.NewTicker(domainVerifyTick)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !isLeader() {
+				continue
+			}
+			if err := sweepDomainVerification(context.Background()); err != nil {
+				slog.Error("Domain verification sweep error", "err", err)
+			}
+		}
+	}()
+}
+
+// Either check passing is enough; the TXT error is the one reported
+func checkDomainControl(ctx context.Context, domain, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, domainVerifyTimeout)
+	defer cancel()
+
+	want := domainTokenPrefix + token
+	records, txtErr := net.DefaultResolver.LookupTXT(ctx, domainTXTPrefix+domain)
+	if txtErr == nil && slices.Contains(records, want) {
+		return nil
+	}
+	if txtErr == nil {
+		txtErr = fmt.Errorf("no TXT record %s with the expected value", domainTXTPrefix+domain)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+domain+domainChallengePath, nil)
+	if err != nil {
+		return txtErr
+	}
+	resp, err := domainCheckClient().Do(req)
+	if err != nil {
+		return txtErr
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode == http.StatusOK && strings.TrimSpace(string(body)) == want {
+		return nil
+	}
+	return txtErr
+}
+
+// Check one domain and record the outcome
+func verifyCustomDomain(ctx context.Context, domain, owner, token string) error {
+	checkErr := checkDomainControl(ctx, domain, token)
+	if checkErr == nil {
+		// Both timestamps are NOW() only when this check verified it
+		var newlyVerified bool
+		err := db.QueryRowContext(ctx,
+			`UPDATE custom_domains SET last_checked_at = NOW(), last_error = NULL, failing_since = NULL,
+				verified_at = COALESCE(verified_at, NOW())
+			 WHERE domain = $1
+			 RETURNING verified_at = last_checked_at`, domain).Scan(&newlyVerified)
+		if err != nil {
+			return err
+		}
+		customDomains.mu.Lock()
+		customDomains.owners[domain] = owner
+		customDomains.mu.Unlock()
+		if newlyVerified {
+			recordAudit(ctx, actorSystem, "domain.verify", domain, map[string]interface{}{"owner": owner})
+		}
+		return nil
+	}
+
+	// Verified domains get a grace period before their links stop resolving
+	var deactivated bool
+	err := db.QueryRowContext(ctx,
+		`UPDATE custom_domains SET last_checked_at = NOW(), last_error = $2,
+			failing_since = CASE WHEN verified_at IS NULL THEN NULL ELSE COALESCE(failing_since, NOW()) END,
+			verified_at = CASE WHEN failing_since < NOW() - make_interval(secs => $3) THEN NULL ELSE verified_at END
+		 WHERE domain = $1
+		 RETURNING verified_at IS NULL AND failing_since IS NOT NULL`,
+		domain, checkErr.Error(), domainFailureGrace.Seconds()).Scan(&deactivated)
+	if err != nil {
+		return err
+	}
+	if deactivated {
+		// Start the next failure period afresh if it's re-verified
+		if _, err := db.ExecContext(ctx, `UPDATE custom_domains SET failing_since = NULL WHERE domain = $1`, domain); err != nil {
+			return err
+		}
+		customDomains.mu.Lock()
+		delete(customDomains.owners, domain)
+		delete(customDomains.settings, domain)
+		customDomains.mu.Unlock()
+		recordAudit(ctx, actorSystem, "domain.deactivate", domain, map[string]interface{}{"owner": owner, "error": checkErr.Error()})
+		slog.InfoContext(ctx, "Deactivated custom domain", "domain", domain, "err", checkErr)
+	}
+	return nil
+}
+
+// Claim the domains due for a check, so concurrent instances split the work
+func sweepDomainVerification(ctx context.Context) error {
+	if _, err := db.ExecContext(ctx,
+		`DELETE FROM custom_domains WHERE verified_at IS NULL AND created_at < NOW() - make_interval(secs => $1)`,
+		domainPendingTTL.Seconds()); err != nil {
+		return err
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`UPDATE custom_domains SET last_checked_at = NOW()
+		 WHERE domain IN (
+			SELECT domain FROM custom_domains
+			WHERE verification_token <> ''
+			  AND (last_checked_at IS NULL
+			       OR (verified_at IS NULL AND last_checked_at < NOW() - make_interval(secs => $1))
+			       OR last_checked_at < NOW() - make_interval(secs => $2))
+			ORDER BY last_checked_at NULLS FIRST
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED)
+		 RETURNING domain, owner, verification_token`,
+		domainVerifyTick.Seconds()/2, domainReverifyInterval.Seconds(), domainVerifyBatch)
+	if err != nil {
+		return err
+	}
+	type due struct{ domain, owner, token string }
+	var domains []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.domain, &d.owner, &d.token); err != nil {
+			rows.Close()
+			return err
+		}
+		domains = append(domains, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range domains {
+		if err := verifyCustomDomain(ctx, d.domain, d.owner, d.token); err != nil {
+			slog.Error("Domain verification error", "domain", d.domain, "err", err)
+		}
+	}
+	return nil
+}
+
+// POST /api/v1/domains/{domain}/verify - check now instead of waiting for
+// the sweep; the response carries the outcome
+func verifyCustomDomainHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return
+	}
+	domain := normalizeDomain(r.PathValue("domain"))
+
+	var token string
+	err := db.QueryRowContext(r.Context(),
+		`SELECT verification_token FROM custom_domains WHERE domain = $1 AND owner = $2`, domain, owner).Scan(&token)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "domain_not_found", "Custom domain not found")
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Custom domain verify error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if token != "" {
+		if err := verifyCustomDomain(r.Context(), domain, owner, token); err != nil {
+			slog.ErrorContext(r.Context(), "Custom domain verify error", "err", err)
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+	}
+
+	d, err := scanCustomDomain(db.QueryRowContext(r.Context(),
+		`SELECT `+customDomainColumns+` FROM custom_domains WHERE domain = $1`, domain))
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "domain_not_found", "Custom domain not found")
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Custom domain verify error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+// GET /.well-known/ihdas-domain-verification - the HTTP challenge, answered
+// for whichever registered domain the request arrived on
+func domainChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	var token string
+	err := db.QueryRowContext(r.Context(),
+		`SELECT verification_token FROM custom_domains WHERE domain = $1 AND verification_token <> ''`,
+		normalizeDomain(host)).Scan(&token)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			slog.ErrorContext(r.Context(), "Domain challenge error", "err", err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, domainTokenPrefix+token+"\n")
+}
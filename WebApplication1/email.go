@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Outgoing email over SMTP. STARTTLS is used whenever the server offers it
+// and SMTP_PASSWORD, when set, authenticates with PLAIN (which net/smtp only
+// sends over TLS or to localhost). Without SMTP_HOST nothing is sent.
+type emailMessage struct {
+	To      string
+	Subject string
+	Body    string // plain text
+	// One-click unsubscribe (RFC 8058) URL, if the mail is optional
+	Unsubscribe string
+}
+
+func emailEnabled() bool {
+	return cfg.SMTPHost != ""
+}
+
+func sendEmail(ctx context.Context, msg emailMessage) error {
+	if !emailEnabled() {
+		return fmt.Errorf("email is not configured")
+	}
+
+	var buf bytes.Buffer
+	id := make([]byte, 12)
+	rand.Read(id)
+	from := cfg.EmailFrom
+	headers := [][2]string{
+		{"From", from},
+		{"To", msg.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", hex.EncodeToString(id), emailDomain(from))},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "8bit"},
+	}
+	if msg.Unsubscribe != "" {
+		headers = append(headers,
+			[2]string{"List-Unsubscribe", "<" + msg.Unsubscribe + ">"},
+			[2]string{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"})
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], h[1])
+	}
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if cfg.SMTPPassword != "" {
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+	addr := net.JoinHostPort(cfg.SMTPHost, fmt.Sprint(cfg.SMTPPort))
+
+	// smtp.SendMail takes no context, so bound it from outside
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(addr, auth, emailAddress(from), []string{msg.To}, buf.Bytes()) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// "Ihdas <noreply@ihd.as>" -> "noreply@ihd.as"
+func emailAddress(s string) string {
+	if addr, err := mail.ParseAddress(s); err == nil {
+		return addr.Address
+	}
+	return s
+}
+
+func emailDomain(s string) string {
+	_, domain, _ := strings.Cut(emailAddress(s), "@")
+	return domain
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Summary report emails. Owners opt in with summary_reports "weekly" or
+// "monthly" in PUT /api/v1/notifications and, after each finished week
+// (Monday to Monday, UTC) or calendar month, get their clicks with the change
+// on the period before, new links and top links. Suspicious clicks don't
+// count. The body is the summary_report.txt template under static/, which
+// static_dir can replace. Reports with nothing in them aren't sent.
+const (
+	summaryOff     = "off"
+	summaryWeekly  = "weekly"
+	summaryMonthly = "monthly"
+
+	summaryReportTick  = time.Hour
+	summaryReportBatch = 500
+	summaryTopLinks    = 5
+)
+
+var summaryFrequencies = []string{summaryOff, summaryWeekly, summaryMonthly}
+
+var summaryUnits = map[string]string{summaryWeekly: "week", summaryMonthly: "month"}
+
+type summaryReport struct {
+	Period, Unit     string // "weekly" and "week", or "monthly" and "month"
+	From, To         string
+	Clicks, NewLinks int64
+	Trend            string // "+12%", "-3%", empty without a previous period to compare
+	TopLinks         []summaryLink
+	Unsubscribe      string
+}
+
+type summaryLink struct {
+	ShortURL, OriginalURL string
+	Clicks                int64
+}
+
+func initSummaryReports() {
+	createTable := `
+	ALTER TABLE notification_preferences ADD COLUMN IF NOT EXISTS summary_reports TEXT NOT NULL DEFAULT 'off';
+	CREATE TABLE IF NOT EXISTS summary_reports_sent (
+		owner TEXT NOT NULL,
+		frequency TEXT NOT NULL,
+		period_start TIMESTAMP NOT NULL,
+		sent_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (owner, frequency, period_start)
+	);
+	`
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Summary report tables creation failed", "err", err)
+	}
+	if !emailEnabled() {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(summaryReportTick)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !isLeader() {
+				continue
+			}
+			for _, frequency := range []string{summaryWeekly, summaryMonthly} {
+				if err := sendSummaryReports(context.Background(), frequency, time.Now()); err != nil {
+					slog.Error("Summary report sweep error", "frequency", frequency, "err", err)
+				}
+			}
+		}
+	}()
+}
+
+// The last finished period before now, and the one before that
+func summaryPeriod(frequency string, now time.Time) (prevStart, start, end time.Time) {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if frequency == summaryWeekly {
+		end = day.AddDate(0, 0, -(int(day.Weekday())+6)%7) // this Monday
+		return end.AddDate(0, 0, -14), end.AddDate(0, 0, -7), end
+	}
+	end = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return end.AddDate(0, -2, 0), end.AddDate(0, -1, 0), end
+}
+
+func sendSummaryReports(ctx context.Context, frequency string, now time.Time) error {
+	prevStart, start, end := summaryPeriod(frequency, now)
+	rows, err := db.QueryContext(ctx,
+		`SELECT p.owner, p.email, p.unsubscribe_token FROM notification_preferences p
+		 WHERE p.summary_reports = $1
+		   AND NOT EXISTS (SELECT 1 FROM summary_reports_sent s
+		                   WHERE s.owner = p.owner AND s.frequency = $1 AND s.period_start = $2)
+		 ORDER BY p.owner LIMIT $3`, frequency, start, summaryReportBatch)
+	if err != nil {
+		return err
+	}
+	type recipient struct{ owner, email, token string }
+	var recipients []recipient
+	for rows.Next() {
+		var rc recipient
+		if err := rows.Scan(&rc.owner, &rc.email, &rc.token); err != nil {
+			rows.Close()
+			return err
+		}
+		recipients = append(recipients, rc)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, rc := range recipients {
+		if err := sendSummaryReport(ctx, frequency, rc.owner, rc.email, rc.token, prevStart, start, end); err != nil {
+			slog.Error("Summary report error", "owner", rc.owner, "frequency", frequency, "err", err)
+		}
+	}
+	return nil
+}
+
+// Claim the period, then mail; another instance sweeping at the same time
+// claims nothing and sends nothing
+func sendSummaryReport(ctx context.Context, frequency, owner, to, token string, prevStart, start, end time.Time) error {
+	result, err := db.ExecContext(ctx,
+		`INSERT INTO summary_reports_sent (owner, frequency, period_start) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+		owner, frequency, start)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+	release := func() {
+		if _, err := db.ExecContext(ctx,
+			`DELETE FROM summary_reports_sent WHERE owner = $1 AND frequency = $2 AND period_start = $3`,
+			owner, frequency, start); err != nil {
+			slog.Error("Summary report release error", "err", err)
+		}
+	}
+
+	// Tenant owners hear from their tenant's host and brand
+	host := publicHost()
+	tenant := ownerTenant(owner)
+	if h := tenantPrimaryHost(tenant); h != "" {
+		host = h
+	}
+	report, err := buildSummaryReport(ctx, owner, host, prevStart, start, end)
+	if err != nil {
+		release()
+		return err
+	}
+	if report.Clicks == 0 && report.NewLinks == 0 {
+		return nil
+	}
+	report.Period = frequency
+	report.Unit = summaryUnits[frequency]
+	report.Unsubscribe = baseURL(host) + "/notifications/unsubscribe?token=" + url.QueryEscape(token)
+
+	tmpl, err := template.ParseFS(staticFiles, "summary_report.txt")
+	if err != nil {
+		release()
+		return fmt.Errorf("summary report template: %w", err)
+	}
+	var body strings.Builder
+	if err := tmpl.Execute(&body, report); err != nil {
+		release()
+		return fmt.Errorf("summary report template: %w", err)
+	}
+
+	subject := fmt.Sprintf("Your %s short link summary: %d clicks", frequency, report.Clicks)
+	if brand := tenantBrand(tenant); brand.Name != "" {
+		subject = brand.Name + ": " + subject
+	}
+	if err := sendEmail(ctx, emailMessage{To: to, Subject: subject, Body: body.String(), Unsubscribe: report.Unsubscribe}); err != nil {
+		// The next sweep tries again
+		release()
+		return err
+	}
+	slog.Info("Summary report sent", "frequency", frequency, "clicks", report.Clicks)
+	return nil
+}
+
+func buildSummaryReport(ctx context.Context, owner, host string, prevStart, start, end time.Time) (*summaryReport, error) {
+	report := &summaryReport{
+		From: start.Format("2 Jan 2006"),
+		To:   end.AddDate(0, 0, -1).Format("2 Jan 2006"),
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT e.short_code, COUNT(*) FROM click_events e JOIN urls u ON u.short_code = e.short_code
+		 WHERE u.owner = $1 AND e.suspicious IS NULL AND e.clicked_at >= $2 AND e.clicked_at < $3
+		 GROUP BY e.short_code ORDER BY 2 DESC, 1`, owner, start, end)
+	if err != nil {
+		return nil, err
+	}
+	var top []string
+	counts := map[string]int64{}
+	for rows.Next() {
+		var code string
+		var clicks int64
+		if err := rows.Scan(&code, &clicks); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		report.Clicks += clicks
+		if len(top) < summaryTopLinks {
+			top = append(top, code)
+			counts[code] = clicks
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var previous int64
+	if err := db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM click_events e JOIN urls u ON u.short_code = e.short_code
+		 WHERE u.owner = $1 AND e.suspicious IS NULL AND e.clicked_at >= $2 AND e.clicked_at < $3`,
+		owner, prevStart, start).Scan(&previous); err != nil {
+		return nil, err
+	}
+	if previous > 0 {
+		report.Trend = fmt.Sprintf("%+d%%", (report.Clicks-previous)*100/previous)
+	}
+	if err := db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM urls WHERE owner = $1 AND created_at >= $2 AND created_at < $3`,
+		owner, start, end).Scan(&report.NewLinks); err != nil {
+		return nil, err
+	}
+
+	for _, code := range top {
+		link, err := store.GetLink(ctx, code)
+		if err != nil {
+			// Deleted since the count; its clicks stay in the total
+			continue
+		}
+		report.TopLinks = append(report.TopLinks, summaryLink{
+			ShortURL:    shortURL(linkHost(link, host), link.ShortCode),
+			OriginalURL: link.OriginalURL,
+			Clicks:      counts[code],
+		})
+	}
+	return report, nil
+}
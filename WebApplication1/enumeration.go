@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Enumeration detection on code lookups. An IP collecting too many 404s
+// within a window is banned (or, with ENUM_BAN_MODE=tarpit, slowed down)
+// for a while. State is per instance.
+//
+//	ENUM_BAN_THRESHOLD  misses per window before a ban, default 20; 0 disables
+//	ENUM_BAN_WINDOW     default 1m
+//	ENUM_BAN_DURATION   default 15m
+const tarpitDelay = 3 * time.Second
+
+type IPBan struct {
+	IP       string    `json:"ip"`
+	Misses   int       `json:"misses"`
+	BannedAt time.Time `json:"banned_at"`
+	Until    time.Time `json:"until"`
+}
+
+type missCounter struct {
+	windowStart time.Time
+	misses      int
+}
+
+type enumerationGuard struct {
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	tarpit    bool
+
+	mu     sync.Mutex
+	misses map[string]*missCounter
+	bans   map[string]*IPBan
+}
+
+var (
+	enumGuard *enumerationGuard
+
+	lookupMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ihdas_lookup_not_found_total",
+		Help: "Code lookups that found no link.",
+	})
+	enumerationBans = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ihdas_enumeration_bans_total",
+		Help: "Client IPs banned for scanning the code space.",
+	})
+	bannedRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ihdas_banned_requests_total",
+		Help: "Lookups refused or tarpitted because the client IP is banned.",
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ihdas_active_ip_bans",
+		Help: "Client IPs currently banned.",
+	}, func() float64 {
+		if enumGuard == nil {
+			return 0
+		}
+		return float64(len(enumGuard.activeBans()))
+	})
+)
+
+func initEnumerationGuard() {
+	threshold := cfg.EnumBanThreshold
+	if threshold <= 0 {
+		return
+	}
+
+	enumGuard = &enumerationGuard{
+		threshold: threshold,
+		window:    cfg.EnumBanWindow,
+		duration:  cfg.EnumBanDuration,
+		tarpit:    cfg.EnumBanMode == "tarpit",
+		misses:    make(map[string]*missCounter),
+		bans:      make(map[string]*IPBan),
+	}
+	go enumGuard.evictExpired()
+}
+
+func (g *enumerationGuard) banned(ip string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ban, ok := g.bans[ip]
+	return ok && time.Now().Before(ban.Until)
+}
+
+func (g *enumerationGuard) recordMiss(ip string) {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	c, ok := g.misses[ip]
+	if !ok || now.Sub(c.windowStart) > g.window {
+		c = &missCounter{windowStart: now}
+		g.misses[ip] = c
+	}
+	c.misses++
+
+	if c.misses >= g.threshold {
+		g.bans[ip] = &IPBan{IP: ip, Misses: c.misses, BannedAt: now, Until: now.Add(g.duration)}
+		delete(g.misses, ip)
+		enumerationBans.Inc()
+	}
+}
+
+func (g *enumerationGuard) activeBans() []IPBan {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	bans := []IPBan{}
+	for _, ban := range g.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, *ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].BannedAt.Before(bans[j].BannedAt) })
+	return bans
+}
+
+func (g *enumerationGuard) unban(ip string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.bans[ip]
+	delete(g.bans, ip)
+	delete(g.misses, ip)
+	return ok
+}
+
+func (g *enumerationGuard) evictExpired() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		g.mu.Lock()
+		for ip, ban := range g.bans {
+			if now.After(ban.Until) {
+				delete(g.bans, ip)
+			}
+		}
+		for ip, c := range g.misses {
+			if now.Sub(c.windowStart) > g.window {
+				delete(g.misses, ip)
+			}
+		}
+		g.mu.Unlock()
+	}
+}
+
+// Wrap a code lookup handler: refuse banned IPs, count everyone's 404s
+func guardEnumeration(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if enumGuard == nil {
+			next(w, r)
+			return
+		}
+
+		ip := getClientIP(r)
+		if enumGuard.banned(ip) {
+			bannedRequests.Inc()
+			if enumGuard.tarpit {
+				// Hold the connection, then answer like any other miss
+				select {
+				case <-time.After(tarpitDelay):
+				case <-r.Context().Done():
+					return
+				}
+				serveNotFound(w, r, domainSettings(requestDomain(r)))
+				return
+			}
+			writeError(w, http.StatusForbidden, "ip_banned", "Too many unknown short codes, try again later")
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == http.StatusNotFound {
+			lookupMisses.Inc()
+			enumGuard.recordMiss(ip)
+		}
+	}
+}
+
+// GET /api/v1/admin/bans
+func listBansHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	bans := []IPBan{}
+	if enumGuard != nil {
+		bans = enumGuard.activeBans()
+	}
+	writeJSON(w, http.StatusOK, bans)
+}
+
+// DELETE /api/v1/admin/bans/{ip}
+func unbanHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	ip := r.PathValue("ip")
+	if enumGuard == nil || !enumGuard.unban(ip) {
+		writeError(w, http.StatusNotFound, "ban_not_found", "IP is not banned")
+		return
+	}
+	auditAdmin(r, "ip.unban", ip, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
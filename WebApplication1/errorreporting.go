@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/getsentry/sentry-go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Optional error reporting to Sentry or anything that speaks its protocol
+// (GlitchTip, Bugsink, ...). With SENTRY_DSN set, every 5xx response and
+// every recovered panic becomes an event carrying the route, request ID,
+// trace ID and the log lines the request produced up to that point.
+// Cookies, Authorization and client IPs are not sent.
+var errorReporting bool
+
+func initErrorReporting() {
+	if cfg.SentryDSN == "" {
+		return
+	}
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:              cfg.SentryDSN,
+		Environment:      cfg.SentryEnvironment,
+		Release:          buildInfo().Version,
+		AttachStacktrace: true,
+		MaxBreadcrumbs:   50,
+		BeforeSend:       scrubEvent,
+	})
+	if err != nil {
+		fatal("Error reporting setup failed", "err", err)
+	}
+	errorReporting = true
+	slog.Info("Error reporting enabled", "environment", cfg.SentryEnvironment)
+}
+
+// Send anything still queued, for shutdown
+func flushErrorReports(ctx context.Context) {
+	if errorReporting {
+		sentry.FlushWithContext(ctx)
+	}
+}
+
+// Never ship credentials or client addresses, whatever the SDK defaults are
+func scrubEvent(event *sentry.Event, hint *sentry.EventHint) *sentry.Event {
+	if event.Request != nil {
+		for name := range event.Request.Headers {
+			switch strings.ToLower(name) {
+			case "authorization", "cookie", "x-api-key", "x-forwarded-for", "x-real-ip", "forwarded":
+				delete(event.Request.Headers, name)
+			}
+		}
+		event.Request.Cookies = ""
+		event.Request.Env = nil
+	}
+	event.User = sentry.User{}
+	return event
+}
+
+// Give each request its own hub, scoped with the request, and report the
+// response if it ends in a server error
+func reportErrors(mux *http.ServeMux, next http.Handler) http.Handler {
+	if !errorReporting {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hub := sentry.CurrentHub().Clone()
+		_, route := mux.Handler(r)
+		hub.Scope().SetRequest(r)
+		hub.Scope().SetTag("route", route)
+		hub.Scope().SetTag("method", r.Method)
+		if id := requestID(r.Context()); id != "" {
+			hub.Scope().SetTag("request_id", id)
+		}
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			hub.Scope().SetTag("trace_id", sc.TraceID().String())
+		}
+		panicked := new(atomic.Bool)
+		ctx := context.WithValue(r.Context(), panicReportedKey, panicked)
+		r = r.WithContext(sentry.SetHubOnContext(ctx, hub))
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		// A panic has already been reported with its stack
+		if rec.status < 500 || panicked.Load() {
+			return
+		}
+		// A 503 with Retry-After is deliberate back-off (startup, maintenance)
+		if rec.status == http.StatusServiceUnavailable && w.Header().Get("Retry-After") != "" {
+			return
+		}
+		hub.WithScope(func(scope *sentry.Scope) {
+			scope.SetTag("status", fmt.Sprint(rec.status))
+			scope.SetLevel(sentry.LevelError)
+			scope.SetFingerprint([]string{"http", route, fmt.Sprint(rec.status)})
+			hub.CaptureMessage(fmt.Sprintf("%d %s on %s", rec.status, http.StatusText(rec.status), route))
+		})
+	})
+}
+
+// Called from recoverPanics with the recovered value
+func reportPanic(ctx context.Context, v interface{}) {
+	if hub := sentry.GetHubFromContext(ctx); hub != nil {
+		hub.RecoverWithContext(ctx, v)
+		if panicked, ok := ctx.Value(panicReportedKey).(*atomic.Bool); ok {
+			panicked.Store(true)
+		}
+	}
+}
+
+// Record a log line against the request it belongs to, so the event shows
+// what the handler logged before failing
+func addBreadcrumb(ctx context.Context, rec slog.Record) {
+	if ctx == nil {
+		return
+	}
+	hub := sentry.GetHubFromContext(ctx)
+	if hub == nil {
+		return
+	}
+	data := make(map[string]interface{}, rec.NumAttrs())
+	rec.Attrs(func(a slog.Attr) bool {
+		data[a.Key] = a.Value.String()
+		return true
+	})
+	hub.AddBreadcrumb(&sentry.Breadcrumb{
+		Category:  "log",
+		Message:   rec.Message,
+		Level:     breadcrumbLevel(rec.Level),
+		Data:      data,
+		Timestamp: rec.Time,
+	}, nil)
+}
+
+func breadcrumbLevel(level slog.Level) sentry.Level {
+	switch {
+	case level >= slog.LevelError:
+		return sentry.LevelError
+	case level >= slog.LevelWarn:
+		return sentry.LevelWarning
+	case level >= slog.LevelInfo:
+		return sentry.LevelInfo
+	}
+	return sentry.LevelDebug
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+// Raw click and link lifecycle events for analytics pipelines, published
+// to a Kafka topic (keyed by short code, so a link's events stay in order
+// within a partition) or to NATS subjects <subject>.<event>, e.g.
+// ihdas.events.link.created. Unlike webhooks this covers every link, owned
+// or not. Publishing is fire-and-forget: events are buffered by the client
+// library and dropped on broker trouble rather than slowing redirects.
+const (
+	StreamEventClick = "click"
+
+	eventStreamFlushTimeout = 5 * time.Second
+)
+
+type StreamEvent struct {
+	ID          string       `json:"id"`
+	Event       string       `json:"event"` // click or a webhook event name (link.created, ...)
+	Time        time.Time    `json:"time"`
+	ShortCode   string       `json:"short_code"`
+	OriginalURL string       `json:"original_url,omitempty"`
+	Owner       string       `json:"owner,omitempty"`
+	Click       *StreamClick `json:"click,omitempty"`
+}
+
+type StreamClick struct {
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent,omitempty"`
+	Referrer  string `json:"referrer,omitempty"`
+}
+
+type eventPublisher interface {
+	Name() string
+	// Publish queues the event without waiting for the broker
+	Publish(event, key string, payload []byte) error
+	// Close flushes what's queued
+	Close(ctx context.Context) error
+}
+
+var (
+	eventStream eventPublisher
+
+	streamEventsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ihdas_stream_events_failed_total",
+		Help: "Events that could not be published to the event stream.",
+	}, []string{"event"})
+)
+
+func initEventStream() {
+	switch strings.ToLower(cfg.EventStream) {
+	case "":
+		return
+	case "kafka":
+		eventStream = newKafkaPublisher(cfg.KafkaBrokers, cfg.KafkaTopic)
+	case "nats":
+		p, err := newNATSPublisher(cfg.NATSURL, cfg.NATSSubject)
+		if err != nil {
+			fatal("NATS connection failed", "err", err)
+		}
+		eventStream = p
+	}
+	slog.Info("Event stream enabled", "provider", eventStream.Name())
+}
+
+func closeEventStream(ctx context.Context) {
+	if eventStream == nil {
+		return
+	}
+	if err := eventStream.Close(ctx); err != nil {
+		slog.Warn("Event stream flush failed", "err", err)
+	}
+}
+
+func publishStreamEvent(e StreamEvent) {
+	if eventStream == nil {
+		return
+	}
+	id := make([]byte, 12)
+	rand.Read(id)
+	e.ID = "evt_" + hex.EncodeToString(id)
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Stream event payload error", "err", err)
+		return
+	}
+	if err := eventStream.Publish(e.Event, e.ShortCode, payload); err != nil {
+		streamEventsFailed.WithLabelValues(e.Event).Inc()
+		slog.Warn("Stream event publish error", "event", e.Event, "err", err)
+	}
+}
+
+func publishLinkEvent(event string, link *Link) {
+	publishStreamEvent(StreamEvent{
+		Event:       event,
+		ShortCode:   link.ShortCode,
+		OriginalURL: link.OriginalURL,
+		Owner:       link.Owner,
+	})
+}
+
+// ip is the client IP as click_ip_mode allows it to leave the service
+func publishClickEvent(c *click, ip string) {
+	publishStreamEvent(StreamEvent{
+		Event:     StreamEventClick,
+		Time:      c.at,
+		ShortCode: c.shortCode,
+		Click: &StreamClick{
+			IP:        ip,
+			UserAgent: c.userAgent,
+			Referrer:  c.referrer,
+		},
+	})
+}
+
+// Kafka
+
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func newKafkaPublisher(brokers []string, topic string) *kafkaPublisher {
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		Async:        true,
+		BatchTimeout: 100 * time.Millisecond,
+		RequiredAcks: kafka.RequireOne,
+	}
+	// With Async, failures only surface here
+	w.Completion = func(messages []kafka.Message, err error) {
+		if err == nil {
+			return
+		}
+		for _, m := range messages {
+			streamEventsFailed.WithLabelValues(messageEvent(m)).Inc()
+		}
+		slog.Warn("Kafka publish error", "messages", len(messages), "err", err)
+	}
+	return &kafkaPublisher{writer: w}
+}
+
+func messageEvent(m kafka.Message) string {
+	for _, h := range m.Headers {
+		if h.Key == "event" {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (p *kafkaPublisher) Name() string { return "kafka" }
+
+func (p *kafkaPublisher) Publish(event, key string, payload []byte) error {
+	return p.writer.WriteMessages(context.Background(), kafka.Message{
+		Key:     []byte(key),
+		Value:   payload,
+		Headers: []kafka.Header{{Key: "event", Value: []byte(event)}},
+	})
+}
+
+func (p *kafkaPublisher) Close(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() { done <- p.writer.Close() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// NATS
+
+type natsPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func newNATSPublisher(url, subject string) (*natsPublisher, error) {
+	conn, err := nats.Connect(url,
+		nats.Name("ihdas"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				slog.Warn("NATS disconnected", "err", err)
+			}
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			slog.Info("NATS reconnected", "url", c.ConnectedUrlRedacted())
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &natsPublisher{conn: conn, subject: subject}, nil
+}
+
+func (p *natsPublisher) Name() string { return "nats" }
+
+func (p *natsPublisher) Publish(event, key string, payload []byte) error {
+	return p.conn.Publish(fmt.Sprintf("%s.%s", p.subject, event), payload)
+}
+
+func (p *natsPublisher) Close(ctx context.Context) error {
+	flushCtx, cancel := context.WithTimeout(ctx, eventStreamFlushTimeout)
+	defer cancel()
+	err := p.conn.FlushWithContext(flushCtx)
+	p.conn.Close()
+	return err
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Expiry reminder emails. Owners opt in by giving an address through
+// PUT /api/v1/notifications and get one email listing their links that
+// expire within their chosen number of days. Each link is mentioned once
+// per expiry date, so moving expires_at later earns a fresh reminder.
+// Every email carries a one-click unsubscribe link.
+const (
+	expiryNoticeTick        = time.Hour
+	expiryNoticeDefaultDays = 3
+	expiryNoticeMaxDays     = 30
+	expiryNoticeBatch       = 5000
+)
+
+type NotificationPreferences struct {
+	Email            string     `json:"email"`
+	ExpiryNotices    bool       `json:"expiry_notices"`
+	ExpiryNoticeDays int        `json:"expiry_notice_days"`
+	DeadLinkNotices  bool       `json:"dead_link_notices"` // see linkhealth.go
+	SummaryReports   string     `json:"summary_reports"`   // off, weekly or monthly; see emailreports.go
+	UpdatedAt        *time.Time `json:"updated_at,omitempty"`
+}
+
+type NotificationPreferencesRequest struct {
+	Email            *string `json:"email,omitempty"`
+	ExpiryNotices    *bool   `json:"expiry_notices,omitempty"`
+	ExpiryNoticeDays *int    `json:"expiry_notice_days,omitempty"`
+	DeadLinkNotices  *bool   `json:"dead_link_notices,omitempty"`
+	SummaryReports   *string `json:"summary_reports,omitempty"`
+}
+
+type expiringLink struct {
+	shortCode   string
+	originalURL string
+	expiresAt   time.Time
+	domain      string
+}
+
+func initExpiryNotices() {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS notification_preferences (
+		owner TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		expiry_notices BOOLEAN NOT NULL DEFAULT TRUE,
+		expiry_notice_days INTEGER NOT NULL DEFAULT 3,
+		unsubscribe_token TEXT UNIQUE NOT NULL,
+		updated_at TIMESTAMP DEFAULT NOW()
+	);
+	ALTER TABLE notification_preferences ADD COLUMN IF NOT EXISTS dead_link_notices BOOLEAN NOT NULL DEFAULT TRUE;
+	CREATE TABLE IF NOT EXISTS expiry_notices (
+		short_code VARCHAR(64) PRIMARY KEY,
+		expires_at TIMESTAMP NOT NULL,
+		notified_at TIMESTAMP DEFAULT NOW()
+	);
+	`
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Notification tables creation failed", "err", err)
+	}
+	if !emailEnabled() {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(expiryNoticeTick)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !isLeader() {
+				continue
+			}
+			if err := sendExpiryNotices(context.Background()); err != nil {
+				slog.Error("Expiry notice sweep error", "err", err)
+			}
+		}
+	}()
+}
+
+func sendExpiryNotices(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx,
+		`SELECT p.owner, p.email, p.unsubscribe_token, u.short_code, u.original_url, u.expires_at, COALESCE(u.domain, '')
+		 FROM urls u JOIN notification_preferences p ON p.owner = u.owner
+		 WHERE p.expiry_notices AND u.disabled_at IS NULL
+		   AND u.expires_at > NOW() AND u.expires_at <= NOW() + make_interval(days => p.expiry_notice_days)
+		   AND NOT EXISTS (SELECT 1 FROM expiry_notices n WHERE n.short_code = u.short_code AND n.expires_at = u.expires_at)
+		 ORDER BY p.owner, u.expires_at
+		 LIMIT $1`, expiryNoticeBatch)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type recipient struct {
+		email, token string
+		links        []expiringLink
+	}
+	var owners []string
+	recipients := map[string]*recipient{}
+	for rows.Next() {
+		var owner, email, token string
+		var link expiringLink
+		if err := rows.Scan(&owner, &email, &token, &link.shortCode, &link.originalURL, &link.expiresAt, &link.domain); err != nil {
+			return err
+		}
+		// Destinations may be encrypted at rest
+		var err error
+		if link.originalURL, err = decryptURL(link.shortCode, link.originalURL); err != nil {
+			slog.Error("Expiry notice decrypt error", "short_code", link.shortCode, "err", err)
+			continue
+		}
+		rc, ok := recipients[owner]
+		if !ok {
+			rc = &recipient{email: email, token: token}
+			recipients[owner] = rc
+			owners = append(owners, owner)
+		}
+		rc.links = append(rc.links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, owner := range owners {
+		rc := recipients[owner]
+		if err := sendExpiryNotice(ctx, owner, rc.email, rc.token, rc.links); err != nil {
+			slog.Error("Expiry notice error", "owner", owner, "err", err)
+		}
+	}
+	return nil
+}
+
+// Claim the links, then mail; another instance sweeping at the same time
+// claims nothing and sends nothing
+func sendExpiryNotice(ctx context.Context, owner, to, token string, links []expiringLink) error {
+	var claimed []expiringLink
+	for _, link := range links {
+		result, err := db.ExecContext(ctx,
+			`INSERT INTO expiry_notices (short_code, expires_at) VALUES ($1, $2)
+			 ON CONFLICT (short_code) DO UPDATE SET expires_at = EXCLUDED.expires_at, notified_at = NOW()
+			 WHERE expiry_notices.expires_at <> EXCLUDED.expires_at`, link.shortCode, link.expiresAt)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			claimed = append(claimed, link)
+		}
+	}
+	if len(claimed) == 0 {
+		return nil
+	}
+
+	// Tenant owners hear from their tenant's host and brand
+	host := publicHost()
+	tenant := ownerTenant(owner)
+	if h := tenantPrimaryHost(tenant); h != "" {
+		host = h
+	}
+	var body strings.Builder
+	if len(claimed) == 1 {
+		body.WriteString("One of your short links expires soon:\n\n")
+	} else {
+		fmt.Fprintf(&body, "%d of your short links expire soon:\n\n", len(claimed))
+	}
+	for _, link := range claimed {
+		lh := linkHost(&Link{ShortCode: link.shortCode, Domain: link.domain}, host)
+		fmt.Fprintf(&body, "  %s  (expires %s)\n    -> %s\n", shortURL(lh, link.shortCode),
+			link.expiresAt.UTC().Format("2 Jan 2006 15:04 MST"), link.originalURL)
+	}
+	body.WriteString("\nAfter that they stop redirecting.\n")
+	unsubscribe := baseURL(host) + "/notifications/unsubscribe?token=" + url.QueryEscape(token)
+	fmt.Fprintf(&body, "\nStop these emails: %s\n", unsubscribe)
+
+	subject := "Your short link expires soon"
+	if len(claimed) > 1 {
+		subject = fmt.Sprintf("%d of your short links expire soon", len(claimed))
+	}
+	if brand := tenantBrand(tenant); brand.Name != "" {
+		subject = brand.Name + ": " + subject
+	}
+	err := sendEmail(ctx, emailMessage{To: to, Subject: subject, Body: body.String(), Unsubscribe: unsubscribe})
+	if err != nil {
+		// Release the claims so the next sweep tries again
+		codes := make([]string, len(claimed))
+		for i, link := range claimed {
+			codes[i] = link.shortCode
+		}
+		codesJSON, _ := json.Marshal(codes)
+		if _, dbErr := db.ExecContext(ctx,
+			`DELETE FROM expiry_notices WHERE short_code IN (SELECT json_array_elements_text($1::JSON))`,
+			string(codesJSON)); dbErr != nil {
+			slog.Error("Expiry notice release error", "err", dbErr)
+		}
+		return err
+	}
+	slog.Info("Expiry notice sent", "links", len(claimed))
+	return nil
+}
+
+func loadNotificationPreferences(ctx context.Context, owner string) (NotificationPreferences, error) {
+	prefs := NotificationPreferences{ExpiryNotices: true, ExpiryNoticeDays: expiryNoticeDefaultDays, DeadLinkNotices: true,
+		SummaryReports: summaryOff}
+	var updatedAt time.Time
+	err := db.QueryRowContext(ctx,
+		`SELECT email, expiry_notices, expiry_notice_days, dead_link_notices, summary_reports, updated_at
+		 FROM notification_preferences WHERE owner = $1`,
+		owner).Scan(&prefs.Email, &prefs.ExpiryNotices, &prefs.ExpiryNoticeDays, &prefs.DeadLinkNotices, &prefs.SummaryReports, &updatedAt)
+	if err == sql.ErrNoRows {
+		return prefs, nil
+	} else if err != nil {
+		return prefs, err
+	}
+	prefs.UpdatedAt = &updatedAt
+	return prefs, nil
+}
+
+// GET /api/v1/notifications
+func getNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return
+	}
+	prefs, err := loadNotificationPreferences(r.Context(), owner)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Notification preferences error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, prefs)
+}
+
+// PUT /api/v1/notifications
+func putNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return
+	}
+	var req NotificationPreferencesRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+
+	prefs, err := loadNotificationPreferences(r.Context(), owner)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Notification preferences error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if req.Email != nil {
+		addr, err := mail.ParseAddress(*req.Email)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_email", "email is not a valid address")
+			return
+		}
+		prefs.Email = addr.Address
+	}
+	if prefs.Email == "" {
+		writeError(w, http.StatusBadRequest, "missing_email", "email is required")
+		return
+	}
+	if req.ExpiryNotices != nil {
+		prefs.ExpiryNotices = *req.ExpiryNotices
+	}
+	if req.ExpiryNoticeDays != nil {
+		if *req.ExpiryNoticeDays < 1 || *req.ExpiryNoticeDays > expiryNoticeMaxDays {
+			writeError(w, http.StatusBadRequest, "invalid_expiry_notice_days",
+				fmt.Sprintf("expiry_notice_days must be between 1 and %d", expiryNoticeMaxDays))
+			return
+		}
+		prefs.ExpiryNoticeDays = *req.ExpiryNoticeDays
+	}
+	if req.DeadLinkNotices != nil {
+		prefs.DeadLinkNotices = *req.DeadLinkNotices
+	}
+	if req.SummaryReports != nil {
+		if !slices.Contains(summaryFrequencies, *req.SummaryReports) {
+			writeError(w, http.StatusBadRequest, "invalid_summary_reports", "summary_reports must be off, weekly or monthly")
+			return
+		}
+		prefs.SummaryReports = *req.SummaryReports
+	}
+
+	raw := make([]byte, 24)
+	rand.Read(raw)
+	var updatedAt time.Time
+	err = db.QueryRowContext(r.Context(),
+		`INSERT INTO notification_preferences (owner, email, expiry_notices, expiry_notice_days, dead_link_notices, summary_reports, unsubscribe_token)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 ON CONFLICT (owner) DO UPDATE SET email = EXCLUDED.email, expiry_notices = EXCLUDED.expiry_notices,
+		 expiry_notice_days = EXCLUDED.expiry_notice_days, dead_link_notices = EXCLUDED.dead_link_notices,
+		 summary_reports = EXCLUDED.summary_reports, updated_at = NOW()
+		 RETURNING updated_at`,
+		owner, prefs.Email, prefs.ExpiryNotices, prefs.ExpiryNoticeDays, prefs.DeadLinkNotices, prefs.SummaryReports,
+		hex.EncodeToString(raw)).Scan(&updatedAt)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Notification preferences update error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	prefs.UpdatedAt = &updatedAt
+	auditCaller(r.Context(), "notifications.update", owner, map[string]interface{}{
+		"expiry_notices": prefs.ExpiryNotices, "expiry_notice_days": prefs.ExpiryNoticeDays,
+		"dead_link_notices": prefs.DeadLinkNotices, "summary_reports": prefs.SummaryReports,
+	})
+	writeJSON(w, http.StatusOK, prefs)
+}
+
+// GET /notifications/unsubscribe?token=... asks for confirmation, since
+// mail scanners open every link in a message
+func unsubscribePageHandler(w http.ResponseWriter, r *http.Request) {
+	t := localizer(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!doctype html><html lang="%s"><title>%s</title>
+<form method="post" action="/notifications/unsubscribe?token=%s">
+<p>%s</p><button type="submit">%s</button>
+</form>`, w.Header().Get("Content-Language"), html.EscapeString(t("unsubscribe.title")),
+		html.EscapeString(url.QueryEscape(r.URL.Query().Get("token"))),
+		html.EscapeString(t("unsubscribe.question")), html.EscapeString(t("unsubscribe.button")))
+}
+
+// POST /notifications/unsubscribe?token=..., from the page above or as the
+// one-click unsubscribe mail clients send from List-Unsubscribe
+func unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	t := localizer(w, r)
+	token := r.URL.Query().Get("token")
+	var owner string
+	err := db.QueryRowContext(r.Context(),
+		`UPDATE notification_preferences SET expiry_notices = FALSE, dead_link_notices = FALSE, summary_reports = 'off', updated_at = NOW()
+		 WHERE unsubscribe_token = $1 RETURNING owner`, token).Scan(&owner)
+	if err == sql.ErrNoRows || token == "" {
+		http.Error(w, t("unsubscribe.invalid"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Unsubscribe error", "err", err)
+		http.Error(w, t("error.retry"), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r.Context(), owner, "notifications.unsubscribe", owner, nil)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, t("unsubscribe.done"))
+}
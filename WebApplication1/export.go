@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Export record - one line of NDJSON or one CSV row per link
+type exportRecord struct {
+	ShortCode   string     `json:"short_code"`
+	OriginalURL string     `json:"original_url"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	ClickCount  *int64     `json:"click_count,omitempty"`
+}
+
+// Flush the stream every N rows so large exports don't sit in the buffer
+const exportFlushEvery = 500
+
+// GET /api/v1/admin/export?format=ndjson|csv&clicks=true
+// Streams every link for backups and migrations off the service.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	if format != "ndjson" && format != "csv" {
+		writeError(w, http.StatusBadRequest, "unsupported_format", "Unsupported export format")
+		return
+	}
+	includeClicks := r.URL.Query().Get("clicks") == "true"
+
+	query := `SELECT short_code, original_url, created_at, expires_at, click_count
+			  FROM urls ORDER BY id`
+	rows, err := db.QueryContext(r.Context(), query)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Export query error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	defer rows.Close()
+
+	// Exports can easily outlive the server's write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	filename := "ihdas-export-" + time.Now().UTC().Format("20060102-150405") + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	var emit func(rec exportRecord) error
+	var flush func()
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		header := []string{"short_code", "original_url", "created_at", "expires_at"}
+		if includeClicks {
+			header = append(header, "click_count")
+		}
+		cw.Write(header)
+
+		emit = func(rec exportRecord) error {
+			expires := ""
+			if rec.ExpiresAt != nil {
+				expires = rec.ExpiresAt.Format(time.RFC3339)
+			}
+			row := []string{rec.ShortCode, rec.OriginalURL, rec.CreatedAt.Format(time.RFC3339), expires}
+			if rec.ClickCount != nil {
+				row = append(row, strconv.FormatInt(*rec.ClickCount, 10))
+			}
+			return cw.Write(row)
+		}
+		flush = func() {
+			cw.Flush()
+			rc.Flush()
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		emit = func(rec exportRecord) error {
+			return enc.Encode(rec)
+		}
+		flush = func() {
+			rc.Flush()
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	count := 0
+	for rows.Next() {
+		var rec exportRecord
+		var clicks int64
+		if err := rows.Scan(&rec.ShortCode, &rec.OriginalURL, &rec.CreatedAt, &rec.ExpiresAt, &clicks); err != nil {
+			slog.ErrorContext(r.Context(), "Export scan error", "err", err)
+			return
+		}
+		if includeClicks {
+			rec.ClickCount = &clicks
+		}
+		// Exports always carry plaintext destinations so they can be restored anywhere
+		if rec.OriginalURL, err = decryptURL(rec.ShortCode, rec.OriginalURL); err != nil {
+			slog.ErrorContext(r.Context(), "Export decryption error", "short_code", rec.ShortCode, "err", err)
+			return
+		}
+		if err := emit(rec); err != nil {
+			slog.ErrorContext(r.Context(), "Export write error", "rows", count, "err", err)
+			return
+		}
+		count++
+		if count%exportFlushEvery == 0 {
+			flush()
+		}
+	}
+	flush()
+
+	// Headers are already sent, so a failure here can only be logged
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(r.Context(), "Export aborted", "rows", count, "err", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Export completed", "links", count, "format", format)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Feature flags for rolling subsystems out gradually. Every flag is declared
+// below with its default; FEATURE_FLAGS overrides defaults per deployment
+// (enable_click_events=false,enable_expand=25) and the admin API overrides
+// both at runtime. A percentage turns the flag on for that share of
+// subjects - short codes, say - picked by a stable hash, so the same link
+// always gets the same answer. Every instance reloads the overrides
+// periodically, so changes made elsewhere apply within featureFlagRefresh.
+const featureFlagRefresh = 30 * time.Second
+
+type featureFlag struct {
+	name        string
+	description string
+	percent     int // default rollout, 0-100
+}
+
+var declaredFlags = []featureFlag{
+	{"enable_click_events", "Record a click event row (referrer, user agent) per redirect", 100},
+	{"enable_expand", "Serve GET /api/v1/expand/{code} lookups", 100},
+	{"enable_link_previews", "Fetch title, description and favicon of new links' destinations", 100},
+}
+
+type FeatureFlag struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Percent     int        `json:"rollout_percent"`
+	Source      string     `json:"source"` // default, config or admin
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+}
+
+type FeatureFlagRequest struct {
+	Enabled *bool `json:"enabled,omitempty"`
+	Percent *int  `json:"rollout_percent,omitempty"`
+}
+
+type flagOverride struct {
+	percent   int
+	updatedAt time.Time
+}
+
+var (
+	flagsMu       sync.RWMutex
+	configFlags   = map[string]int{}
+	adminFlags    = map[string]flagOverride{}
+	declaredIndex = map[string]featureFlag{}
+)
+
+func init() {
+	for _, f := range declaredFlags {
+		declaredIndex[f.name] = f
+	}
+}
+
+func initFeatureFlags() {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS feature_flags (
+		name TEXT PRIMARY KEY,
+		rollout_percent INTEGER NOT NULL CHECK (rollout_percent BETWEEN 0 AND 100),
+		updated_at TIMESTAMP DEFAULT NOW()
+	);
+	`
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Feature flag table creation failed", "err", err)
+	}
+
+	if err := reloadFeatureFlags(); err != nil {
+		fatal("Feature flag load failed", "err", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(featureFlagRefresh)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := reloadFeatureFlags(); err != nil {
+				slog.Error("Feature flag reload error", "err", err)
+			}
+		}
+	}()
+}
+
+// Parse "name", "name=true|false|on|off" or "name=<percent>" entries
+func parseFlagOverrides(entries []string) (map[string]int, error) {
+	overrides := map[string]int{}
+	for _, entry := range entries {
+		name, value, hasValue := strings.Cut(strings.TrimSpace(entry), "=")
+		if _, ok := declaredIndex[name]; !ok {
+			return nil, fmt.Errorf("unknown feature flag %q", name)
+		}
+		percent := 100
+		if hasValue {
+			switch strings.ToLower(value) {
+			case "true", "on":
+			case "false", "off":
+				percent = 0
+			default:
+				n, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+				if err != nil || n < 0 || n > 100 {
+					return nil, fmt.Errorf("feature flag %s: %q is not true, false or a percentage", name, value)
+				}
+				percent = n
+			}
+		}
+		overrides[name] = percent
+	}
+	return overrides, nil
+}
+
+func reloadFeatureFlags() error {
+	rows, err := db.Query(`SELECT name, rollout_percent, updated_at FROM feature_flags`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	overrides := map[string]flagOverride{}
+	for rows.Next() {
+		var name string
+		var o flagOverride
+		if err := rows.Scan(&name, &o.percent, &o.updatedAt); err != nil {
+			return err
+		}
+		// Rows for flags since removed from the code are left alone
+		if _, ok := declaredIndex[name]; ok {
+			overrides[name] = o
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	flagsMu.Lock()
+	adminFlags = overrides
+	flagsMu.Unlock()
+	return nil
+}
+
+// Effective state of a declared flag
+func flagState(name string) FeatureFlag {
+	f := declaredIndex[name]
+	state := FeatureFlag{Name: f.name, Description: f.description, Percent: f.percent, Source: "default"}
+
+	flagsMu.RLock()
+	defer flagsMu.RUnlock()
+	if percent, ok := configFlags[name]; ok {
+		state.Percent, state.Source = percent, "config"
+	}
+	if o, ok := adminFlags[name]; ok {
+		updated := o.updatedAt
+		state.Percent, state.Source, state.UpdatedAt = o.percent, "admin", &updated
+	}
+	return state
+}
+
+// Whether the flag is on for this subject. Undeclared names are a
+// programming error and read as off.
+func flagEnabled(name, subject string) bool {
+	if _, ok := declaredIndex[name]; !ok {
+		slog.Warn("Unknown feature flag", "name", name)
+		return false
+	}
+	switch percent := flagState(name).Percent; percent {
+	case 0:
+		return false
+	case 100:
+		return true
+	default:
+		h := fnv.New32a()
+		h.Write([]byte(name + ":" + subject))
+		return int(h.Sum32()%100) < percent
+	}
+}
+
+// GET /api/v1/admin/flags
+func listFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	flags := make([]FeatureFlag, 0, len(declaredFlags))
+	for _, f := range declaredFlags {
+		flags = append(flags, flagState(f.name))
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	writeJSON(w, http.StatusOK, flags)
+}
+
+// PUT /api/v1/admin/flags/{name}
+func setFlagHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	name := r.PathValue("name")
+	if _, ok := declaredIndex[name]; !ok {
+		writeError(w, http.StatusNotFound, "flag_not_found", "Unknown feature flag")
+		return
+	}
+
+	var req FeatureFlagRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	var percent int
+	switch {
+	case req.Percent != nil && req.Enabled != nil:
+		writeError(w, http.StatusBadRequest, "invalid_flag", "Give either enabled or rollout_percent, not both")
+		return
+	case req.Percent != nil:
+		percent = *req.Percent
+	case req.Enabled != nil:
+		if *req.Enabled {
+			percent = 100
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_flag", "enabled or rollout_percent is required")
+		return
+	}
+	if percent < 0 || percent > 100 {
+		writeError(w, http.StatusBadRequest, "invalid_flag", "rollout_percent must be between 0 and 100")
+		return
+	}
+
+	var o flagOverride
+	err := db.QueryRowContext(r.Context(),
+		`INSERT INTO feature_flags (name, rollout_percent) VALUES ($1, $2)
+		 ON CONFLICT (name) DO UPDATE SET rollout_percent = EXCLUDED.rollout_percent, updated_at = NOW()
+		 RETURNING rollout_percent, updated_at`, name, percent).Scan(&o.percent, &o.updatedAt)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Feature flag update error", "name", name, "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	flagsMu.Lock()
+	adminFlags[name] = o
+	flagsMu.Unlock()
+	slog.InfoContext(r.Context(), "Admin set feature flag", "name", name, "percent", percent)
+	auditAdmin(r, "flag.set", name, map[string]interface{}{"rollout_percent": percent})
+	writeJSON(w, http.StatusOK, flagState(name))
+}
+
+// DELETE /api/v1/admin/flags/{name} drops the runtime override
+func resetFlagHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	name := r.PathValue("name")
+	if _, ok := declaredIndex[name]; !ok {
+		writeError(w, http.StatusNotFound, "flag_not_found", "Unknown feature flag")
+		return
+	}
+
+	if _, err := db.ExecContext(r.Context(), `DELETE FROM feature_flags WHERE name = $1`, name); err != nil {
+		slog.ErrorContext(r.Context(), "Feature flag delete error", "name", name, "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	flagsMu.Lock()
+	delete(adminFlags, name)
+	flagsMu.Unlock()
+	slog.InfoContext(r.Context(), "Admin reset feature flag", "name", name)
+	auditAdmin(r, "flag.reset", name, nil)
+	writeJSON(w, http.StatusOK, flagState(name))
+}
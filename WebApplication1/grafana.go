@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Grafana JSON datasource (simpod-json-datasource / SimpleJSON) backed by
+// the click_events table, so per-link charts don't need a Prometheus label
+// per short code. Point the datasource at /api/v1/admin/grafana with an
+// "Authorization: Bearer <ADMIN_TOKEN>" custom header. Targets:
+//
+//	clicks            all clicks, as a time series
+//	clicks:<code>     one link's clicks
+//	domain_clicks:<d> clicks on one custom domain
+//	links_created     new links
+//	top_links         table of the most clicked links in the range
+//
+// Annotations are audit log entries; the annotation query, if any, is an
+// action prefix such as "link." or "flags.".
+const (
+	grafanaMinInterval   = time.Minute
+	grafanaMaxRange      = 400 * 24 * time.Hour
+	grafanaSearchLimit   = 25
+	grafanaTopLimit      = 50
+	grafanaMaxAnnotation = 500
+)
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type GrafanaQueryRequest struct {
+	Range         grafanaRange `json:"range"`
+	IntervalMs    int64        `json:"intervalMs"`
+	MaxDataPoints int64        `json:"maxDataPoints"`
+	Targets       []struct {
+		Target string `json:"target"`
+		RefID  string `json:"refId"`
+		Hide   bool   `json:"hide"`
+	} `json:"targets"`
+}
+
+type GrafanaTimeSeries struct {
+	Target     string     `json:"target"`
+	Datapoints [][2]int64 `json:"datapoints"` // [value, unix ms]
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type GrafanaTable struct {
+	Type    string          `json:"type"` // always "table"
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+type GrafanaAnnotationRequest struct {
+	Range      grafanaRange `json:"range"`
+	Annotation struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	} `json:"annotation"`
+}
+
+type GrafanaAnnotation struct {
+	Time  int64    `json:"time"`
+	Title string   `json:"title"`
+	Text  string   `json:"text"`
+	Tags  []string `json:"tags"`
+}
+
+// Grafana sends bodies with more fields than we read, so not decodeJSON
+func decodeGrafana(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodyBytes)).Decode(dst); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Invalid request body")
+		return false
+	}
+	return true
+}
+
+func validGrafanaRange(w http.ResponseWriter, rng grafanaRange) bool {
+	if rng.From.IsZero() || !rng.To.After(rng.From) || rng.To.Sub(rng.From) > grafanaMaxRange {
+		writeError(w, http.StatusBadRequest, "invalid_range", "range must be non-empty and at most 400 days")
+		return false
+	}
+	return true
+}
+
+// GET /api/v1/admin/grafana - the datasource's connection test
+func grafanaTestHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// POST /api/v1/admin/grafana/search - metric names for the query editor,
+// plus clicks:<code> for codes starting with what's been typed
+func grafanaSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req struct {
+		Target string `json:"target"`
+	}
+	if !decodeGrafana(w, r, &req) {
+		return
+	}
+
+	results := []string{"clicks", "links_created", "top_links"}
+	prefix := strings.TrimPrefix(req.Target, "clicks:")
+	if prefix != "" {
+		rows, err := db.QueryContext(r.Context(),
+			`SELECT short_code FROM urls WHERE short_code LIKE $1 || '%' ORDER BY click_count DESC LIMIT $2`,
+			strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix), grafanaSearchLimit)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Grafana search error", "err", err)
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var code string
+			if err := rows.Scan(&code); err != nil {
+				slog.ErrorContext(r.Context(), "Grafana search error", "err", err)
+				writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+				return
+			}
+			results = append(results, "clicks:"+code)
+		}
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// POST /api/v1/admin/grafana/query
+func grafanaQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req GrafanaQueryRequest
+	if !decodeGrafana(w, r, &req) {
+		return
+	}
+	if !validGrafanaRange(w, req.Range) {
+		return
+	}
+
+	// Honor Grafana's interval but never return more points than it asked for
+	interval := time.Duration(req.IntervalMs) * time.Millisecond
+	if req.MaxDataPoints > 0 {
+		if floor := req.Range.To.Sub(req.Range.From) / time.Duration(req.MaxDataPoints); interval < floor {
+			interval = floor
+		}
+	}
+	if interval < grafanaMinInterval {
+		interval = grafanaMinInterval
+	}
+
+	results := []interface{}{}
+	for _, t := range req.Targets {
+		if t.Hide || t.Target == "" {
+			continue
+		}
+		var result interface{}
+		var err error
+		switch {
+		case t.Target == "clicks":
+			result, err = grafanaSeries(r.Context(), t.Target,
+				`SELECT clicked_at FROM click_events WHERE clicked_at >= $1 AND clicked_at < $2 AND suspicious IS NULL`, req.Range, interval)
+		case strings.HasPrefix(t.Target, "clicks:"):
+			result, err = grafanaSeries(r.Context(), t.Target,
+				`SELECT clicked_at FROM click_events WHERE clicked_at >= $1 AND clicked_at < $2 AND suspicious IS NULL AND short_code = $4`,
+				req.Range, interval, strings.TrimPrefix(t.Target, "clicks:"))
+		case strings.HasPrefix(t.Target, "domain_clicks:"):
+			result, err = grafanaSeries(r.Context(), t.Target,
+				`SELECT clicked_at FROM click_events WHERE clicked_at >= $1 AND clicked_at < $2 AND suspicious IS NULL AND domain = $4`,
+				req.Range, interval, normalizeDomain(strings.TrimPrefix(t.Target, "domain_clicks:")))
+		case t.Target == "links_created":
+			result, err = grafanaSeries(r.Context(), t.Target,
+				`SELECT created_at FROM urls WHERE created_at >= $1 AND created_at < $2`, req.Range, interval)
+		case t.Target == "top_links":
+			result, err = grafanaTopLinks(r.Context(), req.Range)
+		default:
+			writeError(w, http.StatusBadRequest, "unknown_target", "Unknown target "+t.Target)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Grafana query error", "target", t.Target, "err", err)
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		results = append(results, result)
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// Count the timestamps selected by source ($1 from, $2 to) into buckets of
+// interval ($3, seconds). Empty buckets are filled with zeros so Grafana
+// draws gaps as no clicks rather than interpolating across them.
+func grafanaSeries(ctx context.Context, target, source string, rng grafanaRange, interval time.Duration, args ...interface{}) (*GrafanaTimeSeries, error) {
+	seconds := int64(interval / time.Second)
+	query := `SELECT (FLOOR(EXTRACT(EPOCH FROM t.ts) / $3::BIGINT) * $3::BIGINT)::BIGINT, COUNT(*)
+		FROM (` + source + `) AS t(ts) GROUP BY 1`
+	rows, err := db.QueryContext(ctx, query, append([]interface{}{rng.From.UTC(), rng.To.UTC(), seconds}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[int64]int64{}
+	for rows.Next() {
+		var bucket, count int64
+		if err := rows.Scan(&bucket, &count); err != nil {
+			return nil, err
+		}
+		counts[bucket] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	series := &GrafanaTimeSeries{Target: target, Datapoints: [][2]int64{}}
+	start := rng.From.Unix() / seconds * seconds
+	for bucket := start; bucket < rng.To.Unix(); bucket += seconds {
+		series.Datapoints = append(series.Datapoints, [2]int64{counts[bucket], bucket * 1000})
+	}
+	return series, nil
+}
+
+func grafanaTopLinks(ctx context.Context, rng grafanaRange) (*GrafanaTable, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT short_code, COUNT(*), COUNT(DISTINCT ip_address) FROM click_events
+		 WHERE clicked_at >= $1 AND clicked_at < $2 AND suspicious IS NULL
+		 GROUP BY short_code ORDER BY 2 DESC LIMIT $3`, rng.From.UTC(), rng.To.UTC(), grafanaTopLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	table := &GrafanaTable{
+		Type:    "table",
+		Columns: []grafanaColumn{{"Short code", "string"}, {"Clicks", "number"}, {"Unique visitors", "number"}},
+		Rows:    [][]interface{}{},
+	}
+	for rows.Next() {
+		var code string
+		var clicks, unique int64
+		if err := rows.Scan(&code, &clicks, &unique); err != nil {
+			return nil, err
+		}
+		table.Rows = append(table.Rows, []interface{}{code, clicks, unique})
+	}
+	return table, rows.Err()
+}
+
+// POST /api/v1/admin/grafana/annotations
+func grafanaAnnotationsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req GrafanaAnnotationRequest
+	if !decodeGrafana(w, r, &req) {
+		return
+	}
+	if !validGrafanaRange(w, req.Range) {
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(),
+		`SELECT created_at, actor, action, COALESCE(target, '') FROM audit_log
+		 WHERE created_at >= $1 AND created_at < $2 AND action LIKE $3 || '%'
+		 ORDER BY id DESC LIMIT $4`,
+		req.Range.From.UTC(), req.Range.To.UTC(),
+		strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.TrimSpace(req.Annotation.Query)),
+		grafanaMaxAnnotation)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Grafana annotations error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	defer rows.Close()
+
+	annotations := []GrafanaAnnotation{}
+	for rows.Next() {
+		var at time.Time
+		var actor, action, target string
+		if err := rows.Scan(&at, &actor, &action, &target); err != nil {
+			slog.ErrorContext(r.Context(), "Grafana annotations error", "err", err)
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		annotations = append(annotations, GrafanaAnnotation{
+			Time:  at.UnixMilli(),
+			Title: action,
+			Text:  strings.TrimSpace(target + " by " + actor),
+			Tags:  []string{action, actor},
+		})
+	}
+	writeJSON(w, http.StatusOK, annotations)
+}
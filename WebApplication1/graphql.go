@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// GraphQL API for the dashboard - one request fetches exactly the fields
+// it needs, with nested keyset pagination over a link's clicks.
+const graphQLSchema = `
+	schema {
+		query: Query
+	}
+
+	scalar Time
+
+	type Query {
+		link(code: String!): Link
+		links(first: Int, after: String): LinkConnection!
+		stats: GlobalStats!
+	}
+
+	type Link {
+		shortCode: String!
+		originalUrl: String!
+		clickCount: Float!
+		createdAt: Time!
+		expiresAt: Time
+		expired: Boolean!
+		clicks(first: Int, after: String): ClickConnection!
+	}
+
+	type Click {
+		clickedAt: Time!
+		referrer: String!
+		userAgent: String!
+	}
+
+	type PageInfo {
+		hasNextPage: Boolean!
+		endCursor: String
+	}
+
+	type LinkConnection {
+		nodes: [Link!]!
+		pageInfo: PageInfo!
+	}
+
+	type ClickConnection {
+		nodes: [Click!]!
+		pageInfo: PageInfo!
+	}
+
+	type GlobalStats {
+		totalLinks: Float!
+		activeLinks: Float!
+		totalClicks: Float!
+	}
+`
+
+var graphQL = graphql.MustParseSchema(graphQLSchema, &gqlQuery{})
+
+type gqlPageArgs struct {
+	First *int32
+	After *string
+}
+
+// Decode the paging arguments; ask for one extra row to learn hasNextPage
+func (args gqlPageArgs) window() (afterID int64, limit int, err error) {
+	size := 0
+	if args.First != nil {
+		size = int(*args.First)
+	}
+	cursor := ""
+	if args.After != nil {
+		cursor = *args.After
+	}
+	afterID, err = decodeCursor(cursor)
+	return afterID, clampPageSize(size), err
+}
+
+type gqlPageInfo struct {
+	hasNext bool
+	end     *string
+}
+
+func (p gqlPageInfo) HasNextPage() bool  { return p.hasNext }
+func (p gqlPageInfo) EndCursor() *string { return p.end }
+
+func newPageInfo(lastID int64, hasNext bool) gqlPageInfo {
+	info := gqlPageInfo{hasNext: hasNext}
+	if lastID > 0 {
+		cursor := encodeCursor(lastID)
+		info.end = &cursor
+	}
+	return info
+}
+
+type gqlQuery struct{}
+
+func (q *gqlQuery) Link(ctx context.Context, args struct{ Code string }) (*gqlLink, error) {
+	link, err := getTenantLink(ctx, args.Code)
+	if errors.Is(err, ErrLinkNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &gqlLink{link}, nil
+}
+
+func (q *gqlQuery) Links(ctx context.Context, args gqlPageArgs) (*gqlLinkConnection, error) {
+	afterID, limit, err := args.window()
+	if err != nil {
+		return nil, err
+	}
+
+	links, err := store.ListLinks(ctx, LinkFilter{}, afterID, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	hasNext := len(links) > limit
+	if hasNext {
+		links = links[:limit]
+	}
+	conn := &gqlLinkConnection{}
+	var lastID int64
+	for _, link := range links {
+		conn.nodes = append(conn.nodes, &gqlLink{link})
+		lastID = link.ID
+	}
+	conn.pageInfo = newPageInfo(lastID, hasNext)
+	return conn, nil
+}
+
+func (q *gqlQuery) Stats(ctx context.Context) (*gqlGlobalStats, error) {
+	var stats gqlGlobalStats
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*),
+		       COUNT(*) FILTER (WHERE expires_at IS NULL OR expires_at > NOW()),
+		       COALESCE(SUM(click_count), 0)
+		FROM urls`).Scan(&stats.totalLinks, &stats.activeLinks, &stats.totalClicks)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+type gqlLink struct {
+	link *Link
+}
+
+func (l *gqlLink) ShortCode() string       { return l.link.ShortCode }
+func (l *gqlLink) OriginalURL() string     { return l.link.OriginalURL }
+func (l *gqlLink) ClickCount() float64     { return float64(l.link.ClickCount) }
+func (l *gqlLink) CreatedAt() graphql.Time { return graphql.Time{Time: l.link.CreatedAt} }
+
+func (l *gqlLink) ExpiresAt() *graphql.Time {
+	if l.link.ExpiresAt == nil {
+		return nil
+	}
+	return &graphql.Time{Time: *l.link.ExpiresAt}
+}
+
+func (l *gqlLink) Expired() bool {
+	return l.link.ExpiresAt != nil && l.link.ExpiresAt.Before(time.Now())
+}
+
+// Only resolved when the query selects clicks
+func (l *gqlLink) Clicks(ctx context.Context, args gqlPageArgs) (*gqlClickConnection, error) {
+	afterID, limit, err := args.window()
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := listClickEvents(ctx, l.link.ShortCode, afterID, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	hasNext := len(events) > limit
+	if hasNext {
+		events = events[:limit]
+	}
+	conn := &gqlClickConnection{}
+	var lastID int64
+	for _, ev := range events {
+		conn.nodes = append(conn.nodes, gqlClick{ev})
+		lastID = ev.ID
+	}
+	conn.pageInfo = newPageInfo(lastID, hasNext)
+	return conn, nil
+}
+
+type gqlClick struct {
+	ev ClickEvent
+}
+
+func (c gqlClick) ClickedAt() graphql.Time { return graphql.Time{Time: c.ev.ClickedAt} }
+func (c gqlClick) Referrer() string        { return c.ev.Referrer }
+func (c gqlClick) UserAgent() string       { return c.ev.UserAgent }
+
+type gqlLinkConnection struct {
+	nodes    []*gqlLink
+	pageInfo gqlPageInfo
+}
+
+func (c *gqlLinkConnection) Nodes() []*gqlLink     { return c.nodes }
+func (c *gqlLinkConnection) PageInfo() gqlPageInfo { return c.pageInfo }
+
+type gqlClickConnection struct {
+	nodes    []gqlClick
+	pageInfo gqlPageInfo
+}
+
+func (c *gqlClickConnection) Nodes() []gqlClick     { return c.nodes }
+func (c *gqlClickConnection) PageInfo() gqlPageInfo { return c.pageInfo }
+
+type gqlGlobalStats struct {
+	totalLinks, activeLinks, totalClicks int64
+}
+
+func (s *gqlGlobalStats) TotalLinks() float64  { return float64(s.totalLinks) }
+func (s *gqlGlobalStats) ActiveLinks() float64 { return float64(s.activeLinks) }
+func (s *gqlGlobalStats) TotalClicks() float64 { return float64(s.totalClicks) }
+
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+	Extensions    map[string]interface{} `json:"extensions,omitempty"` // accepted, unused
+}
+
+// POST /api/graphql (or GET with ?query=) - admin only, since it can list everything
+func graphQLHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var req graphQLRequest
+	if r.Method == http.MethodGet {
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if vars := r.URL.Query().Get("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_variables", "Invalid variables")
+				return
+			}
+		}
+	} else if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+
+	if req.Query == "" {
+		writeError(w, http.StatusBadRequest, "missing_query", "Missing query")
+		return
+	}
+
+	// GraphQL reports query errors in the body with a 200
+	response := graphQL.Exec(r.Context(), req.Query, req.OperationName, req.Variables)
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// gRPC API for internal services, sharing the store with the HTTP handlers.
+// Disabled unless GRPC_PORT is set.
+type shortenerServer struct {
+	UnimplementedShortenerServer
+}
+
+var grpcServer *grpc.Server
+
+func startGRPCServer() {
+	port := cfg.GRPCPort
+	if port == "" {
+		return
+	}
+
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		fatal("gRPC listen failed", "err", err)
+	}
+
+	grpcServer = grpc.NewServer(grpc.StatsHandler(otelgrpc.NewServerHandler()))
+	RegisterShortenerServer(grpcServer, &shortenerServer{})
+
+	slog.Info("🔌 gRPC API listening", "port", port)
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil {
+			slog.Error("gRPC server stopped", "err", err)
+		}
+	}()
+}
+
+// Map our HTTP-flavoured errors onto gRPC status codes
+func grpcError(err error) error {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		code := codes.Internal
+		switch apiErr.Status {
+		case http.StatusBadRequest, http.StatusUnprocessableEntity:
+			code = codes.InvalidArgument
+		case http.StatusNotFound:
+			code = codes.NotFound
+		case http.StatusConflict:
+			code = codes.AlreadyExists
+		case http.StatusGone:
+			code = codes.FailedPrecondition
+		}
+		return status.Error(code, apiErr.Message)
+	}
+	if errors.Is(err, ErrLinkNotFound) {
+		return status.Error(codes.NotFound, "Short URL not found")
+	}
+	slog.Error("gRPC error", "err", err)
+	return status.Error(codes.Internal, "Database error")
+}
+
+func optionalTimestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func (s *shortenerServer) Shorten(ctx context.Context, in *ShortenRequest) (*ShortenResponse, error) {
+	if inMaintenance() {
+		return nil, status.Error(codes.Unavailable, "Service is in maintenance, please retry later")
+	}
+	req := CreateURLRequest{
+		OriginalURL: in.GetOriginalUrl(),
+		CustomCode:  in.GetCustomCode(),
+	}
+	if in.GetExpiresAt() != nil {
+		req.ExpiresAt = in.GetExpiresAt().AsTime().Format(time.RFC3339)
+	}
+
+	// There's no browser Host header here, so the public host comes from config
+	host := publicHost()
+
+	if ip := grpcPeerIP(ctx); ip != "" {
+		ctx = context.WithValue(ctx, requestIPKey, ip)
+	}
+
+	resp, err := createShortURL(ctx, req, host)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &ShortenResponse{
+		ShortCode:   resp.ShortCode,
+		ShortUrl:    resp.ShortURL,
+		OriginalUrl: resp.OriginalURL,
+		CreatedAt:   timestamppb.New(resp.CreatedAt),
+		ExpiresAt:   optionalTimestamp(resp.ExpiresAt),
+	}, nil
+}
+
+func (s *shortenerServer) Resolve(ctx context.Context, in *ResolveRequest) (*ResolveResponse, error) {
+	ip := grpcPeerIP(ctx)
+	if err := allowGRPCLookup(ctx, ip); err != nil {
+		return nil, err
+	}
+	link, err := getPublicLink(ctx, in.GetShortCode())
+	if errors.Is(err, ErrLinkNotFound) && enumGuard != nil {
+		lookupMisses.Inc()
+		enumGuard.recordMiss(ip)
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if link.DisabledAt != nil {
+		return nil, status.Error(codes.FailedPrecondition, "Short URL is disabled")
+	}
+
+	return &ResolveResponse{
+		ShortCode:   link.ShortCode,
+		OriginalUrl: link.OriginalURL,
+		ExpiresAt:   optionalTimestamp(link.ExpiresAt),
+		Expired:     link.ExpiresAt != nil && time.Now().After(*link.ExpiresAt),
+	}, nil
+}
+
+// Address of the calling peer, or empty
+func grpcPeerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	ip, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return ""
+	}
+	return ip
+}
+
+// Lookups answer to the redirect rate limit and enumeration bans, as they
+// do over HTTP
+func allowGRPCLookup(ctx context.Context, ip string) error {
+	if limiter := redirectLimiter.current(); limiter != nil {
+		decision, err := limiter.Allow(ctx, ipLimitKey(ip))
+		if err != nil {
+			slog.ErrorContext(ctx, "Rate limiter error", "err", err)
+		} else if !decision.Allowed {
+			return status.Error(codes.ResourceExhausted, "Too many requests, slow down")
+		}
+	}
+	if enumGuard != nil && enumGuard.banned(ip) {
+		bannedRequests.Inc()
+		return status.Error(codes.PermissionDenied, "Too many unknown short codes, try again later")
+	}
+	return nil
+}
+
+// Look a link up by its public code, which is signed when link signing is
+// on, within the caller's tenant
+func getPublicLink(ctx context.Context, token string) (*Link, error) {
+	shortCode, ok := resolveCode(ctx, token)
+	if !ok {
+		return nil, ErrLinkNotFound
+	}
+	return store.GetLink(ctx, shortCode)
+}
+
+func linkStats(link *Link) *LinkStats {
+	return &LinkStats{
+		ShortCode:   link.ShortCode,
+		OriginalUrl: link.OriginalURL,
+		ClickCount:  link.ClickCount,
+		CreatedAt:   timestamppb.New(link.CreatedAt),
+	}
+}
+
+func (s *shortenerServer) GetStats(ctx context.Context, in *GetStatsRequest) (*LinkStats, error) {
+	link, err := getPublicLink(ctx, in.GetShortCode())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return linkStats(link), nil
+}
+
+// Polls the store and pushes a message each time the click count moves
+func (s *shortenerServer) WatchStats(in *WatchStatsRequest, stream Shortener_WatchStatsServer) error {
+	interval := time.Duration(in.GetIntervalSeconds()) * time.Second
+	if interval < time.Second {
+		interval = 2 * time.Second
+	}
+
+	ctx := stream.Context()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastCount := int64(-1)
+	for {
+		link, err := getPublicLink(ctx, in.GetShortCode())
+		if err != nil {
+			return grpcError(err)
+		}
+		if link.ClickCount != lastCount {
+			if err := stream.Send(linkStats(link)); err != nil {
+				return err
+			}
+			lastCount = link.ClickCount
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
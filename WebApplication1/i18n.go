@@ -0,0 +1,106 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// Visitor-facing pages (error pages, the interstitial, unsubscribing, stats
+// pages) are translated from the message catalogs in locales/, one flat JSON
+// object per language named by its BCP 47 tag. The language is negotiated
+// from Accept-Language; English is the fallback both for unsupported
+// languages and for keys a catalog lacks. The API itself stays in English.
+const defaultLocale = "en"
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+var locales struct {
+	tags     []language.Tag // defaultLocale first, as the matcher's fallback
+	catalogs []map[string]string
+	matcher  language.Matcher
+}
+
+func initLocales() {
+	entries, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		fatal("Message catalogs missing", "err", err)
+	}
+	var tags []language.Tag
+	var catalogs []map[string]string
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		tag, err := language.Parse(name)
+		if err != nil {
+			fatal("Message catalog has an invalid language tag", "file", entry.Name(), "err", err)
+		}
+		data, err := localeFiles.ReadFile(path.Join("locales", entry.Name()))
+		if err != nil {
+			fatal("Message catalog unreadable", "file", entry.Name(), "err", err)
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			fatal("Message catalog is not valid JSON", "file", entry.Name(), "err", err)
+		}
+		if name == defaultLocale {
+			tags = append([]language.Tag{tag}, tags...)
+			catalogs = append([]map[string]string{catalog}, catalogs...)
+		} else {
+			tags = append(tags, tag)
+			catalogs = append(catalogs, catalog)
+		}
+	}
+	if len(tags) == 0 || tags[0].String() != defaultLocale {
+		fatal("Message catalog for the default language missing", "locale", defaultLocale)
+	}
+
+	// Gaps fall back to English, but are worth knowing about
+	for i, catalog := range catalogs[1:] {
+		for key := range catalogs[0] {
+			if _, ok := catalog[key]; !ok {
+				slog.Warn("Message catalog incomplete", "locale", tags[i+1].String(), "key", key)
+			}
+		}
+	}
+	locales.tags, locales.catalogs = tags, catalogs
+	locales.matcher = language.NewMatcher(tags)
+}
+
+// Index of the catalog for the request's Accept-Language
+func requestLocale(r *http.Request) int {
+	prefs, _, err := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if err != nil || len(prefs) == 0 {
+		return 0
+	}
+	_, index, confidence := locales.matcher.Match(prefs...)
+	if confidence == language.No {
+		return 0
+	}
+	return index
+}
+
+// A page's translator, with the response marked as varying by language
+func localizer(w http.ResponseWriter, r *http.Request) func(key string, args ...interface{}) string {
+	locale := requestLocale(r)
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", locales.tags[locale].String())
+	return func(key string, args ...interface{}) string {
+		text, ok := locales.catalogs[locale][key]
+		if !ok {
+			if text, ok = locales.catalogs[0][key]; !ok {
+				text = key
+			}
+		}
+		if len(args) > 0 {
+			return fmt.Sprintf(text, args...)
+		}
+		return text
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+)
+
+// Internationalized destination hosts are stored in their ASCII (punycode)
+// form, so müller.de and xn--mller-kva.de are the same destination to
+// lookups, domain lists and reputation checks, and shown in their Unicode
+// form where people read them. Hosts that mix scripts the way homograph
+// phishing does (a Cyrillic "а" in an otherwise Latin name, or an all-
+// Cyrillic look-alike of a Latin name under a Latin TLD) are refused.
+
+// Scripts that legitimately share a label with Latin and each other
+var compatibleScripts = []map[string]bool{
+	{"Latin": true, "Han": true, "Hiragana": true, "Katakana": true}, // Japanese
+	{"Latin": true, "Han": true, "Hangul": true},                     // Korean
+	{"Latin": true, "Han": true, "Bopomofo": true},                   // Chinese
+}
+
+// Letters that pass for Latin ones in most fonts
+var latinLookalikes = map[string]string{
+	"Cyrillic": "аеорсухіјѕԁһӏԛԝү",
+	"Greek":    "οαικνρυχ",
+}
+
+var errConfusableHost = &apiError{http.StatusBadRequest, "confusable_host",
+	"Destination host mixes writing systems the way look-alike domains do"}
+
+// Rewrite an internationalized host in place to its ASCII form, checking it
+// for confusables. Reports whether the URL changed.
+func normalizeIDNHost(u *url.URL) (bool, error) {
+	host := u.Hostname()
+	if !isIDNHost(host) {
+		return false, nil
+	}
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return false, &apiError{http.StatusBadRequest, "invalid_host", "URL host is not a valid internationalized domain name"}
+	}
+	unicodeHost, err := idna.Display.ToUnicode(ascii)
+	if err != nil {
+		return false, &apiError{http.StatusBadRequest, "invalid_host", "URL host is not a valid internationalized domain name"}
+	}
+	if err := checkConfusableHost(unicodeHost); err != nil {
+		return false, err
+	}
+	if ascii == host {
+		return false, nil
+	}
+	if port := u.Port(); port != "" {
+		ascii = net.JoinHostPort(ascii, port)
+	}
+	u.Host = ascii
+	return true, nil
+}
+
+// Non-ASCII or already punycoded; IP literals never are
+func isIDNHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	if strings.Contains(strings.ToLower(host), "xn--") {
+		return true
+	}
+	for _, r := range host {
+		if r > unicode.MaxASCII {
+			return true
+		}
+	}
+	return false
+}
+
+// The destination as people should read it, "" when that's as stored.
+// Only the host changes; url.URL.String would percent-encode it.
+func displayURL(destination string) string {
+	u, err := url.Parse(destination)
+	if err != nil || !strings.Contains(u.Hostname(), "xn--") {
+		return ""
+	}
+	host, err := idna.Display.ToUnicode(u.Hostname())
+	if err != nil {
+		return ""
+	}
+	if port := u.Port(); port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	scheme, rest, _ := strings.Cut(destination, "//")
+	return scheme + "//" + strings.Replace(rest, u.Host, host, 1)
+}
+
+func checkConfusableHost(host string) error {
+	labels := strings.Split(host, ".")
+	tldIsASCII := !isIDNHost(labels[len(labels)-1])
+	for _, label := range labels {
+		scripts := labelScripts(label)
+		if !scriptsCompatible(scripts) {
+			return errConfusableHost
+		}
+		if len(scripts) == 1 && tldIsASCII {
+			for script := range scripts {
+				if lookalikes, ok := latinLookalikes[script]; ok && onlyRunesOf(label, lookalikes) {
+					return errConfusableHost
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Scripts of a label's letters; digits, hyphens and marks shared between
+// scripts (like the Japanese long vowel mark) belong to none
+func labelScripts(label string) map[string]bool {
+	scripts := map[string]bool{}
+	for _, r := range label {
+		if !unicode.IsLetter(r) || unicode.In(r, unicode.Common, unicode.Inherited) {
+			continue
+		}
+		script := "Unknown"
+		for name, table := range unicode.Scripts {
+			if unicode.Is(table, r) {
+				script = name
+				break
+			}
+		}
+		scripts[script] = true
+	}
+	return scripts
+}
+
+func scriptsCompatible(scripts map[string]bool) bool {
+	if len(scripts) <= 1 {
+		return true
+	}
+	for _, allowed := range compatibleScripts {
+		ok := true
+		for script := range scripts {
+			if !allowed[script] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether every letter of label is one of runes
+func onlyRunesOf(label, runes string) bool {
+	for _, r := range label {
+		if unicode.IsLetter(r) && !strings.ContainsRune(runes, r) {
+			return false
+		}
+	}
+	return true
+}
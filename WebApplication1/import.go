@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Imports are bigger than regular API payloads but still bounded
+const (
+	maxImportBytes  = 64 << 20 // 64 MB
+	maxImportErrors = 100
+)
+
+type importLineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// A code that already existed here, so the record was skipped or replaced
+type importConflict struct {
+	Line      int    `json:"line"`
+	ShortCode string `json:"short_code"`
+}
+
+type ImportResponse struct {
+	Imported    int               `json:"imported"`
+	Overwritten int               `json:"overwritten"`
+	Skipped     int               `json:"skipped"`
+	Failed      int               `json:"failed"`
+	Errors      []importLineError `json:"errors,omitempty"`
+	Conflicts   []importConflict  `json:"conflicts,omitempty"`
+}
+
+func (resp *ImportResponse) fail(line int, err error) {
+	resp.Failed++
+	if len(resp.Errors) < maxImportErrors {
+		resp.Errors = append(resp.Errors, importLineError{Line: line, Error: err.Error()})
+	}
+}
+
+func (resp *ImportResponse) conflict(line int, shortCode string) {
+	if len(resp.Conflicts) < maxImportErrors {
+		resp.Conflicts = append(resp.Conflicts, importConflict{Line: line, ShortCode: shortCode})
+	}
+}
+
+// Column names accepted per CSV format, first match wins. The ihdas format
+// is what the export endpoint writes; the others are other shorteners'
+// account exports.
+var importCSVColumns = map[string]map[string][]string{
+	"csv": {
+		"short_code": {"short_code"}, "original_url": {"original_url"},
+		"created_at": {"created_at"}, "expires_at": {"expires_at"}, "click_count": {"click_count"},
+	},
+	"bitly": {
+		"short_code": {"bitlink", "link", "short_url"}, "original_url": {"long_url", "long url", "destination"},
+		"created_at": {"created", "created_at", "date created"}, "click_count": {"clicks", "total clicks"},
+	},
+	"tinyurl": {
+		"short_code": {"alias", "tiny_url", "tinyurl"}, "original_url": {"long_url", "url", "destination"},
+		"created_at": {"created_at", "created"}, "expires_at": {"expires_at"}, "click_count": {"hits", "clicks"},
+	},
+}
+
+// A linkImporter applies records one at a time and tallies the outcome
+type linkImporter struct {
+	policy string
+	owner  string // owner of the imported links, empty for none
+
+	resp           ImportResponse
+	maxNumericCode int64
+}
+
+func (im *linkImporter) handle(ctx context.Context, line int, rec exportRecord) {
+	domain, err := validateImportRecord(&rec)
+	if err != nil {
+		im.resp.fail(line, err)
+		return
+	}
+
+	outcome, err := importRecord(ctx, rec, domain, im.policy, im.owner)
+	if err != nil {
+		slog.ErrorContext(ctx, "Import error", "line", line, "err", err)
+		im.resp.fail(line, errors.New("database error"))
+		return
+	}
+
+	switch outcome {
+	case "imported":
+		im.resp.Imported++
+	case "overwritten":
+		im.resp.Overwritten++
+		im.resp.conflict(line, rec.ShortCode)
+		invalidateCachedURL(ctx, rec.ShortCode)
+	case "skipped":
+		im.resp.Skipped++
+		im.resp.conflict(line, rec.ShortCode)
+	}
+
+	if n, err := strconv.ParseInt(rec.ShortCode, 10, 64); err == nil && n > im.maxNumericCode {
+		im.maxNumericCode = n
+	}
+}
+
+func (im *linkImporter) finish(r *http.Request, source string) {
+	// Imported numeric codes must never be handed out again by the sequence
+	if im.maxNumericCode > 0 {
+		if _, err := db.ExecContext(r.Context(),
+			`SELECT setval('urls_id_seq', GREATEST(last_value, $1)) FROM urls_id_seq`, im.maxNumericCode); err != nil {
+			slog.ErrorContext(r.Context(), "Import sequence bump error", "err", err)
+		}
+	}
+
+	resp := im.resp
+	slog.InfoContext(r.Context(), "Import completed", "source", source,
+		"imported", resp.Imported, "overwritten", resp.Overwritten, "skipped", resp.Skipped, "failed", resp.Failed)
+	auditAdmin(r, "links.import", im.owner, map[string]interface{}{
+		"source": source, "imported": resp.Imported, "overwritten": resp.Overwritten, "skipped": resp.Skipped, "failed": resp.Failed,
+	})
+}
+
+func parseImportPolicy(w http.ResponseWriter, policy string) (string, bool) {
+	if policy == "" {
+		policy = "skip"
+	}
+	if policy != "skip" && policy != "overwrite" {
+		writeError(w, http.StatusBadRequest, "invalid_conflict_policy", "on_conflict must be skip or overwrite")
+		return "", false
+	}
+	return policy, true
+}
+
+// POST /api/v1/admin/import?format=ndjson|csv|bitly|tinyurl&on_conflict=skip|overwrite&owner=
+// Accepts the same records the export endpoint produces, so an export can be
+// restored as-is, or a Bitly or TinyURL CSV export to migrate off them with
+// the same codes. Codes already taken here are listed under conflicts.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+			format = "csv"
+		} else {
+			format = "ndjson"
+		}
+	}
+	columns, isCSV := importCSVColumns[format]
+	if format != "ndjson" && !isCSV {
+		writeError(w, http.StatusBadRequest, "unsupported_format", "Unsupported import format")
+		return
+	}
+
+	policy, ok := parseImportPolicy(w, r.URL.Query().Get("on_conflict"))
+	if !ok {
+		return
+	}
+
+	// Large uploads can outlive the server's read timeout
+	http.NewResponseController(w).SetReadDeadline(time.Time{})
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+	im := &linkImporter{policy: policy, owner: r.URL.Query().Get("owner")}
+	handle := func(line int, rec exportRecord) { im.handle(r.Context(), line, rec) }
+
+	var err error
+	if isCSV {
+		err = readImportCSV(body, columns, handle, &im.resp)
+	} else {
+		err = readImportNDJSON(body, handle, &im.resp)
+	}
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeError(w, http.StatusRequestEntityTooLarge, "body_too_large", "Import too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, "invalid_import", err.Error())
+		return
+	}
+
+	im.finish(r, format)
+	writeJSON(w, http.StatusOK, im.resp)
+}
+
+func readImportNDJSON(body io.Reader, handle func(int, exportRecord), resp *ImportResponse) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var rec exportRecord
+		if err := json.Unmarshal([]byte(text), &rec); err != nil {
+			resp.fail(line, errors.New("invalid JSON"))
+			continue
+		}
+		handle(line, rec)
+	}
+	return scanner.Err()
+}
+
+func readImportCSV(body io.Reader, aliases map[string][]string, handle func(int, exportRecord), resp *ImportResponse) error {
+	cr := csv.NewReader(body)
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err != nil {
+		return errors.New("missing CSV header")
+	}
+	positions := make(map[string]int, len(header))
+	for i, name := range header {
+		positions[strings.TrimSpace(strings.ToLower(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	columns := make(map[string]int, len(aliases))
+	for field, names := range aliases {
+		for _, name := range names {
+			if i, ok := positions[name]; ok {
+				columns[field] = i
+				break
+			}
+		}
+	}
+	for _, required := range []string{"short_code", "original_url"} {
+		if _, ok := columns[required]; !ok {
+			return fmt.Errorf("CSV header is missing %s column", strings.Join(aliases[required], " or "))
+		}
+	}
+
+	field := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	line := 1
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		line++
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				resp.fail(line, err)
+				continue
+			}
+			return err
+		}
+
+		rec := exportRecord{
+			ShortCode:   codeFromShortLink(field(row, "short_code")),
+			OriginalURL: field(row, "original_url"),
+		}
+		if v := field(row, "created_at"); v != "" {
+			if rec.CreatedAt, err = parseImportTime(v); err != nil {
+				resp.fail(line, errors.New("invalid created_at"))
+				continue
+			}
+		}
+		if v := field(row, "expires_at"); v != "" {
+			parsed, err := parseImportTime(v)
+			if err != nil {
+				resp.fail(line, errors.New("invalid expires_at"))
+				continue
+			}
+			rec.ExpiresAt = &parsed
+		}
+		if v := field(row, "click_count"); v != "" {
+			clicks, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				resp.fail(line, errors.New("invalid click_count"))
+				continue
+			}
+			rec.ClickCount = &clicks
+		}
+		handle(line, rec)
+	}
+}
+
+// Other shorteners export the full short link ("bit.ly/abc" or
+// "https://tinyurl.com/abc"); the code is its last path segment
+func codeFromShortLink(v string) string {
+	if i := strings.LastIndex(strings.TrimRight(v, "/"), "/"); i >= 0 {
+		return strings.TrimRight(v, "/")[i+1:]
+	}
+	return v
+}
+
+// Exports write timestamps in RFC 3339, other shorteners in whatever they like
+var importTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05-0700", time.DateTime, time.DateOnly, "1/2/2006 15:04", "1/2/2006"}
+
+func parseImportTime(v string) (time.Time, error) {
+	var err error
+	for _, layout := range importTimeLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// Check a record and return the link domain its code belongs on
+func validateImportRecord(rec *exportRecord) (string, error) {
+	domain, local, err := importCodeDomain(rec.ShortCode)
+	if err != nil {
+		return "", err
+	}
+	if local == "" || len(local) > cfg.MaxCodeLength {
+		return "", fmt.Errorf("short_code must be 1-%d characters", cfg.MaxCodeLength)
+	}
+	if len(rec.ShortCode) > shortCodeColumnLen {
+		return "", errors.New("short_code is too long for its namespace")
+	}
+	parsed, err := parseDestination(rec.OriginalURL)
+	if err != nil {
+		return "", errors.New("invalid original_url: " + err.Error())
+	}
+	if rec.OriginalURL, err = canonicalizeDestination(rec.OriginalURL, parsed); err != nil {
+		return "", errors.New("invalid original_url: " + err.Error())
+	}
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = time.Now()
+	}
+	if rec.ClickCount != nil && *rec.ClickCount < 0 {
+		return "", errors.New("click_count must not be negative")
+	}
+	return domain, nil
+}
+
+// Exports write codes as they're stored, so a tenant's link comes back as
+// "@<tenant>:<code>" and a namespaced one as "<name>:<code>" (or both).
+// They're restored into their tenant and namespace, which have to be set
+// up here too; the link domain is the namespace's host.
+func importCodeDomain(code string) (domain, local string, err error) {
+	if strings.HasPrefix(code, tenantCodeMark) {
+		tenant := codeTenant(code)
+		if tenant == "" {
+			return "", "", errors.New("short_code may start with " + tenantCodeMark + " only as a tenant prefix")
+		}
+		if !tenantKnown(tenant) {
+			return "", "", fmt.Errorf("short_code tenant %q does not exist", tenant)
+		}
+		code = strings.TrimPrefix(code, tenantCodePrefix(tenant))
+	}
+
+	name, local, namespaced := strings.Cut(code, namespaceSeparator)
+	if !namespaced {
+		return "", code, nil
+	}
+	if strings.Contains(local, namespaceSeparator) {
+		return "", "", errors.New("short_code may contain " + namespaceSeparator + " only after a namespace")
+	}
+	host := namespaceHost(name)
+	if cfg.NamespaceDomain == "" || customDomainOwner(host) == "" {
+		return "", "", fmt.Errorf("short_code namespace %q is not registered", name)
+	}
+	return host, local, nil
+}
+
+// Insert one record honoring the conflict policy; reports what happened
+func importRecord(ctx context.Context, rec exportRecord, domain, policy, owner string) (string, error) {
+	storedURL, err := encryptURL(rec.ShortCode, rec.OriginalURL)
+	if err != nil {
+		return "", err
+	}
+
+	if policy == "skip" {
+		var clicks int64
+		if rec.ClickCount != nil {
+			clicks = *rec.ClickCount
+		}
+
+		result, err := db.ExecContext(ctx,
+			`INSERT INTO urls (short_code, original_url, created_at, expires_at, click_count, destination_hash, owner, domain)
+			 VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''))
+			 ON CONFLICT (short_code) DO NOTHING`,
+			rec.ShortCode, storedURL, rec.CreatedAt, rec.ExpiresAt, clicks, destinationHash(rec.OriginalURL), owner, domain)
+		if err != nil {
+			return "", err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return "skipped", nil
+		}
+		return "imported", nil
+	}
+
+	// Records without click_count keep the existing counter on overwrite.
+	// xmax is zero only for freshly inserted rows.
+	var inserted bool
+	err = db.QueryRowContext(ctx,
+		`INSERT INTO urls (short_code, original_url, created_at, expires_at, click_count, destination_hash, owner, domain)
+		 VALUES ($1, $2, $3, $4, COALESCE($5::BIGINT, 0), $6, NULLIF($7, ''), NULLIF($8, ''))
+		 ON CONFLICT (short_code) DO UPDATE SET
+			original_url = EXCLUDED.original_url,
+			owner = COALESCE(EXCLUDED.owner, urls.owner),
+			domain = COALESCE(EXCLUDED.domain, urls.domain),
+			destination_hash = EXCLUDED.destination_hash,
+			created_at = EXCLUDED.created_at,
+			expires_at = EXCLUDED.expires_at,
+			click_count = COALESCE($5::BIGINT, urls.click_count)
+		 RETURNING (xmax = 0)`,
+		rec.ShortCode, storedURL, rec.CreatedAt, rec.ExpiresAt, rec.ClickCount, destinationHash(rec.OriginalURL), owner, domain).Scan(&inserted)
+	if err != nil {
+		return "", err
+	}
+	if inserted {
+		return "imported", nil
+	}
+	return "overwritten", nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Network restriction for the operational surfaces. With ops_allowed_cidrs
+// set, /api/v1/admin/*, /metrics and /dashboard only answer clients inside
+// those ranges; everyone else gets the same 404 as a missing route.
+//
+// The check uses the TCP peer address. X-Forwarded-For is only believed when
+// the peer is itself in trusted_proxy_cidrs, otherwise anyone could claim to
+// be 10.0.0.1.
+type ipAllowlist struct {
+	allowed []netip.Prefix
+	proxies []netip.Prefix
+}
+
+func parseCIDRList(key string, entries []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			// A bare address means just that host
+			if addr, err := netip.ParseAddr(entry); err == nil {
+				entry = netip.PrefixFrom(addr, addr.BitLen()).String()
+			}
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			fatal("Invalid CIDR", "key", key, "value", entry, "err", err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
+
+// Proxies trusted for getClientIP; none until main loads the config
+var trustedProxies = newProxyList(nil)
+
+// A list only walking X-Forwarded-For, allowing nothing
+func newProxyList(proxies []string) *ipAllowlist {
+	return &ipAllowlist{proxies: parseCIDRList("trusted_proxy_cidrs", proxies)}
+}
+
+// nil when no ranges are configured, which leaves the operational endpoints open
+func newIPAllowlist(allowed, proxies []string) *ipAllowlist {
+	if len(allowed) == 0 {
+		return nil
+	}
+	return &ipAllowlist{
+		allowed: parseCIDRList("ops_allowed_cidrs", allowed),
+		proxies: parseCIDRList("trusted_proxy_cidrs", proxies),
+	}
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Address of the client, walking X-Forwarded-For back through trusted proxies
+func (l *ipAllowlist) clientAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0 && containsAddr(l.proxies, addr); i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop
+	}
+	return addr, true
+}
+
+func isOperationalPath(path string) bool {
+	return strings.HasPrefix(path, "/api/v1/admin/") || path == "/metrics" || path == "/dashboard"
+}
+
+func restrictOperational(allow *ipAllowlist, next http.Handler) http.Handler {
+	if allow == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isOperationalPath(r.URL.Path) {
+			addr, ok := allow.clientAddr(r)
+			if !ok || !containsAddr(allow.allowed, addr) {
+				writeError(w, http.StatusNotFound, "not_found", "Not found")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
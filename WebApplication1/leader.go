@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Leader election for cluster-wide background jobs (partition upkeep,
+// sweeps, re-checks, exports): whichever instance holds a PostgreSQL
+// session advisory lock runs them, the others skip their ticks. The lock
+// lives on one pinned connection, so it goes away with that session - a
+// crashed leader's lock is released when PostgreSQL notices, and another
+// instance takes over on its next attempt. Session locks need a direct
+// connection; behind a transaction-pooling PgBouncer every instance would
+// think it holds it.
+//
+// Per-instance work (cache refreshes, in-memory counters) runs everywhere.
+const (
+	leaderLockKey   = 0x6968646173 // "ihdas"
+	leaderRetryTick = 15 * time.Second
+)
+
+var (
+	leading atomic.Bool
+
+	leaderConn struct {
+		mu   sync.Mutex
+		conn *sql.Conn
+	}
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ihdas_leader",
+		Help: "1 while this instance runs the cluster-wide background jobs.",
+	}, func() float64 {
+		if leading.Load() {
+			return 1
+		}
+		return 0
+	})
+)
+
+func initLeaderElection() {
+	campaign()
+	go func() {
+		ticker := time.NewTicker(leaderRetryTick)
+		defer ticker.Stop()
+		for range ticker.C {
+			campaign()
+		}
+	}()
+}
+
+// Whether this instance should run cluster-wide jobs right now
+func isLeader() bool {
+	return leading.Load()
+}
+
+// Take the lock if it's free, or check the session holding it is still up
+func campaign() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	leaderConn.mu.Lock()
+	defer leaderConn.mu.Unlock()
+	if shuttingDown.Load() {
+		return
+	}
+
+	if leaderConn.conn != nil {
+		err := leaderConn.conn.PingContext(ctx)
+		if err == nil {
+			return
+		}
+		slog.Warn("Lost background job leadership", "err", err)
+		discardConn(leaderConn.conn)
+		leaderConn.conn = nil
+		leading.Store(false)
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		slog.Warn("Leader election connection failed", "err", err)
+		return
+	}
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, leaderLockKey).Scan(&acquired); err != nil || !acquired {
+		if err != nil {
+			slog.Warn("Leader election failed", "err", err)
+		}
+		conn.Close()
+		return
+	}
+	leaderConn.conn = conn
+	leading.Store(true)
+	slog.Info("Running background jobs as leader")
+}
+
+// Let another instance take over at shutdown instead of on its next try
+// after our session times out
+func resignLeadership() {
+	leaderConn.mu.Lock()
+	defer leaderConn.mu.Unlock()
+	if leaderConn.conn == nil {
+		return
+	}
+	leading.Store(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := leaderConn.conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, leaderLockKey); err != nil {
+		slog.Warn("Leader lock release failed", "err", err)
+		discardConn(leaderConn.conn)
+	} else {
+		leaderConn.conn.Close()
+	}
+	leaderConn.conn = nil
+}
+
+// Close the session itself rather than return it to the pool, where it
+// could go on holding the lock
+func discardConn(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	conn.Close()
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Destination health: every destination_check_interval each live link's
+// destination gets a HEAD request (a GET where HEAD isn't allowed) and the
+// outcome is kept per link for list and stats responses. A destination
+// failing for destination_dead_after is dead: its owner hears about it once,
+// through the link.destination_dead webhook event and, if they get
+// notification emails, a mail listing their dead links. A link that comes
+// back alive can be reported again later. A page's buttons and a
+// bundle's items are checked with it, and the first one failing is the
+// link's outcome.
+const (
+	healthAlive       = "alive"
+	healthNotFound    = "not_found"  // 404 or 410
+	healthHTTPError   = "http_error" // any other error status
+	healthTimeout     = "timeout"
+	healthSSLError    = "ssl_error"
+	healthDNSError    = "dns_error"
+	healthUnreachable = "unreachable" // refused, reset, blocked internal address, ...
+
+	healthBatchSize    = 200
+	healthWorkers      = 8
+	healthCheckTimeout = 10 * time.Second
+)
+
+type LinkHealth struct {
+	Status       string     `json:"status"`
+	HTTPStatus   int        `json:"http_status,omitempty"`
+	CheckedAt    time.Time  `json:"checked_at"`
+	FailingSince *time.Time `json:"failing_since,omitempty"`
+}
+
+type deadLink struct {
+	link   *Link
+	status string
+}
+
+func initLinkHealth() {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS link_health (
+		short_code VARCHAR(64) PRIMARY KEY,
+		status TEXT NOT NULL,
+		http_status INT,
+		checked_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		failing_since TIMESTAMP,
+		notified_at TIMESTAMP
+	);
+	`
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Link health table creation failed", "err", err)
+	}
+	if cfg.DestinationCheckInterval == 0 {
+		return
+	}
+
+	// Same internal-address protection as previews and webhooks
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.BlockPrivateDestinations {
+		transport.DialContext = (&net.Dialer{Timeout: healthCheckTimeout, Control: blockInternalDial}).DialContext
+	}
+	client := &http.Client{Timeout: healthCheckTimeout, Transport: transport}
+
+	go func() {
+		ticker := time.NewTicker(cfg.DestinationCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !isLeader() {
+				continue
+			}
+			if err := checkDestinations(context.Background(), client); err != nil {
+				slog.Error("Destination check error", "err", err)
+			}
+		}
+	}()
+}
+
+// Check every live link's destination, then tell owners about new dead ones
+func checkDestinations(ctx context.Context, client *http.Client) error {
+	var mu sync.Mutex
+	dead := map[string][]deadLink{} // owner -> links
+
+	var afterID int64
+	for {
+		links, err := store.ListLinks(ctx, LinkFilter{Status: "active"}, afterID, healthBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(links) == 0 {
+			break
+		}
+		afterID = links[len(links)-1].ID
+		items, err := pageDestinationURLs(ctx, links)
+		if err != nil {
+			return err
+		}
+
+		jobs := make(chan *Link)
+		var wg sync.WaitGroup
+		for i := 0; i < healthWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for link := range jobs {
+					status, code := checkDestination(ctx, client, link.OriginalURL)
+					// A page is as healthy as its first failing destination
+					for _, item := range items[link.ShortCode] {
+						if status != healthAlive {
+							break
+						}
+						status, code = checkDestination(ctx, client, item)
+					}
+					newlyDead, err := recordLinkHealth(ctx, link.ShortCode, status, code)
+					if err != nil {
+						slog.Error("Link health store error", "short_code", link.ShortCode, "err", err)
+						continue
+					}
+					if newlyDead {
+						mu.Lock()
+						dead[link.Owner] = append(dead[link.Owner], deadLink{link, status})
+						mu.Unlock()
+					}
+				}
+			}()
+		}
+		for _, link := range links {
+			jobs <- link
+		}
+		close(jobs)
+		wg.Wait()
+	}
+
+	for owner, links := range dead {
+		for _, d := range links {
+			goBackground(func() { emitLinkEvent(EventDestinationDead, d.link) })
+		}
+		if owner == "" || !emailEnabled() {
+			continue
+		}
+		if err := sendDeadLinkNotice(ctx, owner, links); err != nil {
+			slog.Error("Dead link notice error", "owner", owner, "err", err)
+		}
+	}
+	return nil
+}
+
+func checkDestination(ctx context.Context, client *http.Client, destination string) (string, int) {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	resp, err := probeDestination(ctx, client, http.MethodHead, destination)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp, err = probeDestination(ctx, client, http.MethodGet, destination)
+	}
+	if err != nil {
+		return classifyCheckError(err), 0
+	}
+
+	switch code := resp.StatusCode; {
+	case code < 400:
+		return healthAlive, code
+	// Bot walls and rate limits still mean someone is home
+	case code == http.StatusUnauthorized || code == http.StatusForbidden || code == http.StatusTooManyRequests:
+		return healthAlive, code
+	case code == http.StatusNotFound || code == http.StatusGone:
+		return healthNotFound, code
+	default:
+		return healthHTTPError, code
+	}
+}
+
+func probeDestination(ctx context.Context, client *http.Client, method, destination string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, destination, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "ihdas-health/1")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func classifyCheckError(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var hostErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &dnsErr):
+		return healthDNSError
+	case errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &hostErr),
+		errors.As(err, &authorityErr), errors.As(err, &invalidErr):
+		return healthSSLError
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return healthTimeout
+	}
+	return healthUnreachable
+}
+
+// Store a check's outcome; reports whether the link has now been failing
+// long enough to be dead and nobody has been told yet. Claiming the notice
+// here keeps two instances checking at once from both sending it.
+func recordLinkHealth(ctx context.Context, shortCode, status string, httpStatus int) (bool, error) {
+	var failingSince *time.Time
+	var notified bool
+	err := db.QueryRowContext(ctx,
+		`INSERT INTO link_health (short_code, status, http_status, failing_since)
+		 VALUES ($1, $2, NULLIF($3, 0), CASE WHEN $2 = 'alive' THEN NULL ELSE NOW() END)
+		 ON CONFLICT (short_code) DO UPDATE SET status = EXCLUDED.status, http_status = EXCLUDED.http_status,
+		 checked_at = NOW(),
+		 failing_since = CASE WHEN EXCLUDED.status = 'alive' THEN NULL ELSE COALESCE(link_health.failing_since, NOW()) END,
+		 notified_at = CASE WHEN EXCLUDED.status = 'alive' THEN NULL ELSE link_health.notified_at END
+		 RETURNING failing_since, notified_at IS NOT NULL`,
+		shortCode, status, httpStatus).Scan(&failingSince, &notified)
+	if err != nil || failingSince == nil || notified || time.Since(*failingSince) < cfg.DestinationDeadAfter {
+		return false, err
+	}
+	result, err := db.ExecContext(ctx,
+		`UPDATE link_health SET notified_at = NOW() WHERE short_code = $1 AND notified_at IS NULL`, shortCode)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+func sendDeadLinkNotice(ctx context.Context, owner string, links []deadLink) error {
+	var to, token string
+	err := db.QueryRowContext(ctx,
+		`SELECT email, unsubscribe_token FROM notification_preferences WHERE owner = $1 AND dead_link_notices`,
+		owner).Scan(&to, &token)
+	if err == sql.ErrNoRows {
+		// No address, or they don't want these
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Tenant owners hear from their tenant's host and brand
+	host := publicHost()
+	tenant := ownerTenant(owner)
+	if h := tenantPrimaryHost(tenant); h != "" {
+		host = h
+	}
+	var body strings.Builder
+	if len(links) == 1 {
+		body.WriteString("The destination of one of your short links stopped working:\n\n")
+	} else {
+		fmt.Fprintf(&body, "The destinations of %d of your short links stopped working:\n\n", len(links))
+	}
+	for _, d := range links {
+		fmt.Fprintf(&body, "  %s  (%s)\n    -> %s\n", shortURL(linkHost(d.link, host), d.link.ShortCode),
+			strings.ReplaceAll(d.status, "_", " "), d.link.OriginalURL)
+	}
+	body.WriteString("\nThe links still redirect there. Point them somewhere else, or switch them to their archived copy.\n")
+	unsubscribe := baseURL(host) + "/notifications/unsubscribe?token=" + url.QueryEscape(token)
+	fmt.Fprintf(&body, "\nStop these emails: %s\n", unsubscribe)
+
+	subject := "A short link's destination stopped working"
+	if len(links) > 1 {
+		subject = fmt.Sprintf("%d short link destinations stopped working", len(links))
+	}
+	if brand := tenantBrand(tenant); brand.Name != "" {
+		subject = brand.Name + ": " + subject
+	}
+	return sendEmail(ctx, emailMessage{To: to, Subject: subject, Body: body.String(), Unsubscribe: unsubscribe})
+}
+
+func loadLinkHealth(ctx context.Context, codes []string) (map[string]*LinkHealth, error) {
+	health := map[string]*LinkHealth{}
+	if len(codes) == 0 {
+		return health, nil
+	}
+	codesJSON, _ := json.Marshal(codes)
+	rows, err := db.QueryContext(ctx,
+		`SELECT short_code, status, COALESCE(http_status, 0), checked_at, failing_since
+		 FROM link_health WHERE short_code IN (SELECT json_array_elements_text($1::JSON))`, string(codesJSON))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var code string
+		h := &LinkHealth{}
+		if err := rows.Scan(&code, &h.Status, &h.HTTPStatus, &h.CheckedAt, &h.FailingSince); err != nil {
+			return nil, err
+		}
+		health[code] = h
+	}
+	return health, rows.Err()
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Link-in-bio pages: a link with a page attached answers with a server-
+// rendered page of buttons instead of redirecting. The page replaces the
+// redirect without replacing the link, so clicks, expiry, disabling,
+// namespaces and tenants work as they do for any link, and removing the
+// page makes the code redirect to its destination again. Buttons are
+// destinations like any other: they're scored for spam when saved and
+// re-checked by the reputation, blocklist and health sweeps with the link.
+// A bundle (bundles.go) is the other kind of page a link can have instead.
+const (
+	maxPageButtons     = 50
+	maxPageTitleLen    = 100
+	maxPageTextLen     = 300
+	maxButtonTitleLen  = 100
+	defaultButtonColor = "#222222"
+)
+
+type LinkPage struct {
+	ShortCode   string       `json:"short_code"`
+	Title       string       `json:"title"`
+	Description string       `json:"description,omitempty"`
+	Buttons     []PageButton `json:"buttons"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	Status      string       `json:"status,omitempty"` // pending_review while held for spam review
+}
+
+type PageButton struct {
+	Title    string `json:"title"`
+	URL      string `json:"url"`
+	IconURL  string `json:"icon_url,omitempty"`
+	Position int    `json:"position"` // 0 is shown first
+}
+
+// Buttons are shown in the order given
+type LinkPageRequest struct {
+	Title       string              `json:"title"`
+	Description string              `json:"description,omitempty"`
+	Buttons     []PageButtonRequest `json:"buttons"`
+}
+
+type PageButtonRequest struct {
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	IconURL string `json:"icon_url,omitempty"`
+}
+
+func initLinkPages() {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS link_pages (
+		short_code VARCHAR(64) PRIMARY KEY REFERENCES urls(short_code) ON DELETE CASCADE,
+		title TEXT NOT NULL,
+		description TEXT,
+		updated_at TIMESTAMP DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS link_page_buttons (
+		short_code VARCHAR(64) NOT NULL REFERENCES link_pages(short_code) ON DELETE CASCADE,
+		position INT NOT NULL,
+		title TEXT NOT NULL,
+		url TEXT NOT NULL,
+		icon_url TEXT,
+		PRIMARY KEY (short_code, position)
+	);
+	`
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Link pages table creation failed", "err", err)
+	}
+}
+
+// Button destinations get the same checks as link destinations
+func validateLinkPage(ctx context.Context, req *LinkPageRequest) error {
+	req.Title = strings.TrimSpace(req.Title)
+	if req.Title == "" || utf8.RuneCountInString(req.Title) > maxPageTitleLen {
+		return &apiError{http.StatusBadRequest, "invalid_title", fmt.Sprintf("title must be 1-%d characters", maxPageTitleLen)}
+	}
+	if utf8.RuneCountInString(req.Description) > maxPageTextLen {
+		return &apiError{http.StatusBadRequest, "invalid_description", fmt.Sprintf("description must be at most %d characters", maxPageTextLen)}
+	}
+	if len(req.Buttons) == 0 || len(req.Buttons) > maxPageButtons {
+		return &apiError{http.StatusBadRequest, "invalid_buttons", fmt.Sprintf("a page has 1-%d buttons", maxPageButtons)}
+	}
+	for i := range req.Buttons {
+		b := &req.Buttons[i]
+		b.Title = strings.TrimSpace(b.Title)
+		if b.Title == "" || utf8.RuneCountInString(b.Title) > maxButtonTitleLen {
+			return &apiError{http.StatusBadRequest, "invalid_buttons",
+				fmt.Sprintf("buttons[%d]: title must be 1-%d characters", i, maxButtonTitleLen)}
+		}
+		destination, err := validateDestination(ctx, b.URL)
+		if err != nil {
+			return prefixAPIError(err, fmt.Sprintf("buttons[%d]: ", i))
+		}
+		b.URL = destination
+		if b.IconURL != "" {
+			if _, err := parseDestination(b.IconURL); err != nil {
+				return prefixAPIError(err, fmt.Sprintf("buttons[%d].icon_url: ", i))
+			}
+		}
+	}
+	return nil
+}
+
+// Point a field-level error at the field it's about
+func prefixAPIError(err error, prefix string) error {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return &apiError{apiErr.Status, apiErr.Code, prefix + apiErr.Message}
+	}
+	return err
+}
+
+func getLinkPage(ctx context.Context, shortCode string) (*LinkPage, error) {
+	page := LinkPage{ShortCode: shortCode, Buttons: []PageButton{}}
+	err := db.QueryRowContext(ctx,
+		`SELECT title, COALESCE(description, ''), updated_at FROM link_pages WHERE short_code = $1`, shortCode).
+		Scan(&page.Title, &page.Description, &page.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT position, title, url, COALESCE(icon_url, '') FROM link_page_buttons
+		 WHERE short_code = $1 ORDER BY position`, shortCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b PageButton
+		if err := rows.Scan(&b.Position, &b.Title, &b.URL, &b.IconURL); err != nil {
+			return nil, err
+		}
+		if b.URL, err = decryptURL(pageURLData(shortCode, b.Position), b.URL); err != nil {
+			return nil, fmt.Errorf("decrypt button %d of %s: %w", b.Position, shortCode, err)
+		}
+		page.Buttons = append(page.Buttons, b)
+	}
+	return &page, rows.Err()
+}
+
+// Replace a link's page, buttons and all
+func saveLinkPage(ctx context.Context, shortCode string, req LinkPageRequest) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if hasBundle, err := lockLinkPages(ctx, tx, shortCode, "link_bundles"); err != nil {
+		return err
+	} else if hasBundle {
+		return errLinkHasBundle
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO link_pages (short_code, title, description) VALUES ($1, $2, NULLIF($3, ''))
+		 ON CONFLICT (short_code) DO UPDATE SET title = EXCLUDED.title, description = EXCLUDED.description,
+		 updated_at = NOW()`, shortCode, req.Title, req.Description); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM link_page_buttons WHERE short_code = $1`, shortCode); err != nil {
+		return err
+	}
+	for i, b := range req.Buttons {
+		// Encrypted at rest like the link's own destination
+		storedURL, err := encryptURL(pageURLData(shortCode, i), b.URL)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO link_page_buttons (short_code, position, title, url, icon_url) VALUES ($1, $2, $3, $4, NULLIF($5, ''))`,
+			shortCode, i, b.Title, storedURL, b.IconURL); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE urls SET has_page = TRUE WHERE short_code = $1`, shortCode); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func scorePageButtons(ctx context.Context, req LinkPageRequest) *spamScore {
+	urls := make([]string, len(req.Buttons))
+	for i, b := range req.Buttons {
+		urls[i] = b.URL
+	}
+	return scorePageDestinations(ctx, urls, func(i int) string { return "page_button:" + strconv.Itoa(i) })
+}
+
+// Destinations the given links' pages and bundles hand out, by short code,
+// for the sweeps re-checking live destinations
+func pageDestinationURLs(ctx context.Context, links []*Link) (map[string][]string, error) {
+	var codes []string
+	for _, link := range links {
+		if link.HasPage {
+			codes = append(codes, link.ShortCode)
+		}
+	}
+	urls := map[string][]string{}
+	if len(codes) == 0 {
+		return urls, nil
+	}
+	rows, err := db.QueryContext(ctx,
+		`SELECT short_code, n, url FROM (
+			SELECT short_code, number AS n, url FROM link_bundle_items
+			UNION ALL SELECT short_code, position, url FROM link_page_buttons
+		 ) d WHERE short_code = ANY($1) ORDER BY short_code, n`, codes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var code, destination string
+		var n int
+		if err := rows.Scan(&code, &n, &destination); err != nil {
+			return nil, err
+		}
+		if destination, err = decryptURL(pageURLData(code, n), destination); err != nil {
+			return nil, fmt.Errorf("decrypt page destination %d of %s: %w", n, code, err)
+		}
+		urls[code] = append(urls[code], destination)
+	}
+	return urls, rows.Err()
+}
+
+// GET /api/v1/links/{code}/page
+func getLinkPageHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := callerLink(w, r)
+	if !ok {
+		return
+	}
+	page, err := getLinkPage(r.Context(), link.ShortCode)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "page_not_found", "Link has no page")
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Link page lookup error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if link.DisabledReason == spamReviewReason {
+		page.Status = "pending_review"
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// PUT /api/v1/links/{code}/page - attach a page, or replace the one there
+func putLinkPageHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := callerLink(w, r)
+	if !ok {
+		return
+	}
+	var req LinkPageRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	if err := validateLinkPage(r.Context(), &req); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	spam := scorePageButtons(r.Context(), req)
+
+	var apiErr *apiError
+	if err := saveLinkPage(r.Context(), link.ShortCode, req); errors.As(err, &apiErr) {
+		writeAPIError(w, err)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Link page save error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	invalidateCachedURL(r.Context(), link.ShortCode)
+	page, err := getLinkPage(r.Context(), link.ShortCode)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Link page lookup error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	auditCaller(r.Context(), "link.page.save", link.ShortCode, map[string]interface{}{"buttons": len(page.Buttons)})
+	emitLinkUpdated(link.ShortCode)
+	if spam != nil {
+		if err := holdForSpamReview(r.Context(), link, spam); err != nil {
+			slog.ErrorContext(r.Context(), "Spam hold error", "err", err)
+		}
+	}
+	if spam != nil || link.DisabledReason == spamReviewReason {
+		page.Status = "pending_review"
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// DELETE /api/v1/links/{code}/page - the code redirects again
+func deleteLinkPageHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := callerLink(w, r)
+	if !ok {
+		return
+	}
+	res, err := db.ExecContext(r.Context(), `DELETE FROM link_pages WHERE short_code = $1`, link.ShortCode)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Link page delete error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, http.StatusNotFound, "page_not_found", "Link has no page")
+		return
+	}
+	if _, err := db.ExecContext(r.Context(), `UPDATE urls SET has_page = FALSE WHERE short_code = $1`, link.ShortCode); err != nil {
+		slog.ErrorContext(r.Context(), "Link page delete error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	invalidateCachedURL(r.Context(), link.ShortCode)
+	auditCaller(r.Context(), "link.page.delete", link.ShortCode, nil)
+	emitLinkUpdated(link.ShortCode)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Render a link's page for a visitor, in its tenant's colour when it has
+// one; a link without a page row is a bundle
+func serveLinkPage(w http.ResponseWriter, r *http.Request, shortCode string) {
+	page, err := getLinkPage(r.Context(), shortCode)
+	if err == sql.ErrNoRows {
+		serveBundlePage(w, r, shortCode)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Link page lookup error", "err", err)
+		serveErrorPage(w, r, http.StatusInternalServerError, "error.retry")
+		return
+	}
+	color := defaultButtonColor
+	if c := tenantBrand(codeTenant(shortCode)).PrimaryColor; c != "" {
+		color = c
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Content-Security-Policy", linkPageCSP)
+	fmt.Fprintf(w, `<!doctype html><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>%s</title>
+<style>body{font-family:system-ui,sans-serif;max-width:32rem;margin:2rem auto;padding:0 1rem;text-align:center}
+a.b{display:flex;align-items:center;justify-content:center;gap:.5rem;margin:.75rem 0;padding:.9rem;border-radius:.5rem;
+background:%s;color:#fff;text-decoration:none}a.b img{width:1.5rem;height:1.5rem;border-radius:.25rem}</style>
+<h1>%s</h1>
+`, html.EscapeString(page.Title), color, html.EscapeString(page.Title))
+	if page.Description != "" {
+		fmt.Fprintf(w, "<p>%s</p>\n", html.EscapeString(page.Description))
+	}
+	for _, b := range page.Buttons {
+		icon := ""
+		if b.IconURL != "" {
+			icon = fmt.Sprintf(`<img src="%s" alt="">`, html.EscapeString(b.IconURL))
+		}
+		fmt.Fprintf(w, "<a class=\"b\" href=\"%s\" rel=\"nofollow noopener\">%s%s</a>\n",
+			html.EscapeString(b.URL), icon, html.EscapeString(b.Title))
+	}
+}
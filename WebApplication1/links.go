@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+type LinkListResponse struct {
+	Links      []*StatsResponse `json:"links"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+type ClickEventListResponse struct {
+	Events     []ClickEvent `json:"events"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// GET /api/v1/links?cursor=&limit= - the caller's links, oldest first
+func listLinksHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return
+	}
+	afterID, limit, ok := parsePageQuery(w, r)
+	if !ok {
+		return
+	}
+
+	// One extra row tells us whether there is a next page
+	links, err := store.ListLinks(r.Context(), LinkFilter{Owner: owner}, afterID, limit+1)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Link list error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	hasNext := len(links) > limit
+	if hasNext {
+		links = links[:limit]
+	}
+
+	codes := make([]string, len(links))
+	for i, link := range links {
+		codes[i] = link.ShortCode
+	}
+	previews, err := loadLinkPreviews(r.Context(), codes)
+	if err != nil {
+		// The list is still useful without them
+		slog.ErrorContext(r.Context(), "Preview lookup error", "err", err)
+	}
+	health, err := loadLinkHealth(r.Context(), codes)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Link health lookup error", "err", err)
+	}
+
+	resp := LinkListResponse{Links: []*StatsResponse{}}
+	for _, link := range links {
+		resp.Links = append(resp.Links, &StatsResponse{
+			ShortCode:   link.ShortCode,
+			OriginalURL: link.OriginalURL,
+			DisplayURL:  displayURL(link.OriginalURL),
+			ArchiveURL:  link.ArchiveURL,
+			ClickCount:  link.ClickCount,
+			CreatedAt:   link.CreatedAt,
+			Preview:     previews[link.ShortCode],
+			Health:      health[link.ShortCode],
+		})
+	}
+	if len(links) > 0 {
+		resp.NextCursor = nextCursor(links[len(links)-1].ID, hasNext)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// One of the caller's links by the code in the path; writes the error
+// response if there isn't one. Other owners' links are reported as not found.
+func callerLink(w http.ResponseWriter, r *http.Request) (*Link, bool) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return nil, false
+	}
+	link, err := getTenantLink(r.Context(), r.PathValue("code"))
+	if errors.Is(err, ErrLinkNotFound) || (err == nil && link.Owner != owner) {
+		writeError(w, http.StatusNotFound, "link_not_found", "Short URL not found")
+		return nil, false
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Database error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return nil, false
+	}
+	return link, true
+}
+
+// GET /api/v1/links/{code}/events?cursor=&limit= - raw click events for one
+// of the caller's links
+func clickEventsHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := callerLink(w, r)
+	if !ok {
+		return
+	}
+	afterID, limit, ok := parsePageQuery(w, r)
+	if !ok {
+		return
+	}
+
+	events, err := listClickEvents(r.Context(), link.ShortCode, afterID, limit+1)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Click event list error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	hasNext := len(events) > limit
+	if hasNext {
+		events = events[:limit]
+	}
+
+	resp := ClickEventListResponse{Events: []ClickEvent{}}
+	resp.Events = append(resp.Events, events...)
+	if len(events) > 0 {
+		resp.NextCursor = nextCursor(events[len(events)-1].ID, hasNext)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// DELETE /api/v1/links/{code} - delete one of the caller's links
+func deleteLinkHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := callerLink(w, r)
+	if !ok {
+		return
+	}
+
+	link, err := store.DeleteLink(r.Context(), link.ShortCode)
+	if errors.Is(err, ErrLinkNotFound) {
+		writeError(w, http.StatusNotFound, "link_not_found", "Short URL not found")
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Link delete error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	invalidateCachedURL(r.Context(), link.ShortCode)
+	auditCaller(r.Context(), "link.delete", link.ShortCode, map[string]interface{}{"original_url": link.OriginalURL})
+	goBackground(func() { emitLinkEvent(EventLinkDeleted, link) })
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Structured logging. The log format picks the text (default) or json
+// handler and the log level filters by debug, info (default), warn or error.
+//
+// Request-scoped fields such as client_ip and short_code are collected in
+// the context as the request moves through the handlers, and added to every
+// record logged with that context.
+var logLevel = new(slog.LevelVar)
+
+func initLogging() {
+	if err := setLogLevel(cfg.LogLevel); err != nil {
+		fatal("Invalid log level", "value", cfg.LogLevel)
+	}
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch strings.ToLower(cfg.LogFormat) {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	default:
+		fatal("Invalid log format, use text or json", "value", cfg.LogFormat)
+	}
+	// Also routes anything still using the log package through the handler
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+// Change the level of the running handler, e.g. on a config reload
+func setLogLevel(name string) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return err
+	}
+	logLevel.Set(level)
+	return nil
+}
+
+// Log and exit, for startup failures
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type logFields struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+// Start collecting fields for a request
+func withLogFields(ctx context.Context) context.Context {
+	return context.WithValue(ctx, logFieldsKey, &logFields{})
+}
+
+// Attach fields to every later log record for this request
+func addLogAttrs(ctx context.Context, attrs ...slog.Attr) {
+	if f, ok := ctx.Value(logFieldsKey).(*logFields); ok {
+		f.mu.Lock()
+		f.attrs = append(f.attrs, attrs...)
+		f.mu.Unlock()
+	}
+}
+
+func logAttrs(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	f, ok := ctx.Value(logFieldsKey).(*logFields)
+	if !ok {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]slog.Attr(nil), f.attrs...)
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	addBreadcrumb(ctx, rec)
+	rec.AddAttrs(logAttrs(ctx)...)
+	// Jump from a log line straight to its trace
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		rec.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type LookupResponse struct {
+	OriginalURL string               `json:"original_url"`
+	Links       []*CreateURLResponse `json:"links"`
+}
+
+// GET /api/v1/links/lookup?url=... - the caller's existing codes for a
+// destination, so integrations can reuse them instead of creating duplicates
+func lookupHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	originalURL := r.URL.Query().Get("url")
+	if originalURL == "" {
+		writeError(w, http.StatusBadRequest, "missing_url", "url is required")
+		return
+	}
+	// Destinations are stored canonicalized
+	originalURL = canonicalDestination(originalURL)
+
+	links, err := store.FindByDestination(r.Context(), owner, originalURL)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Lookup error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	resp := LookupResponse{OriginalURL: originalURL, Links: []*CreateURLResponse{}}
+	for _, link := range links {
+		resp.Links = append(resp.Links, buildCreateResponse(link, r.Host))
+	}
+	writeJSONWithETag(w, r, http.StatusOK, resp)
+}
+
+// Destination hashes are of the canonical form, keyed when URLs are
+// encrypted, so they go stale when the canonicalization rules,
+// strip_tracking_params or the encryption key change. The scheme they were
+// last computed under is kept in the database; when it differs from this
+// instance's, the leader recomputes every link's hash in the background, in
+// small batches. Rows created before destination_hash existed are filled in
+// the same way. Until a re-hash finishes, lookups miss links it hasn't
+// reached yet.
+const (
+	destinationRehashBatch = 500
+	destinationRehashTick  = 10 * time.Minute
+)
+
+func initDestinationHashes() {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS destination_hash_scheme (
+		id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+		scheme TEXT NOT NULL,
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	`
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Destination hash scheme table creation failed", "err", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(destinationRehashTick)
+		defer ticker.Stop()
+		for ; ; <-ticker.C {
+			if !isLeader() {
+				continue
+			}
+			if err := refreshDestinationHashes(context.Background()); err != nil {
+				slog.Error("Destination hash refresh error", "err", err)
+			}
+		}
+	}()
+}
+
+// What this instance's destination hashes depend on
+func destinationHashScheme() string {
+	return fmt.Sprintf("canonical:%d strip_tracking:%t key:%s",
+		canonicalFormVersion, cfg.StripTrackingParams, destinationHashKeyID())
+}
+
+// Recompute stale hashes: all of them after a scheme change, otherwise the
+// missing ones
+func refreshDestinationHashes(ctx context.Context) error {
+	scheme := destinationHashScheme()
+	var stored string
+	err := db.QueryRowContext(ctx, `SELECT scheme FROM destination_hash_scheme`).Scan(&stored)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	all := stored != scheme
+
+	var afterID int64
+	total := 0
+	for {
+		n, lastID, err := rehashDestinationBatch(ctx, all, afterID)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		total += n
+		afterID = lastID
+	}
+	if all {
+		if _, err := db.ExecContext(ctx,
+			`INSERT INTO destination_hash_scheme (scheme) VALUES ($1)
+			 ON CONFLICT (id) DO UPDATE SET scheme = EXCLUDED.scheme, updated_at = NOW()`, scheme); err != nil {
+			return err
+		}
+	}
+	if total > 0 {
+		slog.Info("Recomputed destination hashes", "links", total, "scheme", scheme)
+	}
+	return nil
+}
+
+// Rehash one batch of links after afterID, or of links without a hash;
+// reports how many it looked at and the last id
+func rehashDestinationBatch(ctx context.Context, all bool, afterID int64) (int, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	condition := `destination_hash IS NULL`
+	if all {
+		condition = `TRUE`
+	}
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, short_code, original_url FROM urls WHERE id > $1 AND `+condition+` ORDER BY id LIMIT $2`,
+		afterID, destinationRehashBatch)
+	if err != nil {
+		return 0, 0, err
+	}
+	type storedLink struct {
+		id              int64
+		code, storedURL string
+	}
+	var links []storedLink
+	for rows.Next() {
+		var l storedLink
+		if err := rows.Scan(&l.id, &l.code, &l.storedURL); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		links = append(links, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(links) == 0 {
+		return 0, 0, err
+	}
+
+	for _, l := range links {
+		destination, err := decryptURL(l.code, l.storedURL)
+		if err != nil {
+			return 0, 0, fmt.Errorf("decrypt destination for %s: %w", l.code, err)
+		}
+		// A link edited meanwhile was hashed by the edit
+		if _, err := db.ExecContext(ctx, `UPDATE urls SET destination_hash = $1 WHERE id = $2 AND original_url = $3`,
+			destinationHash(canonicalDestination(destination)), l.id, l.storedURL); err != nil {
+			return 0, 0, err
+		}
+	}
+	return len(links), links[len(links)-1].id, nil
+}
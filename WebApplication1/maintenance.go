@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Maintenance mode for database work. While it is on, anything that would
+// write gets a 503 with Retry-After, redirects are answered from the cache
+// only, and clicks on them are not recorded. Reads that reach the database
+// still work as long as it does. The switch is per instance: set it on each
+// one through the admin API, or start them with MAINTENANCE_MODE=true.
+type MaintenanceStatus struct {
+	Enabled    bool       `json:"enabled"`
+	Message    string     `json:"message,omitempty"`
+	RetryAfter int        `json:"retry_after_seconds"`
+	Since      *time.Time `json:"since,omitempty"`
+}
+
+type MaintenanceRequest struct {
+	Enabled    bool   `json:"enabled"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after_seconds"`
+}
+
+var maintenance atomic.Pointer[MaintenanceStatus]
+
+var _ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "ihdas_maintenance_mode",
+	Help: "1 while this instance is in maintenance mode.",
+}, func() float64 {
+	if inMaintenance() {
+		return 1
+	}
+	return 0
+})
+
+func initMaintenance() {
+	setMaintenance(cfg.MaintenanceMode, "", int(cfg.MaintenanceRetryAfter.Seconds()))
+	if cfg.MaintenanceMode {
+		slog.Warn("Starting in maintenance mode")
+	}
+}
+
+func setMaintenance(enabled bool, message string, retryAfter int) MaintenanceStatus {
+	status := MaintenanceStatus{Enabled: enabled, Message: message, RetryAfter: retryAfter}
+	if enabled {
+		now := time.Now()
+		status.Since = &now
+	}
+	maintenance.Store(&status)
+	return status
+}
+
+func maintenanceStatus() MaintenanceStatus {
+	if s := maintenance.Load(); s != nil {
+		return *s
+	}
+	return MaintenanceStatus{}
+}
+
+func inMaintenance() bool {
+	s := maintenance.Load()
+	return s != nil && s.Enabled
+}
+
+// 503 for the current maintenance window
+func writeMaintenance(w http.ResponseWriter) {
+	s := maintenanceStatus()
+	w.Header().Set("Retry-After", strconv.Itoa(s.RetryAfter))
+	detail := s.Message
+	if detail == "" {
+		detail = "Service is in maintenance, please retry later"
+	}
+	writeError(w, http.StatusServiceUnavailable, "maintenance", detail)
+}
+
+// Refuse mutations during maintenance. The toggle itself stays reachable
+// so maintenance can be switched off again.
+func maintenanceGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if inMaintenance() && r.URL.Path != "/api/v1/admin/maintenance" {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				writeMaintenance(w)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GET /api/v1/admin/maintenance
+func getMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, maintenanceStatus())
+}
+
+// PUT /api/v1/admin/maintenance
+func putMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var req MaintenanceRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	if req.RetryAfter < 0 {
+		writeError(w, http.StatusBadRequest, "invalid_retry_after", "retry_after_seconds must not be negative")
+		return
+	}
+	if req.RetryAfter == 0 {
+		req.RetryAfter = int(cfg.MaintenanceRetryAfter.Seconds())
+	}
+
+	status := setMaintenance(req.Enabled, req.Message, req.RetryAfter)
+	slog.WarnContext(r.Context(), "Maintenance mode changed", "enabled", req.Enabled)
+	// The audit table may be the thing under maintenance, so don't wait on it
+	goBackground(func() {
+		auditAdmin(r, "maintenance.set", "", map[string]interface{}{"enabled": req.Enabled, "message": req.Message})
+	})
+	writeJSON(w, http.StatusOK, status)
+}
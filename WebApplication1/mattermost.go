@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Self-hosted chat: Mattermost slash commands and outgoing webhooks post to
+// POST /mattermost/command, Rocket.Chat outgoing integrations to
+// POST /rocketchat/webhook. Neither signs its requests; each integration
+// carries a token instead, which must be one of MATTERMOST_TOKENS or
+// ROCKETCHAT_TOKENS. Without tokens the endpoint doesn't exist.
+//
+// As with Slack, links belong to the owner of the API key the team
+// (Mattermost) or channel (Rocket.Chat, whose integrations are set up per
+// channel) is connected to, and messages from elsewhere are refused.
+const chatWebhookMaxBody = 16 << 10
+
+var (
+	mattermostTeams    = &chatPlatform{name: "mattermost", table: "mattermost_teams", idColumn: "team_id"}
+	rocketChatChannels = &chatPlatform{name: "rocketchat", table: "rocketchat_channels", idColumn: "channel_id"}
+)
+
+// The fields both platforms send, whether as a form or as JSON
+type chatWebhookRequest struct {
+	Token       string `json:"token"`
+	TeamID      string `json:"team_id"`
+	ChannelID   string `json:"channel_id"`
+	UserName    string `json:"user_name"`
+	Text        string `json:"text"`
+	TriggerWord string `json:"trigger_word"` // outgoing webhooks only
+}
+
+// Rocket.Chat posts the reply text as a message in the channel
+type rocketChatResponse struct {
+	Text string `json:"text"`
+}
+
+func readChatWebhook(w http.ResponseWriter, r *http.Request) (chatWebhookRequest, bool) {
+	var req chatWebhookRequest
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, chatWebhookMaxBody))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "body_too_large", "Request body too large")
+		return req, false
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		// Payloads carry more fields than we read, so not decodeJSON
+		err = json.Unmarshal(body, &req)
+	} else {
+		var form url.Values
+		form, err = url.ParseQuery(string(body))
+		req = chatWebhookRequest{
+			Token:       form.Get("token"),
+			TeamID:      form.Get("team_id"),
+			ChannelID:   form.Get("channel_id"),
+			UserName:    form.Get("user_name"),
+			Text:        form.Get("text"),
+			TriggerWord: form.Get("trigger_word"),
+		}
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Invalid request body")
+		return req, false
+	}
+
+	// "shorten https://a.b" from an outgoing webhook is a command like any other
+	if req.TriggerWord != "" {
+		req.Text = strings.TrimPrefix(strings.TrimSpace(req.Text), req.TriggerWord)
+	}
+	return req, true
+}
+
+func validChatToken(token string, tokens []string) bool {
+	valid := false
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			valid = true
+		}
+	}
+	return token != "" && valid
+}
+
+// Look up the connection and run the command; the reply is always a message
+func runChatWebhookCommand(ctx context.Context, p *chatPlatform, id, text, host string) (string, bool) {
+	owner, err := p.owner(ctx, id)
+	if err == sql.ErrNoRows {
+		return "This chat isn't connected to the link shortener yet.", false
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Chat connection lookup error", "platform", p.name, "err", err)
+		return "Something went wrong on our side, please try again.", false
+	}
+	ctx = context.WithValue(ctx, callerOwnerKey, owner)
+	return runShortenCommand(ctx, p.name+":"+id, text, host)
+}
+
+// POST /mattermost/command
+func mattermostCommandHandler(w http.ResponseWriter, r *http.Request) {
+	if len(cfg.MattermostTokens) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	req, ok := readChatWebhook(w, r)
+	if !ok {
+		return
+	}
+	if !validChatToken(req.Token, cfg.MattermostTokens) {
+		writeError(w, http.StatusUnauthorized, "invalid_token", "Invalid integration token")
+		return
+	}
+	addLogAttrs(r.Context(), slog.String("mattermost_team", req.TeamID), slog.String("mattermost_user", req.UserName))
+
+	// Mattermost reads response_type the way Slack does, and outgoing
+	// webhooks ignore it
+	text, ok := runChatWebhookCommand(r.Context(), mattermostTeams, req.TeamID, req.Text, r.Host)
+	resp := slackResponse{ResponseType: "ephemeral", Text: text}
+	if ok {
+		resp.ResponseType = "in_channel"
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// POST /rocketchat/webhook
+func rocketChatWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if len(cfg.RocketChatTokens) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	req, ok := readChatWebhook(w, r)
+	if !ok {
+		return
+	}
+	if !validChatToken(req.Token, cfg.RocketChatTokens) {
+		writeError(w, http.StatusUnauthorized, "invalid_token", "Invalid integration token")
+		return
+	}
+	addLogAttrs(r.Context(), slog.String("rocketchat_channel", req.ChannelID), slog.String("rocketchat_user", req.UserName))
+
+	text, _ := runChatWebhookCommand(r.Context(), rocketChatChannels, req.ChannelID, req.Text, r.Host)
+	writeJSON(w, http.StatusOK, rocketChatResponse{Text: text})
+}
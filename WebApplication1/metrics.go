@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, scraped from GET /metrics. Routes are labelled by
+// their mux pattern rather than the raw path to keep cardinality bounded.
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ihdas_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ihdas_http_request_duration_seconds",
+		Help:    "HTTP request latency by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	apiErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ihdas_api_errors_total",
+		Help: "Problem responses by machine-readable error code.",
+	}, []string{"code"})
+
+	redirectCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ihdas_redirect_cache_lookups_total",
+		Help: "Redirect cache lookups by result (hit or miss).",
+	}, []string{"result"})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ihdas_webhook_queue_depth",
+		Help: "Webhook deliveries waiting for a worker.",
+	}, func() float64 { return float64(len(webhookQueue)) })
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ihdas_redirect_cache_entries",
+		Help: "Entries in the in-memory redirect cache.",
+	}, func() float64 {
+		cacheMutex.RLock()
+		defer cacheMutex.RUnlock()
+		return float64(len(recentCache))
+	})
+)
+
+// Connection pool stats (open, in use, idle, wait count/duration, ...)
+func initDBMetrics() {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, "ihdas"))
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Lets http.ResponseController reach Flush and deadlines underneath
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Count, time and log every request. The route is resolved against mux up
+// front, so requests rejected by middleware are attributed correctly too.
+func instrument(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+
+		ctx := withLogFields(r.Context())
+		addLogAttrs(ctx, slog.String("client_ip", getClientIP(r)))
+		r = r.WithContext(ctx)
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		latency := time.Since(start)
+
+		httpDuration.WithLabelValues(route, r.Method).Observe(latency.Seconds())
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+
+		// Every request at debug, server errors always
+		level := slog.LevelDebug
+		if rec.status >= 500 {
+			level = slog.LevelWarn
+		}
+		slog.LogAttrs(ctx, level, "Request",
+			slog.String("method", r.Method),
+			slog.String("route", route),
+			slog.Int("status", rec.status),
+			slog.Duration("latency", latency))
+	})
+}
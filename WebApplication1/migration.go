@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/XSAM/otelsql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Storage migration: with migration_database_url set, every link write that
+// goes through the Store is made on the current database and then copied to
+// the new one, while reads keep coming from the current database alone. A
+// failed copy is logged and counted but never fails the request.
+//
+// Writes made with plain SQL (click counts, archive switches, erasure, ...)
+// aren't mirrored, and links made before the migration started aren't there
+// at all, so the consistency checker walks both databases comparing links.
+// With repair it copies missing and stale links over and removes ones the
+// current database no longer has. Once a run comes back clean, cutting over
+// is pointing database_url at the new database (after moving urls_id_seq
+// past the highest id, as ids are copied as they are).
+//
+// The new store only has to be a migrationTarget, so a different backend
+// slots in the same way; today that's another PostgreSQL database.
+const (
+	migrationBatchSize  = 500
+	migrationMaxSamples = 20
+)
+
+// The store links are being moved to
+type migrationTarget interface {
+	Store
+	// PutLink writes the link exactly as given, replacing any existing copy
+	PutLink(ctx context.Context, link *Link) error
+}
+
+// MigrationReport is the outcome of one consistency check
+type MigrationReport struct {
+	Repair     bool       `json:"repair"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"` // unset while running
+	Checked    int64      `json:"checked"`
+	Missing    int64      `json:"missing"`    // only in the current database
+	Mismatched int64      `json:"mismatched"` // in both, but different
+	Extra      int64      `json:"extra"`      // only in the new database
+	Repaired   int64      `json:"repaired"`
+	Samples    []string   `json:"samples,omitempty"` // the first codes found differing
+	Error      string     `json:"error,omitempty"`
+}
+
+type MigrationCheckRequest struct {
+	Repair bool `json:"repair"`
+}
+
+type MigrationStatus struct {
+	Running bool             `json:"running"`
+	Last    *MigrationReport `json:"last,omitempty"`
+}
+
+type dualStore struct {
+	primary   Store
+	secondary migrationTarget
+}
+
+var (
+	// Set while a migration is configured
+	migration *dualStore
+
+	migrationState struct {
+		mu      sync.Mutex
+		running bool
+		last    *MigrationReport
+	}
+
+	migrationWriteFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ihdas_migration_write_failures_total",
+		Help: "Link writes that reached the current database but not the migration target, by operation.",
+	}, []string{"op"})
+	migrationInconsistencies = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ihdas_migration_inconsistencies",
+		Help: "Links found missing, mismatched or extra in the migration target by the last consistency check.",
+	}, []string{"kind"})
+)
+
+func initMigration() {
+	if cfg.MigrationDatabaseURL == "" {
+		return
+	}
+	target, err := otelsql.Open("pgx", cfg.MigrationDatabaseURL, otelsql.WithAttributes(semconv.DBSystemPostgreSQL))
+	if err != nil {
+		fatal("Migration database connection failed", "err", err)
+	}
+	target.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	target.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	target.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+
+	// Just the columns the Store reads and writes; the rest of the schema
+	// is created when the server first starts against the new database
+	createTable := `
+	CREATE TABLE IF NOT EXISTS urls (
+		id BIGSERIAL PRIMARY KEY,
+		short_code VARCHAR(64) UNIQUE NOT NULL,
+		original_url TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT NOW(),
+		expires_at TIMESTAMP,
+		click_count BIGINT DEFAULT 0
+	);
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS owner TEXT;
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS destination_hash CHAR(64);
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP;
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS disabled_reason TEXT;
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS domain TEXT;
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS has_page BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS archive_url TEXT;
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS serve_archive BOOLEAN NOT NULL DEFAULT FALSE;
+	`
+	if _, err := target.Exec(createTable); err != nil {
+		fatal("Migration database table creation failed", "err", err)
+	}
+
+	migration = &dualStore{primary: store, secondary: &pgStore{db: target}}
+	store = migration
+	slog.Info("Dual-writing links to the migration database")
+
+	if cfg.MigrationCheckInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(cfg.MigrationCheckInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				if !isLeader() {
+					continue
+				}
+				if !startMigrationCheck(cfg.MigrationRepair) {
+					slog.Warn("Migration check still running, skipping")
+				}
+			}
+		}()
+	}
+}
+
+// Copy a write to the migration target, logging rather than failing
+func (d *dualStore) mirror(ctx context.Context, op, shortCode string, fn func() error) {
+	if err := fn(); err != nil {
+		migrationWriteFailures.WithLabelValues(op).Inc()
+		slog.WarnContext(ctx, "Migration write failed", "op", op, "short_code", shortCode, "err", err)
+	}
+}
+
+func (d *dualStore) NextCode(ctx context.Context) (string, error) {
+	return d.primary.NextCode(ctx)
+}
+
+// Side-table steps run on the current database only
+func (d *dualStore) CreateLink(ctx context.Context, link *Link, steps ...TxStep) error {
+	if err := d.primary.CreateLink(ctx, link, steps...); err != nil {
+		return err
+	}
+	d.mirror(ctx, "create", link.ShortCode, func() error { return d.secondary.PutLink(ctx, link) })
+	return nil
+}
+
+func (d *dualStore) CreateLinks(ctx context.Context, links []*Link) ([]error, error) {
+	errs, err := d.primary.CreateLinks(ctx, links)
+	if err != nil {
+		return nil, err
+	}
+	for i, link := range links {
+		if errs[i] == nil {
+			d.mirror(ctx, "create", link.ShortCode, func() error { return d.secondary.PutLink(ctx, link) })
+		}
+	}
+	return errs, nil
+}
+
+func (d *dualStore) GetLink(ctx context.Context, shortCode string) (*Link, error) {
+	return d.primary.GetLink(ctx, shortCode)
+}
+
+func (d *dualStore) ListLinks(ctx context.Context, filter LinkFilter, afterID int64, limit int) ([]*Link, error) {
+	return d.primary.ListLinks(ctx, filter, afterID, limit)
+}
+
+// The whole link is copied over, so a target that never had it catches up
+func (d *dualStore) DisableLink(ctx context.Context, shortCode, reason string) error {
+	if err := d.primary.DisableLink(ctx, shortCode, reason); err != nil {
+		return err
+	}
+	d.mirror(ctx, "disable", shortCode, func() error {
+		link, err := d.primary.GetLink(ctx, shortCode)
+		if err != nil {
+			return err
+		}
+		return d.secondary.PutLink(ctx, link)
+	})
+	return nil
+}
+
+func (d *dualStore) EnableLink(ctx context.Context, shortCode, reason string) error {
+	if err := d.primary.EnableLink(ctx, shortCode, reason); err != nil {
+		return err
+	}
+	d.mirror(ctx, "enable", shortCode, func() error {
+		link, err := d.primary.GetLink(ctx, shortCode)
+		if err != nil {
+			return err
+		}
+		return d.secondary.PutLink(ctx, link)
+	})
+	return nil
+}
+
+func (d *dualStore) DeleteLink(ctx context.Context, shortCode string) (*Link, error) {
+	link, err := d.primary.DeleteLink(ctx, shortCode)
+	if err != nil {
+		return nil, err
+	}
+	d.mirror(ctx, "delete", shortCode, func() error {
+		if _, err := d.secondary.DeleteLink(ctx, shortCode); err != nil && !errors.Is(err, ErrLinkNotFound) {
+			return err
+		}
+		return nil
+	})
+	return link, nil
+}
+
+func (d *dualStore) FindByDestination(ctx context.Context, owner, originalURL string) ([]*Link, error) {
+	return d.primary.FindByDestination(ctx, owner, originalURL)
+}
+
+// Run a check in the background unless one is already going
+func startMigrationCheck(repair bool) bool {
+	migrationState.mu.Lock()
+	defer migrationState.mu.Unlock()
+	if migrationState.running {
+		return false
+	}
+	report := &MigrationReport{Repair: repair, StartedAt: time.Now().UTC()}
+	migrationState.running = true
+	migrationState.last = report
+
+	go func() {
+		err := migration.check(context.Background(), report)
+
+		migrationState.mu.Lock()
+		defer migrationState.mu.Unlock()
+		finished := time.Now().UTC()
+		report.FinishedAt = &finished
+		if err != nil {
+			report.Error = err.Error()
+			slog.Error("Migration check failed", "err", err)
+		} else {
+			migrationInconsistencies.WithLabelValues("missing").Set(float64(report.Missing))
+			migrationInconsistencies.WithLabelValues("mismatched").Set(float64(report.Mismatched))
+			migrationInconsistencies.WithLabelValues("extra").Set(float64(report.Extra))
+			slog.Info("Migration check finished", "checked", report.Checked, "missing", report.Missing,
+				"mismatched", report.Mismatched, "extra", report.Extra, "repaired", report.Repaired)
+		}
+		migrationState.running = false
+	}()
+	return true
+}
+
+// Walk the current database comparing each link with its copy, then the
+// new one for links that shouldn't be there. The report is filled in as it
+// goes, under migrationState.mu, so status requests see progress.
+func (d *dualStore) check(ctx context.Context, report *MigrationReport) error {
+	update := func(fn func()) {
+		migrationState.mu.Lock()
+		fn()
+		migrationState.mu.Unlock()
+	}
+	differs := func(counter *int64, shortCode string) {
+		*counter++
+		if len(report.Samples) < migrationMaxSamples {
+			report.Samples = append(report.Samples, shortCode)
+		}
+	}
+
+	var afterID int64
+	for {
+		links, err := d.primary.ListLinks(ctx, LinkFilter{}, afterID, migrationBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(links) == 0 {
+			break
+		}
+		afterID = links[len(links)-1].ID
+
+		for _, link := range links {
+			copied, err := d.secondary.GetLink(ctx, link.ShortCode)
+			if err != nil && !errors.Is(err, ErrLinkNotFound) {
+				return err
+			}
+			missing, stale := copied == nil, copied != nil && !sameLink(link, copied)
+			if missing || stale {
+				repaired := report.Repair && d.repair(ctx, func() error { return d.secondary.PutLink(ctx, link) }, link.ShortCode)
+				update(func() {
+					if missing {
+						differs(&report.Missing, link.ShortCode)
+					} else {
+						differs(&report.Mismatched, link.ShortCode)
+					}
+					if repaired {
+						report.Repaired++
+					}
+				})
+			}
+			update(func() { report.Checked++ })
+		}
+	}
+
+	afterID = 0
+	for {
+		links, err := d.secondary.ListLinks(ctx, LinkFilter{}, afterID, migrationBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(links) == 0 {
+			break
+		}
+		afterID = links[len(links)-1].ID
+
+		for _, link := range links {
+			_, err := d.primary.GetLink(ctx, link.ShortCode)
+			if err == nil {
+				continue
+			} else if !errors.Is(err, ErrLinkNotFound) {
+				return err
+			}
+			repaired := report.Repair && d.repair(ctx, func() error {
+				_, err := d.secondary.DeleteLink(ctx, link.ShortCode)
+				return err
+			}, link.ShortCode)
+			update(func() {
+				differs(&report.Extra, link.ShortCode)
+				if repaired {
+					report.Repaired++
+				}
+			})
+		}
+	}
+	return nil
+}
+
+func (d *dualStore) repair(ctx context.Context, fn func() error, shortCode string) bool {
+	if err := fn(); err != nil {
+		slog.WarnContext(ctx, "Migration repair failed", "short_code", shortCode, "err", err)
+		return false
+	}
+	return true
+}
+
+// Click counts move with every redirect, so they're left out
+func sameLink(a, b *Link) bool {
+	return a.ID == b.ID && a.OriginalURL == b.OriginalURL && a.CreatedAt.Equal(b.CreatedAt) &&
+		sameTime(a.ExpiresAt, b.ExpiresAt) && a.Owner == b.Owner && a.Domain == b.Domain &&
+		sameTime(a.DisabledAt, b.DisabledAt) && a.DisabledReason == b.DisabledReason &&
+		a.HasPage == b.HasPage && a.ArchiveURL == b.ArchiveURL && a.ServeArchive == b.ServeArchive
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// GET /api/v1/admin/migration
+func migrationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if migration == nil {
+		writeError(w, http.StatusNotFound, "migration_disabled", "No storage migration is configured")
+		return
+	}
+	migrationState.mu.Lock()
+	status := MigrationStatus{Running: migrationState.running}
+	if last := migrationState.last; last != nil {
+		copied := *last
+		copied.Samples = append([]string(nil), last.Samples...)
+		status.Last = &copied
+	}
+	migrationState.mu.Unlock()
+	writeJSON(w, http.StatusOK, status)
+}
+
+// POST /api/v1/admin/migration/check
+func migrationCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if migration == nil {
+		writeError(w, http.StatusNotFound, "migration_disabled", "No storage migration is configured")
+		return
+	}
+	var req MigrationCheckRequest
+	if r.ContentLength != 0 && !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	if !startMigrationCheck(req.Repair) {
+		writeError(w, http.StatusConflict, "check_running", "A consistency check is already running")
+		return
+	}
+	auditAdmin(r, "migration.check", "", map[string]interface{}{"repair": req.Repair})
+	w.WriteHeader(http.StatusAccepted)
+}
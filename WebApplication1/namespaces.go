@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Namespaces are subdomains of NAMESPACE_DOMAIN (team.sho.rt) with a code
+// space of their own: team.sho.rt/launch and sho.rt/launch are different
+// links. A namespace is registered as the custom domain
+// <name>.<NAMESPACE_DOMAIN>, so host matching, certificates and reloads
+// work as they do for custom domains, and its links are stored as
+// "<name>:<code>" so codes only have to be unique within the namespace.
+// The wildcard DNS record is the operator's; only registered names resolve.
+const (
+	namespaceSeparator = ":"
+	maxNamespaceLen    = 32
+	shortCodeColumnLen = 64 // namespace, separator and code
+)
+
+var namespaceNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// Names that would read as the service's own hosts
+var reservedNamespaces = map[string]bool{
+	"www": true, "api": true, "admin": true, "app": true, "mail": true,
+	"static": true, "status": true, "docs": true,
+}
+
+type Namespace struct {
+	Name      string    `json:"name"`
+	Host      string    `json:"host"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type NamespaceRequest struct {
+	Name string `json:"name"`
+}
+
+// Namespaced codes don't fit the original VARCHAR(10) short_code columns.
+// Partitions follow their parent, so only plain and partitioned tables are
+// altered, and only once.
+func initNamespaces() {
+	rows, err := db.Query(`
+		SELECT c.relname FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE a.attname = 'short_code' AND n.nspname = current_schema()
+		  AND c.relkind IN ('r', 'p') AND NOT c.relispartition
+		  AND a.atttypid = 'varchar'::regtype AND a.atttypmod - 4 < $1`, shortCodeColumnLen)
+	if err != nil {
+		fatal("Short code column check failed", "err", err)
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			fatal("Short code column check failed", "err", err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+
+	for _, table := range tables {
+		alter := fmt.Sprintf(`ALTER TABLE %q ALTER COLUMN short_code TYPE VARCHAR(%d)`, table, shortCodeColumnLen)
+		if _, err := db.Exec(alter); err != nil {
+			fatal("Short code column widening failed", "table", table, "err", err)
+		}
+		slog.Info("Widened short_code column", "table", table)
+	}
+}
+
+// Namespace a link domain stands for, empty for other domains
+func hostNamespace(domain string) string {
+	parent := normalizeDomain(cfg.NamespaceDomain)
+	if parent == "" || !strings.HasSuffix(domain, "."+parent) {
+		return ""
+	}
+	name := strings.TrimSuffix(domain, "."+parent)
+	if strings.Contains(name, ".") {
+		return ""
+	}
+	return name
+}
+
+func namespaceHost(name string) string {
+	return name + "." + normalizeDomain(cfg.NamespaceDomain)
+}
+
+// Key a code from a URL path is stored under on the given link domain
+func namespacedCode(domain, code string) string {
+	if ns := hostNamespace(domain); ns != "" {
+		return ns + namespaceSeparator + code
+	}
+	return code
+}
+
+// The URL path part of a stored code (or public token), without its namespace
+func localCode(code string) string {
+	if i := strings.LastIndex(code, namespaceSeparator); i >= 0 {
+		return code[i+1:]
+	}
+	return code
+}
+
+// Check a create request's namespace and turn it into the link domain
+func checkLinkNamespace(ctx context.Context, name, domain string) (string, error) {
+	if name == "" {
+		return domain, nil
+	}
+	if domain != "" {
+		return "", &apiError{http.StatusBadRequest, "invalid_namespace", "set domain or namespace, not both"}
+	}
+	host := namespaceHost(strings.ToLower(name))
+	owner := callerOwner(ctx)
+	if cfg.NamespaceDomain == "" || owner == "" || customDomainOwner(host) != owner {
+		return "", &apiError{http.StatusBadRequest, "unknown_namespace", "namespace is not one of yours"}
+	}
+	return host, nil
+}
+
+func namespacesEnabled(w http.ResponseWriter) bool {
+	if cfg.NamespaceDomain == "" {
+		writeError(w, http.StatusNotFound, "namespaces_disabled", "Namespaces are not enabled on this server")
+		return false
+	}
+	return true
+}
+
+// GET /api/v1/namespaces
+func listNamespacesHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok || !namespacesEnabled(w) {
+		return
+	}
+
+	domains, err := ownerCustomDomains(r.Context(), owner)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Namespace list error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	namespaces := []Namespace{}
+	for _, d := range domains {
+		if name := hostNamespace(d.Domain); name != "" {
+			namespaces = append(namespaces, Namespace{Name: name, Host: d.Domain, CreatedAt: d.CreatedAt})
+		}
+	}
+	writeJSON(w, http.StatusOK, namespaces)
+}
+
+// POST /api/v1/namespaces
+func addNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok || !namespacesEnabled(w) {
+		return
+	}
+
+	var req NamespaceRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	name := strings.ToLower(req.Name)
+	if len(name) > maxNamespaceLen || !namespaceNamePattern.MatchString(name) {
+		writeError(w, http.StatusBadRequest, "invalid_namespace",
+			fmt.Sprintf("name must be 1-%d letters, digits and inner hyphens", maxNamespaceLen))
+		return
+	}
+	if reservedNamespaces[name] {
+		writeError(w, http.StatusBadRequest, "invalid_namespace", "name is reserved")
+		return
+	}
+
+	d, taken, err := insertCustomDomain(r.Context(), namespaceHost(name), owner, true)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Namespace insert error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if taken {
+		writeError(w, http.StatusConflict, "namespace_taken", "Namespace is already registered")
+		return
+	}
+	auditCaller(r.Context(), "namespace.add", name, nil)
+	writeJSON(w, http.StatusCreated, Namespace{Name: name, Host: d.Domain, CreatedAt: d.CreatedAt})
+}
+
+// DELETE /api/v1/namespaces/{name} - only once no links use it
+func deleteNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok || !namespacesEnabled(w) {
+		return
+	}
+	name := strings.ToLower(r.PathValue("name"))
+
+	found, inUse, err := removeCustomDomain(r.Context(), namespaceHost(name), owner)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Namespace delete error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if inUse {
+		writeError(w, http.StatusConflict, "namespace_in_use", "Delete the namespace's links first")
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "namespace_not_found", "Namespace not found")
+		return
+	}
+	auditCaller(r.Context(), "namespace.delete", name, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
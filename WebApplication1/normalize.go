@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Destinations are stored in a canonical form, so the same page linked in
+// different spellings is one destination to lookups and dedupe: lower-case
+// scheme and host (in ASCII, see idn.go), no default port, dot segments
+// resolved and an empty path written as "/". With strip_tracking_params,
+// campaign and click-ID parameters are dropped as well. Links stored before
+// canonicalization keep their original spelling.
+//
+// Bump canonicalFormVersion whenever these rules change: stored
+// destination hashes are of the canonical form, and lookup.go recomputes
+// them when the version (or anything else the hash depends on) changes.
+const canonicalFormVersion = 1
+
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// Query parameters that only identify a campaign or click
+var trackingParams = map[string]bool{
+	"fbclid": true, "gclid": true, "dclid": true, "gbraid": true, "wbraid": true,
+	"msclkid": true, "yclid": true, "twclid": true, "ttclid": true, "igshid": true,
+	"mc_cid": true, "mc_eid": true, "_hsenc": true, "_hsmi": true, "mkt_tok": true,
+}
+
+func isTrackingParam(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasPrefix(name, "utm_") || trackingParams[name]
+}
+
+// rawURL in canonical form, from its parse
+func canonicalizeDestination(rawURL string, parsed *url.URL) (string, error) {
+	if _, err := normalizeIDNHost(parsed); err != nil {
+		return rawURL, err
+	}
+	u := *parsed
+	u.Scheme = strings.ToLower(u.Scheme)
+
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" && port != defaultPorts[u.Scheme] {
+		host += ":" + port
+	}
+	u.Host = host
+
+	// Segments are those of the path as written, where %2F isn't a slash
+	if u.RawPath == "" {
+		u.Path = removeDotSegments(u.Path)
+	} else {
+		u.RawPath = removeDotSegments(u.RawPath)
+		if p, err := url.PathUnescape(u.RawPath); err == nil {
+			u.Path = p
+		}
+	}
+	if u.Path == "" {
+		u.Path, u.RawPath = "/", ""
+	}
+	if cfg.StripTrackingParams {
+		u.RawQuery = stripTrackingParams(u.RawQuery)
+		u.ForceQuery = false
+	}
+	return u.String(), nil
+}
+
+// Canonical form of a URL to look links up by; input that isn't a valid
+// destination is looked up as given
+func canonicalDestination(rawURL string) string {
+	parsed, err := parseDestination(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	canonical, err := canonicalizeDestination(rawURL, parsed)
+	if err != nil {
+		return rawURL
+	}
+	return canonical
+}
+
+// RFC 3986 section 5.2.4, keeping a trailing slash
+func removeDotSegments(p string) string {
+	if !strings.Contains(p, ".") {
+		return p
+	}
+	var out []string
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		switch seg {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, seg)
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+// Drop tracking parameters, keeping the others as written and in order
+func stripTrackingParams(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	var kept []string
+	for _, pair := range strings.Split(rawQuery, "&") {
+		name, _, _ := strings.Cut(pair, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !isTrackingParam(name) {
+			kept = append(kept, pair)
+		}
+	}
+	return strings.Join(kept, "&")
+}
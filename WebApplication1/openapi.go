@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenAPI 3 document generated from the Go request/response types, so the
+// schemas can't drift from what the handlers actually encode.
+// Every /api route added to the router needs an entry here.
+type apiOperation struct {
+	Method       string
+	Path         string
+	Summary      string
+	Tag          string
+	Admin        bool
+	KeyRequired  bool        // needs an X-API-Key
+	Query        []string    // optional query parameters
+	RequestType  interface{} // JSON body, nil for none
+	RequestMime  string      // overrides application/json
+	Status       int
+	Response     interface{} // JSON body, nil for none
+	ResponseMime string      // overrides application/json
+}
+
+var apiOperations = []apiOperation{
+	{Method: "POST", Path: "/api/v1/shorten", Summary: "Create a short URL", Tag: "links",
+		RequestType: CreateURLRequest{}, Status: http.StatusCreated, Response: CreateURLResponse{}},
+	{Method: "GET", Path: "/api/v1/shorten", Summary: "Create a short URL from query parameters", Tag: "links",
+		Query: []string{"url", "code", "expires_at", "qr"}, Status: http.StatusCreated, Response: CreateURLResponse{}},
+	{Method: "GET", Path: "/api/v1/quick", Summary: "Create a short URL and return it as plain text (bookmarklets, extensions)", Tag: "links",
+		Query: []string{"url", "key", "code"}, Status: http.StatusCreated, Response: "", ResponseMime: "text/plain"},
+	{Method: "POST", Path: "/api/v1/shorten/bulk", Summary: "Create many short URLs in one transaction", Tag: "links",
+		RequestType: []CreateURLRequest{}, Status: http.StatusOK, Response: BulkCreateResponse{}},
+	{Method: "POST", Path: "/api/v1/shorten/csv", Summary: "Upload a CSV of URLs to shorten in the background", Tag: "links",
+		RequestMime: "multipart/form-data", RequestType: struct {
+			File string `json:"file"`
+		}{}, Status: http.StatusAccepted, Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/api/v1/jobs/{id}", Summary: "CSV job status and results", Tag: "links",
+		Query: []string{"format"}, Status: http.StatusOK, Response: CSVJob{}},
+	{Method: "GET", Path: "/api/v1/captcha", Summary: "CAPTCHA settings for anonymous creation", Tag: "links",
+		Status: http.StatusOK, Response: CaptchaConfigResponse{}},
+	{Method: "GET", Path: "/api/v1/branding", Summary: "Branding of the tenant serving this host", Tag: "links",
+		Status: http.StatusOK, Response: Branding{}},
+	{Method: "POST", Path: "/api/v1/report/{code}", Summary: "Report a short URL for abuse", Tag: "links",
+		RequestType: CreateReportRequest{}, Status: http.StatusCreated, Response: AbuseReport{}},
+	{Method: "GET", Path: "/api/v1/stats/{code}", Summary: "Get click statistics for a short URL; other owners' links are not found unless their stats are public", Tag: "links",
+		Status: http.StatusOK, Response: StatsResponse{}},
+	{Method: "GET", Path: "/api/v1/expand/{code}", Summary: "Resolve a short URL without redirecting", Tag: "links",
+		Status: http.StatusOK, Response: ExpandResponse{}},
+	{Method: "GET", Path: "/api/v1/qr/{code}", Summary: "QR code image for a short URL", Tag: "links",
+		Query: []string{"size", "format"}, Status: http.StatusOK, Response: "", ResponseMime: "image/png"},
+	{Method: "GET", Path: "/api/v1/links/lookup", Summary: "Find the caller's short URLs for a destination", Tag: "links",
+		KeyRequired: true, Query: []string{"url"}, Status: http.StatusOK, Response: LookupResponse{}},
+	{Method: "GET", Path: "/api/v1/links", Summary: "List the caller's short URLs", Tag: "links",
+		KeyRequired: true, Query: []string{"cursor", "limit"}, Status: http.StatusOK, Response: LinkListResponse{}},
+	{Method: "DELETE", Path: "/api/v1/links/{code}", Summary: "Delete one of the caller's short URLs", Tag: "links",
+		KeyRequired: true, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/links/{code}/events", Summary: "List click events for one of the caller's short URLs", Tag: "links",
+		KeyRequired: true, Query: []string{"cursor", "limit"}, Status: http.StatusOK, Response: ClickEventListResponse{}},
+	{Method: "GET", Path: "/api/v1/links/{code}/page", Summary: "Get the link-in-bio page of one of the caller's short URLs", Tag: "links",
+		KeyRequired: true, Status: http.StatusOK, Response: LinkPage{}},
+	{Method: "PUT", Path: "/api/v1/links/{code}/page", Summary: "Serve a link-in-bio page on a short URL instead of redirecting", Tag: "links",
+		KeyRequired: true, RequestType: LinkPageRequest{}, Status: http.StatusOK, Response: LinkPage{}},
+	{Method: "DELETE", Path: "/api/v1/links/{code}/page", Summary: "Remove a short URL's page so it redirects again", Tag: "links",
+		KeyRequired: true, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/links/{code}/bundle", Summary: "Get the bundle of one of the caller's short URLs, with clicks per item", Tag: "links",
+		KeyRequired: true, Status: http.StatusOK, Response: LinkBundle{}},
+	{Method: "PUT", Path: "/api/v1/links/{code}/bundle", Summary: "Serve a page listing several destinations on a short URL instead of redirecting", Tag: "links",
+		KeyRequired: true, RequestType: LinkBundleRequest{}, Status: http.StatusOK, Response: LinkBundle{}},
+	{Method: "DELETE", Path: "/api/v1/links/{code}/bundle", Summary: "Remove a short URL's bundle so it redirects again", Tag: "links",
+		KeyRequired: true, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/links/{code}/archive", Summary: "Get the Wayback Machine snapshot of one of the caller's short URLs", Tag: "links",
+		KeyRequired: true, Status: http.StatusOK, Response: LinkArchive{}},
+	{Method: "POST", Path: "/api/v1/links/{code}/archive", Summary: "Take a fresh Wayback Machine snapshot of a short URL's destination", Tag: "links",
+		KeyRequired: true, Status: http.StatusAccepted},
+	{Method: "PUT", Path: "/api/v1/links/{code}/archive", Summary: "Redirect a short URL to its snapshot, or back to its destination", Tag: "links",
+		KeyRequired: true, RequestType: LinkArchiveRequest{}, Status: http.StatusOK, Response: LinkArchive{}},
+	{Method: "GET", Path: "/api/v1/links/{code}/sharing", Summary: "Whether a short URL's stats are public", Tag: "links",
+		KeyRequired: true, Status: http.StatusOK, Response: LinkSharing{}},
+	{Method: "PUT", Path: "/api/v1/links/{code}/sharing", Summary: "Open a short URL's stats, stats page or stats widget to anyone, or close them", Tag: "links",
+		KeyRequired: true, RequestType: LinkSharingRequest{}, Status: http.StatusOK, Response: LinkSharing{}},
+	{Method: "GET", Path: "/api/v1/links/{code}/alerts", Summary: "List a short URL's click alerts", Tag: "links",
+		KeyRequired: true, Status: http.StatusOK, Response: []ClickAlert{}},
+	{Method: "POST", Path: "/api/v1/links/{code}/alerts", Summary: "Get notified when a short URL passes a number of clicks", Tag: "links",
+		KeyRequired: true, RequestType: ClickAlertRequest{}, Status: http.StatusCreated, Response: ClickAlert{}},
+	{Method: "DELETE", Path: "/api/v1/links/{code}/alerts/{id}", Summary: "Delete a click alert", Tag: "links",
+		KeyRequired: true, Status: http.StatusNoContent},
+	{Method: "POST", Path: "/api/v1/webhooks", Summary: "Register a webhook for link events", Tag: "webhooks",
+		KeyRequired: true, RequestType: CreateWebhookRequest{}, Status: http.StatusCreated, Response: CreateWebhookResponse{}},
+	{Method: "GET", Path: "/api/v1/webhooks", Summary: "List the caller's webhooks", Tag: "webhooks",
+		KeyRequired: true, Status: http.StatusOK, Response: []Webhook{}},
+	{Method: "DELETE", Path: "/api/v1/webhooks/{id}", Summary: "Delete a webhook", Tag: "webhooks",
+		KeyRequired: true, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/domains", Summary: "The caller's custom domains", Tag: "domains",
+		KeyRequired: true, Status: http.StatusOK, Response: []CustomDomain{}},
+	{Method: "POST", Path: "/api/v1/domains", Summary: "Register a custom domain; it serves links once verified", Tag: "domains",
+		KeyRequired: true, RequestType: CustomDomainRequest{}, Status: http.StatusCreated, Response: CustomDomain{}},
+	{Method: "GET", Path: "/api/v1/domains/{domain}", Summary: "A custom domain's verification status and instructions", Tag: "domains",
+		KeyRequired: true, Status: http.StatusOK, Response: CustomDomain{}},
+	{Method: "POST", Path: "/api/v1/domains/{domain}/verify", Summary: "Check a custom domain's TXT record or HTTP challenge now", Tag: "domains",
+		KeyRequired: true, Status: http.StatusOK, Response: CustomDomain{}},
+	{Method: "GET", Path: "/api/v1/domains/{domain}/settings", Summary: "A custom domain's redirect status, 404 page and interstitial", Tag: "domains",
+		KeyRequired: true, Status: http.StatusOK, Response: DomainSettings{}},
+	{Method: "PUT", Path: "/api/v1/domains/{domain}/settings", Summary: "Change a custom domain's settings", Tag: "domains",
+		KeyRequired: true, RequestType: DomainSettingsRequest{}, Status: http.StatusOK, Response: DomainSettings{}},
+	{Method: "GET", Path: "/api/v1/domains/{domain}/stats", Summary: "Daily clicks and top links on a custom domain", Tag: "domains",
+		KeyRequired: true, Query: []string{"days"}, Status: http.StatusOK, Response: DomainStats{}},
+	{Method: "DELETE", Path: "/api/v1/domains/{domain}", Summary: "Remove a custom domain that no links use", Tag: "domains",
+		KeyRequired: true, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/namespaces", Summary: "The caller's namespace subdomains", Tag: "domains",
+		KeyRequired: true, Status: http.StatusOK, Response: []Namespace{}},
+	{Method: "POST", Path: "/api/v1/namespaces", Summary: "Register a namespace with its own short codes", Tag: "domains",
+		KeyRequired: true, RequestType: NamespaceRequest{}, Status: http.StatusCreated, Response: Namespace{}},
+	{Method: "DELETE", Path: "/api/v1/namespaces/{name}", Summary: "Remove a namespace that no links use", Tag: "domains",
+		KeyRequired: true, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/notifications", Summary: "The caller's email notification preferences", Tag: "notifications",
+		KeyRequired: true, Status: http.StatusOK, Response: NotificationPreferences{}},
+	{Method: "PUT", Path: "/api/v1/notifications", Summary: "Set the notification email, expiry reminder and summary report settings", Tag: "notifications",
+		KeyRequired: true, RequestType: NotificationPreferencesRequest{}, Status: http.StatusOK, Response: NotificationPreferences{}},
+	{Method: "POST", Path: "/api/v1/hooks", Summary: "Subscribe a REST hook to one event", Tag: "webhooks",
+		KeyRequired: true, RequestType: RestHookRequest{}, Status: http.StatusCreated, Response: RestHookSubscription{}},
+	{Method: "DELETE", Path: "/api/v1/hooks/{id}", Summary: "Unsubscribe a REST hook", Tag: "webhooks",
+		KeyRequired: true, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/hooks/sample/{event}", Summary: "Sample payloads for an event, from the caller's latest links", Tag: "webhooks",
+		KeyRequired: true, Status: http.StatusOK, Response: []WebhookEvent{}},
+	{Method: "GET", Path: "/{code}", Summary: "Redirect to the destination URL", Tag: "redirect",
+		Status: http.StatusMovedPermanently},
+	{Method: "GET", Path: "/health", Summary: "Service health", Tag: "operations",
+		Status: http.StatusOK, Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/version", Summary: "Running build version and commit", Tag: "operations",
+		Status: http.StatusOK, Response: BuildInfo{}},
+	{Method: "GET", Path: "/livez", Summary: "Liveness probe", Tag: "operations",
+		Status: http.StatusOK, Response: map[string]string{}},
+	{Method: "GET", Path: "/readyz", Summary: "Readiness probe", Tag: "operations",
+		Status: http.StatusOK, Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/api/v1/admin/export", Summary: "Export all links", Tag: "admin", Admin: true,
+		Query: []string{"format", "clicks"}, Status: http.StatusOK, Response: exportRecord{}, ResponseMime: "application/x-ndjson"},
+	{Method: "GET", Path: "/api/v1/admin/privacy/export", Summary: "Export everything stored about an API key owner (data access requests)", Tag: "admin", Admin: true,
+		Query: []string{"owner"}, Status: http.StatusOK, Response: SubjectRecord{}, ResponseMime: "application/x-ndjson"},
+	{Method: "POST", Path: "/api/v1/admin/privacy/erase", Summary: "Erase an API key owner's data, deleting or anonymizing their links", Tag: "admin", Admin: true,
+		RequestType: ErasureRequest{}, Status: http.StatusOK, Response: ErasureResponse{}},
+	{Method: "POST", Path: "/api/v1/admin/import", Summary: "Import links from an export, Bitly or TinyURL CSV", Tag: "admin", Admin: true,
+		Query: []string{"format", "on_conflict", "owner"}, RequestType: exportRecord{}, RequestMime: "application/x-ndjson",
+		Status: http.StatusOK, Response: ImportResponse{}},
+	{Method: "POST", Path: "/api/v1/admin/import/bitly", Summary: "Import links from a Bitly account", Tag: "admin", Admin: true,
+		RequestType: BitlyImportRequest{}, Status: http.StatusOK, Response: ImportResponse{}},
+	{Method: "POST", Path: "/api/v1/admin/keys", Summary: "Issue an API key", Tag: "admin", Admin: true,
+		RequestType: CreateAPIKeyRequest{}, Status: http.StatusCreated, Response: CreateAPIKeyResponse{}},
+	{Method: "DELETE", Path: "/api/v1/admin/keys/{id}", Summary: "Revoke an API key", Tag: "admin", Admin: true,
+		Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/admin/tenants", Summary: "List tenants", Tag: "admin", Admin: true,
+		Status: http.StatusOK, Response: []Tenant{}},
+	{Method: "POST", Path: "/api/v1/admin/tenants", Summary: "Create a tenant with its hosts and branding", Tag: "admin", Admin: true,
+		RequestType: TenantRequest{}, Status: http.StatusCreated, Response: Tenant{}},
+	{Method: "PUT", Path: "/api/v1/admin/tenants/{id}", Summary: "Replace a tenant's hosts and branding", Tag: "admin", Admin: true,
+		RequestType: TenantRequest{}, Status: http.StatusOK, Response: Tenant{}},
+	{Method: "DELETE", Path: "/api/v1/admin/tenants/{id}", Summary: "Delete a tenant with no keys or links", Tag: "admin", Admin: true,
+		Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/admin/links", Summary: "List all links with filters", Tag: "admin", Admin: true,
+		Query:  []string{"owner", "url", "status", "created_after", "created_before", "cursor", "limit"},
+		Status: http.StatusOK, Response: AdminLinkListResponse{}},
+	{Method: "DELETE", Path: "/api/v1/admin/links/{code}", Summary: "Delete any link", Tag: "admin", Admin: true,
+		Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/admin/stats", Summary: "Global statistics", Tag: "admin", Admin: true,
+		Status: http.StatusOK, Response: AdminStatsResponse{}},
+	{Method: "GET", Path: "/api/v1/admin/migration", Summary: "Storage migration status and the last consistency check", Tag: "admin", Admin: true,
+		Status: http.StatusOK, Response: MigrationStatus{}},
+	{Method: "POST", Path: "/api/v1/admin/migration/check", Summary: "Compare the current and migration databases, optionally repairing", Tag: "admin", Admin: true,
+		RequestType: MigrationCheckRequest{}, Status: http.StatusAccepted},
+	{Method: "GET", Path: "/api/v1/admin/blocklist", Summary: "List blocked destination domains", Tag: "admin", Admin: true,
+		Status: http.StatusOK, Response: []DomainEntry{}},
+	{Method: "POST", Path: "/api/v1/admin/blocklist", Summary: "Block a destination domain and disable its links", Tag: "admin", Admin: true,
+		RequestType: DomainEntryRequest{}, Status: http.StatusCreated, Response: DomainEntry{}},
+	{Method: "DELETE", Path: "/api/v1/admin/blocklist/{domain}", Summary: "Unblock a destination domain", Tag: "admin", Admin: true,
+		Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/admin/grafana", Summary: "Grafana JSON datasource connection test", Tag: "admin", Admin: true,
+		Status: http.StatusOK},
+	{Method: "POST", Path: "/api/v1/admin/grafana/search", Summary: "Grafana JSON datasource metric names", Tag: "admin", Admin: true,
+		RequestType: struct {
+			Target string `json:"target"`
+		}{}, Status: http.StatusOK, Response: []string{}},
+	{Method: "POST", Path: "/api/v1/admin/grafana/query", Summary: "Grafana JSON datasource click time series and tables", Tag: "admin", Admin: true,
+		RequestType: GrafanaQueryRequest{}, Status: http.StatusOK, Response: []GrafanaTimeSeries{}},
+	{Method: "POST", Path: "/api/v1/admin/grafana/annotations", Summary: "Grafana JSON datasource annotations from the audit log", Tag: "admin", Admin: true,
+		RequestType: GrafanaAnnotationRequest{}, Status: http.StatusOK, Response: []GrafanaAnnotation{}},
+	{Method: "GET", Path: "/api/v1/admin/audit", Summary: "Audit log of mutating actions", Tag: "admin", Admin: true,
+		Query: []string{"actor", "action", "target", "cursor", "limit"}, Status: http.StatusOK, Response: AuditListResponse{}},
+	{Method: "GET", Path: "/api/v1/admin/bans", Summary: "IPs banned for code enumeration", Tag: "admin", Admin: true,
+		Status: http.StatusOK, Response: []IPBan{}},
+	{Method: "DELETE", Path: "/api/v1/admin/bans/{ip}", Summary: "Lift an enumeration ban", Tag: "admin", Admin: true,
+		Status: http.StatusNoContent},
+	{Method: "POST", Path: "/api/v1/admin/config/reload", Summary: "Reload rate limits, log level, cache size and flag defaults", Tag: "admin", Admin: true,
+		Status: http.StatusOK, Response: ConfigReloadResponse{}},
+	{Method: "GET", Path: "/api/v1/admin/flags", Summary: "Feature flags and their effective rollout", Tag: "admin", Admin: true,
+		Status: http.StatusOK, Response: []FeatureFlag{}},
+	{Method: "PUT", Path: "/api/v1/admin/flags/{name}", Summary: "Turn a feature flag on, off or to a percentage", Tag: "admin", Admin: true,
+		RequestType: FeatureFlagRequest{}, Status: http.StatusOK, Response: FeatureFlag{}},
+	{Method: "DELETE", Path: "/api/v1/admin/flags/{name}", Summary: "Drop a flag's runtime override", Tag: "admin", Admin: true,
+		Status: http.StatusOK, Response: FeatureFlag{}},
+	{Method: "GET", Path: "/api/v1/admin/slack/workspaces", Summary: "Slack workspaces connected to API keys", Tag: "admin", Admin: true,
+		Status: http.StatusOK, Response: []ChatConnection{}},
+	{Method: "PUT", Path: "/api/v1/admin/slack/workspaces/{id}", Summary: "Connect a Slack workspace (team ID) to an API key", Tag: "admin", Admin: true,
+		RequestType: ChatConnectionRequest{}, Status: http.StatusOK, Response: ChatConnection{}},
+	{Method: "DELETE", Path: "/api/v1/admin/slack/workspaces/{id}", Summary: "Disconnect a Slack workspace", Tag: "admin", Admin: true,
+		Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/admin/discord/guilds", Summary: "Discord servers connected to API keys", Tag: "admin", Admin: true,
+		Status: http.StatusOK, Response: []ChatConnection{}},
+	{Method: "PUT", Path: "/api/v1/admin/discord/guilds/{id}", Summary: "Connect a Discord server (guild ID) to an API key", Tag: "admin", Admin: true,
+		RequestType: ChatConnectionRequest{}, Status: http.StatusOK, Response: ChatConnection{}},
+	{Method: "DELETE", Path: "/api/v1/admin/discord/guilds/{id}", Summary: "Disconnect a Discord server", Tag: "admin", Admin: true,
+		Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/admin/telegram/chats", Summary: "Telegram chats connected to API keys", Tag: "admin", Admin: true,
+		Status: http.StatusOK, Response: []ChatConnection{}},
+	{Method: "PUT", Path: "/api/v1/admin/telegram/chats/{id}", Summary: "Connect a Telegram chat (chat ID) to an API key", Tag: "admin", Admin: true,
+		RequestType: ChatConnectionRequest{}, Status: http.StatusOK, Response: ChatConnection{}},
+	{Method: "DELETE", Path: "/api/v1/admin/telegram/chats/{id}", Summary: "Disconnect a Telegram chat", Tag: "admin", Admin: true,
+		Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/admin/mattermost/teams", Summary: "Mattermost teams connected to API keys", Tag: "admin", Admin: true,
+		Status: http.StatusOK, Response: []ChatConnection{}},
+	{Method: "PUT", Path: "/api/v1/admin/mattermost/teams/{id}", Summary: "Connect a Mattermost team (team ID) to an API key", Tag: "admin", Admin: true,
+		RequestType: ChatConnectionRequest{}, Status: http.StatusOK, Response: ChatConnection{}},
+	{Method: "DELETE", Path: "/api/v1/admin/mattermost/teams/{id}", Summary: "Disconnect a Mattermost team", Tag: "admin", Admin: true,
+		Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/admin/rocketchat/channels", Summary: "Rocket.Chat channels connected to API keys", Tag: "admin", Admin: true,
+		Status: http.StatusOK, Response: []ChatConnection{}},
+	{Method: "PUT", Path: "/api/v1/admin/rocketchat/channels/{id}", Summary: "Connect a Rocket.Chat channel (channel ID) to an API key", Tag: "admin", Admin: true,
+		RequestType: ChatConnectionRequest{}, Status: http.StatusOK, Response: ChatConnection{}},
+	{Method: "DELETE", Path: "/api/v1/admin/rocketchat/channels/{id}", Summary: "Disconnect a Rocket.Chat channel", Tag: "admin", Admin: true,
+		Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/admin/maintenance", Summary: "Maintenance mode status", Tag: "admin", Admin: true,
+		Status: http.StatusOK, Response: MaintenanceStatus{}},
+	{Method: "PUT", Path: "/api/v1/admin/maintenance", Summary: "Turn maintenance mode on or off", Tag: "admin", Admin: true,
+		RequestType: MaintenanceRequest{}, Status: http.StatusOK, Response: MaintenanceStatus{}},
+	{Method: "GET", Path: "/api/v1/admin/reports", Summary: "Abuse report review queue", Tag: "admin", Admin: true,
+		Query: []string{"status", "cursor", "limit"}, Status: http.StatusOK, Response: ReportListResponse{}},
+	{Method: "POST", Path: "/api/v1/admin/reports/{id}/resolve", Summary: "Dismiss a report, disable the link or block its domain", Tag: "admin", Admin: true,
+		RequestType: ResolveReportRequest{}, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/admin/spam", Summary: "New links held for spam review", Tag: "admin", Admin: true,
+		Query: []string{"status", "cursor", "limit"}, Status: http.StatusOK, Response: SpamReviewListResponse{}},
+	{Method: "POST", Path: "/api/v1/admin/spam/{code}/review", Summary: "Approve a held link so it redirects, or reject it", Tag: "admin", Admin: true,
+		RequestType: SpamReviewRequest{}, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/admin/allowlist", Summary: "List allowed destination domains", Tag: "admin", Admin: true,
+		Status: http.StatusOK, Response: []DomainEntry{}},
+	{Method: "POST", Path: "/api/v1/admin/allowlist", Summary: "Allow a destination domain", Tag: "admin", Admin: true,
+		RequestType: DomainEntryRequest{}, Status: http.StatusCreated, Response: DomainEntry{}},
+	{Method: "DELETE", Path: "/api/v1/admin/allowlist/{domain}", Summary: "Remove a domain from the allowlist", Tag: "admin", Admin: true,
+		Status: http.StatusNoContent},
+	{Method: "POST", Path: "/api/graphql", Summary: "GraphQL queries over links and stats", Tag: "admin", Admin: true,
+		RequestType: graphQLRequest{}, Status: http.StatusOK, Response: map[string]interface{}{}},
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  []byte
+)
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPIDoc, _ = json.MarshalIndent(buildOpenAPI(), "", "  ")
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDoc)
+}
+
+func buildOpenAPI() map[string]interface{} {
+	schemas := map[string]interface{}{}
+	problemSchema := schemaFor(reflect.TypeOf(Problem{}), schemas)
+	paths := map[string]map[string]interface{}{}
+
+	for _, op := range apiOperations {
+		operation := map[string]interface{}{
+			"summary": op.Summary,
+			"tags":    []string{op.Tag},
+		}
+
+		var params []interface{}
+		for _, segment := range strings.Split(op.Path, "/") {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				params = append(params, map[string]interface{}{
+					"name": strings.Trim(segment, "{}"), "in": "path", "required": true,
+					"schema": map[string]interface{}{"type": "string"},
+				})
+			}
+		}
+		for _, name := range op.Query {
+			params = append(params, map[string]interface{}{
+				"name": name, "in": "query",
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+
+		if op.RequestType != nil {
+			mime := op.RequestMime
+			if mime == "" {
+				mime = "application/json"
+			}
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					mime: map[string]interface{}{"schema": schemaFor(reflect.TypeOf(op.RequestType), schemas)},
+				},
+			}
+		}
+
+		success := map[string]interface{}{"description": http.StatusText(op.Status)}
+		if op.Response != nil {
+			mime := op.ResponseMime
+			if mime == "" {
+				mime = "application/json"
+			}
+			success["content"] = map[string]interface{}{
+				mime: map[string]interface{}{"schema": schemaFor(reflect.TypeOf(op.Response), schemas)},
+			}
+		}
+		errorResponse := map[string]interface{}{
+			"description": "Error",
+			"content": map[string]interface{}{
+				"application/problem+json": map[string]interface{}{"schema": problemSchema},
+			},
+		}
+		operation["responses"] = map[string]interface{}{
+			strconv.Itoa(op.Status): success,
+			"default":               errorResponse,
+		}
+
+		if op.Admin {
+			operation["security"] = []interface{}{map[string]interface{}{"adminToken": []string{}}}
+		} else if op.KeyRequired {
+			operation["security"] = []interface{}{map[string]interface{}{"apiKey": []string{}}}
+		}
+
+		if paths[op.Path] == nil {
+			paths[op.Path] = map[string]interface{}{}
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "ihdas URL shortener API",
+			"version": "v1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"adminToken": map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"apiKey":     map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// JSON schema for a Go type, registering named structs under components
+func schemaFor(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object"}
+	case t.Kind() != reflect.Struct:
+		return map[string]interface{}{}
+	}
+
+	name := t.Name()
+	if name != "" {
+		if _, exists := schemas[name]; exists {
+			return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+		}
+		// Placeholder first so self-referencing types terminate
+		schemas[name] = map[string]interface{}{}
+	}
+
+	properties := map[string]interface{}{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || !field.IsExported() {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		fieldName := parts[0]
+		if fieldName == "" {
+			fieldName = field.Name
+		}
+		prop := schemaFor(field.Type, schemas)
+		if field.Type.Kind() == reflect.Ptr {
+			prop["nullable"] = true
+		}
+		properties[fieldName] = prop
+
+		omitempty := false
+		for _, opt := range parts[1:] {
+			if opt == "omitempty" {
+				omitempty = true
+			}
+		}
+		if !omitempty && field.Type.Kind() != reflect.Ptr {
+			required = append(required, fieldName)
+		}
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	if name == "" {
+		return schema
+	}
+	schemas[name] = schema
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// Swagger UI served from the public CDN; opt in with ENABLE_SWAGGER_UI=true
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="utf-8">
+    <title>ihdas API</title>
+    <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+    <div id="swagger-ui"></div>
+    <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+    <script>
+        window.ui = SwaggerUIBundle({ url: '/api/v1/openapi.json', dom_id: '#swagger-ui' });
+    </script>
+</body>
+</html>`
+
+func swaggerUIHandler(w http.ResponseWriter, r *http.Request) {
+	if !cfg.EnableSwaggerUI {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerUIPage))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// Keyset pagination - cursors are opaque tokens wrapping the last row id,
+// so deep pages stay cheap and stable while new rows are inserted.
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func encodeCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+// An empty cursor means "from the beginning"
+func decodeCursor(cursor string) (int64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errInvalidCursor
+	}
+	id, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil || id < 0 {
+		return 0, errInvalidCursor
+	}
+	return id, nil
+}
+
+// Page parameters from ?cursor=&limit=; writes a 400 and returns false
+// when either is malformed
+func parsePageQuery(w http.ResponseWriter, r *http.Request) (afterID int64, limit int, ok bool) {
+	query := r.URL.Query()
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "invalid_limit", "limit must be a positive integer")
+			return 0, 0, false
+		}
+		limit = n
+	}
+
+	afterID, err := decodeCursor(query.Get("cursor"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_cursor", "Invalid cursor")
+		return 0, 0, false
+	}
+	return afterID, clampPageSize(limit), true
+}
+
+// Cursor for the page after one ending at lastID, empty on the last page
+func nextCursor(lastID int64, hasNext bool) string {
+	if !hasNext {
+		return ""
+	}
+	return encodeCursor(lastID)
+}
+
+func clampPageSize(n int) int {
+	if n <= 0 {
+		return defaultPageSize
+	}
+	if n > maxPageSize {
+		return maxPageSize
+	}
+	return n
+}
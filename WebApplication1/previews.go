@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Link previews: after a link is created its destination page is fetched
+// in the background for a title, description and favicon, which list and
+// stats responses include so dashboards can show something friendlier than
+// a raw URL. Failures leave the link without a preview; nothing retries.
+const (
+	previewQueueSize = 500
+	previewWorkers   = 2
+	previewTimeout   = 5 * time.Second
+	previewMaxBody   = 512 << 10 // the <head> is all we read
+	previewMaxText   = 300
+)
+
+type LinkPreview struct {
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	FaviconURL  string    `json:"favicon_url,omitempty"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+type previewJob struct {
+	shortCode   string
+	originalURL string
+}
+
+var previewQueue = make(chan previewJob, previewQueueSize)
+
+// Destinations are user-supplied, so the fetch gets the same internal-address
+// protection as webhooks
+func newPreviewClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.BlockPrivateDestinations {
+		transport.DialContext = (&net.Dialer{Timeout: previewTimeout, Control: blockInternalDial}).DialContext
+	}
+	return &http.Client{Timeout: previewTimeout, Transport: transport}
+}
+
+func initLinkPreviews() {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS link_previews (
+		short_code VARCHAR(64) PRIMARY KEY,
+		title TEXT,
+		description TEXT,
+		favicon_url TEXT,
+		fetched_at TIMESTAMP DEFAULT NOW()
+	);
+	`
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Link previews table creation failed", "err", err)
+	}
+
+	client := newPreviewClient()
+	for i := 0; i < previewWorkers; i++ {
+		go func() {
+			for job := range previewQueue {
+				fetchLinkPreview(client, job)
+			}
+		}()
+	}
+}
+
+// Queue a preview fetch for a new link; a full queue skips it
+func queueLinkPreview(link *Link) {
+	if !flagEnabled("enable_link_previews", link.ShortCode) {
+		return
+	}
+	select {
+	case previewQueue <- previewJob{shortCode: link.ShortCode, originalURL: link.OriginalURL}:
+	default:
+		slog.Warn("Preview queue full, skipping", "short_code", link.ShortCode)
+	}
+}
+
+func fetchLinkPreview(client *http.Client, job previewJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), previewTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, job.originalURL, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("User-Agent", "ihdas-preview/1")
+	req.Header.Set("Accept", "text/html")
+	resp, err := client.Do(req)
+	if err != nil {
+		slog.Debug("Preview fetch failed", "short_code", job.shortCode, "err", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusOK || mediaType != "text/html" {
+		return
+	}
+	// Redirects may have moved us, and relative favicons resolve from there
+	preview := parsePreview(io.LimitReader(resp.Body, previewMaxBody), resp.Request.URL)
+
+	_, err = db.ExecContext(ctx,
+		`INSERT INTO link_previews (short_code, title, description, favicon_url) VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (short_code) DO UPDATE SET title = EXCLUDED.title, description = EXCLUDED.description,
+		 favicon_url = EXCLUDED.favicon_url, fetched_at = NOW()`,
+		job.shortCode, preview.Title, preview.Description, preview.FaviconURL)
+	if err != nil {
+		slog.Error("Preview store error", "short_code", job.shortCode, "err", err)
+	}
+}
+
+// Pull title, description and icon out of the document head. Open Graph
+// values win over the plain ones when both are present.
+func parsePreview(r io.Reader, base *url.URL) LinkPreview {
+	var p LinkPreview
+	var title, ogTitle, description, ogDescription, icon string
+	z := html.NewTokenizer(r)
+	inTitle := false
+
+loop:
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			break loop
+		case html.TextToken:
+			if inTitle && title == "" {
+				title = string(z.Text())
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch atom.Lookup(name) {
+			case atom.Title:
+				inTitle = false
+			case atom.Head:
+				break loop
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			attrs := map[string]string{}
+			for hasAttr {
+				var k, v []byte
+				k, v, hasAttr = z.TagAttr()
+				attrs[string(k)] = string(v)
+			}
+			switch atom.Lookup(name) {
+			case atom.Title:
+				inTitle = true
+			case atom.Body:
+				break loop
+			case atom.Meta:
+				switch strings.ToLower(attrs["property"] + attrs["name"]) {
+				case "og:title":
+					ogTitle = attrs["content"]
+				case "og:description":
+					ogDescription = attrs["content"]
+				case "description":
+					description = attrs["content"]
+				}
+			case atom.Link:
+				rel := strings.Fields(strings.ToLower(attrs["rel"]))
+				for _, v := range rel {
+					if v == "icon" && attrs["href"] != "" && icon == "" {
+						icon = attrs["href"]
+					}
+				}
+			}
+		}
+	}
+
+	p.Title = previewText(firstNonEmpty(ogTitle, title))
+	p.Description = previewText(firstNonEmpty(ogDescription, description))
+	if icon == "" {
+		icon = "/favicon.ico"
+	}
+	if u, err := base.Parse(icon); err == nil && (u.Scheme == "https" || u.Scheme == "http") {
+		p.FaviconURL = u.String()
+	}
+	return p
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Collapse whitespace and cap the length, on a rune boundary
+func previewText(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if runes := []rune(s); len(runes) > previewMaxText {
+		s = string(runes[:previewMaxText-1]) + "…"
+	}
+	return s
+}
+
+// Previews for a page of links, keyed by short code
+func loadLinkPreviews(ctx context.Context, codes []string) (map[string]*LinkPreview, error) {
+	previews := map[string]*LinkPreview{}
+	if len(codes) == 0 {
+		return previews, nil
+	}
+	codesJSON, _ := json.Marshal(codes)
+	rows, err := db.QueryContext(ctx,
+		`SELECT short_code, COALESCE(title, ''), COALESCE(description, ''), COALESCE(favicon_url, ''), fetched_at
+		 FROM link_previews WHERE short_code IN (SELECT json_array_elements_text($1::JSON))`, string(codesJSON))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var code string
+		p := &LinkPreview{}
+		if err := rows.Scan(&code, &p.Title, &p.Description, &p.FaviconURL, &p.FetchedAt); err != nil {
+			return nil, err
+		}
+		previews[code] = p
+	}
+	return previews, rows.Err()
+}
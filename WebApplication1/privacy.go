@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Data subject requests (GDPR access and erasure) for an API key owner.
+// The export streams everything stored about the owner as NDJSON. Erasure
+// always deletes the click events recorded on the owner's links and the
+// owner's keys, webhooks, chat connections and notification settings; the
+// links themselves are deleted or, by default, kept working under a
+// pseudonym. Audit entries stay, with the owner and their IP addresses
+// replaced. Events already sent to the event stream or to webhooks are out
+// of reach.
+const (
+	erasureDeleteLinks    = "delete"
+	erasureAnonymizeLinks = "anonymize"
+	subjectClickPage      = 1000
+)
+
+// One line of a data subject export
+type SubjectRecord struct {
+	Type string      `json:"type"` // notification_preferences, api_key, link, click_event, webhook, custom_domain or audit_entry
+	Data interface{} `json:"data"`
+}
+
+type SubjectAPIKey struct {
+	ID        int64      `json:"id"`
+	Tenant    string     `json:"tenant,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type ErasureRequest struct {
+	Owner string `json:"owner"`
+	Links string `json:"links,omitempty"` // anonymize (default) or delete
+}
+
+type ErasureResponse struct {
+	Pseudonym       string `json:"pseudonym"` // owner of whatever was kept
+	LinksDeleted    int64  `json:"links_deleted"`
+	LinksAnonymized int64  `json:"links_anonymized"`
+	ClickEvents     int64  `json:"click_events_deleted"`
+	APIKeys         int64  `json:"api_keys_deleted"`
+	Webhooks        int64  `json:"webhooks_deleted"`
+	CustomDomains   int64  `json:"custom_domains"` // deleted with the links, otherwise anonymized
+	AuditEntries    int64  `json:"audit_entries_anonymized"`
+}
+
+// GET /api/v1/admin/privacy/export?owner=
+func subjectExportHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	owner := strings.TrimSpace(r.URL.Query().Get("owner"))
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "missing_owner", "owner is required")
+		return
+	}
+
+	// Exports can easily outlive the server's write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="ihdas-subject-export.ndjson"`)
+	w.WriteHeader(http.StatusOK)
+	auditAdmin(r, "privacy.export", owner, nil)
+
+	enc := json.NewEncoder(w)
+	count := 0
+	emit := func(kind string, data interface{}) error {
+		count++
+		if count%exportFlushEvery == 0 {
+			rc.Flush()
+		}
+		return enc.Encode(SubjectRecord{Type: kind, Data: data})
+	}
+
+	// Headers are already sent, so a failure can only be logged
+	if err := exportSubject(r.Context(), owner, emit); err != nil {
+		slog.ErrorContext(r.Context(), "Subject export aborted", "records", count, "err", err)
+	}
+	rc.Flush()
+}
+
+func exportSubject(ctx context.Context, owner string, emit func(kind string, data interface{}) error) error {
+	prefs, err := loadNotificationPreferences(ctx, owner)
+	if err != nil {
+		return err
+	}
+	if prefs.UpdatedAt != nil {
+		if err := emit("notification_preferences", prefs); err != nil {
+			return err
+		}
+	}
+
+	keys, err := subjectAPIKeys(ctx, owner)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := emit("api_key", key); err != nil {
+			return err
+		}
+	}
+
+	// Clicks follow the link they were on
+	var afterID int64
+	for {
+		links, err := store.ListLinks(ctx, LinkFilter{Owner: owner}, afterID, maxPageSize)
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			if err := emit("link", AdminLink{
+				ShortCode:      link.ShortCode,
+				OriginalURL:    link.OriginalURL,
+				Owner:          link.Owner,
+				CreatedAt:      link.CreatedAt,
+				ExpiresAt:      link.ExpiresAt,
+				ClickCount:     link.ClickCount,
+				DisabledAt:     link.DisabledAt,
+				DisabledReason: link.DisabledReason,
+			}); err != nil {
+				return err
+			}
+			if err := exportSubjectClicks(ctx, link.ShortCode, emit); err != nil {
+				return err
+			}
+		}
+		if len(links) < maxPageSize {
+			break
+		}
+		afterID = links[len(links)-1].ID
+	}
+
+	hooks, err := listWebhooks(ctx, owner)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		if err := emit("webhook", hook); err != nil {
+			return err
+		}
+	}
+
+	domains, err := ownerCustomDomains(ctx, owner)
+	if err != nil {
+		return err
+	}
+	for _, d := range domains {
+		if err := emit("custom_domain", d); err != nil {
+			return err
+		}
+	}
+
+	return exportSubjectAudit(ctx, owner, emit)
+}
+
+func subjectAPIKeys(ctx context.Context, owner string) ([]SubjectAPIKey, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, COALESCE(tenant_id, ''), created_at, revoked_at FROM api_keys WHERE owner = $1 ORDER BY id`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []SubjectAPIKey
+	for rows.Next() {
+		var key SubjectAPIKey
+		if err := rows.Scan(&key.ID, &key.Tenant, &key.CreatedAt, &key.RevokedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func exportSubjectClicks(ctx context.Context, shortCode string, emit func(kind string, data interface{}) error) error {
+	var afterID int64
+	for {
+		events, err := listClickEvents(ctx, shortCode, afterID, subjectClickPage)
+		if err != nil {
+			return err
+		}
+		for _, ev := range events {
+			if err := emit("click_event", ev); err != nil {
+				return err
+			}
+		}
+		if len(events) < subjectClickPage {
+			return nil
+		}
+		afterID = events[len(events)-1].ID
+	}
+}
+
+// What the owner did, and what was done to their account
+func exportSubjectAudit(ctx context.Context, owner string, emit func(kind string, data interface{}) error) error {
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, actor, action, COALESCE(target, ''), COALESCE(details::TEXT, ''), COALESCE(source_ip, ''), created_at
+		 FROM audit_log WHERE actor = $1 OR target = $1 ORDER BY id`, owner)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry AuditEntry
+		var details string
+		if err := rows.Scan(&entry.ID, &entry.Actor, &entry.Action, &entry.Target, &details, &entry.SourceIP, &entry.CreatedAt); err != nil {
+			return err
+		}
+		if details != "" {
+			json.Unmarshal([]byte(details), &entry.Details)
+		}
+		if err := emit("audit_entry", entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// POST /api/v1/admin/privacy/erase
+func subjectEraseHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req ErasureRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	req.Owner = strings.TrimSpace(req.Owner)
+	if req.Owner == "" {
+		writeError(w, http.StatusBadRequest, "missing_owner", "owner is required")
+		return
+	}
+	if req.Links == "" {
+		req.Links = erasureAnonymizeLinks
+	}
+	if req.Links != erasureAnonymizeLinks && req.Links != erasureDeleteLinks {
+		writeError(w, http.StatusBadRequest, "invalid_links", "links must be anonymize or delete")
+		return
+	}
+
+	resp, deleted, keyHashes, err := eraseSubject(r.Context(), req.Owner, req.Links == erasureDeleteLinks)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Subject erasure error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	// Other instances drop the links too, and catch up on keys within their cache TTLs
+	for _, code := range deleted {
+		invalidateCachedURL(r.Context(), code)
+	}
+	for _, hash := range keyHashes {
+		apiKeyCache.Delete(hash)
+	}
+	webhookCache.Delete(req.Owner)
+	if resp.CustomDomains > 0 {
+		if err := reloadCustomDomains(); err != nil {
+			slog.ErrorContext(r.Context(), "Custom domains reload error", "err", err)
+		}
+	}
+
+	// The entry is about the pseudonym; naming the owner would undo the erasure
+	auditAdmin(r, "privacy.erase", resp.Pseudonym, map[string]interface{}{
+		"links": req.Links, "links_deleted": resp.LinksDeleted, "click_events_deleted": resp.ClickEvents,
+	})
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Erase owner in one transaction, returning the short codes and API key
+// hashes removed so caches can drop them
+func eraseSubject(ctx context.Context, owner string, deleteLinks bool) (*ErasureResponse, []string, []string, error) {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	resp := &ErasureResponse{Pseudonym: "erased-" + hex.EncodeToString(raw)}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer tx.Rollback()
+
+	// Statements run until one fails; err then holds the failure
+	exec := func(n *int64, query string, args ...interface{}) {
+		if err != nil {
+			return
+		}
+		var res sql.Result
+		if res, err = tx.ExecContext(ctx, query, args...); err == nil && n != nil {
+			*n, _ = res.RowsAffected()
+		}
+	}
+
+	exec(&resp.ClickEvents,
+		`DELETE FROM click_events WHERE short_code IN (SELECT short_code FROM urls WHERE owner = $1)`, owner)
+	exec(nil, `UPDATE spam_scores SET creator_ip = NULL WHERE short_code IN (SELECT short_code FROM urls WHERE owner = $1)`, owner)
+	for _, p := range chatPlatforms {
+		exec(nil, fmt.Sprintf(`DELETE FROM %s WHERE api_key_hash IN (SELECT key_hash FROM api_keys WHERE owner = $1)`, p.table), owner)
+	}
+	exec(&resp.Webhooks, `DELETE FROM webhooks WHERE owner = $1`, owner)
+	exec(nil, `DELETE FROM notification_preferences WHERE owner = $1`, owner)
+	exec(nil, `DELETE FROM summary_reports_sent WHERE owner = $1`, owner)
+	exec(&resp.AuditEntries,
+		`UPDATE audit_log SET actor = CASE WHEN actor = $1 THEN $2 ELSE actor END,
+		        target = CASE WHEN target = $1 THEN $2 ELSE target END,
+		        source_ip = CASE WHEN actor = $1 THEN NULL ELSE source_ip END,
+		        details = CASE WHEN details->>'owner' = $1 THEN details || jsonb_build_object('owner', $2::TEXT) ELSE details END
+		 WHERE actor = $1 OR target = $1 OR details->>'owner' = $1`, owner, resp.Pseudonym)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var keyHashes []string
+	rows, err := tx.QueryContext(ctx, `DELETE FROM api_keys WHERE owner = $1 RETURNING key_hash`, owner)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return nil, nil, nil, err
+		}
+		keyHashes = append(keyHashes, hash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	resp.APIKeys = int64(len(keyHashes))
+
+	var deleted []string
+	if !deleteLinks {
+		exec(&resp.LinksAnonymized, `UPDATE urls SET owner = $2 WHERE owner = $1`, owner, resp.Pseudonym)
+		exec(&resp.CustomDomains, `UPDATE custom_domains SET owner = $2 WHERE owner = $1`, owner, resp.Pseudonym)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return resp, nil, keyHashes, tx.Commit()
+	}
+
+	exec(nil, `DELETE FROM link_previews WHERE short_code IN (SELECT short_code FROM urls WHERE owner = $1)`, owner)
+	exec(nil, `DELETE FROM expiry_notices WHERE short_code IN (SELECT short_code FROM urls WHERE owner = $1)`, owner)
+	exec(nil, `DELETE FROM link_health WHERE short_code IN (SELECT short_code FROM urls WHERE owner = $1)`, owner)
+	exec(&resp.CustomDomains, `DELETE FROM custom_domains WHERE owner = $1`, owner)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	rows, err = tx.QueryContext(ctx, `DELETE FROM urls WHERE owner = $1 RETURNING short_code`, owner)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			rows.Close()
+			return nil, nil, nil, err
+		}
+		deleted = append(deleted, code)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	resp.LinksDeleted = int64(len(deleted))
+	return resp, deleted, keyHashes, tx.Commit()
+}
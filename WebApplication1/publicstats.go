@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Public stats: an owner can open a link's stats to anyone (PUT
+// /api/v1/links/{code}/sharing) to share a campaign's numbers without
+// sharing an API key. Otherwise an owned link's stats are only for its
+// owner, and are not found for everyone else; anonymous links have no one
+// to ask and stay public. This is what GET /api/v1/stats/{code} answers
+// since public stats came in; before, any link's stats were open to anyone.
+// The gRPC API, which has no callers to tell apart, still answers for every
+// link. Viewable stats also get a page at /{code}/stats with the clicks of
+// the last days. The embeddable widget (statswidget.go)
+// is switched on here too.
+const publicStatsDays = 30
+
+type LinkSharing struct {
+	ShortCode    string `json:"short_code"`
+	PublicStats  bool   `json:"public_stats"`
+	StatsURL     string `json:"stats_url,omitempty"` // the stats page, while public_stats is on
+	Widget       bool   `json:"widget"`
+	WidgetURL    string `json:"widget_url,omitempty"`    // for an iframe
+	WidgetScript string `json:"widget_script,omitempty"` // or a script tag that adds the iframe
+
+	widgetToken string
+}
+
+// Switching the widget off revokes its token; switching it back on makes a
+// new one
+type LinkSharingRequest struct {
+	PublicStats *bool `json:"public_stats,omitempty"`
+	Widget      *bool `json:"widget,omitempty"`
+}
+
+func initLinkSharing() {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS link_sharing (
+		short_code VARCHAR(64) PRIMARY KEY REFERENCES urls(short_code) ON DELETE CASCADE,
+		public_stats BOOLEAN NOT NULL DEFAULT FALSE,
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	ALTER TABLE link_sharing ADD COLUMN IF NOT EXISTS widget_token TEXT UNIQUE;
+	`
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Link sharing table creation failed", "err", err)
+	}
+}
+
+func loadLinkSharing(ctx context.Context, link *Link, host string) (*LinkSharing, error) {
+	sharing := &LinkSharing{ShortCode: link.ShortCode}
+	err := db.QueryRowContext(ctx,
+		`SELECT public_stats, COALESCE(widget_token, '') FROM link_sharing WHERE short_code = $1`, link.ShortCode).
+		Scan(&sharing.PublicStats, &sharing.widgetToken)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if sharing.PublicStats {
+		sharing.StatsURL = shortURL(linkHost(link, host), link.ShortCode) + "/stats"
+	}
+	if sharing.widgetToken != "" {
+		sharing.Widget = true
+		sharing.WidgetURL = baseURL(linkHost(link, host)) + "/widget/" + sharing.widgetToken
+		sharing.WidgetScript = fmt.Sprintf(`<script src="%s/embed.js" async></script>`, sharing.WidgetURL)
+	}
+	return sharing, nil
+}
+
+// Whether the caller may see a link's stats
+func statsVisible(ctx context.Context, link *Link) (bool, error) {
+	if link.Owner == "" || link.Owner == callerOwner(ctx) {
+		return true, nil
+	}
+	var public bool
+	err := db.QueryRowContext(ctx,
+		`SELECT public_stats FROM link_sharing WHERE short_code = $1`, link.ShortCode).Scan(&public)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return public, err
+}
+
+// Clicks per day over the last days, today last; suspicious clicks don't count
+func dailyLinkClicks(ctx context.Context, shortCode string, days int) ([]DailyClicks, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT d, COUNT(c.id) FROM generate_series(date_trunc('day', NOW()) - make_interval(days => $2 - 1),
+			date_trunc('day', NOW()), INTERVAL '1 day') AS d
+		 LEFT JOIN click_events c ON c.short_code = $1 AND c.clicked_at >= d AND c.clicked_at < d + INTERVAL '1 day'
+			AND c.suspicious IS NULL
+		 GROUP BY d ORDER BY d`, shortCode, days)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	daily := []DailyClicks{}
+	for rows.Next() {
+		var day time.Time
+		var clicks int64
+		if err := rows.Scan(&day, &clicks); err != nil {
+			return nil, err
+		}
+		daily = append(daily, DailyClicks{Date: day.Format(time.DateOnly), Clicks: clicks})
+	}
+	return daily, rows.Err()
+}
+
+// GET /api/v1/links/{code}/sharing
+func getLinkSharingHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := callerLink(w, r)
+	if !ok {
+		return
+	}
+	sharing, err := loadLinkSharing(r.Context(), link, r.Host)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Link sharing lookup error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, sharing)
+}
+
+// PUT /api/v1/links/{code}/sharing - open a link's stats or widget to
+// anyone, or close them again
+func putLinkSharingHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := callerLink(w, r)
+	if !ok {
+		return
+	}
+	var req LinkSharingRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	if req.PublicStats == nil && req.Widget == nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "public_stats or widget is required")
+		return
+	}
+	sharing, err := loadLinkSharing(r.Context(), link, r.Host)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Link sharing lookup error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if req.PublicStats != nil {
+		sharing.PublicStats = *req.PublicStats
+	}
+	if req.Widget != nil && !*req.Widget {
+		sharing.widgetToken = ""
+	} else if req.Widget != nil && sharing.widgetToken == "" {
+		sharing.widgetToken = newWidgetToken()
+	}
+
+	if _, err := db.ExecContext(r.Context(),
+		`INSERT INTO link_sharing (short_code, public_stats, widget_token) VALUES ($1, $2, NULLIF($3, ''))
+		 ON CONFLICT (short_code) DO UPDATE SET public_stats = EXCLUDED.public_stats,
+		 widget_token = EXCLUDED.widget_token, updated_at = NOW()`,
+		link.ShortCode, sharing.PublicStats, sharing.widgetToken); err != nil {
+		slog.ErrorContext(r.Context(), "Link sharing update error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if sharing, err = loadLinkSharing(r.Context(), link, r.Host); err != nil {
+		slog.ErrorContext(r.Context(), "Link sharing lookup error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	auditCaller(r.Context(), "link.sharing.update", link.ShortCode, map[string]interface{}{
+		"public_stats": sharing.PublicStats, "widget": sharing.Widget,
+	})
+	emitLinkUpdated(link.ShortCode)
+	writeJSON(w, http.StatusOK, sharing)
+}
+
+// GET /{code}/stats - the stats page (routed by linkSubpathHandler)
+func statsPageHandler(w http.ResponseWriter, r *http.Request) {
+	domain := requestDomain(r)
+	shortCode, ok := resolveCode(r.Context(), namespacedCode(domain, r.PathValue("code")))
+	if !ok {
+		serveErrorPage(w, r, http.StatusNotFound, "not_found.message")
+		return
+	}
+	addLogAttrs(r.Context(), slog.String("short_code", shortCode))
+
+	link, err := store.GetLink(r.Context(), shortCode)
+	visible := false
+	if err == nil {
+		visible, err = statsVisible(r.Context(), link)
+	}
+	if errors.Is(err, ErrLinkNotFound) || (err == nil && (!visible || link.Domain != domain)) {
+		serveErrorPage(w, r, http.StatusNotFound, "not_found.message")
+		return
+	}
+	// The page links to the destination, which a disabled link (held for
+	// review, flagged or reported) mustn't hand out
+	if err == nil && link.DisabledAt != nil {
+		serveErrorPage(w, r, http.StatusGone, "link_disabled")
+		return
+	}
+	var daily []DailyClicks
+	if err == nil {
+		daily, err = dailyLinkClicks(r.Context(), link.ShortCode, publicStatsDays)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Stats page error", "err", err)
+		serveErrorPage(w, r, http.StatusInternalServerError, "error.retry")
+		return
+	}
+
+	t := localizer(w, r)
+	short := shortURL(linkHost(link, r.Host), link.ShortCode)
+	var peak int64 = 1
+	for _, d := range daily {
+		peak = max(peak, d.Clicks)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	fmt.Fprintf(w, `<!doctype html><html lang="%s"><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>%s</title>
+<style>body{font-family:system-ui,sans-serif;max-width:40rem;margin:2rem auto;padding:0 1rem}
+.c{display:flex;align-items:flex-end;gap:2px;height:8rem}.c span{flex:1;background:#222;min-height:1px}</style>
+<h1>%s</h1>
+<p><a href="%s" rel="nofollow noopener">%s</a></p>
+<p>%s: <strong>%d</strong> &middot; %s: %s</p>
+<h2>%s</h2>
+<div class="c">`, w.Header().Get("Content-Language"), html.EscapeString(t("stats.title", short)),
+		html.EscapeString(t("stats.title", short)), html.EscapeString(link.OriginalURL), html.EscapeString(link.OriginalURL),
+		html.EscapeString(t("stats.clicks")), link.ClickCount, html.EscapeString(t("stats.created")),
+		link.CreatedAt.Format(time.DateOnly), html.EscapeString(t("stats.daily", publicStatsDays)))
+	for _, d := range daily {
+		fmt.Fprintf(w, `<span style="height:%d%%" title="%s: %d"></span>`, d.Clicks*100/peak, d.Date, d.Clicks)
+	}
+	fmt.Fprint(w, "</div>\n")
+}
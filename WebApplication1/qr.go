@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// QR codes for print and posters. Codes use medium error correction, which
+// survives a logo sticker or a scuffed poster, and no quiet zone beyond the
+// standard four modules.
+const (
+	qrDefaultSize = 256
+	qrMinSize     = 64
+	qrMaxSize     = 2048
+)
+
+// PNG of the given width in pixels
+func qrPNG(content string, size int) ([]byte, error) {
+	return qrcode.Encode(content, qrcode.Medium, size)
+}
+
+// SVG scales without loss, so size only sets the nominal width and height
+func qrSVG(content string, size int) ([]byte, error) {
+	q, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		return nil, err
+	}
+	bitmap := q.Bitmap() // includes the quiet zone
+	n := len(bitmap)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, n, n)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+	for y, row := range bitmap {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			// One path segment per horizontal run keeps the file small
+			start := x
+			for x < len(row) && row[x] {
+				x++
+			}
+			fmt.Fprintf(&buf, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes(), nil
+}
+
+// PNG as a data URI, for embedding in JSON responses
+func qrDataURI(content string) (string, error) {
+	png, err := qrPNG(content, qrDefaultSize)
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(png), nil
+}
+
+// GET /api/v1/qr/{code}?size=256&format=png|svg
+func qrHandler(w http.ResponseWriter, r *http.Request) {
+	shortCode, ok := resolveCode(r.Context(), r.PathValue("code"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "link_not_found", "Short URL not found")
+		return
+	}
+	addLogAttrs(r.Context(), slog.String("short_code", shortCode))
+
+	query := r.URL.Query()
+	size := qrDefaultSize
+	if raw := query.Get("size"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < qrMinSize || n > qrMaxSize {
+			writeError(w, http.StatusBadRequest, "invalid_size",
+				fmt.Sprintf("size must be a number of pixels between %d and %d", qrMinSize, qrMaxSize))
+			return
+		}
+		size = n
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "svg" {
+		writeError(w, http.StatusBadRequest, "invalid_format", "format must be png or svg")
+		return
+	}
+
+	link, err := store.GetLink(r.Context(), shortCode)
+	if errors.Is(err, ErrLinkNotFound) {
+		writeError(w, http.StatusNotFound, "link_not_found", "Short URL not found")
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Database error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	content := shortURL(linkHost(link, r.Host), link.ShortCode)
+	var body []byte
+	if format == "svg" {
+		body, err = qrSVG(content, size)
+		w.Header().Set("Content-Type", "image/svg+xml")
+	} else {
+		body, err = qrPNG(content, size)
+		w.Header().Set("Content-Type", "image/png")
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "QR encoding error", "err", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "QR encoding error")
+		return
+	}
+
+	// The image only depends on the short URL, which never changes
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
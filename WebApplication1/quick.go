@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// GET /api/v1/quick?url=...&key=... for bookmarklets and browser extensions
+// that can only open a URL: the API key rides in the query string instead
+// of X-API-Key and the answer is the bare short URL as text/plain. The key
+// is optional, as on every other create endpoint. Responses are never
+// cached, since the same URL creates a fresh link each time it's opened.
+func quickHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	query := r.URL.Query()
+
+	ctx := r.Context()
+	if key := query.Get("key"); key != "" && callerOwner(ctx) == "" {
+		owner, err := lookupAPIKey(ctx, key)
+		if err == sql.ErrNoRows || (err == nil && !ownerAllowedHere(ctx, owner)) {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			slog.ErrorContext(ctx, "API key lookup error", "err", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		ctx = context.WithValue(ctx, callerOwnerKey, owner)
+	}
+
+	req := CreateURLRequest{OriginalURL: strings.TrimSpace(query.Get("url")), CustomCode: query.Get("code")}
+	response, err := createShortURL(ctx, req, r.Host)
+	if err != nil {
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) {
+			slog.ErrorContext(ctx, "Database error", "err", err)
+			apiErr = &apiError{http.StatusInternalServerError, "database_error", "Database error"}
+		}
+		http.Error(w, apiErr.Message, apiErr.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, response.ShortURL)
+}
+
+// Request URI with credentials in the query string masked, for logs
+func redactedRequestURI(u *url.URL) string {
+	query := u.Query()
+	if !query.Has("key") {
+		return u.RequestURI()
+	}
+	query.Set("key", "REDACTED")
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.RequestURI()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rate limiting plumbing. Limiters report their decision so every limited
+// response carries X-RateLimit-* headers (and Retry-After on a 429),
+// letting well-behaved clients throttle themselves.
+type rateDecision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Time     // when the full limit is available again
+	RetryAfter time.Duration // when denied, until the next request is allowed
+}
+
+type rateLimiter interface {
+	Allow(ctx context.Context, key string) (rateDecision, error)
+}
+
+func writeRateLimitHeaders(w http.ResponseWriter, d rateDecision) {
+	remaining := d.Remaining
+	if remaining < 0 {
+		remaining = 0
+	}
+	reset := int64(math.Ceil(time.Until(d.Reset).Seconds()))
+	if reset < 0 {
+		reset = 0
+	}
+
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(d.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+}
+
+// Wrap a handler with a limiter keyed by keyFn. While the limiter is
+// disabled requests pass straight through. Limiter failures fail open - an
+// outage of the limiter backend shouldn't take the API down with it.
+func withRateLimit(limiter *reloadableLimiter, keyFn func(*http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		current := limiter.current()
+		if current == nil {
+			next(w, r)
+			return
+		}
+		decision, err := current.Allow(r.Context(), keyFn(r))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Rate limiter error", "err", err)
+			next(w, r)
+			return
+		}
+
+		writeRateLimitHeaders(w, decision)
+		if !decision.Allowed {
+			wait := decision.RetryAfter
+			if wait <= 0 {
+				wait = time.Until(decision.Reset)
+			}
+			retryAfter := int64(math.Ceil(wait.Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+			writeError(w, http.StatusTooManyRequests, "rate_limited", "Too many requests, slow down")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// Key requests by client address (see getClientIP), per limiter
+func clientIPKey(r *http.Request) string {
+	return ipLimitKey(getClientIP(r))
+}
+
+// IPv6 clients are keyed by their /64, which a single host can hand itself
+// any address in
+func ipLimitKey(ip string) string {
+	if addr, err := netip.ParseAddr(ip); err == nil && addr.Is6() && !addr.Is4In6() {
+		return netip.PrefixFrom(addr, 64).Masked().String()
+	}
+	return ip
+}
+
+// The three limiters behind the public endpoints. Their limits are set
+// from the configuration at startup and again on every reload.
+var (
+	shortenLimiter  = &reloadableLimiter{name: "RATE_LIMIT_SHORTEN"}
+	redirectLimiter = &reloadableLimiter{name: "RATE_LIMIT_REDIRECT"}
+	reportLimiter   = &reloadableLimiter{name: "RATE_LIMIT_REPORT"}
+)
+
+type reloadableLimiter struct {
+	name string
+
+	mu        sync.Mutex
+	perMinute int
+	burst     int
+	limiter   atomic.Pointer[limiterSlot]
+}
+
+// atomic.Pointer needs a concrete type; a nil limiter means disabled
+type limiterSlot struct{ rateLimiter }
+
+func (l *reloadableLimiter) current() rateLimiter {
+	if slot := l.limiter.Load(); slot != nil {
+		return slot.rateLimiter
+	}
+	return nil
+}
+
+// Swap in new limits. Unchanged limits keep their state; changed ones
+// start with fresh budgets.
+func (l *reloadableLimiter) set(perMinute, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limiter.Load() != nil && perMinute == l.perMinute && burst == l.burst {
+		return
+	}
+	old := l.current()
+	l.perMinute, l.burst = perMinute, burst
+	l.limiter.Store(&limiterSlot{newRateLimiter(l.name, perMinute, burst)})
+	if tb, ok := old.(*tokenBucketLimiter); ok {
+		tb.stop()
+	}
+}
+
+// A rate of 0 disables the limiter and a burst of 0 defaults to the
+// per-minute rate. Limits are enforced in Redis when it is configured,
+// otherwise per process; name keeps each limiter's Redis keys apart.
+func newRateLimiter(name string, perMinute, burst int) rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = perMinute
+	}
+	if redisClient != nil {
+		return newRedisLimiter(name, float64(perMinute)/60, burst)
+	}
+	return newTokenBucketLimiter(float64(perMinute)/60, burst)
+}
+
+// In-process token buckets - a bucket holds up to burst tokens and refills
+// at rate tokens per second. Limits are per replica.
+type tokenBucketLimiter struct {
+	rate  float64
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	done    chan struct{}
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+const bucketIdleTTL = 10 * time.Minute
+
+func newTokenBucketLimiter(rate float64, burst int) *tokenBucketLimiter {
+	l := &tokenBucketLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket), done: make(chan struct{})}
+	go l.evictIdle()
+	return l
+}
+
+func (l *tokenBucketLimiter) Allow(ctx context.Context, key string) (rateDecision, error) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.burst), updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+
+	d := rateDecision{Limit: l.burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	d.Remaining = int(b.tokens)
+	d.Reset = now.Add(time.Duration((float64(l.burst) - b.tokens) / l.rate * float64(time.Second)))
+	return d, nil
+}
+
+// Buckets idle long enough to have refilled carry no state worth keeping
+func (l *tokenBucketLimiter) evictIdle() {
+	ticker := time.NewTicker(bucketIdleTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			if time.Since(b.updated) > bucketIdleTTL {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Ends the eviction loop of a limiter that has been replaced
+func (l *tokenBucketLimiter) stop() {
+	close(l.done)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+)
+
+// Shared rate limiting for multi-replica deployments. With REDIS_URL set,
+// every limiter uses GCRA state in Redis instead of per-process buckets,
+// so a client gets the same budget whichever replica it lands on.
+var redisClient *redis.Client
+
+func initRedis() {
+	redisURL := secret("REDIS_URL")
+	if redisURL == "" {
+		return
+	}
+
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		fatal("Invalid REDIS_URL", "err", err)
+	}
+	redisClient = redis.NewClient(opts)
+	if err := redisotel.InstrumentTracing(redisClient); err != nil {
+		slog.Warn("Redis tracing setup failed", "err", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := redisClient.Ping(ctx).Err(); err != nil {
+		// Limiters fail open, so carry on and let Redis come back
+		slog.Warn("Redis not reachable yet", "err", err)
+		return
+	}
+	slog.Info("✅ Redis connected")
+}
+
+// GCRA keeps one value per key - the theoretical arrival time (TAT) of the
+// next request. Redis' own clock is used so replicas never disagree about
+// "now". Times are microseconds. Returns {allowed, tat - now, retry_after}.
+var gcraScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local interval = tonumber(ARGV[1])
+local tolerance = interval * tonumber(ARGV[2])
+
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+
+local new_tat = tat + interval
+local allow_at = new_tat - tolerance
+if allow_at > now then
+	return {0, tat - now, allow_at - now}
+end
+
+redis.call('SET', KEYS[1], new_tat, 'PX', math.ceil((new_tat - now) / 1000))
+return {1, new_tat - now, 0}
+`)
+
+type redisLimiter struct {
+	name     string
+	interval time.Duration // one token's worth of time
+	burst    int
+}
+
+func newRedisLimiter(name string, rate float64, burst int) *redisLimiter {
+	return &redisLimiter{
+		name:     name,
+		interval: time.Duration(float64(time.Second) / rate),
+		burst:    burst,
+	}
+}
+
+func (l *redisLimiter) Allow(ctx context.Context, key string) (rateDecision, error) {
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	res, err := gcraScript.Run(ctx, redisClient, []string{"ihdas:rl:" + l.name + ":" + key},
+		l.interval.Microseconds(), l.burst).Int64Slice()
+	if err != nil {
+		return rateDecision{}, err
+	}
+
+	// res[1] is how far ahead of now the bucket is "booked"
+	booked := time.Duration(res[1]) * time.Microsecond
+	used := int(math.Ceil(float64(booked) / float64(l.interval)))
+	return rateDecision{
+		Allowed:    res[0] == 1,
+		Limit:      l.burst,
+		Remaining:  l.burst - used,
+		Reset:      time.Now().Add(booked),
+		RetryAfter: time.Duration(res[2]) * time.Microsecond,
+	}, nil
+}
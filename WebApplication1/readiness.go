@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Liveness and readiness for load balancers and orchestrators. /livez only
+// says the process is serving; /readyz says this instance should get
+// traffic. Until it is ready the router answers everything else with a 503.
+var (
+	migrationsApplied atomic.Bool
+	cacheWarmed       atomic.Bool
+)
+
+func isReady() bool {
+	return migrationsApplied.Load() && cacheWarmed.Load()
+}
+
+// Preload the most recent live links so a fresh instance doesn't send
+// its first wave of redirects straight to the database
+func warmCache() {
+	defer cacheWarmed.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+linkColumns+` FROM urls
+		WHERE (expires_at IS NULL OR expires_at > NOW()) AND disabled_at IS NULL
+		ORDER BY id DESC LIMIT $1`, cfg.WarmCacheSize)
+	if err != nil {
+		slog.Error("Cache warm-up error", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			slog.Error("Cache warm-up error", "err", err)
+			return
+		}
+		setCachedURL(link)
+		count++
+	}
+	slog.Info("Cache warmed", "links", count)
+}
+
+// GET /livez
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "alive"})
+}
+
+// GET /readyz
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	checks := map[string]string{
+		"migrations": "pending",
+		"cache":      "warming",
+		"database":   "down",
+	}
+	if migrationsApplied.Load() {
+		checks["migrations"] = "applied"
+	}
+	if cacheWarmed.Load() {
+		checks["cache"] = "warm"
+	}
+	dbUp := db != nil && checkDBRead(ctx) == nil
+	if dbUp {
+		checks["database"] = "up"
+	}
+
+	if shuttingDown.Load() {
+		checks["server"] = "shutting_down"
+	}
+
+	// Stay in rotation through maintenance to keep cached redirects flowing
+	if inMaintenance() {
+		checks["maintenance"] = "on"
+		dbUp = true
+	}
+
+	if !isReady() || !dbUp || shuttingDown.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "not_ready", "checks": checks})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ready", "checks": checks})
+}
+
+// Refuse traffic until ready, apart from the probes themselves
+func readinessGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isReady() {
+			switch r.URL.Path {
+			case "/livez", "/readyz", "/health", "/metrics", "/version":
+			default:
+				w.Header().Set("Retry-After", "1")
+				writeError(w, http.StatusServiceUnavailable, "not_ready", "Service is starting up")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// A panicking handler gets a problem+json 500 instead of a dropped
+// connection. The stack goes to the log, tagged with the request ID via
+// the context, and never to the client.
+var panicsRecovered = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "ihdas_http_panics_total",
+	Help: "Handler panics recovered by the HTTP middleware.",
+})
+
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// net/http's own signal for aborting a response
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			panicsRecovered.Inc()
+			reportPanic(r.Context(), v)
+			slog.ErrorContext(r.Context(), "Handler panic",
+				"panic", fmt.Sprint(v),
+				"method", r.Method,
+				"path", r.URL.Path,
+				"stack", string(debug.Stack()))
+
+			// Too late for a clean error once the response has started
+			if rec.status != 0 {
+				return
+			}
+			writeError(rec, http.StatusInternalServerError, "internal_error", "Internal server error")
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Abuse reports - anyone can flag a link; admins work through the queue
+// and dismiss the report, disable the link or block its domain.
+var reportReasons = map[string]bool{
+	"phishing": true,
+	"malware":  true,
+	"spam":     true,
+	"illegal":  true,
+	"other":    true,
+}
+
+const maxReportDetails = 2000
+
+type CreateReportRequest struct {
+	Reason  string `json:"reason"`
+	Details string `json:"details,omitempty"`
+}
+
+type AbuseReport struct {
+	ID         int64      `json:"id"`
+	ShortCode  string     `json:"short_code"`
+	Reason     string     `json:"reason"`
+	Details    string     `json:"details,omitempty"`
+	ReporterIP string     `json:"reporter_ip,omitempty"`
+	Status     string     `json:"status"` // pending, dismissed, link_disabled, domain_blocked
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	// Destination, filled in for the admin queue
+	OriginalURL string `json:"original_url,omitempty"`
+}
+
+type ReportListResponse struct {
+	Reports    []AbuseReport `json:"reports"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+type ResolveReportRequest struct {
+	Action string `json:"action"` // dismiss, disable_link or block_domain
+}
+
+func initReports() {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS abuse_reports (
+		id BIGSERIAL PRIMARY KEY,
+		short_code VARCHAR(64) NOT NULL,
+		reason TEXT NOT NULL,
+		details TEXT,
+		reporter_ip TEXT,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at TIMESTAMP DEFAULT NOW(),
+		resolved_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_abuse_reports_status ON abuse_reports(status, id);
+	`
+
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Abuse reports table creation failed", "err", err)
+	}
+}
+
+// POST /api/v1/report/{code}
+func createReportHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateReportRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	if !reportReasons[req.Reason] {
+		writeError(w, http.StatusBadRequest, "invalid_reason", "reason must be one of phishing, malware, spam, illegal, other")
+		return
+	}
+	if len(req.Details) > maxReportDetails {
+		writeError(w, http.StatusBadRequest, "details_too_long", "details must not exceed "+strconv.Itoa(maxReportDetails)+" characters")
+		return
+	}
+
+	shortCode, ok := resolveCode(r.Context(), r.PathValue("code"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "link_not_found", "Short URL not found")
+		return
+	}
+	addLogAttrs(r.Context(), slog.String("short_code", shortCode))
+	link, err := store.GetLink(r.Context(), shortCode)
+	if errors.Is(err, ErrLinkNotFound) {
+		writeError(w, http.StatusNotFound, "link_not_found", "Short URL not found")
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Database error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	report := AbuseReport{ShortCode: link.ShortCode, Reason: req.Reason, Details: req.Details, Status: "pending"}
+	err = db.QueryRowContext(r.Context(),
+		`INSERT INTO abuse_reports (short_code, reason, details, reporter_ip)
+		 VALUES ($1, $2, NULLIF($3, ''), $4) RETURNING id, created_at`,
+		link.ShortCode, req.Reason, req.Details, getClientIP(r)).Scan(&report.ID, &report.CreatedAt)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Abuse report error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Abuse report filed", "report_id", report.ID, "short_code", link.ShortCode, "reason", req.Reason)
+	writeJSON(w, http.StatusCreated, report)
+}
+
+// GET /api/v1/admin/reports?status=pending&cursor=&limit=
+func listReportsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	afterID, limit, ok := parsePageQuery(w, r)
+	if !ok {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "pending"
+	}
+
+	rows, err := db.QueryContext(r.Context(),
+		`SELECT id, short_code, reason, COALESCE(details, ''), COALESCE(reporter_ip, ''), status, created_at, resolved_at
+		 FROM abuse_reports WHERE status = $1 AND id > $2 ORDER BY id LIMIT $3`, status, afterID, limit+1)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Abuse report list error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	defer rows.Close()
+
+	resp := ReportListResponse{Reports: []AbuseReport{}}
+	for rows.Next() {
+		var report AbuseReport
+		if err := rows.Scan(&report.ID, &report.ShortCode, &report.Reason, &report.Details,
+			&report.ReporterIP, &report.Status, &report.CreatedAt, &report.ResolvedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Abuse report list error", "err", err)
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		resp.Reports = append(resp.Reports, report)
+	}
+	rows.Close()
+
+	hasNext := len(resp.Reports) > limit
+	if hasNext {
+		resp.Reports = resp.Reports[:limit]
+	}
+	for i := range resp.Reports {
+		if link, err := store.GetLink(r.Context(), resp.Reports[i].ShortCode); err == nil {
+			resp.Reports[i].OriginalURL = link.OriginalURL
+		}
+	}
+	if len(resp.Reports) > 0 {
+		resp.NextCursor = nextCursor(resp.Reports[len(resp.Reports)-1].ID, hasNext)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// POST /api/v1/admin/reports/{id}/resolve
+func resolveReportHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_id", "Invalid report id")
+		return
+	}
+	var req ResolveReportRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+
+	var code, reason string
+	err = db.QueryRowContext(r.Context(),
+		`SELECT short_code, reason FROM abuse_reports WHERE id = $1 AND status = 'pending'`, id).Scan(&code, &reason)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "report_not_found", "No pending report with that id")
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Abuse report lookup error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	var status string
+	switch req.Action {
+	case "dismiss":
+		status = "dismissed"
+	case "disable_link":
+		status = "link_disabled"
+		err = store.DisableLink(r.Context(), code, "abuse_report:"+reason)
+		if err == nil {
+			// Every instance stops redirecting it, not just this one
+			invalidateCachedURL(r.Context(), code)
+			emitLinkUpdated(code)
+		} else if errors.Is(err, ErrLinkNotFound) {
+			err = nil // already disabled or deleted
+		}
+	case "block_domain":
+		status = "domain_blocked"
+		var link *Link
+		if link, err = store.GetLink(r.Context(), code); err == nil {
+			var parsed *url.URL
+			if parsed, err = url.Parse(link.OriginalURL); err == nil {
+				_, err = blocklist.add(r.Context(), normalizeDomain(parsed.Hostname()), "abuse report "+strconv.FormatInt(id, 10))
+			}
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_action", "action must be dismiss, disable_link or block_domain")
+		return
+	}
+	if errors.Is(err, ErrLinkNotFound) {
+		writeError(w, http.StatusNotFound, "link_not_found", "Short URL no longer exists")
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Abuse report action error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	// Acting on the link settles every pending report for it; a dismissal
+	// only closes this one
+	_, err = db.ExecContext(r.Context(),
+		`UPDATE abuse_reports SET status = $2, resolved_at = NOW()
+		 WHERE status = 'pending' AND (id = $1 OR ($2 <> 'dismissed' AND short_code = $3))`,
+		id, status, code)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Abuse report resolve error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Admin resolved abuse report", "report_id", id, "status", status)
+	auditAdmin(r, "report.resolve", strconv.FormatInt(id, 10), map[string]interface{}{"short_code": code, "status": status})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// REST Hooks (resthooks.org), the subscription style Zapier, Make and n8n
+// speak: the platform subscribes a target URL to one event when a user
+// turns an automation on and unsubscribes when it's turned off. A
+// subscription is an ordinary webhook with a single event, so it's signed,
+// retried and listed like one, and a target answering 410 Gone is
+// unsubscribed automatically. The sample endpoint gives the platform
+// example payloads to map fields from while the automation is set up.
+type RestHookRequest struct {
+	TargetURL      string `json:"target_url"`
+	Event          string `json:"event"`
+	ClickThreshold *int64 `json:"click_threshold,omitempty"` // for link.click_threshold
+}
+
+type RestHookSubscription struct {
+	ID        int64  `json:"id"`
+	TargetURL string `json:"target_url"`
+	Event     string `json:"event"`
+	Secret    string `json:"secret"` // optional to verify, only ever shown once
+}
+
+const restHookSamples = 3
+
+// POST /api/v1/hooks
+func subscribeRestHookHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	var req RestHookRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	if req.Event == "" {
+		writeError(w, http.StatusBadRequest, "missing_event", "event is required")
+		return
+	}
+	hook, err := registerWebhook(r.Context(), owner, CreateWebhookRequest{
+		URL:            req.TargetURL,
+		Events:         []string{req.Event},
+		ClickThreshold: req.ClickThreshold,
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, RestHookSubscription{
+		ID:        hook.ID,
+		TargetURL: hook.URL,
+		Event:     req.Event,
+		Secret:    hook.Secret,
+	})
+}
+
+// GET /api/v1/hooks/sample/{event}: the caller's latest links shaped as that
+// event's deliveries, newest first
+func restHookSampleHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return
+	}
+	event := r.PathValue("event")
+	if !webhookEvents[event] {
+		writeError(w, http.StatusNotFound, "invalid_event", "Unknown event "+strconv.Quote(event))
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(),
+		`SELECT `+linkColumns+` FROM urls WHERE owner = $1 ORDER BY id DESC LIMIT $2`, owner, restHookSamples)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "REST hook sample error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	defer rows.Close()
+
+	samples := []WebhookEvent{}
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "REST hook sample error", "err", err)
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		samples = append(samples, newWebhookEvent(event, link))
+	}
+	writeJSON(w, http.StatusOK, samples)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// robots.txt and sitemap.xml, generated so they follow the configuration.
+// By default crawlers may index the landing pages but not the short codes:
+// every code is a redirect to someone else's content, and crawling them
+// inflates click counts. ROBOTS_TXT_FILE replaces the generated rules
+// entirely.
+var robotsTxt string
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc string `xml:"loc"`
+}
+
+func initRobots() {
+	if cfg.RobotsTxtFile == "" {
+		return
+	}
+	content, err := os.ReadFile(cfg.RobotsTxtFile)
+	if err != nil {
+		fatal("robots.txt file unreadable", "path", cfg.RobotsTxtFile, "err", err)
+	}
+	robotsTxt = string(content)
+}
+
+// GET /robots.txt
+func robotsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if robotsTxt != "" {
+		fmt.Fprint(w, robotsTxt)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("User-agent: *\n")
+	if cfg.RobotsAllowShortCodes {
+		b.WriteString("Allow: /\n")
+	} else {
+		// Longest match wins, so these beat the blanket Disallow
+		for _, path := range cfg.SitemapPaths {
+			fmt.Fprintf(&b, "Allow: %s$\n", path)
+		}
+		b.WriteString("Allow: /static/\n")
+		b.WriteString("Disallow: /\n")
+	}
+	if cfg.SitemapEnabled {
+		fmt.Fprintf(&b, "\nSitemap: %s/sitemap.xml\n", baseURL(r.Host))
+	}
+	fmt.Fprint(w, b.String())
+}
+
+// GET /sitemap.xml lists the public landing pages, never short codes
+func sitemapHandler(w http.ResponseWriter, r *http.Request) {
+	if !cfg.SitemapEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	set := sitemapURLSet{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	for _, path := range cfg.SitemapPaths {
+		set.URLs = append(set.URLs, sitemapURL{Loc: baseURL(r.Host) + path})
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	fmt.Fprint(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(set)
+}
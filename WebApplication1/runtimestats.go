@@ -0,0 +1,67 @@
+package main
+
+import (
+	"runtime"
+	"time"
+)
+
+// Process snapshot for /health, for when there's no Prometheus to ask.
+// The same numbers (and more) are on /metrics.
+func runtimeStats() map[string]interface{} {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	// PauseNs is a ring of the most recent 256 pauses
+	var lastPause, maxPause uint64
+	if mem.NumGC > 0 {
+		lastPause = mem.PauseNs[(mem.NumGC+255)%256]
+		recent := mem.NumGC
+		if recent > 256 {
+			recent = 256
+		}
+		for i := uint32(0); i < recent; i++ {
+			if p := mem.PauseNs[(mem.NumGC-1-i)%256]; p > maxPause {
+				maxPause = p
+			}
+		}
+	}
+	gc := map[string]interface{}{
+		"cycles":              mem.NumGC,
+		"pause_total_ms":      msFromNanos(mem.PauseTotalNs),
+		"last_pause_ms":       msFromNanos(lastPause),
+		"max_recent_pause_ms": msFromNanos(maxPause),
+		"cpu_fraction":        mem.GCCPUFraction,
+	}
+	if mem.LastGC > 0 {
+		gc["last_run"] = time.Unix(0, int64(mem.LastGC)).UTC().Format(time.RFC3339)
+	}
+
+	stats := map[string]interface{}{
+		"goroutines":        runtime.NumGoroutine(),
+		"heap_in_use_bytes": mem.HeapInuse,
+		"heap_alloc_bytes":  mem.HeapAlloc,
+		"heap_objects":      mem.HeapObjects,
+		"sys_bytes":         mem.Sys,
+		"gc":                gc,
+		"webhook_queue":     len(webhookQueue),
+	}
+
+	if db != nil {
+		pool := db.Stats()
+		stats["db_pool"] = map[string]interface{}{
+			"max_open":            pool.MaxOpenConnections,
+			"open":                pool.OpenConnections,
+			"in_use":              pool.InUse,
+			"idle":                pool.Idle,
+			"wait_count":          pool.WaitCount,
+			"wait_duration_ms":    pool.WaitDuration.Milliseconds(),
+			"max_idle_closed":     pool.MaxIdleClosed,
+			"max_lifetime_closed": pool.MaxLifetimeClosed,
+		}
+	}
+	return stats
+}
+
+func msFromNanos(ns uint64) float64 {
+	return float64(ns) / float64(time.Millisecond)
+}
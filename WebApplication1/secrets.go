@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// Secrets are resolved once at startup so none of them have to live in
+// source or in the process environment. Each can be given as:
+//
+//	NAME=value                         plain environment variable
+//	NAME_FILE=/run/secrets/name        file contents (Docker/Kubernetes secrets)
+//	NAME=vault:secret/data/ihdas#key   Vault KV v2, using VAULT_ADDR and VAULT_TOKEN
+//	NAME=awssm:prod/ihdas#key          AWS Secrets Manager, using the default credential chain
+//
+// The "#key" suffix picks a field out of a JSON secret; without it the whole
+// value is used.
+var secretNames = []string{
+	"DATABASE_URL",
+	"MIGRATION_DATABASE_URL",
+	"ADMIN_TOKEN",
+	"REDIS_URL",
+	"URL_ENCRYPTION_KEY",
+	"SIGNED_LINKS_KEY",
+	"SAFE_BROWSING_API_KEY",
+	"CAPTCHA_SECRET",
+	"SENTRY_DSN",
+	"SLACK_SIGNING_SECRET",
+	"TELEGRAM_BOT_TOKEN",
+	"TELEGRAM_WEBHOOK_SECRET",
+	"MATTERMOST_TOKENS",
+	"ROCKETCHAT_TOKENS",
+	"NATS_URL",
+	"SMTP_PASSWORD",
+}
+
+var secrets = make(map[string]string)
+
+func initSecrets() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, name := range secretNames {
+		value, err := loadSecret(ctx, name)
+		if err != nil {
+			fatal("Loading secret failed", "name", name, "err", err)
+		}
+		secrets[name] = value
+	}
+}
+
+// Resolved value of a secret, empty when it isn't configured
+func secret(name string) string {
+	return secrets[name]
+}
+
+func loadSecret(ctx context.Context, name string) (string, error) {
+	value := os.Getenv(name)
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		value = strings.TrimSpace(string(data))
+	}
+
+	switch {
+	case strings.HasPrefix(value, "vault:"):
+		return vaultSecret(ctx, strings.TrimPrefix(value, "vault:"))
+	case strings.HasPrefix(value, "awssm:"):
+		return awsSecret(ctx, strings.TrimPrefix(value, "awssm:"))
+	}
+	return value, nil
+}
+
+// Split "path#key" into its parts
+func splitSecretRef(ref string) (path, key string) {
+	path, key, _ = strings.Cut(ref, "#")
+	return path, key
+}
+
+// Pick one field out of a JSON object, or return the raw value
+func secretField(raw []byte, key string) (string, error) {
+	if key == "" {
+		return strings.TrimSpace(string(raw)), nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object: %w", err)
+	}
+	value, ok := fields[key].(string)
+	if !ok {
+		return "", fmt.Errorf("secret has no string field %q", key)
+	}
+	return value, nil
+}
+
+// Read a Vault KV v2 secret, e.g. "secret/data/ihdas#database_url"
+func vaultSecret(ctx context.Context, ref string) (string, error) {
+	addr := strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+	token := os.Getenv("VAULT_TOKEN")
+	if path := os.Getenv("VAULT_TOKEN_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if addr == "" || token == "" {
+		return "", errors.New("VAULT_ADDR and VAULT_TOKEN are required for vault: secrets")
+	}
+
+	path, key := splitSecretRef(ref)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s for %s", resp.Status, path)
+	}
+
+	var body struct {
+		Data struct {
+			Data json.RawMessage `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if key == "" {
+		return "", errors.New("vault secrets need a #key")
+	}
+	return secretField(body.Data.Data, key)
+}
+
+// Read an AWS Secrets Manager secret, e.g. "prod/ihdas#database_url"
+func awsSecret(ctx context.Context, ref string) (string, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	id, key := splitSecretRef(ref)
+	out, err := secretsmanager.NewFromConfig(cfg).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(id),
+	})
+	if err != nil {
+		return "", err
+	}
+	if out.SecretString == nil {
+		return "", fmt.Errorf("secret %s has no string value", id)
+	}
+	return secretField([]byte(*out.SecretString), key)
+}
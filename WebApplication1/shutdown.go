@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Graceful shutdown on SIGINT/SIGTERM: /readyz starts failing so load
+// balancers stop routing here, the listeners close, in-flight requests get
+// up to the shutdown timeout (default 30s) to finish, queued clicks and webhook
+// deliveries are given the remaining time, and only then are the database and Redis
+// pools closed. A second signal exits immediately.
+var (
+	shuttingDown atomic.Bool
+
+	// Work a request kicks off that should finish before the pools close
+	background sync.WaitGroup
+)
+
+func goBackground(fn func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		fn()
+	}()
+}
+
+// Serve until a signal arrives, then shut down in order
+func runServer(server *http.Server, serve func() error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() { errc <- serve() }()
+
+	select {
+	case err := <-errc:
+		fatal("Server stopped", "err", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	timeout := cfg.ShutdownTimeout
+	slog.Info("Shutting down", "timeout", timeout)
+	shuttingDown.Store(true)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		go func() {
+			select {
+			case <-stopped:
+			case <-shutdownCtx.Done():
+				grpcServer.Stop()
+			}
+		}()
+	}
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("HTTP drain incomplete", "err", err)
+	}
+	if err := <-errc; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Warn("HTTP server error during shutdown", "err", err)
+	}
+
+	if !waitFor(shutdownCtx, clickPending.Wait) {
+		slog.Warn("Dropping queued clicks", "count", len(clickQueue))
+	}
+	if !waitFor(shutdownCtx, background.Wait) {
+		slog.Warn("Background work still running at shutdown")
+	}
+	if !waitFor(shutdownCtx, func() {
+		for len(webhookQueue) > 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}) {
+		slog.Warn("Dropping queued webhook deliveries", "count", len(webhookQueue))
+	}
+
+	closeEventStream(shutdownCtx)
+	flushErrorReports(shutdownCtx)
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Warn("Trace flush failed", "err", err)
+	}
+	if redisClient != nil {
+		redisClient.Close()
+	}
+	resignLeadership()
+	db.Close()
+	slog.Info("👋 Shutdown complete")
+}
+
+// Run fn and report whether it returned before ctx ended
+func waitFor(ctx context.Context, fn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
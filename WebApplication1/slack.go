@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Slack slash command: /shorten <url> in Slack replies with a short link.
+// Requests are verified with the app's signing secret
+// (SLACK_SIGNING_SECRET); without it the endpoint doesn't exist.
+//
+// Each workspace is connected to an ihdas API key through the admin API,
+// and links made from that workspace belong to the key's owner. Revoking
+// the key disconnects the workspace; commands from workspaces that aren't
+// connected are refused.
+const (
+	slackMaxBody   = 16 << 10
+	slackClockSkew = 5 * time.Minute
+)
+
+type slackResponse struct {
+	ResponseType string `json:"response_type"` // ephemeral or in_channel
+	Text         string `json:"text"`
+}
+
+// Check X-Slack-Signature: v0=HMAC-SHA256(secret, "v0:<timestamp>:<body>")
+func verifySlackSignature(secret string, header http.Header, body []byte, now time.Time) bool {
+	ts, err := strconv.ParseInt(header.Get("X-Slack-Request-Timestamp"), 10, 64)
+	if err != nil {
+		return false
+	}
+	// Old requests are refused so a captured one can't be replayed later
+	if skew := now.Sub(time.Unix(ts, 0)); skew > slackClockSkew || skew < -slackClockSkew {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + strconv.FormatInt(ts, 10) + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature")))
+}
+
+var slackWorkspaces = &chatPlatform{name: "slack", table: "slack_workspaces", idColumn: "team_id"}
+
+// POST /slack/command
+func slackCommandHandler(w http.ResponseWriter, r *http.Request) {
+	signingSecret := secret("SLACK_SIGNING_SECRET")
+	if signingSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, slackMaxBody))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "body_too_large", "Request body too large")
+		return
+	}
+	if !verifySlackSignature(signingSecret, r.Header, body, time.Now()) {
+		writeError(w, http.StatusUnauthorized, "invalid_signature", "Invalid Slack signature")
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Invalid request body")
+		return
+	}
+
+	teamID := form.Get("team_id")
+	addLogAttrs(r.Context(), slog.String("slack_team", teamID), slog.String("slack_user", form.Get("user_id")))
+
+	// Slack shows non-200 responses as a bare failure, so every outcome
+	// from here on is a 200 with a message
+	owner, err := slackWorkspaces.owner(r.Context(), teamID)
+	if err == sql.ErrNoRows {
+		writeJSON(w, http.StatusOK, slackResponse{"ephemeral", "This Slack workspace isn't connected to the link shortener yet."})
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Slack workspace lookup error", "err", err)
+		writeJSON(w, http.StatusOK, slackResponse{"ephemeral", "Something went wrong on our side, please try again."})
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), callerOwnerKey, owner)
+	text, ok := runShortenCommand(ctx, "slack:"+teamID, form.Get("text"), r.Host)
+	resp := slackResponse{ResponseType: "ephemeral", Text: text}
+	if ok {
+		resp.ResponseType = "in_channel"
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
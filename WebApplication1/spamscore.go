@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Spam scoring for new links. With spam_hold_score set, every new link is
+// scored on its destination (DNS blocklist hits, a newly registered domain,
+// a random-looking URL) and on how many links its creator's IP made in the
+// last hour. Links reaching the score are created disabled and wait in the
+// admin queue (GET /api/v1/admin/spam) to be approved or rejected; the rest
+// go live as usual. DNS lookups fail open, like reputation checks.
+const (
+	spamReviewReason   = "spam_review" // disabled_reason of held links
+	spamLookupTimeout  = 2 * time.Second
+	spamVelocityWindow = time.Hour
+	spamVelocityFree   = 10 // links per IP per window before they add to the score
+
+	spamDNSBLPoints     = 50
+	spamNewDomainPoints = 40
+	spamEntropyPoints   = 25
+	spamVelocityPoint   = 3 // per link over spamVelocityFree
+	spamVelocityMax     = 30
+
+	spamScoreWorkers = 8 // batches are scored this many links at a time
+
+	spamEntropyMinLen = 24  // shorter URLs say too little
+	spamEntropyBits   = 4.5 // bits per character; hand-written URLs sit well below
+)
+
+type SpamReview struct {
+	ID          int64      `json:"id"`
+	ShortCode   string     `json:"short_code"`
+	OriginalURL string     `json:"original_url,omitempty"`
+	Score       int        `json:"score"`
+	Reasons     []string   `json:"reasons"` // e.g. dnsbl:dbl.spamhaus.org, new_domain, entropy, velocity
+	CreatorIP   string     `json:"creator_ip,omitempty"`
+	Status      string     `json:"status"` // pending, approved or rejected
+	CreatedAt   time.Time  `json:"created_at"`
+	ReviewedAt  *time.Time `json:"reviewed_at,omitempty"`
+}
+
+type SpamReviewListResponse struct {
+	Reviews    []SpamReview `json:"reviews"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+type SpamReviewRequest struct {
+	Action string `json:"action"` // approve or reject
+}
+
+type spamScore struct {
+	score   int
+	reasons []string
+	ip      string
+}
+
+func initSpamScoring() {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS spam_scores (
+		id BIGSERIAL PRIMARY KEY,
+		short_code VARCHAR(64) UNIQUE NOT NULL REFERENCES urls(short_code) ON DELETE CASCADE,
+		score INT NOT NULL,
+		reasons TEXT NOT NULL DEFAULT '',
+		creator_ip TEXT,
+		status TEXT NOT NULL, -- passed, pending, approved, rejected
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		reviewed_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_spam_scores_ip ON spam_scores(creator_ip, created_at);
+	CREATE INDEX IF NOT EXISTS idx_spam_scores_status ON spam_scores(status, id);
+	`
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Spam scores table creation failed", "err", err)
+	}
+	if cfg.SpamHoldScore > 0 {
+		slog.Info("Spam scoring enabled", "hold_score", cfg.SpamHoldScore,
+			"dnsbl_zones", cfg.SpamDNSBLZones, "new_domain_zones", cfg.SpamNewDomainZones)
+	}
+}
+
+// Score a prepared link, marking it disabled when it's to be held; nil
+// with scoring off. batched is how many links the same request creates
+// ahead of this one, which count towards velocity like earlier requests.
+func scoreNewLink(ctx context.Context, link *Link, batched int) *spamScore {
+	if cfg.SpamHoldScore <= 0 {
+		return nil
+	}
+	s := scoreDestination(ctx, link.OriginalURL)
+	s.ip, _ = ctx.Value(requestIPKey).(string)
+
+	if s.ip != "" {
+		var recent int
+		if err := db.QueryRowContext(ctx,
+			`SELECT COUNT(*) FROM spam_scores WHERE creator_ip = $1 AND created_at > NOW() - make_interval(secs => $2)`,
+			s.ip, spamVelocityWindow.Seconds()).Scan(&recent); err != nil {
+			slog.ErrorContext(ctx, "Spam velocity lookup error", "err", err)
+		} else if recent += batched; recent > spamVelocityFree {
+			s.add(min((recent-spamVelocityFree)*spamVelocityPoint, spamVelocityMax), "velocity")
+		}
+	}
+
+	if s.score >= cfg.SpamHoldScore {
+		now := time.Now()
+		link.DisabledAt = &now
+		link.DisabledReason = spamReviewReason
+	}
+	return s
+}
+
+// Score a destination on what it is: DNS list hits and how random it looks
+func scoreDestination(ctx context.Context, rawURL string) *spamScore {
+	s := &spamScore{}
+	if parsed, err := url.Parse(rawURL); err == nil {
+		domain, err := publicsuffix.EffectiveTLDPlusOne(parsed.Hostname())
+		if err != nil {
+			domain = parsed.Hostname()
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, spamLookupTimeout)
+		for _, zone := range cfg.SpamDNSBLZones {
+			if dnsListed(lookupCtx, domain, zone) {
+				s.add(spamDNSBLPoints, "dnsbl:"+zone)
+				break
+			}
+		}
+		for _, zone := range cfg.SpamNewDomainZones {
+			if dnsListed(lookupCtx, domain, zone) {
+				s.add(spamNewDomainPoints, "new_domain")
+				break
+			}
+		}
+		cancel()
+		if rest := parsed.Host + parsed.EscapedPath() + parsed.RawQuery; len(rest) >= spamEntropyMinLen &&
+			shannonEntropy(rest) >= spamEntropyBits {
+			s.add(spamEntropyPoints, "entropy")
+		}
+	}
+	return s
+}
+
+// Score a batch's links concurrently, each counting the ones before it
+func scoreNewLinks(ctx context.Context, links []*Link) []*spamScore {
+	scores := make([]*spamScore, len(links))
+	if cfg.SpamHoldScore <= 0 {
+		return scores
+	}
+	scoreConcurrently(len(links), func(i int) { scores[i] = scoreNewLink(ctx, links[i], i) })
+	return scores
+}
+
+// The worst-scoring of a page's or bundle's destinations when it reaches
+// spam_hold_score, nil otherwise. Velocity was counted when the link was
+// made, so only the destinations themselves are scored; item names the
+// destination picked in the reasons.
+func scorePageDestinations(ctx context.Context, urls []string, item func(i int) string) *spamScore {
+	if cfg.SpamHoldScore <= 0 {
+		return nil
+	}
+	scores := make([]*spamScore, len(urls))
+	scoreConcurrently(len(urls), func(i int) { scores[i] = scoreDestination(ctx, urls[i]) })
+
+	var worst *spamScore
+	var worstItem int
+	for i, s := range scores {
+		if s.score >= cfg.SpamHoldScore && (worst == nil || s.score > worst.score) {
+			worst, worstItem = s, i
+		}
+	}
+	if worst != nil {
+		worst.reasons = append(worst.reasons, item(worstItem))
+		worst.ip, _ = ctx.Value(requestIPKey).(string)
+	}
+	return worst
+}
+
+// Run score for 0..n-1, spamScoreWorkers at a time
+func scoreConcurrently(n int, score func(i int)) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < min(spamScoreWorkers, n); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				score(j)
+			}
+		}()
+	}
+	for j := 0; j < n; j++ {
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func (s *spamScore) add(points int, reason string) {
+	s.score += points
+	s.reasons = append(s.reasons, reason)
+}
+
+// Whether domain is listed in a DNS list zone. Lists answer with a
+// 127.0.0.0/8 address; 127.255.255.0/24 is how Spamhaus and others refuse
+// a query, which isn't a listing.
+func dnsListed(ctx context.Context, domain, zone string) bool {
+	addrs, err := net.DefaultResolver.LookupHost(ctx, domain+"."+strings.TrimSuffix(zone, "."))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			slog.WarnContext(ctx, "DNS list lookup error", "zone", zone, "err", err)
+		}
+		return false
+	}
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, "127.") && !strings.HasPrefix(addr, "127.255.255.") {
+			return true
+		}
+	}
+	return false
+}
+
+// Bits per character
+func shannonEntropy(s string) float64 {
+	counts := map[rune]int{}
+	n := 0
+	for _, r := range s {
+		counts[r]++
+		n++
+	}
+	var bits float64
+	for _, c := range counts {
+		p := float64(c) / float64(n)
+		bits -= p * math.Log2(p)
+	}
+	return bits
+}
+
+// Store the score of a link just created, for velocity and, when it's
+// held, the review queue
+func recordSpamScore(ctx context.Context, link *Link, s *spamScore) {
+	if s == nil {
+		return
+	}
+	status := "passed"
+	if link.DisabledReason == spamReviewReason {
+		status = "pending"
+		slog.InfoContext(ctx, "Link held for spam review", "short_code", link.ShortCode, "score", s.score, "reasons", s.reasons)
+		auditCaller(ctx, "link.spam.hold", link.ShortCode, map[string]interface{}{"score": s.score, "reasons": s.reasons})
+	}
+	if _, err := db.ExecContext(ctx,
+		`INSERT INTO spam_scores (short_code, score, reasons, creator_ip, status) VALUES ($1, $2, $3, NULLIF($4, ''), $5)`,
+		link.ShortCode, s.score, strings.Join(s.reasons, ","), s.ip, status); err != nil {
+		slog.ErrorContext(ctx, "Spam score store error", "err", err)
+	}
+}
+
+// Hold a live link for review over destinations it gained after creation,
+// like a bundle's items or a page's buttons. A link already disabled for
+// something else is left as it is.
+func holdForSpamReview(ctx context.Context, link *Link, s *spamScore) error {
+	err := store.DisableLink(ctx, link.ShortCode, spamReviewReason)
+	if errors.Is(err, ErrLinkNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// Every instance stops redirecting it, not just this one
+	invalidateCachedURL(ctx, link.ShortCode)
+	emitLinkUpdated(link.ShortCode)
+	slog.InfoContext(ctx, "Link held for spam review", "short_code", link.ShortCode, "score", s.score, "reasons", s.reasons)
+	auditCaller(ctx, "link.spam.hold", link.ShortCode, map[string]interface{}{"score": s.score, "reasons": s.reasons})
+	_, err = db.ExecContext(ctx,
+		`INSERT INTO spam_scores (short_code, score, reasons, creator_ip, status) VALUES ($1, $2, $3, NULLIF($4, ''), 'pending')
+		 ON CONFLICT (short_code) DO UPDATE SET score = EXCLUDED.score, reasons = EXCLUDED.reasons,
+		 creator_ip = EXCLUDED.creator_ip, status = 'pending', created_at = NOW(), reviewed_at = NULL`,
+		link.ShortCode, s.score, strings.Join(s.reasons, ","), s.ip)
+	return err
+}
+
+// GET /api/v1/admin/spam?status=pending&cursor=&limit=
+func listSpamReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	afterID, limit, ok := parsePageQuery(w, r)
+	if !ok {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "pending"
+	}
+
+	rows, err := db.QueryContext(r.Context(),
+		`SELECT id, short_code, score, reasons, COALESCE(creator_ip, ''), status, created_at, reviewed_at
+		 FROM spam_scores WHERE status = $1 AND id > $2 ORDER BY id LIMIT $3`, status, afterID, limit+1)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Spam review list error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	defer rows.Close()
+
+	resp := SpamReviewListResponse{Reviews: []SpamReview{}}
+	for rows.Next() {
+		var review SpamReview
+		var reasons string
+		if err := rows.Scan(&review.ID, &review.ShortCode, &review.Score, &reasons, &review.CreatorIP,
+			&review.Status, &review.CreatedAt, &review.ReviewedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Spam review list error", "err", err)
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		review.Reasons = []string{}
+		if reasons != "" {
+			review.Reasons = strings.Split(reasons, ",")
+		}
+		resp.Reviews = append(resp.Reviews, review)
+	}
+	rows.Close()
+
+	hasNext := len(resp.Reviews) > limit
+	if hasNext {
+		resp.Reviews = resp.Reviews[:limit]
+	}
+	for i := range resp.Reviews {
+		if link, err := store.GetLink(r.Context(), resp.Reviews[i].ShortCode); err == nil {
+			resp.Reviews[i].OriginalURL = link.OriginalURL
+		}
+	}
+	if len(resp.Reviews) > 0 {
+		resp.NextCursor = nextCursor(resp.Reviews[len(resp.Reviews)-1].ID, hasNext)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// POST /api/v1/admin/spam/{code}/review - approving lets the link redirect;
+// rejecting leaves it disabled for good
+func reviewSpamHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req SpamReviewRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	var status string
+	switch req.Action {
+	case "approve":
+		status = "approved"
+	case "reject":
+		status = "rejected"
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_action", "action must be approve or reject")
+		return
+	}
+
+	code := r.PathValue("code")
+	var pending bool
+	err := db.QueryRowContext(r.Context(),
+		`SELECT TRUE FROM spam_scores WHERE short_code = $1 AND status = 'pending'`, code).Scan(&pending)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "review_not_found", "No pending spam review for that code")
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Spam review lookup error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	if status == "approved" {
+		// Only the hold is lifted; a link disabled since for another
+		// reason stays disabled
+		err = store.EnableLink(r.Context(), code, spamReviewReason)
+		if err == nil {
+			invalidateCachedURL(r.Context(), code)
+			emitLinkUpdated(code)
+		} else if errors.Is(err, ErrLinkNotFound) {
+			err = nil
+		}
+	}
+	if err == nil {
+		_, err = db.ExecContext(r.Context(),
+			`UPDATE spam_scores SET status = $2, reviewed_at = NOW() WHERE short_code = $1 AND status = 'pending'`, code, status)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Spam review error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Admin reviewed held link", "short_code", code, "status", status)
+	auditAdmin(r, "link.spam.review", code, map[string]interface{}{"status": status})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Embeddable stats widget: a link's click counter and a sparkline of its
+// last days, for showing on other sites. The owner switches it on with PUT
+// /api/v1/links/{code}/sharing and gets a token of its own, so embedding
+// neither needs public_stats nor gives away the code's other stats; turning
+// it off revokes the token. /widget/{token} is the page to frame,
+// /widget/{token}/embed.js adds that frame where its script tag is, and
+// /widget/{token}/data is the same numbers as JSON for any origin.
+const (
+	widgetWidth  = 240
+	widgetHeight = 80
+	widgetMaxAge = 300 // seconds embedding pages may cache the numbers
+)
+
+type WidgetData struct {
+	ShortURL   string        `json:"short_url"`
+	ClickCount int64         `json:"click_count"`
+	Daily      []DailyClicks `json:"daily"` // the last 30 days, today last
+}
+
+func newWidgetToken() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// Widget numbers for a token; ErrLinkNotFound for unknown or revoked ones
+func loadWidgetData(ctx context.Context, token, host string) (*WidgetData, error) {
+	var shortCode string
+	err := db.QueryRowContext(ctx,
+		`SELECT short_code FROM link_sharing WHERE widget_token = $1`, token).Scan(&shortCode)
+	if err == sql.ErrNoRows || token == "" {
+		return nil, ErrLinkNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	link, err := store.GetLink(ctx, shortCode)
+	if err != nil {
+		return nil, err
+	}
+	daily, err := dailyLinkClicks(ctx, link.ShortCode, publicStatsDays)
+	if err != nil {
+		return nil, err
+	}
+	return &WidgetData{ShortURL: shortURL(linkHost(link, host), link.ShortCode), ClickCount: link.ClickCount, Daily: daily}, nil
+}
+
+// Load the widget numbers, or write the failure as an error page (asJSON
+// false) or a problem response; false when there aren't any
+func widgetData(w http.ResponseWriter, r *http.Request, asJSON bool) (*WidgetData, bool) {
+	data, err := loadWidgetData(r.Context(), r.PathValue("token"), r.Host)
+	if errors.Is(err, ErrLinkNotFound) {
+		if asJSON {
+			writeError(w, http.StatusNotFound, "widget_not_found", "Widget not found")
+		} else {
+			serveErrorPage(w, r, http.StatusNotFound, "not_found.message")
+		}
+		return nil, false
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Widget lookup error", "err", err)
+		if asJSON {
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		} else {
+			serveErrorPage(w, r, http.StatusInternalServerError, "error.retry")
+		}
+		return nil, false
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", widgetMaxAge))
+	return data, true
+}
+
+// GET /widget/{token} - the counter and sparkline, to be framed. The
+// security headers let any site frame it (see securityPolicy.apply).
+func widgetHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := widgetData(w, r, false)
+	if !ok {
+		return
+	}
+	t := localizer(w, r)
+
+	// One point per day on a 100x20 box, scaled to the busiest day
+	var peak int64 = 1
+	for _, d := range data.Daily {
+		peak = max(peak, d.Clicks)
+	}
+	points := make([]string, len(data.Daily))
+	for i, d := range data.Daily {
+		x := float64(i) * 100 / float64(max(len(data.Daily)-1, 1))
+		points[i] = fmt.Sprintf("%.1f,%.1f", x, 19-float64(d.Clicks)*18/float64(peak))
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!doctype html><html lang="%s"><meta charset="utf-8"><title>%s</title>
+<style>body{margin:0;font-family:system-ui,sans-serif}a{display:block;padding:.5rem;color:inherit;text-decoration:none}
+b{font-size:1.5rem}svg{display:block;width:100%%;height:2rem}</style>
+<a href="%s" target="_blank" rel="noopener"><b>%d</b> %s
+<svg viewBox="0 0 100 20" preserveAspectRatio="none"><polyline fill="none" stroke="currentColor" stroke-width="1" vector-effect="non-scaling-stroke" points="%s"/></svg></a>
+`, w.Header().Get("Content-Language"), html.EscapeString(t("stats.clicks")), html.EscapeString(data.ShortURL),
+		data.ClickCount, html.EscapeString(t("stats.clicks")), strings.Join(points, " "))
+}
+
+// GET /widget/{token}/embed.js - adds the widget's iframe after the script
+// tag that loaded it
+func widgetScriptHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := widgetData(w, r, true)
+	if !ok {
+		return
+	}
+	// JSON-encoded strings are safe JavaScript string literals
+	src, _ := json.Marshal(baseURL(r.Host) + "/widget/" + r.PathValue("token"))
+	title, _ := json.Marshal(data.ShortURL)
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	fmt.Fprintf(w, `(function () {
+  var s = document.currentScript, f = document.createElement("iframe");
+  f.src = %s; f.title = %s; f.width = "%d"; f.height = "%d";
+  f.loading = "lazy"; f.style.border = "0";
+  s.parentNode.insertBefore(f, s.nextSibling);
+})();
+`, src, title, widgetWidth, widgetHeight)
+}
+
+// GET /widget/{token}/data - the numbers as JSON. The token is the only key,
+// so any origin may read them whatever cors_allowed_origins says.
+func widgetDataHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := widgetData(w, r, true)
+	if !ok {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Del("Access-Control-Allow-Credentials")
+	writeJSON(w, http.StatusOK, data)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrLinkNotFound = errors.New("link not found")
+	ErrCodeTaken    = errors.New("short code already exists")
+)
+
+// Link is a stored short link with its destination in plaintext
+type Link struct {
+	ID             int64
+	ShortCode      string
+	OriginalURL    string
+	CreatedAt      time.Time
+	ExpiresAt      *time.Time
+	ClickCount     int64
+	Owner          string // API key owner, empty for anonymous links
+	Domain         string // custom domain it's served on, empty for the default hosts
+	DisabledAt     *time.Time
+	DisabledReason string // e.g. "safe_browsing:MALWARE"
+	HasPage        bool   // a link-in-bio page or bundle is served instead of the redirect
+	ArchiveURL     string // Wayback Machine snapshot of the destination
+	ServeArchive   bool   // redirects go to ArchiveURL instead
+}
+
+// LinkFilter narrows ListLinks; zero values match everything
+type LinkFilter struct {
+	Owner         string
+	Destination   string // exact destination URL
+	Status        string // "active", "expired" or "disabled"
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+}
+
+// TxStep writes side-table rows (tags, owner, campaign, ...) for a link
+// inside the creation transaction; returning an error rolls back everything.
+type TxStep func(ctx context.Context, tx *sql.Tx, link *Link) error
+
+// Store is the persistence boundary for links
+type Store interface {
+	NextCode(ctx context.Context) (string, error)
+	CreateLink(ctx context.Context, link *Link, steps ...TxStep) error
+	// CreateLinks inserts a batch in one transaction; errs[i] is nil when
+	// links[i] was created. A non-nil error means nothing was committed.
+	CreateLinks(ctx context.Context, links []*Link) (errs []error, err error)
+	GetLink(ctx context.Context, shortCode string) (*Link, error)
+	// ListLinks returns up to limit links matching filter with id > afterID,
+	// oldest first
+	ListLinks(ctx context.Context, filter LinkFilter, afterID int64, limit int) ([]*Link, error)
+	// DisableLink stops a link from redirecting, keeping it for the record
+	DisableLink(ctx context.Context, shortCode, reason string) error
+	// EnableLink lets a link disabled for reason redirect again; links
+	// disabled for anything else stay disabled
+	EnableLink(ctx context.Context, shortCode, reason string) error
+	// DeleteLink removes a link and returns it as it was
+	DeleteLink(ctx context.Context, shortCode string) (*Link, error)
+	// FindByDestination returns the owner's links pointing at originalURL
+	FindByDestination(ctx context.Context, owner, originalURL string) ([]*Link, error)
+}
+
+// PostgreSQL implementation
+type pgStore struct {
+	db *sql.DB
+}
+
+// Sequential codes come from the same sequence as the primary key
+func (s *pgStore) NextCode(ctx context.Context) (string, error) {
+	var nextID int64
+	if err := s.db.QueryRowContext(ctx, `SELECT nextval('urls_id_seq')`).Scan(&nextID); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(nextID, 10), nil
+}
+
+// CreateLink inserts the link and runs every step in one transaction
+func (s *pgStore) CreateLink(ctx context.Context, link *Link, steps ...TxStep) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		if err := insertLink(ctx, tx, link); err != nil {
+			return err
+		}
+		for _, step := range steps {
+			if err := step(ctx, tx, link); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Codes are reserved before the insert: of concurrent requests for one code,
+// on any instance, the first to take its advisory lock goes ahead and the
+// rest wait for it to commit or roll back, then find the code taken or
+// free. The unique index is still there behind it.
+func insertLink(ctx context.Context, tx *sql.Tx, link *Link) error {
+	storedURL, err := encryptURL(link.ShortCode, link.OriginalURL)
+	if err != nil {
+		return fmt.Errorf("encrypt destination: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1, 0))`, link.ShortCode); err != nil {
+		return fmt.Errorf("reserve code: %w", err)
+	}
+	// A statement of its own, so it sees whatever the lock holder committed
+	var taken bool
+	if err := tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM urls WHERE short_code = $1)`, link.ShortCode).Scan(&taken); err != nil {
+		return err
+	}
+	if taken {
+		return ErrCodeTaken
+	}
+
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO urls (short_code, original_url, expires_at, owner, destination_hash, domain, disabled_at, disabled_reason)
+		 VALUES ($1, $2, $3, NULLIF($4, ''), $5, NULLIF($6, ''), $7, NULLIF($8, ''))
+		 RETURNING id, created_at`,
+		link.ShortCode, storedURL, link.ExpiresAt, link.Owner, destinationHash(link.OriginalURL), link.Domain,
+		link.DisabledAt, link.DisabledReason).Scan(&link.ID, &link.CreatedAt)
+	if isUniqueViolation(err) {
+		return ErrCodeTaken
+	}
+	return err
+}
+
+// Each link gets its own savepoint, so one conflicting code doesn't
+// abort the rest of the batch. The codes are all reserved up front in
+// sorted order, so batches sharing codes queue up rather than deadlock.
+func (s *pgStore) CreateLinks(ctx context.Context, links []*Link) ([]error, error) {
+	errs := make([]error, len(links))
+	codes := make([]string, len(links))
+	for i, link := range links {
+		codes[i] = link.ShortCode
+	}
+	sort.Strings(codes)
+	codesJSON, _ := json.Marshal(codes)
+
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx,
+			`SELECT pg_advisory_xact_lock(hashtextextended(code, 0)) FROM json_array_elements_text($1::JSON) AS code`,
+			string(codesJSON)); err != nil {
+			return fmt.Errorf("reserve codes: %w", err)
+		}
+		for i, link := range links {
+			if _, err := tx.ExecContext(ctx, `SAVEPOINT bulk_item`); err != nil {
+				return err
+			}
+			if err := insertLink(ctx, tx, link); err != nil {
+				if _, rbErr := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT bulk_item`); rbErr != nil {
+					return rbErr
+				}
+				errs[i] = err
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, `RELEASE SAVEPOINT bulk_item`); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// Columns read by scanLink, in order
+const linkColumns = `id, short_code, original_url, created_at, expires_at, click_count, COALESCE(owner, ''),
+	disabled_at, COALESCE(disabled_reason, ''), COALESCE(domain, ''), has_page, COALESCE(archive_url, ''), serve_archive`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanLink(row rowScanner) (*Link, error) {
+	var link Link
+	var storedURL, storedArchive string
+	if err := row.Scan(&link.ID, &link.ShortCode, &storedURL, &link.CreatedAt,
+		&link.ExpiresAt, &link.ClickCount, &link.Owner, &link.DisabledAt, &link.DisabledReason, &link.Domain, &link.HasPage,
+		&storedArchive, &link.ServeArchive); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if link.OriginalURL, err = decryptURL(link.ShortCode, storedURL); err != nil {
+		return nil, fmt.Errorf("decrypt destination for %s: %w", link.ShortCode, err)
+	}
+	// Snapshot URLs name the destination, so they're encrypted alike
+	if link.ArchiveURL, err = decryptURL(link.ShortCode, storedArchive); err != nil {
+		return nil, fmt.Errorf("decrypt archive URL for %s: %w", link.ShortCode, err)
+	}
+	return &link, nil
+}
+
+func (s *pgStore) queryLinks(ctx context.Context, query string, args ...interface{}) ([]*Link, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []*Link
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+func (s *pgStore) GetLink(ctx context.Context, shortCode string) (*Link, error) {
+	link, err := scanLink(s.db.QueryRowContext(ctx,
+		`SELECT `+linkColumns+` FROM urls WHERE short_code = $1`, shortCode))
+	if err == sql.ErrNoRows {
+		return nil, ErrLinkNotFound
+	}
+	return link, err
+}
+
+func (s *pgStore) ListLinks(ctx context.Context, filter LinkFilter, afterID int64, limit int) ([]*Link, error) {
+	where := []string{"id > $1"}
+	args := []interface{}{afterID}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if filter.Owner != "" {
+		add("owner = $%d", filter.Owner)
+	}
+	if filter.Destination != "" {
+		add("destination_hash = $%d", destinationHash(filter.Destination))
+	}
+	switch filter.Status {
+	case "active":
+		where = append(where, "(expires_at IS NULL OR expires_at > NOW()) AND disabled_at IS NULL")
+	case "expired":
+		where = append(where, "expires_at <= NOW()")
+	case "disabled":
+		where = append(where, "disabled_at IS NOT NULL")
+	}
+	if filter.CreatedAfter != nil {
+		add("created_at >= $%d", *filter.CreatedAfter)
+	}
+	if filter.CreatedBefore != nil {
+		add("created_at < $%d", *filter.CreatedBefore)
+	}
+	args = append(args, limit)
+
+	links, err := s.queryLinks(ctx,
+		`SELECT `+linkColumns+` FROM urls WHERE `+strings.Join(where, " AND ")+
+			fmt.Sprintf(` ORDER BY id LIMIT $%d`, len(args)), args...)
+	if err != nil || filter.Destination == "" {
+		return links, err
+	}
+
+	// Guard against hash collisions; links stored before the rules last
+	// changed are compared in today's canonical form, as they're hashed
+	matches := links[:0]
+	for _, link := range links {
+		if canonicalDestination(link.OriginalURL) == filter.Destination {
+			matches = append(matches, link)
+		}
+	}
+	return matches, nil
+}
+
+func (s *pgStore) DisableLink(ctx context.Context, shortCode, reason string) error {
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE urls SET disabled_at = NOW(), disabled_reason = $2
+		 WHERE short_code = $1 AND disabled_at IS NULL`, shortCode, reason)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrLinkNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) EnableLink(ctx context.Context, shortCode, reason string) error {
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE urls SET disabled_at = NULL, disabled_reason = NULL
+		 WHERE short_code = $1 AND disabled_at IS NOT NULL AND disabled_reason = $2`, shortCode, reason)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrLinkNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) DeleteLink(ctx context.Context, shortCode string) (*Link, error) {
+	link, err := scanLink(s.db.QueryRowContext(ctx,
+		`DELETE FROM urls WHERE short_code = $1 RETURNING `+linkColumns, shortCode))
+	if err == sql.ErrNoRows {
+		return nil, ErrLinkNotFound
+	}
+	return link, err
+}
+
+// PutLink writes the link as given, id and click count included, creating or
+// overwriting it. It's how links are copied into a migration target, so
+// the columns written match linkColumns.
+func (s *pgStore) PutLink(ctx context.Context, link *Link) error {
+	storedURL, err := encryptURL(link.ShortCode, link.OriginalURL)
+	if err != nil {
+		return fmt.Errorf("encrypt destination: %w", err)
+	}
+	var storedArchive string
+	if link.ArchiveURL != "" {
+		if storedArchive, err = encryptURL(link.ShortCode, link.ArchiveURL); err != nil {
+			return fmt.Errorf("encrypt archive URL: %w", err)
+		}
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO urls (id, short_code, original_url, created_at, expires_at, click_count, owner, destination_hash,
+			domain, disabled_at, disabled_reason, has_page, archive_url, serve_archive)
+		 VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, NULLIF($9, ''), $10, NULLIF($11, ''), $12, NULLIF($13, ''), $14)
+		 ON CONFLICT (short_code) DO UPDATE SET original_url = EXCLUDED.original_url, created_at = EXCLUDED.created_at,
+			expires_at = EXCLUDED.expires_at, click_count = EXCLUDED.click_count, owner = EXCLUDED.owner,
+			destination_hash = EXCLUDED.destination_hash, domain = EXCLUDED.domain, disabled_at = EXCLUDED.disabled_at,
+			disabled_reason = EXCLUDED.disabled_reason, has_page = EXCLUDED.has_page, archive_url = EXCLUDED.archive_url,
+			serve_archive = EXCLUDED.serve_archive`,
+		link.ID, link.ShortCode, storedURL, link.CreatedAt, link.ExpiresAt, link.ClickCount, link.Owner,
+		destinationHash(link.OriginalURL), link.Domain, link.DisabledAt, link.DisabledReason, link.HasPage,
+		storedArchive, link.ServeArchive)
+	return err
+}
+
+// Destinations may be encrypted, so matching goes through destination_hash
+func (s *pgStore) FindByDestination(ctx context.Context, owner, originalURL string) ([]*Link, error) {
+	links, err := s.queryLinks(ctx,
+		`SELECT `+linkColumns+` FROM urls
+		 WHERE destination_hash = $1 AND owner = $2
+		 ORDER BY id LIMIT $3`, destinationHash(originalURL), owner, maxPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// Guard against hash collisions
+	matches := links[:0]
+	for _, link := range links {
+		if canonicalDestination(link.OriginalURL) == originalURL {
+			matches = append(matches, link)
+		}
+	}
+	return matches, nil
+}
+
+// Run fn in a transaction, rolling back on error or panic
+func (s *pgStore) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Telegram bot: send the bot a URL (or /shorten <url> [code]) and it replies
+// with the short link and its QR code. Telegram delivers updates to
+// POST /telegram/webhook with the secret_token given to setWebhook in
+// X-Telegram-Bot-Api-Secret-Token; without TELEGRAM_BOT_TOKEN the endpoint
+// doesn't exist.
+//
+// Anyone can talk to a bot, so chats make anonymous links unless an admin
+// has connected the chat to an API key, in which case they belong to the
+// key's owner.
+const (
+	telegramMaxBody = 64 << 10
+	telegramQRSize  = 512
+)
+
+var (
+	telegramChats  = &chatPlatform{name: "telegram", table: "telegram_chats", idColumn: "chat_id"}
+	telegramClient = &http.Client{Timeout: 10 * time.Second}
+	telegramAPI    = "https://api.telegram.org"
+)
+
+type telegramUpdate struct {
+	Message *struct {
+		MessageID int64  `json:"message_id"`
+		Text      string `json:"text"`
+		Chat      struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+	} `json:"message"`
+}
+
+// POST /telegram/webhook
+func telegramWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if cfg.TelegramBotToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	token := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.TelegramWebhookSecret)) != 1 {
+		writeError(w, http.StatusUnauthorized, "invalid_secret_token", "Invalid Telegram secret token")
+		return
+	}
+
+	// Updates carry far more fields than we read, so not decodeJSON
+	var update telegramUpdate
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, telegramMaxBody)).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Invalid request body")
+		return
+	}
+	// Edits, joins, stickers and the like are acknowledged and ignored
+	if update.Message == nil || strings.TrimSpace(update.Message.Text) == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	msg := update.Message
+	chatID := strconv.FormatInt(msg.Chat.ID, 10)
+	addLogAttrs(r.Context(), slog.String("telegram_chat", chatID))
+
+	// Telegram retries until it gets a 200, so answer straight away and
+	// reply through the Bot API afterwards
+	ctx := context.WithoutCancel(r.Context())
+	host := r.Host
+	goBackground(func() {
+		handleTelegramMessage(ctx, chatID, msg.MessageID, msg.Text, host)
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleTelegramMessage(ctx context.Context, chatID string, messageID int64, text, host string) {
+	// "/shorten@mybot <url>" in groups, "/shorten <url>" or a bare URL in DMs
+	command, rest, _ := strings.Cut(strings.TrimSpace(text), " ")
+	command, _, _ = strings.Cut(command, "@")
+	switch command {
+	case "/start", "/help":
+		telegramSend(ctx, chatID, messageID, "Send me a link and I'll shorten it.\n"+shortenCommandUsage, nil)
+		return
+	case "/shorten":
+		text = rest
+	default:
+		if strings.HasPrefix(command, "/") {
+			telegramSend(ctx, chatID, messageID, shortenCommandUsage, nil)
+			return
+		}
+	}
+
+	owner, err := telegramChats.owner(ctx, chatID)
+	if err != nil && err != sql.ErrNoRows {
+		slog.ErrorContext(ctx, "Telegram chat lookup error", "err", err)
+		telegramSend(ctx, chatID, messageID, "Something went wrong on our side, please try again.", nil)
+		return
+	}
+	if owner != "" {
+		ctx = context.WithValue(ctx, callerOwnerKey, owner)
+	}
+
+	reply, ok := runShortenCommand(ctx, "telegram:"+chatID, text, host)
+	if !ok {
+		telegramSend(ctx, chatID, messageID, reply, nil)
+		return
+	}
+	qr, err := qrPNG(reply, telegramQRSize)
+	if err != nil {
+		// The link is made either way; the QR code is a bonus
+		slog.ErrorContext(ctx, "QR encoding error", "err", err)
+	}
+	telegramSend(ctx, chatID, messageID, reply, qr)
+}
+
+// Reply with sendMessage, or sendPhoto with text as the caption when there
+// is an image
+func telegramSend(ctx context.Context, chatID string, replyTo int64, text string, photo []byte) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("chat_id", chatID)
+	form.WriteField("reply_to_message_id", strconv.FormatInt(replyTo, 10))
+	method := "sendMessage"
+	if photo != nil {
+		method = "sendPhoto"
+		form.WriteField("caption", text)
+		part, _ := form.CreateFormFile("photo", "qr.png")
+		part.Write(photo)
+	} else {
+		form.WriteField("text", text)
+	}
+	form.Close()
+
+	// Errors from here embed the URL, and with it the bot token, so they
+	// aren't logged
+	url := fmt.Sprintf("%s/bot%s/%s", telegramAPI, cfg.TelegramBotToken, method)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &body)
+	if err != nil {
+		slog.ErrorContext(ctx, "Telegram request error", "method", method)
+		return
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := telegramClient.Do(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Telegram send error", "method", method)
+		return
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if !result.OK {
+		slog.ErrorContext(ctx, "Telegram send failed", "method", method, "status", resp.StatusCode, "description", result.Description)
+	}
+}
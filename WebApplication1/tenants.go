@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// White-label tenants: isolated customers of one deployment, each served on
+// its own hosts with its own branding. A tenant's API keys carry owners
+// scoped as "<tenant>/<owner>", so everything filtered by owner (links,
+// domains, webhooks, chat connections, ...) stays inside the tenant, and a
+// key only authenticates on its tenant's hosts and custom domains. Tenant
+// links are stored as "@<tenant>:<code>": codes are unique per tenant, and a
+// code looked up on a tenant's host can only ever find that tenant's links.
+// The default tenant is "" and keeps unprefixed codes. Tenants are managed
+// by the operator through the admin API, which sees across all of them.
+const (
+	tenantCodeMark = "@"
+	tenantOwnerSep = "/"
+	maxTenantIDLen = 32
+	maxTenantHosts = 20
+)
+
+var (
+	tenantIDPattern    = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+	brandColorPattern  = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+	errTenantHostTaken = &apiError{http.StatusConflict, "host_taken", "A host is already in use"}
+)
+
+type TenantBrand struct {
+	Name         string `json:"name,omitempty"`
+	LogoURL      string `json:"logo_url,omitempty"`
+	PrimaryColor string `json:"primary_color,omitempty"`
+	SupportEmail string `json:"support_email,omitempty"`
+}
+
+type Tenant struct {
+	ID        string      `json:"id"`
+	Hosts     []string    `json:"hosts"` // the first is used for links made outside a request
+	Brand     TenantBrand `json:"brand"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+type TenantRequest struct {
+	ID    string      `json:"id,omitempty"` // on create only
+	Hosts []string    `json:"hosts"`
+	Brand TenantBrand `json:"brand"`
+}
+
+type Branding struct {
+	Tenant string      `json:"tenant,omitempty"`
+	Brand  TenantBrand `json:"brand"`
+}
+
+var tenants = struct {
+	mu     sync.RWMutex
+	byHost map[string]string // host -> tenant id
+	byID   map[string]*Tenant
+}{byHost: map[string]string{}, byID: map[string]*Tenant{}}
+
+func initTenants() {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS tenants (
+		id TEXT PRIMARY KEY,
+		brand_name TEXT,
+		logo_url TEXT,
+		primary_color TEXT,
+		support_email TEXT,
+		created_at TIMESTAMP DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS tenant_hosts (
+		host TEXT PRIMARY KEY,
+		tenant_id TEXT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+		position INTEGER NOT NULL
+	);
+	ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS tenant_id TEXT REFERENCES tenants(id);
+	CREATE INDEX IF NOT EXISTS idx_api_keys_tenant ON api_keys(tenant_id) WHERE tenant_id IS NOT NULL;
+	`
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Tenants table creation failed", "err", err)
+	}
+	if err := reloadTenants(); err != nil {
+		fatal("Tenants load failed", "err", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(domainListRefresh)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := reloadTenants(); err != nil {
+				slog.Error("Tenants reload error", "err", err)
+			}
+		}
+	}()
+}
+
+func reloadTenants() error {
+	list, err := queryTenants(context.Background(), "")
+	if err != nil {
+		return err
+	}
+	byHost := map[string]string{}
+	byID := map[string]*Tenant{}
+	for _, t := range list {
+		byID[t.ID] = t
+		for _, h := range t.Hosts {
+			byHost[h] = t.ID
+		}
+	}
+
+	tenants.mu.Lock()
+	tenants.byHost = byHost
+	tenants.byID = byID
+	tenants.mu.Unlock()
+	return nil
+}
+
+// All tenants, or just id when it's set
+func queryTenants(ctx context.Context, id string) ([]*Tenant, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT t.id, COALESCE(t.brand_name, ''), COALESCE(t.logo_url, ''), COALESCE(t.primary_color, ''),
+			COALESCE(t.support_email, ''), t.created_at,
+			COALESCE((SELECT json_agg(host ORDER BY position) FROM tenant_hosts h WHERE h.tenant_id = t.id), '[]')::TEXT
+		 FROM tenants t WHERE $1 = '' OR t.id = $1 ORDER BY t.id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []*Tenant{}
+	for rows.Next() {
+		t := &Tenant{}
+		var hosts string
+		if err := rows.Scan(&t.ID, &t.Brand.Name, &t.Brand.LogoURL, &t.Brand.PrimaryColor,
+			&t.Brand.SupportEmail, &t.CreatedAt, &hosts); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(hosts), &t.Hosts); err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+// Tenant whose own host this is, empty for other hosts
+func tenantByHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	tenants.mu.RLock()
+	defer tenants.mu.RUnlock()
+	return tenants.byHost[normalizeDomain(host)]
+}
+
+// Tenant a host serves: one of its own hosts, or a custom domain or
+// namespace registered by one of its owners
+func servingTenant(host string) string {
+	if t := tenantByHost(host); t != "" {
+		return t
+	}
+	return ownerTenant(customDomainOwner(customDomainHost(host)))
+}
+
+func ownerTenant(owner string) string {
+	if i := strings.Index(owner, tenantOwnerSep); i >= 0 {
+		return owner[:i]
+	}
+	return ""
+}
+
+// Tenant a request is handled for: the host's, set by authenticate, or for
+// callers that arrive without one (chat platforms, gRPC) the owner's
+func requestTenant(ctx context.Context) string {
+	if t, ok := ctx.Value(servingTenantKey).(string); ok {
+		return t
+	}
+	return ownerTenant(callerOwner(ctx))
+}
+
+func tenantCodePrefix(tenant string) string {
+	return tenantCodeMark + tenant + namespaceSeparator
+}
+
+// Key a code is stored under for a tenant
+func tenantKey(tenant, code string) string {
+	if tenant == "" {
+		return code
+	}
+	return tenantCodePrefix(tenant) + code
+}
+
+// Storage key for a code (or token) the caller supplied, accepted with or
+// without the tenant prefix. False when it names another tenant's link.
+func tenantCode(ctx context.Context, code string) (string, bool) {
+	tenant := requestTenant(ctx)
+	if tenant == "" {
+		return code, !strings.HasPrefix(code, tenantCodeMark)
+	}
+	return tenantKey(tenant, strings.TrimPrefix(code, tenantCodePrefix(tenant))), true
+}
+
+// A public token from a request, resolved to the link code within the
+// request's tenant
+func resolveCode(ctx context.Context, token string) (string, bool) {
+	key, ok := tenantCode(ctx, token)
+	if !ok {
+		return "", false
+	}
+	return resolvePublicCode(key)
+}
+
+// Look a link up by the code a caller has for it, within the caller's tenant
+func getTenantLink(ctx context.Context, code string) (*Link, error) {
+	key, ok := tenantCode(ctx, code)
+	if !ok {
+		return nil, ErrLinkNotFound
+	}
+	return store.GetLink(ctx, key)
+}
+
+// Tenant a stored code belongs to
+func codeTenant(code string) string {
+	if !strings.HasPrefix(code, tenantCodeMark) {
+		return ""
+	}
+	rest := strings.TrimPrefix(code, tenantCodeMark)
+	if i := strings.Index(rest, namespaceSeparator); i >= 0 {
+		return rest[:i]
+	}
+	return ""
+}
+
+// Whether a tenant is set up here, from the loaded list
+func tenantKnown(tenant string) bool {
+	tenants.mu.RLock()
+	defer tenants.mu.RUnlock()
+	return tenants.byID[tenant] != nil
+}
+
+func tenantBrand(tenant string) TenantBrand {
+	tenants.mu.RLock()
+	defer tenants.mu.RUnlock()
+	if t := tenants.byID[tenant]; t != nil {
+		return t.Brand
+	}
+	return TenantBrand{}
+}
+
+// Host links of a tenant are built on outside a request
+func tenantPrimaryHost(tenant string) string {
+	tenants.mu.RLock()
+	defer tenants.mu.RUnlock()
+	if t := tenants.byID[tenant]; t != nil && len(t.Hosts) > 0 {
+		return t.Hosts[0]
+	}
+	return ""
+}
+
+// Whether a key's owner may authenticate on the request's host
+func ownerAllowedHere(ctx context.Context, owner string) bool {
+	return ownerTenant(owner) == requestTenant(ctx)
+}
+
+func validateTenantRequest(req *TenantRequest) *apiError {
+	if len(req.Hosts) == 0 || len(req.Hosts) > maxTenantHosts {
+		return &apiError{http.StatusBadRequest, "invalid_hosts", "hosts must list 1-20 host names"}
+	}
+	seen := map[string]bool{}
+	for i, h := range req.Hosts {
+		h = normalizeDomain(h)
+		if h == "" || !strings.Contains(h, ".") || strings.ContainsAny(h, "/:@ ") || seen[h] {
+			return &apiError{http.StatusBadRequest, "invalid_hosts", "hosts must be distinct bare host names"}
+		}
+		if h == normalizeDomain(publicHost()) || customDomainOwner(h) != "" || hostNamespace(h) != "" {
+			return errTenantHostTaken
+		}
+		seen[h] = true
+		req.Hosts[i] = h
+	}
+	b := req.Brand
+	if b.PrimaryColor != "" && !brandColorPattern.MatchString(b.PrimaryColor) {
+		return &apiError{http.StatusBadRequest, "invalid_brand", "primary_color must look like #1a2b3c"}
+	}
+	if b.LogoURL != "" {
+		if _, err := parseDestination(b.LogoURL); err != nil {
+			return &apiError{http.StatusBadRequest, "invalid_brand", "logo_url: " + err.Error()}
+		}
+	}
+	if b.SupportEmail != "" && !strings.Contains(b.SupportEmail, "@") {
+		return &apiError{http.StatusBadRequest, "invalid_brand", "support_email is not an email address"}
+	}
+	return nil
+}
+
+// Write a tenant's brand and hosts; hosts are replaced wholesale
+func saveTenant(ctx context.Context, id string, req TenantRequest, create bool) (*Tenant, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE tenants SET brand_name = NULLIF($2, ''), logo_url = NULLIF($3, ''),
+		primary_color = NULLIF($4, ''), support_email = NULLIF($5, '') WHERE id = $1`
+	if create {
+		query = `INSERT INTO tenants (id, brand_name, logo_url, primary_color, support_email)
+			VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''))`
+	}
+	result, err := tx.ExecContext(ctx, query, id, req.Brand.Name, req.Brand.LogoURL, req.Brand.PrimaryColor, req.Brand.SupportEmail)
+	if isUniqueViolation(err) {
+		return nil, &apiError{http.StatusConflict, "tenant_exists", "Tenant already exists"}
+	} else if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, &apiError{http.StatusNotFound, "tenant_not_found", "Tenant not found"}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM tenant_hosts WHERE tenant_id = $1`, id); err != nil {
+		return nil, err
+	}
+	for i, h := range req.Hosts {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO tenant_hosts (host, tenant_id, position) VALUES ($1, $2, $3)`, h, id, i); isUniqueViolation(err) {
+			return nil, errTenantHostTaken
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if err := reloadTenants(); err != nil {
+		slog.ErrorContext(ctx, "Tenants reload error", "err", err)
+	}
+	list, err := queryTenants(ctx, id)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	return list[0], nil
+}
+
+func writeTenantError(w http.ResponseWriter, r *http.Request, err error) {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		writeAPIError(w, err)
+		return
+	}
+	slog.ErrorContext(r.Context(), "Tenant error", "err", err)
+	writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+}
+
+// GET /api/v1/branding - the brand of the tenant serving this host, for
+// front ends to theme themselves; empty for the default tenant
+func brandingHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := requestTenant(r.Context())
+	resp := Branding{Tenant: tenant, Brand: tenantBrand(tenant)}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// GET /api/v1/admin/tenants
+func listTenantsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	list, err := queryTenants(r.Context(), "")
+	if err != nil {
+		writeTenantError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// POST /api/v1/admin/tenants
+func createTenantHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req TenantRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	if len(req.ID) > maxTenantIDLen || !tenantIDPattern.MatchString(req.ID) {
+		writeError(w, http.StatusBadRequest, "invalid_tenant_id", "id must be 1-32 lowercase letters, digits and inner hyphens")
+		return
+	}
+	if apiErr := validateTenantRequest(&req); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	t, err := saveTenant(r.Context(), req.ID, req, true)
+	if err != nil {
+		writeTenantError(w, r, err)
+		return
+	}
+	auditAdmin(r, "tenant.create", t.ID, map[string]interface{}{"hosts": t.Hosts})
+	writeJSON(w, http.StatusCreated, t)
+}
+
+// PUT /api/v1/admin/tenants/{id}
+func updateTenantHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req TenantRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	id := r.PathValue("id")
+	if req.ID != "" && req.ID != id {
+		writeError(w, http.StatusBadRequest, "invalid_tenant_id", "A tenant's id can't be changed")
+		return
+	}
+	// The tenant's current hosts are free for it to keep
+	tenants.mu.RLock()
+	for i, h := range req.Hosts {
+		if tenants.byHost[normalizeDomain(h)] == id {
+			req.Hosts[i] = normalizeDomain(h)
+		}
+	}
+	tenants.mu.RUnlock()
+	if apiErr := validateTenantRequest(&req); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	t, err := saveTenant(r.Context(), id, req, false)
+	if err != nil {
+		writeTenantError(w, r, err)
+		return
+	}
+	auditAdmin(r, "tenant.update", t.ID, map[string]interface{}{"hosts": t.Hosts})
+	writeJSON(w, http.StatusOK, t)
+}
+
+// DELETE /api/v1/admin/tenants/{id} - only once it has no API keys or links
+func deleteTenantHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+
+	var inUse bool
+	err := db.QueryRowContext(r.Context(),
+		`SELECT EXISTS (SELECT 1 FROM api_keys WHERE tenant_id = $1)
+		     OR EXISTS (SELECT 1 FROM urls WHERE short_code LIKE $2 || '%')`,
+		id, strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(tenantCodePrefix(id))).Scan(&inUse)
+	if err != nil {
+		writeTenantError(w, r, err)
+		return
+	}
+	if inUse {
+		writeError(w, http.StatusConflict, "tenant_in_use", "Revoke the tenant's API keys and delete its links first")
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `DELETE FROM tenants WHERE id = $1`, id)
+	if err != nil {
+		writeTenantError(w, r, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeError(w, http.StatusNotFound, "tenant_not_found", "Tenant not found")
+		return
+	}
+	if err := reloadTenants(); err != nil {
+		slog.ErrorContext(r.Context(), "Tenants reload error", "err", err)
+	}
+	auditAdmin(r, "tenant.delete", id, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Whether a tenant exists; for API key creation
+func tenantExists(ctx context.Context, id string) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM tenants WHERE id = $1)`, id).Scan(&exists)
+	return exists, err
+}
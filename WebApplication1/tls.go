@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Built-in TLS with Let's Encrypt, for deployments without a reverse proxy.
+// tls_domains lists the hostnames to request certificates for; when set the
+// server listens on :443 and answers HTTP-01 challenges on :80, redirecting
+// everything else there to https. Certificates are cached in tls_cache_dir
+// so restarts don't hit the ACME rate limits.
+//
+// Registered custom domains get certificates too, on first request.
+func newCertManager(domains []string) *autocert.Manager {
+	listed := autocert.HostWhitelist(domains...)
+	return &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		HostPolicy: func(ctx context.Context, host string) error {
+			if customDomainOwner(normalizeDomain(host)) != "" || tenantByHost(host) != "" {
+				return nil
+			}
+			return listed(ctx, host)
+		},
+		Cache: autocert.DirCache(cfg.TLSCacheDir),
+		Email: cfg.ACMEEmail,
+	}
+}
+
+// Serve the handler over TLS on :443, with the challenge listener on :80
+func serveAutocert(server *http.Server, domains []string) error {
+	m := newCertManager(domains)
+
+	// Pending custom domains have no certificate yet, so their verification
+	// challenge is answered over plain http; everything else goes to https
+	acme := m.HTTPHandler(nil)
+	challenge := &http.Server{
+		Addr: ":80",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == domainChallengePath {
+				domainChallengeHandler(w, r)
+				return
+			}
+			acme.ServeHTTP(w, r)
+		}),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := challenge.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("ACME challenge listener failed", "err", err)
+		}
+	}()
+
+	server.Addr = ":443"
+	server.TLSConfig = m.TLSConfig()
+	slog.Info("🔒 TLS enabled", "domains", strings.Join(domains, ","))
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"unicode"
+)
+
+// Links pasted into chat often arrive with the sentence around them stuck
+// on: "see ihd.as/abc." or "(ihd.as/abc)" or a trailing %20. With
+// tolerant_codes, a code that isn't found as given is looked up again with
+// such trailing characters removed, so codes that really end in one of
+// them still resolve first.
+
+// Characters the surrounding text tends to leave on the end of a code
+func isCodeArtifact(r rune) bool {
+	switch r {
+	case '.', ',', ';', ':', '!', '?', ')', ']', '}', '>', '\'', '"', '*', '…',
+		'\u200b', '\u200c', '\u200d', '\u2060', '\ufeff': // zero-width characters
+		return true
+	}
+	return unicode.IsSpace(r)
+}
+
+// The code to look up for one taken from a request path on domain
+func tolerantCode(ctx context.Context, domain, code string) string {
+	if !cfg.TolerantCodes {
+		return code
+	}
+	cleaned := strings.TrimRightFunc(code, isCodeArtifact)
+	if cleaned == code || cleaned == "" {
+		return code
+	}
+	if key, ok := resolveCode(ctx, namespacedCode(domain, code)); ok && codeExists(ctx, key) {
+		return code
+	}
+	return cleaned
+}
+
+func codeExists(ctx context.Context, key string) bool {
+	if _, ok := getCachedURL(ctx, key); ok {
+		return true
+	}
+	_, err := store.GetLink(ctx, key)
+	return err == nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// OpenTelemetry tracing, exported over OTLP to Jaeger, Tempo or a collector.
+// Enabled by OTEL_EXPORTER_OTLP_ENDPOINT (or the traces-specific variant);
+// the exporter and sampler read the rest of the standard OTEL_* variables,
+// and OTEL_EXPORTER_OTLP_PROTOCOL picks grpc or http/protobuf (default).
+// Without an endpoint the global provider stays a no-op, so the spans
+// below cost next to nothing.
+var tracer = otel.Tracer("ihdas")
+
+// Flushes buffered spans; a no-op until tracing is initialised
+var shutdownTracing = func(context.Context) error { return nil }
+
+func initTracing() {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return
+	}
+
+	ctx := context.Background()
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	if protocol == "" {
+		protocol = "http/protobuf"
+	}
+	var client otlptrace.Client
+	switch protocol {
+	case "grpc":
+		client = otlptracegrpc.NewClient()
+	case "http/protobuf":
+		client = otlptracehttp.NewClient()
+	default:
+		fatal("Unsupported OTEL_EXPORTER_OTLP_PROTOCOL, use grpc or http/protobuf", "value", protocol)
+	}
+	exporter, err := otlptrace.New(ctx, client)
+	if err != nil {
+		fatal("OTLP exporter setup failed", "err", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override these
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("ihdas"),
+		semconv.ServiceVersion(buildInfo().Version),
+	))
+	if err == nil {
+		res, err = resource.Merge(res, resource.Environment())
+	}
+	if err != nil {
+		fatal("OTel resource setup failed", "err", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	shutdownTracing = provider.Shutdown
+
+	slog.Info("🔭 OpenTelemetry tracing enabled")
+}
+
+// Server span per request, named after the mux pattern like the metrics.
+// Incoming traceparent headers are honoured, so a trace can start at the
+// load balancer.
+func traced(mux *http.ServeMux, next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			if _, route := mux.Handler(r); route != "" {
+				return route
+			}
+			return r.Method + " unmatched"
+		}),
+		// Scrapes and probes would drown out real traffic
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			switch r.URL.Path {
+			case "/metrics", "/livez", "/readyz", "/health":
+				return false
+			}
+			return true
+		}),
+	)
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Outbound webhooks - owners register endpoints that are called on link
+// lifecycle events. Each delivery is signed with the webhook's secret:
+//
+//	X-Ihdas-Signature: t=<unix>,v1=<hex HMAC-SHA256 of "<unix>.<body>">
+//
+// Deliveries are retried with exponential backoff from an in-memory queue;
+// anything still queued at shutdown is lost.
+const (
+	EventLinkCreated     = "link.created"
+	EventLinkUpdated     = "link.updated"
+	EventLinkDeleted     = "link.deleted"
+	EventLinkExpired     = "link.expired"
+	EventClickThreshold  = "link.click_threshold"
+	EventClickMilestone  = "link.click_milestone" // 10, 100, 1000, ... clicks
+	EventDestinationDead = "link.destination_dead"
+	EventClickAlert      = "link.click_alert" // a per-link alert (see clickalerts.go)
+)
+
+var webhookEvents = map[string]bool{
+	EventLinkCreated:     true,
+	EventLinkUpdated:     true,
+	EventLinkDeleted:     true,
+	EventLinkExpired:     true,
+	EventClickThreshold:  true,
+	EventClickMilestone:  true,
+	EventDestinationDead: true,
+	EventClickAlert:      true,
+}
+
+const (
+	webhookMaxAttempts  = 6
+	webhookBaseBackoff  = 2 * time.Second
+	webhookTimeout      = 10 * time.Second
+	webhookQueueSize    = 1000
+	webhookWorkers      = 4
+	webhookCacheTTL     = time.Minute
+	webhookExpiryTick   = time.Minute
+	webhookMaxPerOwner  = 20
+	webhookSecretPrefix = "whsec_"
+)
+
+type Webhook struct {
+	ID             int64     `json:"id"`
+	URL            string    `json:"url"`
+	Events         []string  `json:"events"`
+	ClickThreshold *int64    `json:"click_threshold,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	owner          string
+	secret         string
+}
+
+type CreateWebhookRequest struct {
+	URL            string   `json:"url"`
+	Events         []string `json:"events"`
+	ClickThreshold *int64   `json:"click_threshold,omitempty"`
+}
+
+type CreateWebhookResponse struct {
+	ID             int64     `json:"id"`
+	URL            string    `json:"url"`
+	Events         []string  `json:"events"`
+	ClickThreshold *int64    `json:"click_threshold,omitempty"`
+	Secret         string    `json:"secret"` // only ever shown once
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type WebhookEvent struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      WebhookLink `json:"data"`
+}
+
+type WebhookLink struct {
+	ShortCode   string     `json:"short_code"`
+	OriginalURL string     `json:"original_url"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	ClickCount  int64      `json:"click_count"`
+
+	AlertThreshold int64 `json:"alert_threshold,omitempty"` // link.click_alert only
+}
+
+type webhookDelivery struct {
+	hook    *Webhook
+	event   string
+	payload []byte
+	attempt int
+}
+
+type cachedWebhooks struct {
+	hooks    []*Webhook
+	cachedAt time.Time
+}
+
+var (
+	webhookQueue = make(chan *webhookDelivery, webhookQueueSize)
+	webhookCache sync.Map // owner -> cachedWebhooks
+
+	// Built on first use, once the configuration is loaded
+	webhookClient = sync.OnceValue(newWebhookClient)
+)
+
+// Webhook targets are user-supplied, so they get the same internal-address
+// protection as destinations, enforced again at connect time
+func newWebhookClient() *http.Client {
+	if !cfg.BlockPrivateDestinations {
+		return &http.Client{Timeout: webhookTimeout}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: 5 * time.Second, Control: blockInternalDial}).DialContext
+	return &http.Client{Timeout: webhookTimeout, Transport: transport}
+}
+
+func initWebhooks() {
+	createTable := `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id BIGSERIAL PRIMARY KEY,
+		owner TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT[] NOT NULL,
+		click_threshold BIGINT,
+		created_at TIMESTAMP DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_webhooks_owner ON webhooks(owner);
+	`
+
+	if _, err := db.Exec(createTable); err != nil {
+		fatal("Webhooks table creation failed", "err", err)
+	}
+
+	for i := 0; i < webhookWorkers; i++ {
+		go webhookWorker()
+	}
+	go watchExpiredLinks()
+}
+
+// A receiver answering 410 Gone has gone away for good, as REST hooks
+// subscribers signal an unsubscribe
+var errWebhookGone = errors.New("endpoint returned 410")
+
+func webhookWorker() {
+	for d := range webhookQueue {
+		d.attempt++
+		err := deliverWebhook(d)
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, errWebhookGone) {
+			removeGoneWebhook(d.hook)
+			continue
+		}
+		if d.attempt >= webhookMaxAttempts {
+			slog.Warn("Webhook delivery giving up", "webhook_id", d.hook.ID, "event", d.event, "attempts", d.attempt, "err", err)
+			continue
+		}
+
+		// 2s, 4s, 8s, ... then back onto the queue
+		backoff := webhookBaseBackoff << (d.attempt - 1)
+		time.AfterFunc(backoff, func() { enqueueWebhook(d) })
+	}
+}
+
+func enqueueWebhook(d *webhookDelivery) {
+	select {
+	case webhookQueue <- d:
+	default:
+		slog.Warn("Webhook queue full, dropping delivery", "webhook_id", d.hook.ID, "event", d.event)
+	}
+}
+
+func deliverWebhook(d *webhookDelivery) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, d.hook.URL, bytes.NewReader(d.payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ihdas-webhooks/1")
+	req.Header.Set("X-Ihdas-Event", d.event)
+	req.Header.Set("X-Ihdas-Signature", "t="+timestamp+",v1="+signWebhook(d.hook.secret, timestamp, d.payload))
+
+	resp, err := webhookClient().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return errWebhookGone
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func removeGoneWebhook(hook *Webhook) {
+	if _, err := db.Exec(`DELETE FROM webhooks WHERE id = $1`, hook.ID); err != nil {
+		slog.Error("Webhook delete error", "webhook_id", hook.ID, "err", err)
+		return
+	}
+	webhookCache.Delete(hook.owner)
+	slog.Info("Webhook removed after 410 Gone", "webhook_id", hook.ID)
+	recordAudit(context.Background(), actorSystem, "webhook.delete", strconv.FormatInt(hook.ID, 10), map[string]interface{}{"owner": hook.owner, "reason": "gone"})
+}
+
+// Receivers recompute this over the raw body and compare in constant time
+func signWebhook(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Fire event for every webhook of the link's owner subscribed to it, and
+// on the event stream. Anonymous links have no webhooks to notify.
+func emitLinkEvent(event string, link *Link) {
+	publishLinkEvent(event, link)
+	if link.Owner == "" {
+		return
+	}
+	hooks, err := ownerWebhooks(context.Background(), link.Owner)
+	if err != nil {
+		slog.Error("Webhook lookup error", "err", err)
+		return
+	}
+	for _, hook := range hooks {
+		if hook.subscribed(event) {
+			queueLinkEvent(hook, event, link)
+		}
+	}
+}
+
+// Tell subscribers a link changed, in the background and as it is now:
+// its page, bundle, archive or sharing settings, or it was disabled or
+// enabled again
+func emitLinkUpdated(shortCode string) {
+	goBackground(func() {
+		link, err := store.GetLink(context.Background(), shortCode)
+		if err != nil {
+			if !errors.Is(err, ErrLinkNotFound) {
+				slog.Error("Link event lookup error", "short_code", shortCode, "err", err)
+			}
+			return
+		}
+		emitLinkEvent(EventLinkUpdated, link)
+	})
+}
+
+// Called with the new count right after a click; fires once per webhook,
+// on the click that reaches its threshold or a milestone
+func notifyClickThreshold(shortCode, owner string, clicks int64) {
+	hooks, err := ownerWebhooks(context.Background(), owner)
+	if err != nil {
+		slog.Error("Webhook lookup error", "err", err)
+		return
+	}
+
+	var link *Link
+	for _, hook := range hooks {
+		var events []string
+		if hook.ClickThreshold != nil && *hook.ClickThreshold == clicks && hook.subscribed(EventClickThreshold) {
+			events = append(events, EventClickThreshold)
+		}
+		if isClickMilestone(clicks) && hook.subscribed(EventClickMilestone) {
+			events = append(events, EventClickMilestone)
+		}
+		if len(events) == 0 {
+			continue
+		}
+		if link == nil {
+			if link, err = store.GetLink(context.Background(), shortCode); err != nil {
+				slog.Error("Webhook link lookup error", "short_code", shortCode, "err", err)
+				return
+			}
+			link.ClickCount = clicks
+		}
+		for _, event := range events {
+			queueLinkEvent(hook, event, link)
+		}
+	}
+}
+
+// Powers of ten from 10 up
+func isClickMilestone(clicks int64) bool {
+	if clicks < 10 {
+		return false
+	}
+	for clicks%10 == 0 {
+		clicks /= 10
+	}
+	return clicks == 1
+}
+
+func (h *Webhook) subscribed(event string) bool {
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func newWebhookEvent(event string, link *Link) WebhookEvent {
+	id := make([]byte, 12)
+	rand.Read(id)
+
+	return WebhookEvent{
+		ID:        "evt_" + hex.EncodeToString(id),
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Data: WebhookLink{
+			ShortCode:   link.ShortCode,
+			OriginalURL: link.OriginalURL,
+			CreatedAt:   link.CreatedAt,
+			ExpiresAt:   link.ExpiresAt,
+			ClickCount:  link.ClickCount,
+		},
+	}
+}
+
+func queueLinkEvent(hook *Webhook, event string, link *Link) {
+	payload, err := json.Marshal(newWebhookEvent(event, link))
+	if err != nil {
+		slog.Error("Webhook payload error", "err", err)
+		return
+	}
+	enqueueWebhook(&webhookDelivery{hook: hook, event: event, payload: payload})
+}
+
+// Webhooks are read on every event, so cache them per owner; changes made
+// through another instance show up within webhookCacheTTL
+func ownerWebhooks(ctx context.Context, owner string) ([]*Webhook, error) {
+	if val, ok := webhookCache.Load(owner); ok {
+		entry := val.(cachedWebhooks)
+		if time.Since(entry.cachedAt) < webhookCacheTTL {
+			return entry.hooks, nil
+		}
+	}
+
+	hooks, err := listWebhooks(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	webhookCache.Store(owner, cachedWebhooks{hooks: hooks, cachedAt: time.Now()})
+	return hooks, nil
+}
+
+func listWebhooks(ctx context.Context, owner string) ([]*Webhook, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, url, secret, array_to_json(events)::TEXT, click_threshold, created_at
+		FROM webhooks WHERE owner = $1 ORDER BY id`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []*Webhook{}
+	for rows.Next() {
+		hook := &Webhook{owner: owner}
+		var events string
+		var threshold sql.NullInt64
+		if err := rows.Scan(&hook.ID, &hook.URL, &hook.secret, &events, &threshold, &hook.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(events), &hook.Events); err != nil {
+			return nil, err
+		}
+		if threshold.Valid {
+			hook.ClickThreshold = &threshold.Int64
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+// Expiry isn't an action anyone takes, so poll for owned links whose
+// expires_at passed since the last sweep. Only the leader sweeps; the others
+// keep moving since along, so a new leader picks up about where the last
+// one stopped (a handover can repeat or miss one tick's events).
+func watchExpiredLinks() {
+	since := time.Now()
+	ticker := time.NewTicker(webhookExpiryTick)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if !isLeader() {
+			since = now
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := emitExpiredBetween(ctx, since, now)
+		cancel()
+		if err != nil {
+			slog.Error("Webhook expiry sweep error", "err", err)
+			continue
+		}
+		since = now
+	}
+}
+
+func emitExpiredBetween(ctx context.Context, since, until time.Time) error {
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+linkColumns+` FROM urls
+		WHERE owner IS NOT NULL AND expires_at > $1 AND expires_at <= $2`, since, until)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var expired []*Link
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return err
+		}
+		expired = append(expired, link)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, link := range expired {
+		emitLinkEvent(EventLinkExpired, link)
+	}
+	return nil
+}
+
+// Handlers
+
+// POST /api/v1/webhooks
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	var req CreateWebhookRequest
+	if !decodeJSON(w, r, &req, maxJSONBodyBytes) {
+		return
+	}
+	resp, err := registerWebhook(r.Context(), owner, req)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// Validate and store a webhook; shared with the REST hooks subscribe call
+func registerWebhook(ctx context.Context, owner string, req CreateWebhookRequest) (*CreateWebhookResponse, error) {
+	parsed, err := url.ParseRequestURI(req.URL)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+		return nil, &apiError{http.StatusBadRequest, "invalid_url", "url must be an http(s) URL"}
+	}
+	if err := checkDestinationHost(ctx, parsed.Hostname()); err != nil {
+		return nil, err
+	}
+	if len(req.Events) == 0 {
+		return nil, &apiError{http.StatusBadRequest, "missing_events", "events is required"}
+	}
+	for _, event := range req.Events {
+		if !webhookEvents[event] {
+			return nil, &apiError{http.StatusBadRequest, "invalid_event", "Unknown event " + strconv.Quote(event)}
+		}
+	}
+	if req.ClickThreshold != nil && *req.ClickThreshold < 1 {
+		return nil, &apiError{http.StatusBadRequest, "invalid_click_threshold", "click_threshold must be positive"}
+	}
+
+	var count int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM webhooks WHERE owner = $1`, owner).Scan(&count); err != nil {
+		return nil, err
+	}
+	if count >= webhookMaxPerOwner {
+		return nil, &apiError{http.StatusConflict, "webhook_limit_reached", "Webhook limit reached, maximum is " + strconv.Itoa(webhookMaxPerOwner)}
+	}
+
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, &apiError{http.StatusInternalServerError, "internal_error", "Secret generation error"}
+	}
+	eventsJSON, _ := json.Marshal(req.Events)
+	resp := &CreateWebhookResponse{
+		URL:            req.URL,
+		Events:         req.Events,
+		ClickThreshold: req.ClickThreshold,
+		Secret:         webhookSecretPrefix + hex.EncodeToString(raw),
+	}
+
+	err = db.QueryRowContext(ctx,
+		`INSERT INTO webhooks (owner, url, secret, events, click_threshold)
+		VALUES ($1, $2, $3, ARRAY(SELECT json_array_elements_text($4::JSON)), $5)
+		RETURNING id, created_at`,
+		owner, req.URL, resp.Secret, string(eventsJSON), req.ClickThreshold).Scan(&resp.ID, &resp.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	webhookCache.Delete(owner)
+	auditCaller(ctx, "webhook.create", strconv.FormatInt(resp.ID, 10), map[string]interface{}{"url": req.URL, "events": req.Events})
+	return resp, nil
+}
+
+// GET /api/v1/webhooks
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	hooks, err := listWebhooks(r.Context(), owner)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Webhook list error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, hooks)
+}
+
+// DELETE /api/v1/webhooks/{id}
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireCaller(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_id", "Invalid webhook id")
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `DELETE FROM webhooks WHERE id = $1 AND owner = $2`, id, owner)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Webhook delete error", "err", err)
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeError(w, http.StatusNotFound, "webhook_not_found", "Webhook not found")
+		return
+	}
+
+	webhookCache.Delete(owner)
+	auditCaller(r.Context(), "webhook.delete", strconv.FormatInt(id, 10), nil)
+	w.WriteHeader(http.StatusNoContent)
+}